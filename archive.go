@@ -0,0 +1,215 @@
+package dstore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NewTarStore returns a read-only store serving the members of the `size` bytes tar archive
+// `r`, each regular file member being an object named after its path in the archive. The
+// archive is indexed once, members are then read directly from `r` without unpacking. See
+// `FSStore` for the operations supported.
+func NewTarStore(r io.ReaderAt, size int64) (*FSStore, error) {
+	fsys, err := newTarFS(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return newFSStore(fsys, &url.URL{Scheme: "tar", Path: "/"}, "", ""), nil
+}
+
+// NewZipStore returns a read-only store serving the files of the `size` bytes zip archive `r`,
+// like `NewTarStore` does for tar archives.
+func NewZipStore(r io.ReaderAt, size int64) (*FSStore, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("reading zip archive: %w", err)
+	}
+
+	return newFSStore(archive, &url.URL{Scheme: "zip", Path: "/"}, "", ""), nil
+}
+
+// tarFS is the `fs.FS` of the members of a tar archive, indexed by `newTarFS`
+type tarFS struct {
+	r       io.ReaderAt
+	members map[string]*tarMember // by path, the root directory being "."
+}
+
+func newTarFS(r io.ReaderAt, size int64) (*tarFS, error) {
+	fsys := &tarFS{
+		r:       r,
+		members: map[string]*tarMember{".": {name: ".", mode: fs.ModeDir | 0555}},
+	}
+
+	// The section reader being seekable, the tar reader skips over the content of members
+	section := io.NewSectionReader(r, 0, size)
+	reader := tar.NewReader(section)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading tar archive: %w", err)
+		}
+
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if !fs.ValidPath(name) || name == "." {
+			continue
+		}
+
+		offset, err := section.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, fmt.Errorf("locating tar member %q: %w", header.Name, err)
+		}
+
+		fsys.add(name, &tarMember{
+			name:    path.Base(name),
+			offset:  offset,
+			size:    header.Size,
+			modTime: header.ModTime,
+			mode:    0444,
+		})
+	}
+
+	for _, member := range fsys.members {
+		sort.Slice(member.entries, func(i, j int) bool { return member.entries[i].Name() < member.entries[j].Name() })
+	}
+	return fsys, nil
+}
+
+// add indexes the file `member` at `name`, creating its parent directories, a later member
+// replacing an earlier one of the same name like when extracting the archive
+func (f *tarFS) add(name string, member *tarMember) {
+	if _, found := f.members[name]; !found {
+		f.addEntry(path.Dir(name), member)
+	} else {
+		parent := f.members[path.Dir(name)]
+		for i, entry := range parent.entries {
+			if entry.Name() == member.name {
+				parent.entries[i] = member
+			}
+		}
+	}
+	f.members[name] = member
+}
+
+func (f *tarFS) addEntry(dir string, entry *tarMember) {
+	parent, found := f.members[dir]
+	if !found {
+		parent = &tarMember{name: path.Base(dir), mode: fs.ModeDir | 0555}
+		f.members[dir] = parent
+		f.addEntry(path.Dir(dir), parent)
+	}
+	parent.entries = append(parent.entries, entry)
+}
+
+func (f *tarFS) Open(name string) (fs.File, error) {
+	member, err := f.member("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if member.IsDir() {
+		return &tarDir{member: member}, nil
+	}
+	return &tarFile{member: member, reader: io.NewSectionReader(f.r, member.offset, member.size)}, nil
+}
+
+func (f *tarFS) Stat(name string) (fs.FileInfo, error) {
+	return f.member("stat", name)
+}
+
+func (f *tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	member, err := f.member("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !member.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	return append([]fs.DirEntry(nil), member.entries...), nil
+}
+
+func (f *tarFS) member(op, name string) (*tarMember, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	member, found := f.members[name]
+	if !found {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return member, nil
+}
+
+// tarMember is a file or directory of a tar archive, both its `fs.FileInfo` and `fs.DirEntry`
+type tarMember struct {
+	name    string
+	offset  int64
+	size    int64
+	modTime time.Time
+	mode    fs.FileMode
+	entries []fs.DirEntry // directories only
+}
+
+func (m *tarMember) Name() string               { return m.name }
+func (m *tarMember) Size() int64                { return m.size }
+func (m *tarMember) Mode() fs.FileMode          { return m.mode }
+func (m *tarMember) ModTime() time.Time         { return m.modTime }
+func (m *tarMember) IsDir() bool                { return m.mode.IsDir() }
+func (m *tarMember) Sys() interface{}           { return nil }
+func (m *tarMember) Type() fs.FileMode          { return m.mode.Type() }
+func (m *tarMember) Info() (fs.FileInfo, error) { return m, nil }
+
+type tarFile struct {
+	member *tarMember
+	reader *io.SectionReader
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error)                   { return f.member, nil }
+func (f *tarFile) Read(p []byte) (int, error)                   { return f.reader.Read(p) }
+func (f *tarFile) ReadAt(p []byte, off int64) (int, error)      { return f.reader.ReadAt(p, off) }
+func (f *tarFile) Seek(offset int64, whence int) (int64, error) { return f.reader.Seek(offset, whence) }
+func (f *tarFile) Close() error                                 { return nil }
+
+type tarDir struct {
+	member *tarMember
+	read   int
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.member, nil }
+func (d *tarDir) Close() error               { return nil }
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.member.name, Err: errors.New("is a directory")}
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.member.entries[d.read:]
+	if n > 0 {
+		if len(remaining) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(remaining) {
+			remaining = remaining[:n]
+		}
+	}
+
+	d.read += len(remaining)
+	return append([]fs.DirEntry(nil), remaining...), nil
+}
@@ -0,0 +1,92 @@
+package dstore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarStore(t *testing.T) {
+	ctx := context.Background()
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, member := range []struct{ name, content string }{
+		{"0000000000-0000000100.dbin", "first range"},
+		{"./blocks/0000000100-0000000200.dbin", "second range"},
+		{"blocks/nested/index", "index"},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: member.name, Mode: 0644, Size: int64(len(member.content)), ModTime: modTime, Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(member.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "empty/", Mode: 0755, Typeflag: tar.TypeDir}))
+	require.NoError(t, tw.Close())
+
+	store, err := NewTarStore(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	content, err := ReadObjectString(ctx, store, "blocks/0000000100-0000000200.dbin")
+	require.NoError(t, err)
+	assert.Equal(t, "second range", content)
+
+	content, err = ReadObjectString(ctx, store, "0000000000-0000000100.dbin")
+	require.NoError(t, err)
+	assert.Equal(t, "first range", content)
+
+	exists, err := store.FileExists(ctx, "blocks/nested/index")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = store.FileExists(ctx, "missing")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	attrs, err := store.ObjectAttributes(ctx, "blocks/nested/index")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), attrs.Size)
+	assert.True(t, modTime.Equal(attrs.LastModified))
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0000000000-0000000100.dbin", "blocks/0000000100-0000000200.dbin", "blocks/nested/index"}, files)
+
+	files, err = store.ListFiles(ctx, "blocks/", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"blocks/0000000100-0000000200.dbin", "blocks/nested/index"}, files)
+
+	assert.ErrorIs(t, WriteObjectString(ctx, store, "new", "content"), ErrNotSupported)
+	assert.ErrorIs(t, store.DeleteObject(ctx, "blocks/nested/index"), ErrNotSupported)
+}
+
+func TestZipStore(t *testing.T) {
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{"a/file": "a content", "b": "b content"} {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+
+	store, err := NewZipStore(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	content, err := ReadObjectString(ctx, store, "a/file")
+	require.NoError(t, err)
+	assert.Equal(t, "a content", content)
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/file", "b"}, files)
+}
@@ -1,6 +1,10 @@
 package dstore
 
-import "time"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
 type ObjectAttributes struct {
 	// Size is the size of the object in bytes.
@@ -9,3 +13,63 @@ type ObjectAttributes struct {
 	// LastModified is the time the object was last modified.
 	LastModified time.Time
 }
+
+// FileWithAttrs is a file listed along with its attributes, see `WalkWithAttributes`.
+type FileWithAttrs struct {
+	Name string
+	ObjectAttributes
+}
+
+// attributesWalker is implemented by the stores whose listings return the attributes of the
+// objects listed.
+type attributesWalker interface {
+	walkWithAttributes(ctx context.Context, prefix string, f func(file FileWithAttrs) error) error
+}
+
+// WalkWithAttributes calls `f` for each file under `prefix`, in the order of `Walk`, along with
+// its attributes as `ObjectAttributes` returns them. S3, GCS, Azure, local and memory stores
+// take the attributes from the listing itself, other stores, and sharded ones, fetch them for
+// each file. `f` returning `StopIteration` ends the walk without error.
+func WalkWithAttributes(ctx context.Context, store Store, prefix string, f func(file FileWithAttrs) error) error {
+	if walker, ok := store.(attributesWalker); ok {
+		return walker.walkWithAttributes(ctx, prefix, f)
+	}
+	return walkWithObjectAttributes(ctx, store, prefix, f)
+}
+
+// walkWithObjectAttributes walks `prefix` fetching the attributes of each file, the ones deleted
+// since being listed being skipped
+func walkWithObjectAttributes(ctx context.Context, store Store, prefix string, f func(file FileWithAttrs) error) error {
+	return store.Walk(ctx, prefix, func(filename string) error {
+		attrs, err := store.ObjectAttributes(ctx, filename)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		return f(FileWithAttrs{Name: filename, ObjectAttributes: *attrs})
+	})
+}
+
+// ListFilesModifiedSince returns the files under `prefix` last modified at or after `since`, in
+// the order of `Walk`, for instance to process everything changed since a previous run. The
+// files are listed with `WalkWithAttributes`, cloud stores not requiring a request per file.
+//
+// The precision of the modification times depends on the backend: S3 and Azure have a one
+// second precision, GCS a millisecond one, while local and memory stores have the precision of
+// the host clock. A `since` taken from a previous listing is thus safer than one taken from the
+// local clock.
+func ListFilesModifiedSince(ctx context.Context, store Store, prefix string, since time.Time) (out []FileWithAttrs, err error) {
+	err = WalkWithAttributes(ctx, store, prefix, func(file FileWithAttrs) error {
+		if !file.LastModified.Before(since) {
+			out = append(out, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,239 @@
+package dstore
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewAttributeCachingStore wraps `inner` so that `FileExists` and `ObjectAttributes` results
+// are cached in-process for `ttl`, keeping at most `maxEntries` entries (least recently used
+// entries being evicted first). Writing, copying or deleting a key through the returned store
+// invalidates its cached entry, changes performed outside of it are only seen once the entry
+// expires. All other operations pass through untouched.
+func NewAttributeCachingStore(inner Store, ttl time.Duration, maxEntries int) Store {
+	return &attributeCachingStore{
+		Store:      inner,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+type attributeCachingStore struct {
+	Store
+
+	ttl        time.Duration
+	maxEntries int
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type attributeCacheEntry struct {
+	key     string
+	exists  bool
+	attrs   *ObjectAttributes // nil when only existence is known
+	expires time.Time
+}
+
+func (s *attributeCachingStore) FileExists(ctx context.Context, base string) (bool, error) {
+	if entry := s.get(base); entry != nil {
+		return entry.exists, nil
+	}
+
+	exists, err := s.Store.FileExists(ctx, base)
+	if err != nil {
+		return false, err
+	}
+
+	s.set(base, exists, nil)
+	return exists, nil
+}
+
+func (s *attributeCachingStore) ObjectAttributes(ctx context.Context, base string) (*ObjectAttributes, error) {
+	if entry := s.get(base); entry != nil {
+		if !entry.exists {
+			return nil, ErrNotFound
+		}
+		if entry.attrs != nil {
+			attrs := *entry.attrs
+			return &attrs, nil
+		}
+	}
+
+	attrs, err := s.Store.ObjectAttributes(ctx, base)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			s.set(base, false, nil)
+		}
+		return nil, err
+	}
+
+	if attrs != nil {
+		cached := *attrs
+		s.set(base, true, &cached)
+	}
+	return attrs, nil
+}
+
+func (s *attributeCachingStore) OpenObjectWithCompression(ctx context.Context, name string, compressionType string) (io.ReadCloser, error) {
+	return OpenObjectWithCompression(ctx, s.Store, name, compressionType)
+}
+
+func (s *attributeCachingStore) OpenObjectIfModifiedSince(ctx context.Context, name string, since time.Time) (io.ReadCloser, bool, error) {
+	return OpenObjectIfModifiedSince(ctx, s.Store, name, since)
+}
+
+func (s *attributeCachingStore) DownloadTo(ctx context.Context, name string, w io.Writer) (int64, error) {
+	return DownloadTo(ctx, s.Store, name, w)
+}
+
+func (s *attributeCachingStore) PeekObject(ctx context.Context, name string, n int) ([]byte, error) {
+	return PeekObject(ctx, s.Store, name, n)
+}
+
+func (s *attributeCachingStore) WriteFrom(ctx context.Context, base string, src Store, srcName string) error {
+	// Goes through this store's `CopyObject` or `WriteObject`, which invalidate `base`
+	return writeFrom(ctx, s, base, src, srcName)
+}
+
+func (s *attributeCachingStore) WriteObject(ctx context.Context, base string, f io.Reader) error {
+	defer s.invalidate(base)
+	return s.Store.WriteObject(ctx, base, f)
+}
+
+func (s *attributeCachingStore) WriteObjectSized(ctx context.Context, base string, f io.Reader, size int64) error {
+	defer s.invalidate(base)
+	return WriteObjectSized(ctx, s.Store, base, f, size)
+}
+
+func (s *attributeCachingStore) UploadFrom(ctx context.Context, base string, r io.ReaderAt, size int64) error {
+	defer s.invalidate(base)
+	return UploadFrom(ctx, s.Store, base, r, size)
+}
+
+func (s *attributeCachingStore) WriteObjectSeekable(ctx context.Context, base string, rs io.ReadSeeker) error {
+	defer s.invalidate(base)
+	return WriteObjectSeekable(ctx, s.Store, base, rs)
+}
+
+func (s *attributeCachingStore) PushLocalFile(ctx context.Context, localFile, toBaseName string) error {
+	defer s.invalidate(toBaseName)
+	return s.Store.PushLocalFile(ctx, localFile, toBaseName)
+}
+
+func (s *attributeCachingStore) CopyObject(ctx context.Context, src, dest string) error {
+	defer s.invalidate(dest)
+	return s.Store.CopyObject(ctx, src, dest)
+}
+
+func (s *attributeCachingStore) Touch(ctx context.Context, base string) error {
+	defer s.invalidate(base)
+	return Touch(ctx, s.Store, base)
+}
+
+func (s *attributeCachingStore) SetObjectMetadata(ctx context.Context, base string, md map[string]string) error {
+	// Updating the metadata may bump the last modified time, on S3 for instance
+	defer s.invalidate(base)
+	return SetObjectMetadata(ctx, s.Store, base, md)
+}
+
+func (s *attributeCachingStore) GetObjectMetadata(ctx context.Context, base string) (map[string]string, error) {
+	return GetObjectMetadata(ctx, s.Store, base)
+}
+
+func (s *attributeCachingStore) DeleteObject(ctx context.Context, base string) error {
+	defer s.invalidate(base)
+	return s.Store.DeleteObject(ctx, base)
+}
+
+func (s *attributeCachingStore) DeleteObjectsUnderPrefix(ctx context.Context, prefix string, force bool) (int, error) {
+	defer s.invalidatePrefix(prefix)
+	return DeleteObjectsUnderPrefix(ctx, s.Store, prefix, force)
+}
+
+func (s *attributeCachingStore) HasAnyFiles(ctx context.Context, prefix string) (bool, error) {
+	return HasAnyFiles(ctx, s.Store, prefix)
+}
+
+func (s *attributeCachingStore) ListSubPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	return ListSubPrefixes(ctx, s.Store, prefix)
+}
+
+func (s *attributeCachingStore) SubStore(subFolder string) (Store, error) {
+	sub, err := s.Store.SubStore(subFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAttributeCachingStore(sub, s.ttl, s.maxEntries), nil
+}
+
+func (s *attributeCachingStore) get(key string) *attributeCacheEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	element, found := s.entries[key]
+	if !found {
+		return nil
+	}
+
+	entry := element.Value.(*attributeCacheEntry)
+	if time.Now().After(entry.expires) {
+		s.remove(element)
+		return nil
+	}
+
+	s.lru.MoveToFront(element)
+	return entry
+}
+
+func (s *attributeCachingStore) set(key string, exists bool, attrs *ObjectAttributes) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry := &attributeCacheEntry{key: key, exists: exists, attrs: attrs, expires: time.Now().Add(s.ttl)}
+	if element, found := s.entries[key]; found {
+		element.Value = entry
+		s.lru.MoveToFront(element)
+		return
+	}
+
+	s.entries[key] = s.lru.PushFront(entry)
+	for s.maxEntries > 0 && s.lru.Len() > s.maxEntries {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *attributeCachingStore) invalidate(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if element, found := s.entries[key]; found {
+		s.remove(element)
+	}
+}
+
+func (s *attributeCachingStore) invalidatePrefix(prefix string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, element := range s.entries {
+		if strings.HasPrefix(key, prefix) {
+			s.remove(element)
+		}
+	}
+}
+
+// remove must be called with the lock held
+func (s *attributeCachingStore) remove(element *list.Element) {
+	s.lru.Remove(element)
+	delete(s.entries, element.Value.(*attributeCacheEntry).key)
+}
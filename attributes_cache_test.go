@@ -0,0 +1,95 @@
+package dstore
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCountingMockStore() (*MockStore, *int) {
+	calls := 0
+	store := NewMockStore(nil)
+	store.FileExistsFunc = func(ctx context.Context, base string) (bool, error) {
+		calls++
+		_, exists := store.Files[base]
+		return exists, nil
+	}
+
+	return store, &calls
+}
+
+func TestAttributeCachingStore_FileExistsCached(t *testing.T) {
+	ctx := context.Background()
+	inner, calls := newCountingMockStore()
+	inner.SetFile("file", []byte("content"))
+
+	store := NewAttributeCachingStore(inner, time.Minute, 10)
+
+	exists, err := store.FileExists(ctx, "file")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = store.FileExists(ctx, "file")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, 1, *calls)
+}
+
+func TestAttributeCachingStore_Expires(t *testing.T) {
+	ctx := context.Background()
+	inner, calls := newCountingMockStore()
+
+	store := NewAttributeCachingStore(inner, time.Millisecond, 10)
+
+	_, err := store.FileExists(ctx, "file")
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+
+	_, err = store.FileExists(ctx, "file")
+	require.NoError(t, err)
+	assert.Equal(t, 2, *calls)
+}
+
+func TestAttributeCachingStore_InvalidatedOnWrite(t *testing.T) {
+	ctx := context.Background()
+	inner, calls := newCountingMockStore()
+
+	store := NewAttributeCachingStore(inner, time.Minute, 10)
+
+	exists, err := store.FileExists(ctx, "file")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, store.WriteObject(ctx, "file", strings.NewReader("content")))
+
+	exists, err = store.FileExists(ctx, "file")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, 2, *calls)
+
+	require.NoError(t, store.DeleteObject(ctx, "file"))
+
+	exists, err = store.FileExists(ctx, "file")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, 3, *calls)
+}
+
+func TestAttributeCachingStore_EvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	inner, calls := newCountingMockStore()
+
+	store := NewAttributeCachingStore(inner, time.Minute, 2)
+
+	for _, name := range []string{"a", "b", "a", "c", "a", "b"} {
+		_, err := store.FileExists(ctx, name)
+		require.NoError(t, err)
+	}
+
+	// "a", "b", "c" are misses, "a" is a hit twice, "b" was evicted by "c"
+	assert.Equal(t, 4, *calls)
+}
@@ -2,25 +2,43 @@ package dstore
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
 )
 
+// azureMaxListPageSize is the maximum number of blobs Azure returns per listing segment
+const azureMaxListPageSize = 5000
+
+// azureInitialUploadBufferSize is the size of the first buffer of an upload of unknown size, the
+// following ones doubling up to the size returned by `azureUploadBuffers`
+const azureInitialUploadBufferSize = 64 * 1024
+
+// azureBufferAllocator allocates the buffers the uploaded content is read into, overridden in tests
+var azureBufferAllocator = func(size int) []byte { return make([]byte, size) }
+
 type AzureStore struct {
 	*commonStore
 
 	baseURL      *url.URL
 	containerURL azblob.ContainerURL
+
+	// Used to build one-off pipelines for credentials overrides, see `WithRequestCredentials`
+	pipelineOptions azblob.PipelineOptions
 }
 
 func NewAzureStore(baseURL *url.URL, extension, compressionType string, overwrite bool, opts ...Option) (*AzureStore, error) {
@@ -32,7 +50,11 @@ func (s *AzureStore) Clone(ctx context.Context, opts ...Option) (Store, error) {
 	return newAzureStoreContext(ctx, s.baseURL, s.extension, s.compressionType, s.overwrite, opts...)
 }
 
-func newAzureStoreContext(_ context.Context, baseURL *url.URL, extension, compressionType string, overwrite bool, opts ...Option) (*AzureStore, error) {
+func (s *AzureStore) Rebase(ctx context.Context, baseURL string, opts ...Option) (Store, error) {
+	return s.rebase(ctx, baseURL, nil, opts)
+}
+
+func newAzureStoreContext(ctx context.Context, baseURL *url.URL, extension, compressionType string, overwrite bool, opts ...Option) (*AzureStore, error) {
 	accountName, containerName, err := decodeAzureScheme(baseURL)
 	if err != nil {
 		return nil, fmt.Errorf("specify azure account name and container like: az://account.container/path")
@@ -48,37 +70,76 @@ func newAzureStoreContext(_ context.Context, baseURL *url.URL, extension, compre
 		return nil, fmt.Errorf("azure authentication failed: %w", err)
 	}
 
-	p := azblob.NewPipeline(credential, azblob.PipelineOptions{
+	conf := config{}
+	for _, opt := range opts {
+		opt.apply(&conf)
+	}
+	if conf.err != nil {
+		return nil, conf.err
+	}
+	baseURL = withDefaultPrefix(baseURL, conf.defaultPrefix)
+
+	pipelineOptions := azblob.PipelineOptions{
 		RequestLog: azblob.RequestLogOptions{
 			LogWarningIfTryOverThreshold: time.Millisecond * 200,
 		},
-	})
+		Telemetry: azblob.TelemetryOptions{
+			Value: conf.userAgentOrDefault(),
+		},
+	}
+	if conf.httpClient != nil {
+		pipelineOptions.HTTPSender = newAzureHTTPSender(conf.httpClient)
+	}
+
+	p := azblob.NewPipeline(credential, pipelineOptions)
 	u, _ := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", accountName, containerName))
 	containerURL := azblob.NewContainerURL(*u, p)
 
-	conf := config{}
-	for _, opt := range opts {
-		opt.apply(&conf)
-	}
-
 	common := &commonStore{
 		compressionType:           compressionType,
 		extension:                 extension,
 		overwrite:                 overwrite,
+		skipDirectoryMarkers:      conf.skipDirectoryMarkers,
+		sizeValidation:            conf.sizeValidation,
+		listPageSize:              conf.listPageSize,
+		sharder:                   conf.sharder,
+		objectPathFunc:            conf.objectPathFunc,
+		keySeparator:              conf.keySeparator,
 		uncompressedReadCallback:  conf.uncompressedReadCallback,
 		compressedReadCallback:    conf.compressedReadCallback,
 		uncompressedWriteCallback: conf.uncompressedWriteCallback,
 		compressedWriteCallback:   conf.compressedWriteCallback,
+		writeStatsCallback:        conf.writeStatsCallback,
+		overwriteSkipCallback:     conf.overwriteSkipCallback,
+		baseContext:               conf.baseContextOr(ctx),
+		uploadBuffers:             conf.uploadBuffers,
+		keepLocalAfterPush:        conf.keepLocalAfterPush,
+		clampFutureMTimes:         conf.clampFutureMTimes,
+		errorOnEmptyWrite:         conf.errorOnEmptyWrite,
+		deleteIgnoreNotFound:      conf.deleteIgnoreNotFound,
+		walkProgressCallback:      conf.walkProgressCallback,
+		operationTimeout:          conf.operationTimeout,
+		existenceCache:            newExistenceCache(conf.existenceCacheTTL),
+		existenceBloom:            newExistenceBloom(conf.existenceBloomHint, conf.existenceBloomHintMaxAge),
+		zstdDecoders:              zstdDecoderPoolFor(conf.zstdDecoderConcurrency, conf.zstdMaxIdleDecoders),
+		postWriteHook:             conf.postWriteHook,
+		retryObserver:             conf.retryObserver,
+		compressionDetection:      conf.compressionDetection,
 	}
 
 	return &AzureStore{
-		baseURL:      baseURL,
-		containerURL: containerURL,
-		commonStore:  common,
+		baseURL:         baseURL,
+		containerURL:    containerURL,
+		pipelineOptions: pipelineOptions,
+		commonStore:     common,
 	}, nil
 }
 
 func (s *AzureStore) SubStore(subFolder string) (Store, error) {
+	if err := s.subStoreErr(subFolder); err != nil {
+		return nil, err
+	}
+
 	url, err := url.Parse(s.baseURL.String())
 	if err != nil {
 		return nil, fmt.Errorf("azure store parsing base url: %w", err)
@@ -86,21 +147,155 @@ func (s *AzureStore) SubStore(subFolder string) (Store, error) {
 	url.Path = path.Join(url.Path, subFolder)
 
 	return &AzureStore{
-		baseURL:      url,
-		containerURL: s.containerURL,
-		commonStore:  s.commonStore,
+		baseURL:         url,
+		containerURL:    s.containerURL,
+		pipelineOptions: s.pipelineOptions,
+		commonStore:     s.commonStore,
 	}, nil
 }
 
+// containerURLFor returns the container to use for an operation, going through a one-off
+// pipeline using the overridden credentials when the context carries some, see
+// `WithRequestCredentials`.
+func (s *AzureStore) containerURLFor(ctx context.Context) (azblob.ContainerURL, error) {
+	creds := requestCredentialsFromContext(ctx)
+	if creds == nil {
+		return s.containerURL, nil
+	}
+	if creds.Azure == nil {
+		return azblob.ContainerURL{}, missingRequestCredentials("Azure")
+	}
+
+	return s.containerURL.WithPipeline(azblob.NewPipeline(creds.Azure, s.pipelineOptions)), nil
+}
+
+// azureCopyPollInterval is the interval at which the status of a pending server-side copy is
+// checked, overridden in tests
+var azureCopyPollInterval = 500 * time.Millisecond
+
+// CopyObject copies the blob server-side, its content and metadata being kept as is. Copies
+// within a storage account usually complete right away, pending ones are waited for.
 func (s *AzureStore) CopyObject(ctx context.Context, src, dest string) error {
-	// TODO optimize this
-	reader, err := s.OpenObject(ctx, src)
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	containerURL, err := s.containerURLFor(ctx)
 	if err != nil {
 		return err
 	}
-	defer reader.Close()
 
-	return s.WriteObject(ctx, dest, reader)
+	srcURL := containerURL.NewBlockBlobURL(s.ObjectPath(src)).URL()
+	destURL := containerURL.NewBlockBlobURL(s.ObjectPath(dest))
+
+	copied, err := destURL.StartCopyFromURL(ctx, srcURL, nil, azblob.ModifiedAccessConditions{}, azblob.BlobAccessConditions{}, azblob.AccessTierNone, nil)
+	if err != nil {
+		if serr, ok := err.(azblob.StorageError); ok && serr.Response() != nil && serr.Response().StatusCode == http.StatusNotFound {
+			// A missing source is reported as `BlobNotFound` or `CannotVerifyCopySource`
+			return ErrNotFound
+		}
+		return fmt.Errorf("copying object %q to %q: %w", src, dest, err)
+	}
+
+	status, description := copied.CopyStatus(), ""
+	for status == azblob.CopyStatusPending {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(azureCopyPollInterval):
+		}
+
+		props, err := destURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			return fmt.Errorf("checking copy of object %q to %q: %w", src, dest, err)
+		}
+		status, description = props.CopyStatus(), props.CopyStatusDescription()
+	}
+	if status != azblob.CopyStatusSuccess {
+		return fmt.Errorf("copy of object %q to %q ended with status %q: %s", src, dest, status, description)
+	}
+
+	s.existenceBloom.add(s.ObjectURL(dest))
+	return nil
+}
+
+func (s *AzureStore) SetObjectMetadata(ctx context.Context, base string, md map[string]string) error {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	containerURL, err := s.containerURLFor(ctx)
+	if err != nil {
+		return err
+	}
+
+	blobURL := containerURL.NewBlockBlobURL(s.ObjectPath(base))
+
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if serr, ok := err.(azblob.StorageError); ok && serr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	metadata := props.NewMetadata()
+	for key, value := range md {
+		metadata[key] = value
+	}
+
+	if _, err := blobURL.SetMetadata(ctx, metadata, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{}); err != nil {
+		return fmt.Errorf("setting metadata of object %q: %w", base, err)
+	}
+	return nil
+}
+
+func (s *AzureStore) GetObjectMetadata(ctx context.Context, base string) (map[string]string, error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	containerURL, err := s.containerURLFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	props, err := containerURL.NewBlockBlobURL(s.ObjectPath(base)).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if serr, ok := err.(azblob.StorageError); ok && serr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	md := map[string]string{}
+	for key, value := range props.NewMetadata() {
+		md[key] = value
+	}
+	return md, nil
+}
+
+// Touch sets the blob's metadata to its current value, which bumps its last modified time.
+func (s *AzureStore) Touch(ctx context.Context, base string) error {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	containerURL, err := s.containerURLFor(ctx)
+	if err != nil {
+		return err
+	}
+
+	blobURL := containerURL.NewBlockBlobURL(s.ObjectPath(base))
+
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if serr, ok := err.(azblob.StorageError); ok && serr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	if _, err := blobURL.SetMetadata(ctx, props.NewMetadata(), azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{}); err != nil {
+		return fmt.Errorf("touching object %q: %w", base, err)
+	}
+	return nil
 }
 
 func (s *AzureStore) BaseURL() *url.URL {
@@ -108,18 +303,39 @@ func (s *AzureStore) BaseURL() *url.URL {
 }
 
 func (s *AzureStore) ObjectPath(name string) string {
-	return path.Join(strings.TrimLeft(s.baseURL.Path, "/"), s.pathWithExt(name))
+	return path.Join(strings.TrimLeft(s.baseURL.Path, "/"), s.shardedPathWithExt(name))
 }
 
 func (s *AzureStore) ObjectURL(name string) string {
-	return fmt.Sprintf("%s/%s", strings.TrimRight(s.baseURL.String(), "/"), strings.TrimLeft(s.pathWithExt(name), "/"))
+	return objectURL(s.baseURL, s.shardedPathWithExt(name))
+}
+
+func (s *AzureStore) SupportsConcurrentWrites() bool {
+	return true
 }
 
 func (s *AzureStore) FileExists(ctx context.Context, base string) (bool, error) {
+	if s.existenceBloom.definitelyAbsent(ctx, s, base) {
+		return false, nil
+	}
+	return s.fileExists(ctx, base)
+}
+
+// fileExists checks the existence of the object with the backend, regardless of the existence
+// bloom hint, see `WithExistenceBloomHint`
+func (s *AzureStore) fileExists(ctx context.Context, base string) (bool, error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
 	path := s.ObjectPath(base)
 
-	blobURL := s.containerURL.NewBlockBlobURL(path)
-	_, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	containerURL, err := s.containerURLFor(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	blobURL := containerURL.NewBlockBlobURL(path)
+	_, err = blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
 	if err != nil {
 
 		// azure returns a 404 error when blob NOT FOUND
@@ -136,73 +352,316 @@ func (s *AzureStore) FileExists(ctx context.Context, base string) (bool, error)
 }
 
 func (s *AzureStore) ObjectAttributes(ctx context.Context, base string) (*ObjectAttributes, error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
 	path := s.ObjectPath(base)
 
-	blobURL := s.containerURL.NewBlockBlobURL(path)
+	containerURL, err := s.containerURLFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	blobURL := containerURL.NewBlockBlobURL(path)
 	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
 	if err != nil {
+		if serr, ok := err.(azblob.StorageError); ok && serr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+			return nil, ErrNotFound
+		}
 		return nil, err
 	}
 
 	return &ObjectAttributes{
-		LastModified: props.LastModified(),
+		LastModified: s.clampedMTime(base, props.LastModified()),
 		Size:         props.ContentLength(),
 	}, nil
 }
 
+func (s *AzureStore) WriteFrom(ctx context.Context, base string, src Store, srcName string) error {
+	return writeFrom(ctx, s, base, src, srcName)
+}
+
 func (s *AzureStore) WriteObject(ctx context.Context, base string, f io.Reader) (err error) {
+	return s.writeObject(ctx, base, f, -1)
+}
+
+func (s *AzureStore) WriteObjectSized(ctx context.Context, base string, f io.Reader, size int64) (err error) {
+	return s.writeObject(ctx, base, f, size)
+}
+
+func (s *AzureStore) WriteObjectSeekable(ctx context.Context, base string, rs io.ReadSeeker) error {
+	return writeObjectSeekable(ctx, s, base, rs, isAzureRetryableError, s.observeRetry)
+}
+
+// isAzureRetryableError classifies the write failures of `WriteObjectSeekable`, responses with a
+// 408, 429 or 5xx status and network failures being transient.
+func isAzureRetryableError(err error) bool {
+	var serr azblob.StorageError
+	if errors.As(err, &serr) {
+		if serr.Response() == nil {
+			return false
+		}
+
+		status := serr.Response().StatusCode
+		return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// UploadFrom uploads uncompressed files with `UploadFileToBlockBlob`, which sends blocks
+// concurrently straight from the file. Compressed stores, or readers that are not a file of
+// `size` bytes, go through `WriteObjectSized`.
+func (s *AzureStore) UploadFrom(ctx context.Context, base string, r io.ReaderAt, size int64) error {
+	file, ok := r.(*os.File)
+	if !ok || s.compressionType != "" {
+		return uploadFrom(ctx, s, base, r, size)
+	}
+	if info, err := file.Stat(); err != nil || info.Size() != size {
+		return uploadFrom(ctx, s, base, r, size)
+	}
+
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	ctx = withFileName(ctx, base)
+	ctx = withStoreType(ctx, "azure")
+	ctx = withLogger(ctx, zlog, tracer)
+
+	if err := s.ensureWritable(); err != nil {
+		return err
+	}
+
+	containerURL, err := s.containerURLFor(ctx)
+	if err != nil {
+		return err
+	}
+
+	skip, err := s.skipExistingObject(ctx, base, s.ObjectURL(base), s.fileExists)
+	if err != nil || skip {
+		return err
+	}
+
+	if err := s.nonEmptySize(size); err != nil {
+		return err
+	}
+
+	blobURL := containerURL.NewBlockBlobURL(s.ObjectPath(base))
+	_, err = azblob.UploadFileToBlockBlob(ctx, file, blobURL, azblob.UploadToBlockBlobOptions{
+		BlobHTTPHeaders: azblob.BlobHTTPHeaders{
+			ContentType:  "application/octet-stream",
+			CacheControl: "public, max-age=86400",
+		},
+		Metadata: azblob.Metadata(s.compressionMetadata(ctx, azureCompressionMetadataKey)),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.reportUncompressedUpload(ctx, size)
+	s.reportWritten(ctx, base, s.ObjectURL(base), s.ObjectAttributes)
+	return nil
+}
+
+// writeObject uploads the object, `size` is the known uncompressed size of the content
+// or -1 if unknown, the upload being tuned with the size stored, see `storedSizeBound`.
+func (s *AzureStore) writeObject(ctx context.Context, base string, f io.Reader, size int64) (err error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	size = s.storedSizeBound(size)
+
 	ctx = withFileName(ctx, base)
 	ctx = withStoreType(ctx, "azure")
 	ctx = withLogger(ctx, zlog, tracer)
 
+	if err := s.ensureWritable(); err != nil {
+		return err
+	}
+
 	path := s.ObjectPath(base)
 
-	exists, err := s.FileExists(ctx, base)
+	containerURL, err := s.containerURLFor(ctx)
 	if err != nil {
 		return err
 	}
 
-	if !s.overwrite && exists {
-		// We silently ignore when we ask not to overwrite
-		return nil
+	skip, err := s.skipExistingObject(ctx, base, s.ObjectURL(base), s.fileExists)
+	if err != nil || skip {
+		return err
+	}
+
+	f, err = s.nonEmptySource(f)
+	if err != nil {
+		return err
 	}
 
+	bufferSize, maxBuffers := azureUploadBuffers(size)
+	releaseBuffers, err := s.uploadBuffers.acquire(ctx, int64(bufferSize)*int64(maxBuffers))
+	if err != nil {
+		return err
+	}
+	defer releaseBuffers()
+
 	pipeRead, pipeWrite := io.Pipe()
 	writeDone := make(chan error, 1)
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
+	var stats writeStats
 	go func(ctx context.Context) {
-		defer pipeWrite.Close()
-
-		err := s.compressedCopy(ctx, pipeWrite, f)
+		var err error
+		stats, err = s.compressedCopyWithStats(ctx, pipeWrite, f)
 		if err != nil {
+			// Fails the upload reading from the pipe instead of letting it complete a truncated blob
+			pipeWrite.CloseWithError(err)
 			cancel()
+		} else {
+			pipeWrite.Close()
 		}
 		writeDone <- err
 	}(ctx)
 
-	bufferSize := 1 * 1024 * 1024 // Size of the rotating buffers that are used when uploading
-	maxBuffers := 3               // Number of rotating buffers that are used when uploading
-	blobURL := s.containerURL.NewBlockBlobURL(path)
+	blobURL := containerURL.NewBlockBlobURL(path)
 	blobHeader := azblob.BlobHTTPHeaders{
 		ContentType:  "application/octet-stream",
 		CacheControl: "public, max-age=86400",
 	}
 
+	initialBufferSize := bufferSize
+	if size < 0 && azureInitialUploadBufferSize < bufferSize {
+		initialBufferSize = azureInitialUploadBufferSize
+	}
+
 	_, err = azblob.UploadStreamToBlockBlob(ctx, pipeRead, blobURL, azblob.UploadStreamToBlockBlobOptions{BlobHTTPHeaders: blobHeader,
-		BufferSize:       bufferSize,
-		MaxBuffers:       maxBuffers,
-		Metadata:         azblob.Metadata{},
+		TransferManager:  newAzureTransferManager(initialBufferSize, bufferSize, maxBuffers),
+		Metadata:         azblob.Metadata(s.compressionMetadata(ctx, azureCompressionMetadataKey)),
 		AccessConditions: azblob.BlobAccessConditions{},
 	})
 	if err != nil {
+		// Unblocks the compression if it's still writing to the pipe, then waits for it, its
+		// error being the root cause of the upload failure when there is one
+		pipeRead.CloseWithError(err)
+		if copyErr := <-writeDone; copyErr != nil {
+			return fmt.Errorf("writing through pipe: %w", copyErr)
+		}
 		return err
 	}
 
+	if err := <-writeDone; err != nil {
+		return fmt.Errorf("writing through pipe: %w", err)
+	}
+
+	s.reportWriteStats(ctx, stats)
+	s.reportWritten(ctx, base, s.ObjectURL(base), s.ObjectAttributes)
 	return nil
 }
 
 func (s *AzureStore) OpenObject(ctx context.Context, name string) (out io.ReadCloser, err error) {
+	return s.openObject(ctx, name, s.compressionType, true, time.Time{})
+}
+
+func (s *AzureStore) OpenObjectIfModifiedSince(ctx context.Context, name string, since time.Time) (io.ReadCloser, bool, error) {
+	return openedIfModified(s.openObject(ctx, name, s.compressionType, true, since))
+}
+
+func (s *AzureStore) OpenObjectWithCompression(ctx context.Context, name string, compressionType string) (out io.ReadCloser, err error) {
+	return s.openObject(ctx, name, compressionType, false, time.Time{})
+}
+
+// PeekObject fetches only the first `n` bytes with a ranged request on stores without
+// compression, streaming through `OpenObject` otherwise or when the object is recorded as
+// compressed.
+func (s *AzureStore) PeekObject(ctx context.Context, name string, n int) ([]byte, error) {
+	if s.compressionType != "" {
+		return peekObject(ctx, s, name, n)
+	}
+	if n <= 0 {
+		return []byte{}, nil
+	}
+
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	containerURL, err := s.containerURLFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	blobURL := containerURL.NewBlockBlobURL(s.ObjectPath(name))
+	get, err := blobURL.Download(ctx, 0, int64(n), azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if serr, ok := err.(azblob.StorageError); ok {
+			switch serr.ServiceCode() {
+			case azblob.ServiceCodeBlobNotFound:
+				return nil, ErrNotFound
+			case azblob.ServiceCodeInvalidRange:
+				// The blob is empty, no range of it is satisfiable
+				return []byte{}, nil
+			}
+		}
+		return nil, err
+	}
+
+	if s.recordedCompression(get.NewMetadata(), azureCompressionMetadataKey) != "" {
+		get.Body(azblob.RetryReaderOptions{}).Close()
+		return peekObject(ctx, s, name, n)
+	}
+
+	reader, err := s.uncompressedReaderWith(ctx, get.Body(azblob.RetryReaderOptions{}), "")
+	if err != nil {
+		return nil, err
+	}
+	return readPeeked(reader, n)
+}
+
+func (s *AzureStore) readRange(ctx context.Context, name string, offset, length int64) ([]byte, string, error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	containerURL, err := s.containerURLFor(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	blobURL := containerURL.NewBlockBlobURL(s.ObjectPath(name))
+	get, err := blobURL.Download(ctx, offset, length, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if serr, ok := err.(azblob.StorageError); ok {
+			switch serr.ServiceCode() {
+			case azblob.ServiceCodeBlobNotFound:
+				return nil, "", ErrNotFound
+			case azblob.ServiceCodeInvalidRange:
+				// The range starts past the end of the blob
+				return []byte{}, "", nil
+			}
+		}
+		return nil, "", err
+	}
+
+	body := get.Body(azblob.RetryReaderOptions{})
+	defer body.Close()
+
+	content, err := io.ReadAll(body)
+	return content, s.recordedCompression(get.NewMetadata(), azureCompressionMetadataKey), err
+}
+
+// openObject opens the object, when `since` is not zero only if it was modified after `since`,
+// `errNotModified` being returned otherwise. The compression recorded in the object's metadata,
+// if any, replaces `compressionType` when `detectCompression` is set, see
+// `WithCompressionDetectionOnWrite`.
+func (s *AzureStore) openObject(ctx context.Context, name string, compressionType string, detectCompression bool, since time.Time) (out io.ReadCloser, err error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer func() {
+		// The operation lasts until the returned reader is closed
+		if err != nil {
+			cancelOperation()
+			return
+		}
+		out = wrapReadCloser(out, cancelOperation)
+	}()
+
 	ctx = withStoreType(ctx, "azure")
 	ctx = withLogger(ctx, zlog, tracer)
 
@@ -213,11 +672,24 @@ func (s *AzureStore) OpenObject(ctx context.Context, name string) (out io.ReadCl
 		zlog.Debug("opening dstore file", zap.String("path", path))
 	}
 
-	blobURL := s.containerURL.NewBlockBlobURL(path)
+	containerURL, err := s.containerURLFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	blobURL := containerURL.NewBlockBlobURL(path)
 
-	get, err := blobURL.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	accessConditions := azblob.BlobAccessConditions{}
+	if !since.IsZero() {
+		accessConditions.ModifiedAccessConditions.IfModifiedSince = since
+	}
+
+	get, err := blobURL.Download(ctx, 0, 0, accessConditions, false, azblob.ClientProvidedKeyOptions{})
 	if err != nil {
-		if err.Error() == string(azblob.ServiceCodeBlobNotFound) {
+		if stgErr, ok := err.(azblob.StorageError); ok && stgErr.Response() != nil && stgErr.Response().StatusCode == http.StatusNotModified {
+			return nil, errNotModified
+		}
+		if serr, ok := err.(azblob.StorageError); ok && serr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
 			return nil, ErrNotFound
 		}
 
@@ -225,8 +697,11 @@ func (s *AzureStore) OpenObject(ctx context.Context, name string) (out io.ReadCl
 	}
 
 	reader := get.Body(azblob.RetryReaderOptions{})
+	if detectCompression && s.compressionDetection {
+		compressionType = detectedCompression(get.NewMetadata(), azureCompressionMetadataKey, compressionType)
+	}
 
-	out, err = s.uncompressedReader(ctx, reader)
+	out, err = s.uncompressedReaderWith(ctx, s.sizeValidatedReader(reader, get.ContentLength()), compressionType)
 	if tracer.Enabled() {
 		out = wrapReadCloser(out, func() {
 			zlog.Debug("closing dstore file", zap.String("path", path))
@@ -235,6 +710,11 @@ func (s *AzureStore) OpenObject(ctx context.Context, name string) (out io.ReadCl
 	return
 }
 
+// OpenObjectSeekable is not supported on Azure stores.
+func (s *AzureStore) OpenObjectSeekable(_ context.Context, _ string) (io.ReadSeekCloser, error) {
+	return nil, fmt.Errorf("seeking Azure objects: %w", ErrNotSupported)
+}
+
 func (s *AzureStore) PushLocalFile(ctx context.Context, localFile, toBaseName string) error {
 	remove, err := pushLocalFile(ctx, s, localFile, toBaseName)
 	if err != nil {
@@ -248,21 +728,42 @@ func (s *AzureStore) WalkFrom(ctx context.Context, prefix, startingPoint string,
 }
 
 func (s *AzureStore) Walk(ctx context.Context, prefix string, f func(filename string) (err error)) error {
+	if s.isSharded() {
+		return s.shardedWalk(ctx, prefix, s.walk, f)
+	}
+	return s.walk(ctx, prefix, f)
+}
 
-	p := strings.TrimLeft(s.baseURL.Path, "/") + "/"
-	if prefix != "" {
-		p = filepath.Join(p, prefix)
-		// join cleans the string and will remove the trailing / in the prefix is present.
-		// adding it back to prevent false positive matches
-		if prefix[len(prefix)-1:] == "/" {
-			p = p + "/"
-		}
+func (s *AzureStore) walk(ctx context.Context, prefix string, f func(filename string) (err error)) error {
+	return s.walkAttributes(ctx, prefix, func(file FileWithAttrs) error {
+		return f(file.Name)
+	})
+}
+
+func (s *AzureStore) walkWithAttributes(ctx context.Context, prefix string, f func(file FileWithAttrs) error) error {
+	if s.isSharded() {
+		return walkWithObjectAttributes(ctx, s, prefix, f)
 	}
+	return s.walkAttributes(ctx, prefix, f)
+}
+
+func (s *AzureStore) walkAttributes(ctx context.Context, prefix string, f func(file FileWithAttrs) error) error {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
 
+	p := s.listPrefix(prefix)
+
+	containerURL, err := s.containerURLFor(ctx)
+	if err != nil {
+		return err
+	}
+
+	progress := s.newWalkProgress(ctx)
 	for marker := (azblob.Marker{}); marker.NotDone(); { // The parens around Marker{} are required to avoid compiler error.
 		// Get a result segment starting with the blob indicated by the current Marker.
-		listBlob, err := s.containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
-			Prefix: p,
+		listBlob, err := containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Prefix:     p,
+			MaxResults: int32(s.cappedListPageSize(azureMaxListPageSize)),
 		})
 		if err != nil {
 			return err
@@ -271,33 +772,247 @@ func (s *AzureStore) Walk(ctx context.Context, prefix string, f func(filename st
 		// IMPORTANT: ListBlobs returns the start of the next segment; you MUST use this to get
 		// the next segment (after processing the current result segment).
 		marker = listBlob.NextMarker
+		progress.pageFetched(len(listBlob.Segment.BlobItems))
 
 		// Process the blobs returned in this result segment (if the segment is empty, the loop body won't execute)
 		for _, blobInfo := range listBlob.Segment.BlobItems {
-			if err := f(s.toBaseName(blobInfo.Name)); err != nil {
-				if err == StopIteration {
+			if s.isSkippedDirectoryMarker(blobInfo.Name) {
+				continue
+			}
+			filename := s.toBaseName(blobInfo.Name)
+			file := FileWithAttrs{Name: filename, ObjectAttributes: ObjectAttributes{
+				LastModified: s.clampedMTime(filename, blobInfo.Properties.LastModified),
+			}}
+			if blobInfo.Properties.ContentLength != nil {
+				file.Size = *blobInfo.Properties.ContentLength
+			}
+			if err := f(file); err != nil {
+				if errors.Is(err, StopIteration) {
 					return nil
 				}
+				return err
 			}
 		}
 	}
 	return nil
 }
 
+// listPrefix returns the blob name prefix listing the blobs under `prefix`
+func (s *AzureStore) listPrefix(prefix string) string {
+	prefix = s.flatKey(prefix)
+	p := strings.TrimLeft(s.baseURL.Path, "/") + "/"
+	if prefix != "" {
+		p = filepath.Join(p, prefix)
+		// join cleans the string and will remove the trailing / in the prefix is present.
+		// adding it back to prevent false positive matches
+		if prefix[len(prefix)-1:] == "/" {
+			p = p + "/"
+		}
+	}
+	return p
+}
+
+// HasAnyFiles lists a single blob under `prefix`.
+func (s *AzureStore) HasAnyFiles(ctx context.Context, prefix string) (bool, error) {
+	if s.isSharded() {
+		return hasAnyFiles(ctx, s, prefix)
+	}
+
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	containerURL, err := s.containerURLFor(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	listBlob, err := containerURL.ListBlobsFlatSegment(ctx, azblob.Marker{}, azblob.ListBlobsSegmentOptions{
+		Prefix:     s.listPrefix(prefix),
+		MaxResults: 1,
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(listBlob.Segment.BlobItems) == 0 {
+		// A segment may be empty while more blobs follow, they are walked
+		if listBlob.NextMarker.NotDone() {
+			return hasAnyFiles(ctx, s, prefix)
+		}
+		return false, nil
+	}
+
+	if s.isSkippedDirectoryMarker(listBlob.Segment.BlobItems[0].Name) {
+		// The first blob is not a file, the following ones are walked
+		return hasAnyFiles(ctx, s, prefix)
+	}
+	return true, nil
+}
+
 func (s *AzureStore) ListFiles(ctx context.Context, prefix string, max int) ([]string, error) {
 	return listFiles(ctx, s, prefix, max)
 }
 
+func (s *AzureStore) ListSubPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	if s.isSharded() || s.keySeparator != "" {
+		// Physical keys do not follow the logical names, the sub-prefixes are derived from them
+		return listSubPrefixes(ctx, s, prefix)
+	}
+
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	basePrefix := strings.TrimLeft(s.baseURL.Path, "/") + "/"
+
+	containerURL, err := s.containerURLFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []string{}
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listBlob, err := containerURL.ListBlobsHierarchySegment(ctx, marker, "/", azblob.ListBlobsSegmentOptions{
+			Prefix:     s.listPrefix(prefix),
+			MaxResults: int32(s.cappedListPageSize(azureMaxListPageSize)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		marker = listBlob.NextMarker
+
+		for _, blobPrefix := range listBlob.Segment.BlobPrefixes {
+			out = append(out, strings.TrimPrefix(blobPrefix.Name, basePrefix))
+		}
+	}
+
+	// Listings are in lexicographical order, and so are the sub-prefixes
+	return out, nil
+}
+
 func (s *AzureStore) DeleteObject(ctx context.Context, base string) error {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	s.existenceCache.forget(s.ObjectURL(base))
+
 	path := s.ObjectPath(base)
 
-	blobURL := s.containerURL.NewBlockBlobURL(path)
+	containerURL, err := s.containerURLFor(ctx)
+	if err != nil {
+		return err
+	}
+
+	blobURL := containerURL.NewBlockBlobURL(path)
 
-	_, err := blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	_, err = blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	if serr, ok := err.(azblob.StorageError); ok && serr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+		return s.deleteResult(ErrNotFound)
+	}
 
 	return err
 }
 
+// azureUploadBuffers returns the size and the count of the rotating buffers used when
+// uploading content of the given size (-1 if unknown).
+func azureUploadBuffers(size int64) (bufferSize int, maxBuffers int) {
+	bufferSize = 1 * 1024 * 1024
+	maxBuffers = 3
+
+	switch {
+	case size < 0:
+	case size < int64(bufferSize):
+		// Small content fits in a single block, no need for rotating buffers
+		bufferSize = int(size) + 1
+		maxBuffers = 1
+	case size/int64(bufferSize) >= azblob.BlockBlobMaxBlocks:
+		bufferSize = int(size/azblob.BlockBlobMaxBlocks) + 1
+	}
+	return
+}
+
+// azureTransferManager is the `azblob.TransferManager` of `writeObject`. Unlike the SDK's, which
+// allocates all its buffers upfront and of at least 1MiB, buffers are allocated as the content
+// flows, the first one being of `initialSize` bytes and each following one doubling up to
+// `maxSize`. Small objects thus only allocate what they need while large ones are still uploaded
+// through up to `maxBuffers` concurrent blocks of `maxSize` bytes.
+type azureTransferManager struct {
+	inUse chan struct{}
+	free  chan []byte
+
+	lock     sync.Mutex
+	nextSize int
+	maxSize  int
+}
+
+func newAzureTransferManager(initialSize, maxSize, maxBuffers int) *azureTransferManager {
+	return &azureTransferManager{
+		inUse:    make(chan struct{}, maxBuffers),
+		free:     make(chan []byte, maxBuffers),
+		nextSize: initialSize,
+		maxSize:  maxSize,
+	}
+}
+
+// Get returns a buffer, blocking while `maxBuffers` of them are in use
+func (m *azureTransferManager) Get() []byte {
+	m.inUse <- struct{}{}
+
+	select {
+	case buffer := <-m.free:
+		return buffer
+	default:
+	}
+
+	m.lock.Lock()
+	size := m.nextSize
+	if m.nextSize < m.maxSize {
+		m.nextSize *= 2
+		if m.nextSize > m.maxSize {
+			m.nextSize = m.maxSize
+		}
+	}
+	m.lock.Unlock()
+
+	return azureBufferAllocator(size)
+}
+
+// Put releases `buffer`, keeping it for reuse unless it's smaller than the ones now allocated
+func (m *azureTransferManager) Put(buffer []byte) {
+	buffer = buffer[:cap(buffer)]
+
+	m.lock.Lock()
+	reusable := len(buffer) >= m.nextSize
+	m.lock.Unlock()
+
+	if reusable {
+		select {
+		case m.free <- buffer:
+		default:
+		}
+	}
+	<-m.inUse
+}
+
+// Run runs `f` in its own goroutine, the concurrency being bounded by the buffers in use
+func (m *azureTransferManager) Run(f func()) {
+	go f()
+}
+
+func (m *azureTransferManager) Close() {}
+
+// newAzureHTTPSender returns a pipeline factory sending the Azure requests through the
+// provided client instead of the SDK's default one.
+func newAzureHTTPSender(client *http.Client) pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			r, err := client.Do(request.WithContext(ctx))
+			if err != nil {
+				err = pipeline.NewError(err, "HTTP request failed")
+			}
+			return pipeline.NewHTTPResponse(r), err
+		}
+	})
+}
+
 func decodeAzureScheme(baseURL *url.URL) (accountName string, container string, err error) {
 	chunks := strings.Split(baseURL.Host, ".")
 	if len(chunks) != 2 {
@@ -320,5 +1035,5 @@ func decodeAzureScheme(baseURL *url.URL) (accountName string, container string,
 }
 
 func (s *AzureStore) toBaseName(filename string) string {
-	return strings.TrimPrefix(strings.TrimSuffix(filename, s.pathWithExt("")), strings.TrimLeft(s.baseURL.Path, "/")+"/")
+	return s.unflatKey(strings.TrimPrefix(strings.TrimSuffix(filename, s.pathWithExt("")), strings.TrimLeft(s.baseURL.Path, "/")+"/"))
 }
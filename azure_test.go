@@ -3,11 +3,19 @@ package dstore
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -118,3 +126,185 @@ func TestAzureStoreWriteObject(t *testing.T) {
 	require.NoError(t, err)
 	assert.ElementsMatch(t, []string{}, readFiles)
 }
+
+func Test_azureUploadBuffers(t *testing.T) {
+	bufferSize, maxBuffers := azureUploadBuffers(-1)
+	assert.Equal(t, 1*1024*1024, bufferSize)
+	assert.Equal(t, 3, maxBuffers)
+
+	bufferSize, maxBuffers = azureUploadBuffers(1024)
+	assert.Equal(t, 1025, bufferSize)
+	assert.Equal(t, 1, maxBuffers)
+
+	size := int64(1*1024*1024) * azblob.BlockBlobMaxBlocks * 2
+	bufferSize, maxBuffers = azureUploadBuffers(size)
+	assert.LessOrEqual(t, size/int64(bufferSize), int64(azblob.BlockBlobMaxBlocks))
+	assert.Equal(t, 3, maxBuffers)
+}
+
+func TestNewStore_AzureSchemes(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_KEY", "c2VjcmV0")
+
+	for _, scheme := range []string{"az", "azblob", "azure"} {
+		t.Run(scheme, func(t *testing.T) {
+			store, err := NewStore(scheme+"://account.container/path", "", "", false)
+			require.NoError(t, err)
+			require.IsType(t, &AzureStore{}, store)
+			assert.Equal(t, "path/file", store.ObjectPath("file"))
+		})
+	}
+}
+
+// azureUploadTransport answers Azure `GetProperties` requests with a blob not found error and
+// accepts every upload
+type azureUploadTransport struct{}
+
+func (azureUploadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodHead {
+		return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Header: http.Header{"X-Ms-Error-Code": []string{"BlobNotFound"}}, Body: http.NoBody, Request: req}, nil
+	}
+
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+	}
+	return &http.Response{StatusCode: http.StatusCreated, Status: "201 Created", Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+}
+
+// failingReader yields some content then fails with `err`
+type failingReader struct {
+	content io.Reader
+	err     error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.content.Read(p)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+func TestAzureStore_WriteObject_ReaderError(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_KEY", "c2VjcmV0")
+
+	store, err := NewStore("az://account.container/path", "", "gzip", true, WithHTTPClient(&http.Client{Transport: azureUploadTransport{}}))
+	require.NoError(t, err)
+
+	require.NoError(t, store.WriteObject(context.Background(), "file", strings.NewReader("content")))
+
+	readErr := errors.New("reader failure")
+	err = store.WriteObject(context.Background(), "file", &failingReader{content: strings.NewReader("partial content"), err: readErr})
+	assert.ErrorIs(t, err, readErr)
+
+	err = WriteObjectSized(context.Background(), store, "file", &failingReader{content: bytes.NewReader(make([]byte, 3*1024*1024)), err: readErr}, 4*1024*1024)
+	assert.ErrorIs(t, err, readErr)
+}
+
+func TestAzureStore_UploadFrom(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_KEY", "c2VjcmV0")
+
+	payload := bytes.Repeat([]byte("0123456789"), 300*1024)
+	localFile := filepath.Join(t.TempDir(), "payload")
+	require.NoError(t, os.WriteFile(localFile, payload, 0644))
+
+	file, err := os.Open(localFile)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var uncompressed, compressed int64
+	store, err := NewStore("az://account.container/path", "", "", true, WithHTTPClient(&http.Client{Transport: azureUploadTransport{}}), WithWriteStats(func(_ context.Context, u, c int64) {
+		uncompressed, compressed = u, c
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, UploadFrom(context.Background(), store, "payload", file, int64(len(payload))))
+	assert.Equal(t, int64(len(payload)), uncompressed)
+	assert.Equal(t, int64(len(payload)), compressed)
+}
+
+func TestAzureStore_WriteObject_AdaptiveBuffers(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_KEY", "c2VjcmV0")
+
+	var lock sync.Mutex
+	var allocations []int
+	defaultAllocator := azureBufferAllocator
+	azureBufferAllocator = func(size int) []byte {
+		lock.Lock()
+		allocations = append(allocations, size)
+		lock.Unlock()
+		return make([]byte, size)
+	}
+	defer func() { azureBufferAllocator = defaultAllocator }()
+
+	store, err := NewStore("az://account.container/path", "", "", true, WithHTTPClient(&http.Client{Transport: azureUploadTransport{}}))
+	require.NoError(t, err)
+
+	require.NoError(t, store.WriteObject(context.Background(), "tiny", strings.NewReader("content")))
+	assert.Equal(t, []int{azureInitialUploadBufferSize}, allocations, "a tiny object of unknown size should only allocate the initial buffer")
+
+	allocations = nil
+	require.NoError(t, WriteObjectSized(context.Background(), store, "tiny", strings.NewReader("content"), 7))
+	assert.Equal(t, []int{8}, allocations, "a tiny object of known size should only allocate its size")
+
+	allocations = nil
+	require.NoError(t, store.WriteObject(context.Background(), "large", bytes.NewReader(make([]byte, 5*1024*1024))))
+	require.NotEmpty(t, allocations)
+	assert.Equal(t, azureInitialUploadBufferSize, allocations[0])
+	for _, size := range allocations {
+		assert.LessOrEqual(t, size, 1*1024*1024)
+	}
+	assert.Contains(t, allocations, 1*1024*1024, "buffers should grow up to the maximum size as content flows")
+}
+
+// azureNotFoundTransport answers every request with the error Azure returns for a missing blob
+type azureNotFoundTransport struct{}
+
+func (azureNotFoundTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := `<?xml version="1.0" encoding="utf-8"?><Error><Code>BlobNotFound</Code><Message>The specified blob does not exist.</Message></Error>`
+	header := http.Header{"X-Ms-Error-Code": []string{string(azblob.ServiceCodeBlobNotFound)}, "Content-Type": []string{"application/xml"}}
+	return &http.Response{StatusCode: http.StatusNotFound, Status: "404 The specified blob does not exist.", Header: header, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+}
+
+func TestAzureStore_OpenObject_NotFound(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_KEY", "c2VjcmV0")
+
+	store, err := NewStore("az://account.container/path", "", "", false, WithHTTPClient(&http.Client{Transport: azureNotFoundTransport{}}))
+	require.NoError(t, err)
+
+	_, err = store.OpenObject(context.Background(), "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+// azureCopyTransport answers `Copy Blob` requests with a pending copy, completed when the blob
+// properties are fetched, recording the copy sources
+type azureCopyTransport struct {
+	sources []string
+}
+
+func (t *azureCopyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	header := http.Header{"X-Ms-Copy-Id": []string{"copy-id"}}
+	if req.Method == http.MethodHead {
+		header.Set("X-Ms-Copy-Status", string(azblob.CopyStatusSuccess))
+		return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: header, Body: http.NoBody, Request: req}, nil
+	}
+
+	t.sources = append(t.sources, req.Header.Get("X-Ms-Copy-Source"))
+	header.Set("X-Ms-Copy-Status", string(azblob.CopyStatusPending))
+	return &http.Response{StatusCode: http.StatusAccepted, Status: "202 Accepted", Header: header, Body: http.NoBody, Request: req}, nil
+}
+
+func TestAzureStore_CopyObject(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_KEY", "c2VjcmV0")
+
+	defaultInterval := azureCopyPollInterval
+	azureCopyPollInterval = time.Millisecond
+	defer func() { azureCopyPollInterval = defaultInterval }()
+
+	transport := &azureCopyTransport{}
+	store, err := NewStore("az://account.container/path", "dbin", "zstd", false, WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	require.NoError(t, store.WriteFrom(context.Background(), "dest", store, "src"))
+	require.Len(t, transport.sources, 1)
+	assert.True(t, strings.HasSuffix(transport.sources[0], "/container/path/src.dbin"), transport.sources[0])
+}
@@ -22,6 +22,28 @@ func (cbw *callbackWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	return
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	cr.n += int64(n)
+	return
+}
+
 type callbackReadCloser struct {
 	rc  io.ReadCloser
 	ctx context.Context
@@ -42,6 +64,32 @@ func (cbr *callbackReadCloser) Close() error {
 	return cbr.rc.Close()
 }
 
+type callbackReadSeekCloser struct {
+	rsc io.ReadSeekCloser
+	ctx context.Context
+
+	callbacks []func(ctx context.Context, n int)
+}
+
+func (cbr *callbackReadSeekCloser) Read(p []byte) (n int, err error) {
+	n, err = cbr.rsc.Read(p)
+
+	for _, callback := range cbr.callbacks {
+		if callback != nil {
+			callback(cbr.ctx, n)
+		}
+	}
+	return
+}
+
+func (cbr *callbackReadSeekCloser) Seek(offset int64, whence int) (int64, error) {
+	return cbr.rsc.Seek(offset, whence)
+}
+
+func (cbr *callbackReadSeekCloser) Close() error {
+	return cbr.rsc.Close()
+}
+
 type callbackReader struct {
 	r   io.Reader
 	ctx context.Context
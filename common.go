@@ -1,14 +1,24 @@
 package dstore
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"path"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/klauspost/compress/zstd"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
 )
 
 //
@@ -20,15 +30,331 @@ type commonStore struct {
 	compressionType string
 	overwrite       bool
 
+	skipDirectoryMarkers bool
+	sizeValidation       bool
+	listPageSize         int
+
+	sharder        func(name string) string
+	objectPathFunc func(base string) string
+	keySeparator   string
+
+	// baseContext cancels all in-flight operations of the store when done, see `WithBaseContext`
+	baseContext context.Context
+
+	// keepLocalAfterPush keeps the local file once pushed, see `WithKeepLocalAfterPush`
+	keepLocalAfterPush bool
+
+	// clampFutureMTimes clamps last modified times in the future, see `WithClampFutureMTimes`
+	clampFutureMTimes bool
+
+	// errorOnEmptyWrite rejects writes of empty content, see `WithErrorOnEmptyWrite`
+	errorOnEmptyWrite bool
+
+	// deleteIgnoreNotFound deletes missing objects successfully, see `WithDeleteIgnoreNotFound`
+	deleteIgnoreNotFound bool
+
+	walkProgressCallback func(ctx context.Context, filesSeen int, pagesFetched int)
+
+	// operationTimeout bounds each individual backend call, see `WithOperationTimeout`
+	operationTimeout time.Duration
+
+	// existenceCache remembers the objects found existing by writes, see `WithExistenceCache`
+	existenceCache *existenceCache
+
+	// existenceBloom answers existence checks of objects certainly missing, see `WithExistenceBloomHint`
+	existenceBloom *existenceBloom
+
+	// zstdDecoders are the decoders of zstd reads, see `WithZstdDecoderConcurrency`
+	zstdDecoders *zstdDecoderPool
+
+	postWriteHook func(ctx context.Context, name string, attrs *ObjectAttributes)
+
+	// retryObserver is told about each retry decision, see `WithRetryObserver`
+	retryObserver func(op string, attempt int, err error, willRetry bool)
+
+	// compressionDetection records and honors the compression of objects in their metadata, see
+	// `WithCompressionDetectionOnWrite`
+	compressionDetection bool
+
+	// uploadBuffers bounds the memory of concurrent upload buffers, see `WithMaxInFlightBytes`
+	uploadBuffers *uploadBufferLimiter
+
 	compressedWriteCallback   func(ctx context.Context, size int)
 	uncompressedWriteCallback func(ctx context.Context, size int)
 	compressedReadCallback    func(ctx context.Context, size int)
 	uncompressedReadCallback  func(ctx context.Context, size int)
+	writeStatsCallback        func(ctx context.Context, uncompressed, compressed int64)
+	overwriteSkipCallback     func(ctx context.Context, name string)
+}
+
+// writeStats holds the totals of a single write operation
+type writeStats struct {
+	uncompressed int64
+	compressed   int64
+}
+
+func (c *commonStore) commonConfig() *commonStore { return c }
+
+// errNotModified is returned by the stores' conditional opens when the object was not modified
+// since the given time, see `openedIfModified`.
+var errNotModified = errors.New("not modified")
+
+// openedIfModified adapts the result of a conditional open to the `OpenObjectIfModifiedSince`
+// contract.
+func openedIfModified(out io.ReadCloser, err error) (io.ReadCloser, bool, error) {
+	if errors.Is(err, errNotModified) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
+
+// openObjectIfModifiedSince checks the modification time of the object before opening it, see
+// `OpenObjectIfModifiedSince`.
+func openObjectIfModifiedSince(ctx context.Context, store Store, name string, since time.Time) (io.ReadCloser, bool, error) {
+	attrs, err := store.ObjectAttributes(ctx, name)
+	if err != nil {
+		return nil, false, err
+	}
+	if !attrs.LastModified.After(since) {
+		return nil, false, nil
+	}
+
+	return openedIfModified(store.OpenObject(ctx, name))
+}
+
+// objectURL returns the URL of the object at `name`, relative to `baseURL`, percent-encoding
+// its path so that the URL is valid and parses back to the raw name, whatever characters (spaces,
+// `#`, `?`, unicode) it contains. The query of `baseURL` is kept after the path.
+func objectURL(baseURL *url.URL, name string) string {
+	out := *baseURL
+	out.Path = strings.TrimRight(baseURL.Path, "/") + "/" + strings.TrimLeft(name, "/")
+	out.RawPath = ""
+	return out.String()
+}
+
+// operationContext returns the context of an operation, cancelled as soon as `ctx` or the store's
+// base context (see `WithBaseContext`) is. `cancel` must be called once the operation completes.
+func (c *commonStore) operationContext(ctx context.Context) (out context.Context, cancel context.CancelFunc) {
+	if c.baseContext == nil || c.baseContext.Done() == nil {
+		return ctx, func() {}
+	}
+
+	out, cancel = context.WithCancel(ctx)
+	if c.baseContext.Err() != nil {
+		cancel()
+		return out, cancel
+	}
+
+	go func() {
+		select {
+		case <-c.baseContext.Done():
+			cancel()
+		case <-out.Done():
+		}
+	}()
+
+	return out, cancel
+}
+
+// operationErr returns the error of `ctx` or of the store's base context (see `WithBaseContext`),
+// whichever is done, nil while both are live. Unlike the context returned by `operationContext`,
+// which is cancelled asynchronously, it reflects a cancellation right away.
+func (c *commonStore) operationErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.baseContext != nil {
+		return c.baseContext.Err()
+	}
+	return nil
+}
+
+// cancellableSource returns `r` failing once `ctx` or the store's base context is done, aborting
+// the transfers of local and memory stores whose I/O takes no context. `r` is returned as-is when
+// the store has no cancellable base context, keeping its `io.WriterTo` fast path.
+func (c *commonStore) cancellableSource(ctx context.Context, r io.Reader) io.Reader {
+	if c.baseContext == nil || c.baseContext.Done() == nil {
+		return r
+	}
+	return &cancellableReader{ctx: ctx, store: c, r: r}
+}
+
+type cancellableReader struct {
+	ctx   context.Context
+	store *commonStore
+	r     io.Reader
+}
+
+func (r *cancellableReader) Read(p []byte) (int, error) {
+	if err := r.store.operationErr(r.ctx); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// cancellableReadCloser is like `cancellableSource` for the content of `rc`, closing it on close
+func (c *commonStore) cancellableReadCloser(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	if c.baseContext == nil || c.baseContext.Done() == nil {
+		return rc
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&cancellableReader{ctx: ctx, store: c, r: rc}, rc}
+}
+
+// callTimer bounds the individual backend calls issued with the context returned by
+// `callTimer`, each armed call cancelling that context when it lasts longer than the store's
+// operation timeout (see `WithOperationTimeout`). Calls must be wrapped with `start` and `stop`,
+// the time spent between calls (reading a body, writing content) is not accounted for.
+//
+// A nil `*callTimer`, returned when no timeout is configured, is valid and does nothing.
+type callTimer struct {
+	timeout time.Duration
+	cancel  context.CancelFunc
+
+	lock  sync.Mutex
+	timer *time.Timer
+	fired bool
+}
+
+// callTimer returns the context to issue bounded backend calls with and its timer, `release`
+// must be called once the context is no longer used.
+func (c *commonStore) callTimer(ctx context.Context) (context.Context, *callTimer) {
+	if c.operationTimeout <= 0 {
+		return ctx, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, &callTimer{timeout: c.operationTimeout, cancel: cancel}
+}
+
+// start arms the timer before a backend call
+func (t *callTimer) start() {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.timer == nil {
+		t.timer = time.AfterFunc(t.timeout, t.expire)
+		return
+	}
+	t.timer.Reset(t.timeout)
+}
+
+// stop disarms the timer once a backend call returned
+func (t *callTimer) stop() {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+func (t *callTimer) expire() {
+	t.lock.Lock()
+	t.fired = true
+	t.lock.Unlock()
+
+	t.cancel()
+}
+
+// release stops the timer and cancels its context
+func (t *callTimer) release() {
+	if t == nil {
+		return
+	}
+
+	t.stop()
+	t.cancel()
+}
+
+// err reports `err` as a `context.DeadlineExceeded` error if the timer cancelled the call
+// that failed with it.
+func (t *callTimer) err(err error) error {
+	if t == nil || err == nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.fired {
+		return err
+	}
+	return fmt.Errorf("%w: backend call took longer than %s: %s", context.DeadlineExceeded, t.timeout, err)
 }
 
 func (c *commonStore) Overwrite() bool      { return c.overwrite }
 func (c *commonStore) SetOverwrite(in bool) { c.overwrite = in }
 
+// rebase creates the store at `baseURL` inheriting the configuration of `c`, `backendOpts`
+// reproducing the backend specific one, see `Rebasable`.
+func (c *commonStore) rebase(ctx context.Context, baseURL string, backendOpts optionFunc, opts []Option) (Store, error) {
+	inherited := optionFunc(func(config *config) {
+		config.skipDirectoryMarkers = c.skipDirectoryMarkers
+		config.sizeValidation = c.sizeValidation
+		config.listPageSize = c.listPageSize
+		config.sharder = c.sharder
+		config.objectPathFunc = c.objectPathFunc
+		config.keySeparator = c.keySeparator
+		config.uploadBuffers = c.uploadBuffers
+		config.keepLocalAfterPush = c.keepLocalAfterPush
+		config.clampFutureMTimes = c.clampFutureMTimes
+		config.errorOnEmptyWrite = c.errorOnEmptyWrite
+		config.deleteIgnoreNotFound = c.deleteIgnoreNotFound
+		config.walkProgressCallback = c.walkProgressCallback
+		config.operationTimeout = c.operationTimeout
+		config.existenceCacheTTL = c.existenceCache.ttlOrZero()
+		config.existenceBloomHint = c.existenceBloom != nil
+		config.existenceBloomHintMaxAge = c.existenceBloom.maxAgeOrZero()
+		if c.zstdDecoders != nil {
+			config.zstdDecoderConcurrency = c.zstdDecoders.concurrency
+			config.zstdMaxIdleDecoders = c.zstdDecoders.maxIdle
+		}
+		config.postWriteHook = c.postWriteHook
+		config.retryObserver = c.retryObserver
+		config.compressionDetection = c.compressionDetection
+		config.compressedReadCallback = c.compressedReadCallback
+		config.uncompressedReadCallback = c.uncompressedReadCallback
+		config.compressedWriteCallback = c.compressedWriteCallback
+		config.uncompressedWriteCallback = c.uncompressedWriteCallback
+		config.writeStatsCallback = c.writeStatsCallback
+		config.overwriteSkipCallback = c.overwriteSkipCallback
+		if backendOpts != nil {
+			backendOpts(config)
+		}
+	})
+
+	return newStoreContext(ctx, baseURL, c.extension, c.compressionType, c.overwrite, append([]Option{inherited}, opts...)...)
+}
+
+// cappedListPageSize returns the configured listing page size bounded by `max`, 0 meaning
+// the backend's default page size should be used.
+func (c *commonStore) cappedListPageSize(max int) int {
+	if c.listPageSize <= 0 {
+		return 0
+	}
+	if c.listPageSize > max {
+		return max
+	}
+	return c.listPageSize
+}
+
+// isSkippedDirectoryMarker returns true if `key` is a directory marker and the store is
+// configured to skip them while walking.
+func (c *commonStore) isSkippedDirectoryMarker(key string) bool {
+	return c.skipDirectoryMarkers && strings.HasSuffix(key, "/")
+}
+
 func (c *commonStore) pathWithExt(base string) string {
 	if c.extension != "" {
 		return base + "." + c.extension
@@ -36,11 +362,115 @@ func (c *commonStore) pathWithExt(base string) string {
 	return base
 }
 
+// shardedPathWithExt returns the object key relative to the store's base path, which
+// includes the shard when prefix sharding is enabled or is the transformed path when
+// an object path function is configured, flattened by the key separator if any.
+func (c *commonStore) shardedPathWithExt(base string) string {
+	if c.objectPathFunc != nil {
+		return c.flatKey(c.pathWithExt(c.objectPathFunc(base)))
+	}
+	if c.sharder != nil {
+		return c.flatKey(c.sharder(base) + "/" + c.pathWithExt(base))
+	}
+	return c.flatKey(c.pathWithExt(base))
+}
+
+// flatKey replaces the `/` of the relative key or prefix `key` by the key separator, see
+// `WithKeySeparator`
+func (c *commonStore) flatKey(key string) string {
+	if c.keySeparator == "" {
+		return key
+	}
+	return strings.ReplaceAll(key, "/", c.keySeparator)
+}
+
+// subStoreErr returns the error of `SubStore` on stores with a key separator, whose sub folders
+// are not folders of their keys, nil otherwise
+func (c *commonStore) subStoreErr(subFolder string) error {
+	if c.keySeparator == "" {
+		return nil
+	}
+	return fmt.Errorf("sub store %q of store with key separator %q: %w", subFolder, c.keySeparator, ErrNotSupported)
+}
+
+// unflatKey reverses `flatKey` on a walked relative key
+func (c *commonStore) unflatKey(key string) string {
+	if c.keySeparator == "" {
+		return key
+	}
+	return strings.ReplaceAll(key, c.keySeparator, "/")
+}
+
+// unshardedName returns the object name of the walked `filename`, `found` being false when
+// `filename` is not the path of any object name.
+func (c *commonStore) unshardedName(filename string) (name string, found bool) {
+	if c.objectPathFunc != nil {
+		// Longest candidates first, the logical name being a suffix of the path
+		for candidate := filename; ; {
+			if c.objectPathFunc(candidate) == filename {
+				return candidate, true
+			}
+
+			_, rest, found := strings.Cut(candidate, "/")
+			if !found {
+				return "", false
+			}
+			candidate = rest
+		}
+	}
+
+	shard, name, found := strings.Cut(filename, "/")
+	if !found || shard != c.sharder(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// isSharded returns true when object paths are not the object names themselves, walking
+// the store then goes through `shardedWalk`.
+func (c *commonStore) isSharded() bool {
+	return c.sharder != nil || c.objectPathFunc != nil
+}
+
+// shardedWalk walks all shards of the store by walking it in full through `walk`, which
+// yields `<shard>/<name>` filenames (or transformed paths with an object path function).
+// Names matching `prefix` are collected, sorted and then passed to `f`, so that the order
+// is the same as for a store without sharding.
+func (c *commonStore) shardedWalk(ctx context.Context, prefix string, walk func(ctx context.Context, prefix string, f func(filename string) error) error, f func(filename string) error) error {
+	var names []string
+	err := walk(ctx, "", func(filename string) error {
+		name, found := c.unshardedName(filename)
+		if !found || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		if err := f(name); err != nil {
+			if errors.Is(err, StopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
 func commonWalkFrom(store Store, ctx context.Context, prefix, startingPoint string, f func(filename string) (err error)) error {
 	if startingPoint != "" && !strings.HasPrefix(startingPoint, prefix) {
 		return fmt.Errorf("starting point %q must start with prefix %q", startingPoint, prefix)
 	}
 
+	// Walk yields files in lexicographical order, so once a file reaches the starting point all following
+	// ones do too. An empty starting point lets every file through, and a starting point equal to a
+	// file name (the prefix itself included) is inclusive.
 	var gatePassed bool
 	return store.Walk(ctx, prefix, func(filename string) error {
 		if gatePassed {
@@ -54,6 +484,109 @@ func commonWalkFrom(store Store, ctx context.Context, prefix, startingPoint stri
 	})
 }
 
+// commonWalkFromExclusive walks through `store.WalkFrom`, which is inclusive, skipping the file
+// named exactly `afterPoint`.
+func commonWalkFromExclusive(store Store, ctx context.Context, prefix, afterPoint string, f func(filename string) (err error)) error {
+	return store.WalkFrom(ctx, prefix, afterPoint, func(filename string) error {
+		if filename == afterPoint {
+			return nil
+		}
+		return f(filename)
+	})
+}
+
+// commonWalkReverse lists all files under `prefix` through `store.Walk` and passes them to `f` in
+// descending lexicographical order. Backends only list in ascending order, so every name under
+// `prefix` is buffered in memory before the first callback, keep the prefix narrow on large stores.
+func commonWalkReverse(store Store, ctx context.Context, prefix string, f func(filename string) (err error)) error {
+	var names []string
+	err := store.Walk(ctx, prefix, func(filename string) error {
+		names = append(names, filename)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(names) - 1; i >= 0; i-- {
+		if err := f(names[i]); err != nil {
+			if errors.Is(err, StopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// commonWalkSorted lists all files under `prefix` through `store.Walk` and passes them to `f` in
+// the order defined by `less`, buffering every name under `prefix` in memory to sort them.
+func commonWalkSorted(store Store, ctx context.Context, prefix string, less func(a, b string) bool, f func(filename string) (err error)) error {
+	var names []string
+	err := store.Walk(ctx, prefix, func(filename string) error {
+		names = append(names, filename)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(names, func(i, j int) bool { return less(names[i], names[j]) })
+	for _, name := range names {
+		if err := f(name); err != nil {
+			if errors.Is(err, StopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func pushLocalFiles(ctx context.Context, store Store, files map[string]string, concurrency int) error {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	type push struct{ localFile, toBaseName string }
+	pushes := make(chan push)
+
+	var lock sync.Mutex
+	var errs error
+	addErr := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		errs = multierr.Append(errs, err)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range pushes {
+				if err := store.PushLocalFile(ctx, p.localFile, p.toBaseName); err != nil {
+					addErr(fmt.Errorf("push %q to %q: %w", p.localFile, p.toBaseName, err))
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for localFile, toBaseName := range files {
+		select {
+		case pushes <- push{localFile, toBaseName}:
+		case <-ctx.Done():
+			addErr(ctx.Err())
+			break dispatch
+		}
+	}
+	close(pushes)
+	wg.Wait()
+
+	return errs
+}
+
 func pushLocalFile(ctx context.Context, store Store, localFile, toBaseName string) (removeFunc func() error, err error) {
 	f, err := os.Open(localFile)
 	if err != nil {
@@ -61,18 +594,263 @@ func pushLocalFile(ctx context.Context, store Store, localFile, toBaseName strin
 	}
 	defer f.Close()
 
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat file: %w", err)
+	}
+
 	objPath := store.ObjectPath(toBaseName)
 
-	err = store.WriteObject(ctx, toBaseName, f)
+	err = WriteObjectSized(ctx, store, toBaseName, f, info.Size())
 	if err != nil {
 		return nil, fmt.Errorf("writing %q to storage %q: %w", localFile, objPath, err)
 	}
 
+	if c, ok := store.(interface{ commonConfig() *commonStore }); ok && c.commonConfig().keepLocalAfterPush {
+		return func() error { return nil }, nil
+	}
+
 	return func() error {
 		return os.Remove(localFile)
 	}, nil
 }
 
+func deleteObjectsUnderPrefix(ctx context.Context, store Store, prefix string, force bool) (deleted int, err error) {
+	if prefix == "" && !force {
+		return 0, fmt.Errorf("refusing to delete objects with an empty prefix, this would delete the whole store, use force to proceed")
+	}
+
+	// Names are collected first, deleting while walking is not supported by all stores
+	var names []string
+	err = store.Walk(ctx, prefix, func(filename string) error {
+		names = append(names, filename)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("walking prefix %q: %w", prefix, err)
+	}
+
+	if batchDeleter, ok := store.(BatchDeleter); ok {
+		if err := batchDeleter.DeleteObjects(ctx, names); err != nil {
+			return 0, fmt.Errorf("batch deleting objects: %w", err)
+		}
+		return len(names), nil
+	}
+
+	for _, name := range names {
+		if err := store.DeleteObject(ctx, name); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return deleted, fmt.Errorf("deleting object %q: %w", name, err)
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// hasAnyFiles reports whether `store` has any file under `prefix`, walking it up to the first one.
+func hasAnyFiles(ctx context.Context, store Store, prefix string) (bool, error) {
+	found := false
+	err := store.Walk(ctx, prefix, func(_ string) error {
+		found = true
+		return StopIteration
+	})
+	return found, err
+}
+
+// uploadFrom writes the `size` bytes of `r` as the object `base` through `WriteObjectSized`.
+func uploadFrom(ctx context.Context, store Store, base string, r io.ReaderAt, size int64) error {
+	return WriteObjectSized(ctx, store, base, io.NewSectionReader(r, 0, size), size)
+}
+
+// WriteObjectSeekableAttempts is the maximum number of attempts of a `WriteObjectSeekable`
+// upload failing with a retryable error.
+var WriteObjectSeekableAttempts = 3
+
+// writeObjectSeekable writes `rs` from its start as the object `base` through `WriteObjectSized`,
+// rewinding it to retry uploads failing with a retryable error, see `WriteObjectSeekable`.
+// Failures are classified by `isRetryable`, the backend classification, when not nil, see
+// `isRetryableWriteError`. Each retry decision is reported to `observe` when not nil, see
+// `WithRetryObserver`.
+func writeObjectSeekable(ctx context.Context, store Store, base string, rs io.ReadSeeker, isRetryable func(err error) bool, observe func(op string, attempt int, err error, willRetry bool)) error {
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("seeking to end: %w", err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("seeking to start: %w", err)
+		}
+
+		err := WriteObjectSized(ctx, store, base, rs, size)
+		willRetry := err != nil && attempt < WriteObjectSeekableAttempts && isRetryableWriteError(ctx, err, isRetryable)
+		if observe != nil && (err != nil || attempt > 1) {
+			observe("WriteObjectSeekable", attempt, err, willRetry)
+		}
+		if !willRetry {
+			return err
+		}
+
+		zlog.Debug("write of seekable content failed, retrying", zap.String("name", base), zap.Int("attempt", attempt), zap.Error(err))
+	}
+}
+
+// isRetryableWriteError returns true when the write failure `err` may be transient, it is not
+// when `ctx` is done or when the write was refused by the store (unsupported, failed
+// precondition, permission denied, ...). Other failures are classified by `isRetryable`, the
+// backend classification, or considered transient when it is nil.
+func isRetryableWriteError(ctx context.Context, err error, isRetryable func(err error) bool) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	for _, permanent := range []error{ErrNotSupported, ErrEmptyObject, ErrPreconditionFailed, ErrAlreadyExists, ErrNotFound, os.ErrPermission} {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+
+	if isRetryable != nil {
+		return isRetryable(err)
+	}
+	return true
+}
+
+// writeObjectWithDeadline writes `f` as the object `base` through `WriteObject` with `ctx`
+// bounded by `deadline`, reads of `f` failing once it is reached. Writes of all backends are
+// atomic, a write failing past the deadline leaves no object behind, so there is nothing to clean
+// up (deleting would race with a concurrent writer of the same object).
+func writeObjectWithDeadline(ctx context.Context, store Store, base string, f io.Reader, deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	err := store.WriteObject(ctx, base, &contextReader{ctx: ctx, reader: f})
+	if err == nil || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("%w: %s", context.DeadlineExceeded, err)
+	}
+	return fmt.Errorf("writing object %q: %w", base, err)
+}
+
+// contextReader fails reads of `reader` once `ctx` is done
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// peekObject returns the first `n` bytes of the object `name` of `store` through `OpenObject`.
+func peekObject(ctx context.Context, store Store, name string, n int) ([]byte, error) {
+	reader, err := store.OpenObject(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return readPeeked(reader, n)
+}
+
+// readPeeked reads up to `n` bytes from `reader` then closes it.
+func readPeeked(reader io.ReadCloser, n int) ([]byte, error) {
+	defer reader.Close()
+
+	out, err := io.ReadAll(io.LimitReader(reader, int64(n)))
+	if err != nil {
+		return nil, fmt.Errorf("reading first %d bytes: %w", n, err)
+	}
+	return out, nil
+}
+
+// downloadTo copies the object `name` of `store` into `w` through `OpenObject`.
+func downloadTo(ctx context.Context, store Store, name string, w io.Writer) (int64, error) {
+	reader, err := store.OpenObject(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := io.Copy(w, reader)
+	if err != nil {
+		reader.Close()
+		return written, fmt.Errorf("copying object %q: %w", name, err)
+	}
+
+	return written, reader.Close()
+}
+
+func writeFrom(ctx context.Context, dst Store, base string, src Store, srcName string) error {
+	if canCopyServerSide(dst, src) {
+		return dst.CopyObject(ctx, srcName, base)
+	}
+
+	reader, err := src.OpenObject(ctx, srcName)
+	if err != nil {
+		return fmt.Errorf("open source object %q: %w", srcName, err)
+	}
+	defer reader.Close()
+
+	if err := dst.WriteObject(ctx, base, reader); err != nil {
+		return fmt.Errorf("write object %q: %w", base, err)
+	}
+	return nil
+}
+
+// canCopyServerSide returns true when `src` objects can be copied to `dst` with `CopyObject`,
+// that is both stores are the same one or point to the same location with the same encoding and
+// object naming. Custom object paths or differing key separators map names differently, the
+// content is then streamed.
+func canCopyServerSide(dst, src Store) bool {
+	if dst == src {
+		return true
+	}
+
+	if _, ok := dst.(*MemoryStore); ok {
+		// Each memory store instance holds its own data, only the same instance shares it
+		return false
+	}
+
+	dstCommon, ok := dst.(interface{ commonConfig() *commonStore })
+	if !ok {
+		return false
+	}
+	srcCommon, ok := src.(interface{ commonConfig() *commonStore })
+	if !ok {
+		return false
+	}
+
+	if reflect.TypeOf(dst) != reflect.TypeOf(src) || dst.BaseURL().String() != src.BaseURL().String() {
+		return false
+	}
+
+	d, s := dstCommon.commonConfig(), srcCommon.commonConfig()
+	if d.objectPathFunc != nil || s.objectPathFunc != nil || d.keySeparator != s.keySeparator {
+		return false
+	}
+	return d.extension == s.extension && d.compressionType == s.compressionType && !d.isSharded() && !s.isSharded()
+}
+
+func statObject(ctx context.Context, store Store, base string) (exists bool, attrs *ObjectAttributes, err error) {
+	attrs, err = store.ObjectAttributes(ctx, base)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, nil, nil
+		}
+		return false, nil, err
+	}
+
+	return true, attrs, nil
+}
+
 func listFiles(ctx context.Context, store Store, prefix string, max int) (out []string, err error) {
 	var count int
 	err = store.Walk(ctx, prefix, func(filename string) error {
@@ -91,14 +869,117 @@ func listFiles(ctx context.Context, store Store, prefix string, max int) (out []
 	return
 }
 
+// listFilesGlob lists the files matching the `path.Match` glob `pattern`, walking only the
+// files under the longest literal prefix of the pattern.
+func listFilesGlob(ctx context.Context, store Store, pattern string, max int) (out []string, err error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob pattern %q: %w", pattern, err)
+	}
+
+	var count int
+	err = store.Walk(ctx, globLiteralPrefix(pattern), func(filename string) error {
+		if matched, _ := path.Match(pattern, filename); !matched {
+			return nil
+		}
+
+		count++
+		if max >= 0 && count > max {
+			return StopIteration
+		}
+
+		out = append(out, filename)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// listSubPrefixes lists the sub-prefixes under `prefix`, see `ListSubPrefixes`, walking all the
+// files under `prefix`.
+func listSubPrefixes(ctx context.Context, store Store, prefix string) ([]string, error) {
+	var names []string
+	err := store.Walk(ctx, prefix, func(filename string) error {
+		names = append(names, filename)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return subPrefixesOf(names, prefix), nil
+}
+
+// subPrefixesOf returns the sorted distinct sub-prefixes of `names` under `prefix`, see
+// `ListSubPrefixes`, for stores that hold all their names at hand.
+func subPrefixesOf(names []string, prefix string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		if i := strings.Index(name[len(prefix):], "/"); i >= 0 {
+			subPrefix := name[:len(prefix)+i+1]
+			if !seen[subPrefix] {
+				seen[subPrefix] = true
+				out = append(out, subPrefix)
+			}
+		}
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+// globLiteralPrefix returns the part of `pattern` preceding its first special character.
+func globLiteralPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// ensureWritable returns an error when the store's compression can only be read, checked
+// before a write reaches the backend so that no partial object gets created.
+func (c *commonStore) ensureWritable() error {
+	if c.compressionType == "bzip2" {
+		return fmt.Errorf("bzip2 compression is read-only, writing objects is not supported: %w", ErrNotSupported)
+	}
+	return nil
+}
+
 func (c *commonStore) compressedCopy(ctx context.Context, destination io.Writer, source io.Reader) error {
+	_, err := c.compressedCopyWithStats(ctx, destination, source)
+	return err
+}
+
+// compressedCopyWithStats is like compressedCopy but also returns the totals of bytes
+// read from `source` and written to `destination`. A `source` implementing `io.WriterTo`
+// writes itself into the destination, `io.Copy` picking that path without an extra buffer.
+func (c *commonStore) compressedCopyWithStats(ctx context.Context, destination io.Writer, source io.Reader) (stats writeStats, err error) {
 	// Wrap the writer with the uncompressed write callback if it exists
 	if c.compressedWriteCallback != nil {
 		destination = &callbackWriter{w: destination, callback: c.compressedWriteCallback, ctx: ctx}
 	}
 
+	counter := &countingWriter{w: destination}
+	defer func() { stats.compressed = counter.n }()
+	destination = counter
+
+	if err := c.ensureWritable(); err != nil {
+		return stats, err
+	}
+
+	compressionType := c.compressionType
+	if isPreCompressed(ctx) {
+		compressionType = ""
+	}
+
 	var dest io.Writer
-	switch c.compressionType {
+	switch compressionType {
 	case "gzip":
 		gw := gzip.NewWriter(destination)
 		if c.uncompressedWriteCallback != nil {
@@ -106,27 +987,27 @@ func (c *commonStore) compressedCopy(ctx context.Context, destination io.Writer,
 		} else {
 			dest = gw
 		}
-		if _, err := io.Copy(dest, source); err != nil {
-			return err
+		if stats.uncompressed, err = io.Copy(dest, source); err != nil {
+			return stats, err
 		}
 		if err := gw.Close(); err != nil {
-			return err
+			return stats, err
 		}
 	case "zstd":
 		zstdEncoder, err := zstd.NewWriter(destination)
 		if err != nil {
-			return err
+			return stats, err
 		}
 		if c.uncompressedWriteCallback != nil {
 			dest = &callbackWriter{w: zstdEncoder, callback: c.uncompressedWriteCallback, ctx: ctx}
 		} else {
 			dest = zstdEncoder
 		}
-		if _, err := io.Copy(dest, source); err != nil {
-			return err
+		if stats.uncompressed, err = io.Copy(dest, source); err != nil {
+			return stats, err
 		}
 		if err := zstdEncoder.Close(); err != nil {
-			return err
+			return stats, err
 		}
 	default:
 		if c.uncompressedWriteCallback != nil {
@@ -134,19 +1015,209 @@ func (c *commonStore) compressedCopy(ctx context.Context, destination io.Writer,
 		} else {
 			dest = destination
 		}
-		if _, err := io.Copy(dest, source); err != nil {
-			return err
+		if stats.uncompressed, err = io.Copy(dest, source); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// nonEmptySource returns a reader yielding the content of `source`, failing with `ErrEmptyObject`
+// when it has no content at all and `WithErrorOnEmptyWrite` is used. The first byte is read
+// ahead so that the check happens before anything is sent to the backend.
+func (c *commonStore) nonEmptySource(source io.Reader) (io.Reader, error) {
+	if !c.errorOnEmptyWrite {
+		return source, nil
+	}
+
+	var first [1]byte
+	n, err := io.ReadFull(source, first[:])
+	if n == 0 {
+		if err == io.EOF {
+			return nil, ErrEmptyObject
 		}
+		return nil, err
+	}
+
+	return io.MultiReader(bytes.NewReader(first[:n]), source), nil
+}
+
+// nonEmptySize is like `nonEmptySource` for content of known `size`.
+func (c *commonStore) nonEmptySize(size int64) error {
+	if c.errorOnEmptyWrite && size == 0 {
+		return ErrEmptyObject
 	}
 	return nil
 }
 
+// storedSizeBound returns an upper bound of the size stored for content of known uncompressed
+// `size`, -1 when unknown, which is what uploads are tuned with. Compression can slightly grow
+// incompressible content, the bound covers the framing overhead of the writable compressions.
+func (c *commonStore) storedSizeBound(size int64) int64 {
+	if size < 0 || c.compressionType == "" {
+		return size
+	}
+	return size + size/64 + 1024
+}
+
+// walkProgressBatchSize is the count of files reported as a page by stores without listing pages
+const walkProgressBatchSize = 1000
+
+// walkProgress accumulates the progress of a single walk reported to `WithWalkProgress`
+type walkProgress struct {
+	ctx      context.Context
+	callback func(ctx context.Context, filesSeen int, pagesFetched int)
+
+	files   int
+	pages   int
+	pending int
+}
+
+func (c *commonStore) newWalkProgress(ctx context.Context) *walkProgress {
+	return &walkProgress{ctx: ctx, callback: c.walkProgressCallback}
+}
+
+// pageFetched reports a listing page of `files` objects
+func (p *walkProgress) pageFetched(files int) {
+	p.files += files
+	p.pages++
+	if p.callback != nil {
+		p.callback(p.ctx, p.files, p.pages)
+	}
+}
+
+// fileSeen counts a file listed outside of a known page, reported once the batch is full or
+// on `flush`
+func (p *walkProgress) fileSeen() {
+	p.pending++
+	if p.pending == walkProgressBatchSize {
+		p.flush()
+	}
+}
+
+func (p *walkProgress) flush() {
+	if p.pending > 0 {
+		p.pageFetched(p.pending)
+		p.pending = 0
+	}
+}
+
+// deleteResult returns the error of a `DeleteObject`, `nil` when the object was not found and
+// `WithDeleteIgnoreNotFound` is used.
+func (c *commonStore) deleteResult(err error) error {
+	if c.deleteIgnoreNotFound && errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// reportUncompressedUpload reports to the write callbacks `size` bytes uploaded as is, for writes
+// of uncompressed content not going through `compressedCopyWithStats`.
+func (c *commonStore) reportUncompressedUpload(ctx context.Context, size int64) {
+	if c.compressedWriteCallback != nil {
+		c.compressedWriteCallback(ctx, int(size))
+	}
+	if c.uncompressedWriteCallback != nil {
+		c.uncompressedWriteCallback(ctx, int(size))
+	}
+	c.reportWriteStats(ctx, writeStats{uncompressed: size, compressed: size})
+}
+
+// reportWriteStats invokes the write stats callback, if any, must only be called once the
+// write has been successfully committed to the backend.
+func (c *commonStore) reportWriteStats(ctx context.Context, stats writeStats) {
+	if c.writeStatsCallback != nil {
+		c.writeStatsCallback(ctx, stats.uncompressed, stats.compressed)
+	}
+}
+
+// reportWritten records the object `base` just written, identified by `key` in the existence
+// bloom hint, and invokes the post write hook, if any, with its attributes as returned by
+// `attributes`. See `WithPostWriteHook`.
+func (c *commonStore) reportWritten(ctx context.Context, base, key string, attributes func(ctx context.Context, base string) (*ObjectAttributes, error)) {
+	c.existenceBloom.add(key)
+
+	if c.postWriteHook == nil {
+		return
+	}
+
+	attrs, err := attributes(ctx, base)
+	if err != nil {
+		zlog.Warn("unable to fetch attributes of written object for post write hook", zap.String("name", base), zap.Error(err))
+		attrs = nil
+	}
+	c.postWriteHook(ctx, base, attrs)
+}
+
+// CompressionMetadataKey is the metadata key holding the compression of the objects written
+// with `WithCompressionDetectionOnWrite`. Azure stores use `x_dstore_compression` instead, the
+// keys of Azure metadata being unable to hold dashes.
+const CompressionMetadataKey = "x-dstore-compression"
+
+const azureCompressionMetadataKey = "x_dstore_compression"
+
+// compressionMetadata returns the metadata recording the compression of the objects written
+// with `ctx` under `key`, nil when the store does not record it. The compression set on `ctx` by
+// `withRecordedCompression`, if any, is recorded whatever the store's configuration.
+func (c *commonStore) compressionMetadata(ctx context.Context, key string) map[string]string {
+	compressionType, found := recordedCompressionFromContext(ctx)
+	if !found {
+		if !c.compressionDetection {
+			return nil
+		}
+		compressionType = c.compressionType
+	}
+
+	if compressionType == "" {
+		compressionType = "none"
+	}
+	return map[string]string{key: compressionType}
+}
+
+// recordedCompression returns the compression recorded under `key` in the object `metadata`, ""
+// when the store does not honor recorded compressions or the object is recorded uncompressed.
+// The ranged and parallel reads of the stored bytes are only valid when it returns "".
+func (c *commonStore) recordedCompression(metadata map[string]string, key string) string {
+	if !c.compressionDetection {
+		return ""
+	}
+	return detectedCompression(metadata, key, "")
+}
+
+// detectedCompression returns the compression recorded under `key` in the object `metadata`,
+// backends differing in the case of the keys they return, or `fallback` when none is.
+func detectedCompression(metadata map[string]string, key, fallback string) string {
+	for candidate, compressionType := range metadata {
+		if strings.EqualFold(candidate, key) {
+			if compressionType == "none" {
+				return ""
+			}
+			return compressionType
+		}
+	}
+	return fallback
+}
+
+// observeRetry reports to the retry observer, if any, the outcome of `attempt` (1-based) of
+// `op`, see `WithRetryObserver`.
+func (c *commonStore) observeRetry(op string, attempt int, err error, willRetry bool) {
+	if c.retryObserver != nil {
+		c.retryObserver(op, attempt, err, willRetry)
+	}
+}
+
 func (c *commonStore) uncompressedReader(ctx context.Context, reader io.ReadCloser) (out io.ReadCloser, err error) {
+	return c.uncompressedReaderWith(ctx, reader, c.compressionType)
+}
+
+// uncompressedReaderWith is like uncompressedReader but decodes the content using
+// `compressionType` instead of the store's configured compression.
+func (c *commonStore) uncompressedReaderWith(ctx context.Context, reader io.ReadCloser, compressionType string) (out io.ReadCloser, err error) {
 	if c.compressedReadCallback != nil {
 		reader = &callbackReadCloser{rc: reader, callback: c.compressedReadCallback, ctx: ctx}
 	}
 
-	switch c.compressionType {
+	switch compressionType {
 	case "gzip":
 		gzipReader, err := NewGZipReadCloser(reader)
 		if err != nil {
@@ -160,15 +1231,28 @@ func (c *commonStore) uncompressedReader(ctx context.Context, reader io.ReadClos
 		}
 
 	case "zstd":
-		zstdReader, err := zstd.NewReader(reader)
+		decoders := c.zstdDecoders
+		if decoders == nil {
+			decoders = zstdDecoderPoolFor(0, 0)
+		}
+
+		zstdReader, err := decoders.newReader(reader)
 		if err != nil {
 			return nil, fmt.Errorf("unable to create zstd reader: %w", err)
 		}
 
 		if c.uncompressedReadCallback != nil {
-			out = &callbackReadCloser{rc: zstdReader.IOReadCloser(), callback: c.uncompressedReadCallback, ctx: ctx}
+			out = &callbackReadCloser{rc: zstdReader, callback: c.uncompressedReadCallback, ctx: ctx}
+		} else {
+			out = zstdReader
+		}
+
+	case "bzip2":
+		bzip2Reader := newBZip2ReadCloser(reader)
+		if c.uncompressedReadCallback != nil {
+			out = &callbackReadCloser{rc: bzip2Reader, callback: c.uncompressedReadCallback, ctx: ctx}
 		} else {
-			out = zstdReader.IOReadCloser()
+			out = bzip2Reader
 		}
 	default:
 		if c.uncompressedReadCallback != nil {
@@ -181,6 +1265,101 @@ func (c *commonStore) uncompressedReader(ctx context.Context, reader io.ReadClos
 	return out, nil
 }
 
+// seekableReader returns `reader` wrapped so that the read callbacks are invoked, compressed
+// and uncompressed bytes being the same since seekable objects are never compressed.
+func (c *commonStore) seekableReader(ctx context.Context, reader io.ReadSeekCloser) io.ReadSeekCloser {
+	if c.compressedReadCallback == nil && c.uncompressedReadCallback == nil {
+		return reader
+	}
+
+	return &callbackReadSeekCloser{
+		rsc:       reader,
+		ctx:       ctx,
+		callbacks: []func(ctx context.Context, n int){c.compressedReadCallback, c.uncompressedReadCallback},
+	}
+}
+
+// clampedMTime returns `modified` clamped to the current time when it is later than now plus
+// `FutureMTimeSkew` and `WithClampFutureMTimes` is used.
+func (c *commonStore) clampedMTime(base string, modified time.Time) time.Time {
+	if !c.clampFutureMTimes {
+		return modified
+	}
+
+	now := time.Now()
+	if modified.After(now.Add(FutureMTimeSkew)) {
+		zlog.Warn("clamping future last modified time, backend clock is probably skewed",
+			zap.String("object", base),
+			zap.Time("last_modified", modified),
+			zap.Time("now", now),
+		)
+		return now
+	}
+	return modified
+}
+
+// sizeValidatedReader wraps `reader` so that a premature `io.EOF` is turned into a
+// `*ShortReadError` when size validation is enabled and `expectedSize` is known (>= 0).
+func (c *commonStore) sizeValidatedReader(reader io.ReadCloser, expectedSize int64) io.ReadCloser {
+	if !c.sizeValidation || expectedSize < 0 {
+		return reader
+	}
+
+	return &sizeValidatingReadCloser{rc: reader, expected: expectedSize}
+}
+
+type sizeValidatingReadCloser struct {
+	rc       io.ReadCloser
+	expected int64
+	read     int64
+}
+
+func (r *sizeValidatingReadCloser) Read(p []byte) (n int, err error) {
+	n, err = r.rc.Read(p)
+	r.read += int64(n)
+
+	if err == io.EOF && r.read < r.expected {
+		return n, &ShortReadError{Expected: r.expected, Actual: r.read}
+	}
+	return
+}
+
+func (r *sizeValidatingReadCloser) Close() error {
+	return r.rc.Close()
+}
+
+// skipExistingObject reports whether the write of `base`, identified by `key` in the existence
+// cache (see `WithExistenceCache`), must be skipped because the object exists and the store does
+// not allow overwrites, checking its existence with `fileExists` when not known to exist.
+func (c *commonStore) skipExistingObject(ctx context.Context, base, key string, fileExists func(ctx context.Context, base string) (bool, error)) (bool, error) {
+	if c.overwrite {
+		return false, nil
+	}
+
+	if !c.existenceCache.exists(key) {
+		exists, err := fileExists(ctx, base)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			return false, nil
+		}
+		c.existenceCache.add(key)
+	}
+
+	// We silently ignore when we ask not to overwrite
+	c.reportOverwriteSkip(ctx, base)
+	return true, nil
+}
+
+// reportOverwriteSkip invokes the overwrite skip callback, if any, must be called when a
+// write is skipped because the object already exists.
+func (c *commonStore) reportOverwriteSkip(ctx context.Context, name string) {
+	if c.overwriteSkipCallback != nil {
+		c.overwriteSkipCallback(ctx, name)
+	}
+}
+
 func wrapReadCloser(orig io.ReadCloser, f func()) io.ReadCloser {
 	return &wrappedReadCloser{
 		orig:      orig,
@@ -201,3 +1380,11 @@ func (wrc *wrappedReadCloser) Close() error {
 func (wrc *wrappedReadCloser) Read(p []byte) (n int, err error) {
 	return wrc.orig.Read(p)
 }
+
+// WriteTo keeps the `io.WriterTo` fast path of the wrapped reader, if any, available to `io.Copy`
+func (wrc *wrappedReadCloser) WriteTo(w io.Writer) (n int64, err error) {
+	if writerTo, ok := wrc.orig.(io.WriterTo); ok {
+		return writerTo.WriteTo(w)
+	}
+	return io.Copy(w, wrc.orig)
+}
@@ -5,7 +5,13 @@ import (
 	"compress/gzip"
 	"context"
 	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
@@ -374,6 +380,107 @@ func TestUncompressedReaderZstd(t *testing.T) {
 	assert.Greater(t, uncompressedN, compressedN)
 }
 
+// closeTrackingReader records whether it was closed
+type closeTrackingReader struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeTrackingReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func zstdCompressed(t testing.TB, content []byte) []byte {
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	require.NoError(t, err)
+	_, err = zw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestUncompressedReaderZstd_PooledDecoders(t *testing.T) {
+	ctx := context.Background()
+	c := commonStore{compressionType: "zstd", zstdDecoders: &zstdDecoderPool{concurrency: 1, idle: make(chan *zstd.Decoder, 1)}}
+
+	first := bytes.Repeat([]byte("first"), 100000)
+	second := bytes.Repeat([]byte("second"), 100)
+	compressedFirst, compressedSecond := zstdCompressed(t, first), zstdCompressed(t, second)
+
+	// The first stream is abandoned half read, the pooled decoder must be reset on the next one
+	src := &closeTrackingReader{Reader: bytes.NewReader(compressedFirst)}
+	reader, err := c.uncompressedReader(ctx, src)
+	require.NoError(t, err)
+	_, err = io.ReadFull(reader, make([]byte, len(first)/2))
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.True(t, src.closed)
+	require.Len(t, c.zstdDecoders.idle, 1)
+
+	_, err = reader.Read(make([]byte, 1))
+	assert.Error(t, err, "reading a closed reader must not use the released decoder")
+
+	reader, err = c.uncompressedReader(ctx, io.NopCloser(bytes.NewReader(compressedSecond)))
+	require.NoError(t, err)
+	assert.Len(t, c.zstdDecoders.idle, 0, "idle decoder should be reused")
+	read, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.Equal(t, second, read)
+}
+
+func TestUncompressedReaderZstd_PooledAllocations(t *testing.T) {
+	ctx := context.Background()
+	compressed := zstdCompressed(t, bytes.Repeat([]byte("content"), 10000))
+
+	allocated := func(open func() io.ReadCloser) uint64 {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		for i := 0; i < 50; i++ {
+			reader := open()
+			_, err := io.Copy(io.Discard, reader)
+			require.NoError(t, err)
+			require.NoError(t, reader.Close())
+		}
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+
+	c := commonStore{compressionType: "zstd", zstdDecoders: zstdDecoderPoolFor(2, 0)}
+	pooled := allocated(func() io.ReadCloser {
+		reader, err := c.uncompressedReader(ctx, io.NopCloser(bytes.NewReader(compressed)))
+		require.NoError(t, err)
+		return reader
+	})
+	unpooled := allocated(func() io.ReadCloser {
+		decoder, err := zstd.NewReader(bytes.NewReader(compressed), zstd.WithDecoderConcurrency(2))
+		require.NoError(t, err)
+		return decoder.IOReadCloser()
+	})
+
+	assert.Less(t, pooled, unpooled/2, "pooled %d bytes, unpooled %d bytes", pooled, unpooled)
+}
+
+func BenchmarkUncompressedReaderZstd(b *testing.B) {
+	ctx := context.Background()
+	compressed := zstdCompressed(b, bytes.Repeat([]byte("content"), 10000))
+	c := commonStore{compressionType: "zstd"}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		reader, err := c.uncompressedReader(ctx, io.NopCloser(bytes.NewReader(compressed)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, reader); err != nil {
+			b.Fatal(err)
+		}
+		reader.Close()
+	}
+}
+
 func TestUncompressedReaderPlain(t *testing.T) {
 	uncompressedN := 0
 	compressedN := 0
@@ -410,3 +517,167 @@ func TestUncompressedReaderPlain(t *testing.T) {
 	assert.Greater(t, compressedN, 0)
 	assert.Equal(t, uncompressedN, compressedN)
 }
+
+// bzip2Content is "some bzip2 content" compressed with bzip2, the standard library having no encoder
+var bzip2Content = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x58, 0x0f, 0x64, 0x96, 0x00, 0x00,
+	0x07, 0x19, 0x80, 0x40, 0x00, 0x10, 0x00, 0x1a, 0x23, 0xcc, 0x10, 0x20, 0x00, 0x21, 0xa9, 0xa6,
+	0x04, 0x79, 0x08, 0x06, 0x80, 0x23, 0xbe, 0x71, 0x65, 0x11, 0x6b, 0xe6, 0x90, 0x5a, 0x2e, 0xe4,
+	0x8a, 0x70, 0xa1, 0x20, 0xb0, 0x1e, 0xc9, 0x2c,
+}
+
+func TestUncompressedReaderBZip2(t *testing.T) {
+	uncompressedN := 0
+	compressedN := 0
+
+	c := commonStore{
+		compressionType: "bzip2",
+		uncompressedReadCallback: func(ctx context.Context, n int) {
+			uncompressedN += n
+		},
+		compressedReadCallback: func(ctx context.Context, n int) {
+			compressedN += n
+		},
+	}
+
+	ur, err := c.uncompressedReader(context.Background(), io.NopCloser(bytes.NewReader(bzip2Content)))
+	require.NoError(t, err)
+
+	content, err := io.ReadAll(ur)
+	require.NoError(t, err)
+	require.NoError(t, ur.Close())
+
+	assert.Equal(t, "some bzip2 content", string(content))
+	assert.Equal(t, len("some bzip2 content"), uncompressedN)
+	assert.Equal(t, len(bzip2Content), compressedN)
+}
+
+func TestCompressedCopyBZip2(t *testing.T) {
+	c := commonStore{compressionType: "bzip2"}
+
+	err := c.compressedCopy(context.Background(), io.Discard, strings.NewReader("content"))
+	assert.ErrorIs(t, err, ErrNotSupported)
+}
+
+func TestPushLocalFile_PassesSize(t *testing.T) {
+	localFile := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(localFile, []byte("hello world"), 0644))
+
+	var receivedSize int64 = -1
+	store := NewMockStore(nil)
+	store.WriteObjectSizedFunc = func(ctx context.Context, base string, f io.Reader, size int64) error {
+		receivedSize = size
+		return nil
+	}
+
+	require.NoError(t, store.PushLocalFile(context.Background(), localFile, "file.txt"))
+	assert.Equal(t, int64(11), receivedSize)
+
+	_, err := os.Stat(localFile)
+	assert.True(t, os.IsNotExist(err), "local file should have been removed")
+}
+
+func TestCompressedCopyWithStats(t *testing.T) {
+	for _, compressionType := range []string{"", "gzip", "zstd"} {
+		t.Run(compressionType, func(t *testing.T) {
+			var uncompressedN, compressedN int64
+
+			c := commonStore{
+				compressionType: compressionType,
+				uncompressedWriteCallback: func(ctx context.Context, n int) {
+					uncompressedN += int64(n)
+				},
+				compressedWriteCallback: func(ctx context.Context, n int) {
+					compressedN += int64(n)
+				},
+			}
+
+			w := bytes.NewBuffer(nil)
+			stats, err := c.compressedCopyWithStats(context.Background(), w, bytes.NewBuffer(bytes.Repeat([]byte("1"), 1024)))
+			require.NoError(t, err)
+
+			assert.Equal(t, uncompressedN, stats.uncompressed)
+			assert.Equal(t, compressedN, stats.compressed)
+			assert.Equal(t, int64(w.Len()), stats.compressed)
+			assert.Equal(t, int64(1024), stats.uncompressed)
+		})
+	}
+}
+
+func TestSizeValidatedReader(t *testing.T) {
+	c := commonStore{sizeValidation: true}
+
+	r := c.sizeValidatedReader(io.NopCloser(bytes.NewReader([]byte("short"))), 10)
+	_, err := io.ReadAll(r)
+
+	var shortRead *ShortReadError
+	require.ErrorAs(t, err, &shortRead)
+	assert.ErrorIs(t, err, ErrShortRead)
+	assert.Equal(t, int64(10), shortRead.Expected)
+	assert.Equal(t, int64(5), shortRead.Actual)
+
+	r = c.sizeValidatedReader(io.NopCloser(bytes.NewReader([]byte("exact"))), 5)
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "exact", string(content))
+}
+
+func TestStoredSizeBound(t *testing.T) {
+	content := make([]byte, 1024*1024)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+
+	for _, compressionType := range []string{"gzip", "zstd"} {
+		c := &commonStore{compressionType: compressionType}
+		out := &bytes.Buffer{}
+		require.NoError(t, c.compressedCopy(context.Background(), out, bytes.NewReader(content)))
+
+		assert.LessOrEqual(t, int64(out.Len()), c.storedSizeBound(int64(len(content))), compressionType)
+	}
+
+	assert.Equal(t, int64(-1), (&commonStore{compressionType: "zstd"}).storedSizeBound(-1))
+	assert.Equal(t, int64(42), (&commonStore{}).storedSizeBound(42))
+}
+
+func TestListSubPrefixes_WalkFallback(t *testing.T) {
+	inner := NewMockStore(nil)
+	inner.SetFile("eth/a", nil)
+	inner.SetFile("eth/b/c", nil)
+	inner.SetFile("sol/d/e", nil)
+	inner.SetFile("top", nil)
+
+	// the manifest store does not list sub-prefixes natively, its files are walked
+	store := NewManifestAcceleratedStore(inner, "manifest.json", time.Minute, false)
+	_, native := Store(store).(SubPrefixLister)
+	require.False(t, native)
+
+	prefixes, err := ListSubPrefixes(context.Background(), store, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eth/", "sol/"}, prefixes)
+
+	prefixes, err = ListSubPrefixes(context.Background(), store, "eth/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eth/b/"}, prefixes)
+}
+
+func TestCanCopyServerSide(t *testing.T) {
+	dir := t.TempDir()
+
+	newStore := func(opts ...Option) Store {
+		store, err := NewStore(dir, "dbin", "zstd", false, opts...)
+		require.NoError(t, err)
+		return store
+	}
+
+	plain := newStore()
+	assert.True(t, canCopyServerSide(plain, plain))
+	assert.True(t, canCopyServerSide(plain, newStore()))
+	assert.False(t, canCopyServerSide(plain, newStore(WithKeySeparator("_"))), "key separators differ")
+	assert.False(t, canCopyServerSide(newStore(WithKeySeparator("_")), plain), "key separators differ")
+	assert.True(t, canCopyServerSide(newStore(WithKeySeparator("_")), newStore(WithKeySeparator("_"))))
+
+	withPathFunc := newStore(WithObjectPathFunc(func(base string) string { return "custom/" + base }))
+	assert.True(t, canCopyServerSide(withPathFunc, withPathFunc))
+	assert.False(t, canCopyServerSide(plain, withPathFunc), "object paths are mapped differently")
+	assert.False(t, canCopyServerSide(withPathFunc, plain), "object paths are mapped differently")
+}
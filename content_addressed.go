@@ -0,0 +1,231 @@
+package dstore
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	contentAddressedIndexPrefix = "index/"
+	contentAddressedTempPrefix  = "tmp/"
+)
+
+// NewContentAddressedStore wraps `inner` so that written content is stored once per distinct
+// content: `WriteObject` streams the content through `hash` and stores it under its hex digest,
+// ignoring the provided name, while an index object `index/<name>` holding the digest maps the
+// logical name to its content. Reads, attributes and walks resolve names through the index, so
+// identical content written under several names is stored a single time.
+//
+// As the digest is only known once the content has been fully read, it is first written to a
+// temporary `tmp/<random>` key and then copied to its digest key with `CopyObject` (when not
+// already present) before the temporary key is removed. The copy is server-side on S3, Google
+// Storage and Azure stores, local stores reading and writing the content again.
+//
+// Deleting a name only removes its index entry, the content itself is never garbage collected
+// since other names may still reference it.
+func NewContentAddressedStore(inner Store, hash func() hash.Hash) Store {
+	return &contentAddressedStore{
+		Store: inner,
+		hash:  hash,
+	}
+}
+
+type contentAddressedStore struct {
+	Store
+
+	hash func() hash.Hash
+}
+
+func (s *contentAddressedStore) OpenObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	digest, err := s.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Store.OpenObject(ctx, digest)
+}
+
+func (s *contentAddressedStore) OpenObjectWithCompression(ctx context.Context, name string, compressionType string) (io.ReadCloser, error) {
+	digest, err := s.resolve(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenObjectWithCompression(ctx, s.Store, digest, compressionType)
+}
+
+func (s *contentAddressedStore) OpenObjectIfModifiedSince(ctx context.Context, name string, since time.Time) (io.ReadCloser, bool, error) {
+	// The index entry is rewritten on each write of `name` while the content may be much older
+	attrs, err := s.Store.ObjectAttributes(ctx, contentAddressedIndexPrefix+name)
+	if err == nil && !attrs.LastModified.After(since) {
+		return nil, false, nil
+	}
+
+	return openedIfModified(s.OpenObject(ctx, name))
+}
+
+func (s *contentAddressedStore) FileExists(ctx context.Context, base string) (bool, error) {
+	return s.Store.FileExists(ctx, contentAddressedIndexPrefix+base)
+}
+
+func (s *contentAddressedStore) ObjectAttributes(ctx context.Context, base string) (*ObjectAttributes, error) {
+	digest, err := s.resolve(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Store.ObjectAttributes(ctx, digest)
+}
+
+func (s *contentAddressedStore) WriteObject(ctx context.Context, base string, f io.Reader) error {
+	if !s.Store.Overwrite() {
+		exists, err := s.FileExists(ctx, base)
+		if err != nil {
+			return fmt.Errorf("checking index entry of %q: %w", base, err)
+		}
+		if exists {
+			return nil
+		}
+	}
+
+	hasher := s.hash()
+	tempKey := contentAddressedTempPrefix + randomString(16)
+	if err := s.Store.WriteObject(ctx, tempKey, io.TeeReader(f, hasher)); err != nil {
+		return fmt.Errorf("writing temporary object: %w", err)
+	}
+	defer s.Store.DeleteObject(ctx, tempKey)
+
+	digest := hex.EncodeToString(hasher.Sum(nil))
+	exists, err := s.Store.FileExists(ctx, digest)
+	if err != nil {
+		return fmt.Errorf("checking content %q: %w", digest, err)
+	}
+
+	if !exists {
+		if err := s.Store.CopyObject(ctx, tempKey, digest); err != nil {
+			return fmt.Errorf("moving temporary object to content %q: %w", digest, err)
+		}
+	}
+
+	if err := s.writeIndex(ctx, base, digest); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *contentAddressedStore) WriteObjectSized(ctx context.Context, base string, f io.Reader, size int64) error {
+	return s.WriteObject(ctx, base, io.LimitReader(f, size))
+}
+
+func (s *contentAddressedStore) PushLocalFile(ctx context.Context, localFile, toBaseName string) error {
+	removeFunc, err := pushLocalFile(ctx, s, localFile, toBaseName)
+	if err != nil {
+		return err
+	}
+	return removeFunc()
+}
+
+func (s *contentAddressedStore) WriteFrom(ctx context.Context, base string, src Store, srcName string) error {
+	return writeFrom(ctx, s, base, src, srcName)
+}
+
+// CopyObject only copies the index entry of `src`, both names then share the same content.
+func (s *contentAddressedStore) CopyObject(ctx context.Context, src, dest string) error {
+	digest, err := s.resolve(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	return s.writeIndex(ctx, dest, digest)
+}
+
+func (s *contentAddressedStore) Touch(ctx context.Context, base string) error {
+	return Touch(ctx, s.Store, contentAddressedIndexPrefix+base)
+}
+
+// SetObjectMetadata sets the metadata on the index entry of `base`, as names sharing the same
+// content may have different metadata.
+func (s *contentAddressedStore) SetObjectMetadata(ctx context.Context, base string, md map[string]string) error {
+	return SetObjectMetadata(ctx, s.Store, contentAddressedIndexPrefix+base, md)
+}
+
+func (s *contentAddressedStore) GetObjectMetadata(ctx context.Context, base string) (map[string]string, error) {
+	return GetObjectMetadata(ctx, s.Store, contentAddressedIndexPrefix+base)
+}
+
+func (s *contentAddressedStore) WalkFrom(ctx context.Context, prefix, startingPoint string, f func(filename string) (err error)) error {
+	return commonWalkFrom(s, ctx, prefix, startingPoint, f)
+}
+
+func (s *contentAddressedStore) Walk(ctx context.Context, prefix string, f func(filename string) (err error)) error {
+	return s.Store.Walk(ctx, contentAddressedIndexPrefix+prefix, func(filename string) error {
+		return f(strings.TrimPrefix(filename, contentAddressedIndexPrefix))
+	})
+}
+
+func (s *contentAddressedStore) ListFiles(ctx context.Context, prefix string, max int) ([]string, error) {
+	return listFiles(ctx, s, prefix, max)
+}
+
+func (s *contentAddressedStore) HasAnyFiles(ctx context.Context, prefix string) (bool, error) {
+	return HasAnyFiles(ctx, s.Store, contentAddressedIndexPrefix+prefix)
+}
+
+func (s *contentAddressedStore) ListSubPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	subPrefixes, err := ListSubPrefixes(ctx, s.Store, contentAddressedIndexPrefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, subPrefix := range subPrefixes {
+		subPrefixes[i] = strings.TrimPrefix(subPrefix, contentAddressedIndexPrefix)
+	}
+	return subPrefixes, nil
+}
+
+// DeleteObject only removes the index entry of `base`, its content is kept as other names
+// may still reference it.
+func (s *contentAddressedStore) DeleteObject(ctx context.Context, base string) error {
+	return s.Store.DeleteObject(ctx, contentAddressedIndexPrefix+base)
+}
+
+func (s *contentAddressedStore) SubStore(subFolder string) (Store, error) {
+	sub, err := s.Store.SubStore(subFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewContentAddressedStore(sub, s.hash), nil
+}
+
+// resolve returns the digest key holding the content of `name`, `ErrNotFound` when `name`
+// has no index entry.
+func (s *contentAddressedStore) resolve(ctx context.Context, name string) (string, error) {
+	reader, err := s.Store.OpenObject(ctx, contentAddressedIndexPrefix+name)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	digest, err := io.ReadAll(reader)
+	if err != nil {
+		return "", fmt.Errorf("reading index entry of %q: %w", name, err)
+	}
+
+	if len(digest) == 0 {
+		return "", fmt.Errorf("index entry of %q is empty: %w", name, ErrNotFound)
+	}
+	return string(digest), nil
+}
+
+func (s *contentAddressedStore) writeIndex(ctx context.Context, name, digest string) error {
+	if err := s.Store.WriteObject(ctx, contentAddressedIndexPrefix+name, strings.NewReader(digest)); err != nil {
+		return fmt.Errorf("writing index entry of %q: %w", name, err)
+	}
+	return nil
+}
@@ -10,6 +10,8 @@ import (
 
 type fileKey string
 type storeKey string
+type preCompressedKey string
+type recordedCompressionKey string
 
 func withLogger(ctx context.Context, logger *zap.Logger, tracer logging.Tracer) context.Context {
 	ctx = context.WithValue(ctx, "logger", logger)
@@ -38,3 +40,25 @@ func FileNameFromContext(ctx context.Context) string {
 	}
 	return ""
 }
+
+// withPreCompressed marks the writes performed with the returned context as receiving content
+// already compressed, to be written as-is, see `WriteObjectPreCompressed`
+func withPreCompressed(ctx context.Context) context.Context {
+	return context.WithValue(ctx, preCompressedKey("pre-compressed"), true)
+}
+
+func isPreCompressed(ctx context.Context) bool {
+	return ctx.Value(preCompressedKey("pre-compressed")) != nil
+}
+
+// withRecordedCompression makes the writes performed with the returned context record
+// `compressionType` as the compression of the object written, in the metadata uploaded along
+// with the content, see `NewPerExtensionCompressionStore`
+func withRecordedCompression(ctx context.Context, compressionType string) context.Context {
+	return context.WithValue(ctx, recordedCompressionKey("recorded-compression"), compressionType)
+}
+
+func recordedCompressionFromContext(ctx context.Context) (string, bool) {
+	compressionType, found := ctx.Value(recordedCompressionKey("recorded-compression")).(string)
+	return compressionType, found
+}
@@ -0,0 +1,49 @@
+package dstore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"golang.org/x/oauth2"
+)
+
+type credentialsKey string
+
+// RequestCredentials overrides the credentials of the store for the operations performed with a
+// context built by `WithRequestCredentials`. Only the field matching the store's backend is used,
+// an operation on a store whose field is not set fails instead of falling back to the store's
+// own credentials.
+type RequestCredentials struct {
+	// S3 credentials used by S3 stores, e.g. `credentials.NewStaticCredentials(...)`.
+	S3 *credentials.Credentials
+
+	// GCS token source used by Google Storage stores, e.g. `oauth2.StaticTokenSource(...)`.
+	GCS oauth2.TokenSource
+
+	// Azure credential used by Azure stores, e.g. `azblob.NewSharedKeyCredential(...)`.
+	Azure azblob.Credential
+}
+
+// WithRequestCredentials returns a context making the stores perform operations with `creds`
+// instead of their own credentials, useful in multi-tenant services acting on behalf of a caller.
+//
+// Overriding has a cost: each operation builds a one-off client (S3, Google Storage) or request
+// pipeline (Azure) for the given credentials instead of reusing the store's one, so it should be
+// reserved to the operations that really need it. Google Storage one-off clients are closed once
+// the operation is done, when the returned reader is closed for reads.
+func WithRequestCredentials(ctx context.Context, creds *RequestCredentials) context.Context {
+	return context.WithValue(ctx, credentialsKey("credentials"), creds)
+}
+
+func requestCredentialsFromContext(ctx context.Context) *RequestCredentials {
+	if v := ctx.Value(credentialsKey("credentials")); v != nil {
+		return v.(*RequestCredentials)
+	}
+	return nil
+}
+
+func missingRequestCredentials(backend string) error {
+	return fmt.Errorf("request credentials override has no %s credentials", backend)
+}
@@ -0,0 +1,179 @@
+package dstore
+
+import (
+	"context"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const existenceBloomHashes = 6
+
+// existenceBloom answers "definitely not present" for the objects missing from the listing of
+// the store they belong to, see `WithExistenceBloomHint`. Objects are identified by their
+// `ObjectURL`, each store listed, sub stores included, having its own filter keyed by its base
+// URL. Objects written through the store are added as they are written, an object is never
+// removed, only ever causing an unnecessary check. A nil filter never answers.
+type existenceBloom struct {
+	maxAge time.Duration
+
+	lock       sync.Mutex
+	filters    map[string]*bloomFilter // by base URL of the store listed
+	rebuilding map[string][]string     // by base URL of the store being listed, the objects written meanwhile
+}
+
+type bloomFilter struct {
+	bits     []uint64
+	listedAt time.Time
+}
+
+func newExistenceBloom(enabled bool, maxAge time.Duration) *existenceBloom {
+	if !enabled {
+		return nil
+	}
+
+	return &existenceBloom{
+		maxAge:     maxAge,
+		filters:    map[string]*bloomFilter{},
+		rebuilding: map[string][]string{},
+	}
+}
+
+// maxAgeOrZero returns the max age of the filters, 0 for a nil filter
+func (b *existenceBloom) maxAgeOrZero() time.Duration {
+	if b == nil {
+		return 0
+	}
+	return b.maxAge
+}
+
+// definitelyAbsent returns true when `base` is certainly not present in `store`, listing the
+// store first when not done recently. While the store is being listed, by this call or a
+// concurrent one, and on listing failure, it answers false. It must only be used to answer
+// `FileExists` calls of users, never to guard writes or deletions.
+func (b *existenceBloom) definitelyAbsent(ctx context.Context, store Store, base string) bool {
+	if b == nil {
+		return false
+	}
+
+	root := withoutQuery(store.BaseURL().String())
+	key := withoutQuery(store.ObjectURL(base))
+
+	b.lock.Lock()
+	filter := b.filters[root]
+	if filter != nil && time.Since(filter.listedAt) <= b.maxAge {
+		defer b.lock.Unlock()
+		return !filter.mayContain(key)
+	}
+
+	if _, found := b.rebuilding[root]; found {
+		b.lock.Unlock()
+		return false
+	}
+	b.rebuilding[root] = nil
+	b.lock.Unlock()
+
+	// Listed without the lock held, the objects written meanwhile being recorded by `add`
+	filter, err := b.list(ctx, store)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	written := b.rebuilding[root]
+	delete(b.rebuilding, root)
+	if err != nil {
+		zlog.Debug("unable to list store for existence bloom hint, checking object instead", zap.String("store", root), zap.Error(err))
+		return false
+	}
+
+	for _, key := range written {
+		filter.set(key)
+	}
+	b.filters[root] = filter
+	return !filter.mayContain(key)
+}
+
+// add records that the object identified by `key` exists, in the filters of the stores it
+// belongs to
+func (b *existenceBloom) add(key string) {
+	if b == nil {
+		return
+	}
+
+	key = withoutQuery(key)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for root, filter := range b.filters {
+		if strings.HasPrefix(key, root) {
+			filter.set(key)
+		}
+	}
+	for root, written := range b.rebuilding {
+		if strings.HasPrefix(key, root) {
+			b.rebuilding[root] = append(written, key)
+		}
+	}
+}
+
+// list builds a filter holding the objects of `store`
+func (b *existenceBloom) list(ctx context.Context, store Store) (*bloomFilter, error) {
+	listedAt := time.Now()
+
+	var keys []string
+	err := store.Walk(ctx, "", func(filename string) error {
+		keys = append(keys, withoutQuery(store.ObjectURL(filename)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// About 16 bits per object, with room for the objects written before the next listing,
+	// keeps false positives well under 1%
+	filter := &bloomFilter{bits: make([]uint64, (len(keys)+1024)/4), listedAt: listedAt}
+	for _, key := range keys {
+		filter.set(key)
+	}
+	return filter, nil
+}
+
+func (f *bloomFilter) set(key string) {
+	h1, h2 := bloomHashes(key)
+	size := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < existenceBloomHashes; i++ {
+		bit := (h1 + i*h2) % size
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (f *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHashes(key)
+	size := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < existenceBloomHashes; i++ {
+		bit := (h1 + i*h2) % size
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutQuery strips the query of the base URL from an object URL, so that the URLs of the
+// objects of a store start with its base URL, the `?` of object names being escaped
+func withoutQuery(objectURL string) string {
+	out, _, _ := strings.Cut(objectURL, "?")
+	return out
+}
+
+// bloomHashes derives the two hashes combined into the filter's hashes from `key`
+func bloomHashes(key string) (uint64, uint64) {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	sum := hasher.Sum64()
+	return sum & 0xffffffff, sum>>32 | 1
+}
@@ -0,0 +1,99 @@
+package dstore
+
+import (
+	"sync"
+	"time"
+)
+
+// existenceCacheMinSweep is the count of entries below which expired entries are not swept
+const existenceCacheMinSweep = 1024
+
+// existenceCache remembers for `ttl` the objects known to exist, letting writes to stores not
+// allowing overwrites skip objects already written without checking with the backend again.
+// Only positive results are cached, a missing object is always checked again since it may have
+// been written in between. A nil cache remembers nothing.
+type existenceCache struct {
+	ttl time.Duration
+
+	lock      sync.Mutex
+	expiries  map[string]time.Time
+	nextSweep int
+}
+
+func newExistenceCache(ttl time.Duration) *existenceCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &existenceCache{
+		ttl:       ttl,
+		expiries:  map[string]time.Time{},
+		nextSweep: existenceCacheMinSweep,
+	}
+}
+
+// exists reports whether `key` is known to exist
+func (c *existenceCache) exists(key string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	expiry, found := c.expiries[key]
+	if !found {
+		return false
+	}
+	if !time.Now().Before(expiry) {
+		delete(c.expiries, key)
+		return false
+	}
+	return true
+}
+
+// add records that `key` exists
+func (c *existenceCache) add(key string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	c.expiries[key] = now.Add(c.ttl)
+
+	if len(c.expiries) >= c.nextSweep {
+		for key, expiry := range c.expiries {
+			if !now.Before(expiry) {
+				delete(c.expiries, key)
+			}
+		}
+
+		c.nextSweep = 2 * len(c.expiries)
+		if c.nextSweep < existenceCacheMinSweep {
+			c.nextSweep = existenceCacheMinSweep
+		}
+	}
+}
+
+// forget drops `key`, which may not exist anymore
+func (c *existenceCache) forget(key string) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.expiries, key)
+}
+
+// ttlOrZero returns the duration entries are kept, zero for a nil cache
+func (c *existenceCache) ttlOrZero() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return c.ttl
+}
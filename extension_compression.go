@@ -0,0 +1,211 @@
+package dstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// NewPerExtensionCompressionStore wraps the uncompressed store `inner` so that objects are
+// compressed according to the extension of their name, `rules` mapping extensions (`jsonl` or
+// `.jsonl`) to the compression type (`gzip`, `zstd` or "" for none) of the objects written
+// through the returned store, objects of other extensions being written as-is.
+//
+// The compression of each object written is recorded in its metadata under
+// `CompressionMetadataKey` (`x_dstore_compression` on Azure, in a sidecar file for local
+// stores), uploaded along with the content. Reads decode each object accordingly whatever its
+// name, objects without recorded compression being read as-is, at the cost of a metadata lookup
+// first.
+func NewPerExtensionCompressionStore(inner Store, rules map[string]string) (Store, error) {
+	if common, ok := inner.(interface{ commonConfig() *commonStore }); ok && common.commonConfig().compressionType != "" {
+		return nil, fmt.Errorf("per extension compression store must wrap an uncompressed store, got a %s compressed one", common.commonConfig().compressionType)
+	}
+	if _, ok := inner.(MetadataStore); !ok {
+		return nil, fmt.Errorf("per extension compression store must wrap a store supporting object metadata, got a %T", inner)
+	}
+	if _, ok := inner.(CompressionOverrideOpener); !ok {
+		return nil, fmt.Errorf("per extension compression store must wrap a store opening objects with another compression, got a %T", inner)
+	}
+
+	compressions := make(map[string]string, len(rules))
+	for extension, compressionType := range rules {
+		switch compressionType {
+		case "", "gzip", "zstd":
+		default:
+			return nil, fmt.Errorf("invalid compression type %q for extension %q", compressionType, extension)
+		}
+
+		compressions["."+strings.TrimPrefix(extension, ".")] = compressionType
+	}
+
+	metadataKey := CompressionMetadataKey
+	if _, ok := inner.(*AzureStore); ok {
+		metadataKey = azureCompressionMetadataKey
+	}
+
+	return &perExtensionCompressionStore{
+		Store:        inner,
+		compressions: compressions,
+		metadataKey:  metadataKey,
+	}, nil
+}
+
+type perExtensionCompressionStore struct {
+	Store
+
+	compressions map[string]string // by extension, leading dot included
+	metadataKey  string
+}
+
+func (s *perExtensionCompressionStore) OpenObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	compressionType, err := s.recordedCompression(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenObjectWithCompression(ctx, s.Store, name, compressionType)
+}
+
+func (s *perExtensionCompressionStore) OpenObjectSeekable(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	compressionType, err := s.recordedCompression(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if compressionType != "" {
+		return nil, fmt.Errorf("seeking %s compressed object %q: %w", compressionType, name, ErrNotSupported)
+	}
+
+	seekable, ok := s.Store.(SeekableStore)
+	if !ok {
+		return nil, fmt.Errorf("seeking objects of %T: %w", s.Store, ErrNotSupported)
+	}
+	return seekable.OpenObjectSeekable(ctx, name)
+}
+
+func (s *perExtensionCompressionStore) WriteObject(ctx context.Context, base string, f io.Reader) error {
+	return s.write(ctx, base, f, func(ctx context.Context, f io.Reader, compressed bool) error {
+		return s.Store.WriteObject(ctx, base, f)
+	})
+}
+
+func (s *perExtensionCompressionStore) WriteObjectSized(ctx context.Context, base string, f io.Reader, size int64) error {
+	return s.write(ctx, base, f, func(ctx context.Context, f io.Reader, compressed bool) error {
+		if compressed {
+			// The size of the compressed content is unknown
+			return s.Store.WriteObject(ctx, base, f)
+		}
+		return WriteObjectSized(ctx, s.Store, base, f, size)
+	})
+}
+
+func (s *perExtensionCompressionStore) WriteFrom(ctx context.Context, base string, src Store, srcName string) error {
+	return writeFrom(ctx, s, base, src, srcName)
+}
+
+func (s *perExtensionCompressionStore) PushLocalFile(ctx context.Context, localFile, toBaseName string) error {
+	remove, err := pushLocalFile(ctx, s, localFile, toBaseName)
+	if err != nil {
+		return err
+	}
+
+	if common, ok := s.Store.(interface{ commonConfig() *commonStore }); ok && common.commonConfig().keepLocalAfterPush {
+		return nil
+	}
+	return remove()
+}
+
+// CopyObject copies the stored bytes as-is, the copy keeping the compression of `src` whatever
+// the extension of `dest`.
+func (s *perExtensionCompressionStore) CopyObject(ctx context.Context, src, dest string) error {
+	compressionType, err := s.recordedCompression(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Store.CopyObject(ctx, src, dest); err != nil {
+		return err
+	}
+	return s.recordCompression(ctx, dest, compressionType)
+}
+
+func (s *perExtensionCompressionStore) Touch(ctx context.Context, base string) error {
+	return Touch(ctx, s.Store, base)
+}
+
+func (s *perExtensionCompressionStore) SetObjectMetadata(ctx context.Context, base string, md map[string]string) error {
+	return SetObjectMetadata(ctx, s.Store, base, md)
+}
+
+func (s *perExtensionCompressionStore) GetObjectMetadata(ctx context.Context, base string) (map[string]string, error) {
+	return GetObjectMetadata(ctx, s.Store, base)
+}
+
+func (s *perExtensionCompressionStore) HasAnyFiles(ctx context.Context, prefix string) (bool, error) {
+	return HasAnyFiles(ctx, s.Store, prefix)
+}
+
+func (s *perExtensionCompressionStore) ListSubPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	return ListSubPrefixes(ctx, s.Store, prefix)
+}
+
+func (s *perExtensionCompressionStore) SubStore(subFolder string) (Store, error) {
+	sub, err := s.Store.SubStore(subFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	return &perExtensionCompressionStore{
+		Store:        sub,
+		compressions: s.compressions,
+		metadataKey:  s.metadataKey,
+	}, nil
+}
+
+// write writes `f` as `base` through `write`, compressing it first according to the extension
+// of `base`, the context passed to `write` making the inner store record the compression in the
+// metadata of the object uploaded.
+func (s *perExtensionCompressionStore) write(ctx context.Context, base string, f io.Reader, write func(ctx context.Context, f io.Reader, compressed bool) error) error {
+	compressionType := s.compressions[path.Ext(base)]
+	ctx = withRecordedCompression(ctx, compressionType)
+
+	if compressionType == "" {
+		return write(ctx, f, false)
+	}
+
+	compressor := &commonStore{compressionType: compressionType}
+	pipeRead, pipeWrite := io.Pipe()
+	copyDone := make(chan struct{})
+	go func() {
+		defer close(copyDone)
+		pipeWrite.CloseWithError(compressor.compressedCopy(ctx, pipeWrite, f))
+	}()
+
+	err := write(ctx, pipeRead, true)
+	// Unblocks the compression when the write returned without consuming it all, which is how
+	// stores not allowing overwrites skip existing objects
+	pipeRead.CloseWithError(io.ErrClosedPipe)
+	<-copyDone
+	return err
+}
+
+func (s *perExtensionCompressionStore) recordCompression(ctx context.Context, base, compressionType string) error {
+	if compressionType == "" {
+		compressionType = "none"
+	}
+
+	if err := SetObjectMetadata(ctx, s.Store, base, map[string]string{s.metadataKey: compressionType}); err != nil {
+		return fmt.Errorf("recording compression of %q: %w", base, err)
+	}
+	return nil
+}
+
+func (s *perExtensionCompressionStore) recordedCompression(ctx context.Context, name string) (string, error) {
+	metadata, err := GetObjectMetadata(ctx, s.Store, name)
+	if err != nil {
+		return "", err
+	}
+
+	return detectedCompression(metadata, s.metadataKey, ""), nil
+}
@@ -0,0 +1,132 @@
+package dstore
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPerExtensionCompressionStore(t *testing.T) {
+	ctx := context.Background()
+
+	memoryStore := newTestMemoryStore(t)
+	localStore, err := NewLocalStore(&url.URL{Scheme: "file", Path: t.TempDir()}, "", "", false)
+	require.NoError(t, err)
+
+	for name, inner := range map[string]Store{"memory": memoryStore, "local": localStore} {
+		t.Run(name, func(t *testing.T) {
+			store, err := NewPerExtensionCompressionStore(inner, map[string]string{"jsonl": "gzip", ".log": "zstd"})
+			require.NoError(t, err)
+
+			jsonl := strings.Repeat(`{"key":"value"}`+"\n", 100)
+			logs := strings.Repeat("some log line\n", 100)
+			png := "\x89PNG\r\n\x1a\nraw image"
+			require.NoError(t, store.WriteObject(ctx, "data.jsonl", strings.NewReader(jsonl)))
+			require.NoError(t, WriteObjectString(ctx, store, "app.log", logs))
+			require.NoError(t, store.WriteObject(ctx, "image.png", strings.NewReader(png)))
+
+			stored := func(name string) []byte {
+				reader, err := OpenObjectWithCompression(ctx, inner, name, "")
+				require.NoError(t, err)
+				defer reader.Close()
+				content, err := io.ReadAll(reader)
+				require.NoError(t, err)
+				return content
+			}
+			assert.True(t, hasCompressionMagic(stored("data.jsonl"), "gzip"), "jsonl files should be gzipped")
+			assert.True(t, hasCompressionMagic(stored("app.log"), "zstd"), "log files should be zstd compressed")
+			assert.Equal(t, png, string(stored("image.png")), "png files should be stored raw")
+
+			metadata, err := GetObjectMetadata(ctx, inner, "data.jsonl")
+			require.NoError(t, err)
+			assert.Equal(t, "gzip", metadata[CompressionMetadataKey])
+			metadata, err = GetObjectMetadata(ctx, inner, "image.png")
+			require.NoError(t, err)
+			assert.Equal(t, "none", metadata[CompressionMetadataKey])
+
+			for name, expected := range map[string]string{"data.jsonl": jsonl, "app.log": logs, "image.png": png} {
+				content, err := ReadObjectString(ctx, store, name)
+				require.NoError(t, err)
+				assert.Equal(t, expected, content, name)
+			}
+
+			// Copies keep the compression of their source
+			require.NoError(t, store.CopyObject(ctx, "data.jsonl", "copy.png"))
+			content, err := ReadObjectString(ctx, store, "copy.png")
+			require.NoError(t, err)
+			assert.Equal(t, jsonl, content)
+		})
+	}
+}
+
+func TestPerExtensionCompressionStore_S3(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	ctx := context.Background()
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	transport := &objectTransport{objects: map[string][]byte{}, headers: map[string]http.Header{}}
+	inner, err := NewS3Store(baseURL, "", "", false, WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+	store, err := NewPerExtensionCompressionStore(inner, map[string]string{"jsonl": "gzip"})
+	require.NoError(t, err)
+
+	jsonl := strings.Repeat(`{"key":"value"}`+"\n", 100)
+	require.NoError(t, WriteObjectString(ctx, store, "data.jsonl", jsonl))
+	require.NoError(t, WriteObjectString(ctx, store, "image.png", "raw image"))
+
+	// The compression is recorded with the upload itself
+	assert.Equal(t, "gzip", transport.headers["/path/data.jsonl"].Get("X-Amz-Meta-X-Dstore-Compression"))
+	assert.Equal(t, "none", transport.headers["/path/image.png"].Get("X-Amz-Meta-X-Dstore-Compression"))
+	assert.True(t, hasCompressionMagic(transport.objects["/path/data.jsonl"], "gzip"))
+
+	content, err := ReadObjectString(ctx, store, "data.jsonl")
+	require.NoError(t, err)
+	assert.Equal(t, jsonl, content)
+}
+
+func TestNewPerExtensionCompressionStore_Invalid(t *testing.T) {
+	_, err := NewPerExtensionCompressionStore(newTestMemoryStore(t), map[string]string{"jsonl": "bzip2"})
+	assert.Error(t, err)
+
+	compressed, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "gzip", false)
+	require.NoError(t, err)
+	_, err = NewPerExtensionCompressionStore(compressed, map[string]string{"jsonl": "gzip"})
+	assert.Error(t, err)
+}
+
+func TestPerExtensionCompressionStore_OpenObjectIfModifiedSince(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := NewPerExtensionCompressionStore(newTestMemoryStore(t), map[string]string{"jsonl": "gzip"})
+	require.NoError(t, err)
+	require.NoError(t, WriteObjectString(ctx, store, "data.jsonl", "content"))
+
+	// the store does not open conditionally itself, the modification time is checked first
+	_, native := store.(ConditionalOpener)
+	require.False(t, native)
+
+	attrs, err := store.ObjectAttributes(ctx, "data.jsonl")
+	require.NoError(t, err)
+
+	reader, modified, err := OpenObjectIfModifiedSince(ctx, store, "data.jsonl", attrs.LastModified)
+	require.NoError(t, err)
+	assert.False(t, modified)
+	assert.Nil(t, reader)
+
+	reader, modified, err = OpenObjectIfModifiedSince(ctx, store, "data.jsonl", attrs.LastModified.Add(-time.Second))
+	require.NoError(t, err)
+	require.True(t, modified)
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.Equal(t, "content", string(content))
+}
@@ -0,0 +1,258 @@
+package dstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// FSStore is a read-only store over an `fs.FS`, for example an `embed.FS` bundling test
+// fixtures or assets. Objects are the files of the file system, named by their slash separated
+// path. Writes and deletions fail with an error matching `ErrNotSupported`.
+type FSStore struct {
+	*commonStore
+
+	fsys    fs.FS
+	baseURL *url.URL
+}
+
+// NewFSStore returns a read-only store serving the files of `fsys`, with the given extension
+// and compression like the other stores.
+func NewFSStore(fsys fs.FS, extension, compressionType string) *FSStore {
+	return newFSStore(fsys, &url.URL{Scheme: "fs", Path: "/"}, extension, compressionType)
+}
+
+func newFSStore(fsys fs.FS, baseURL *url.URL, extension, compressionType string) *FSStore {
+	return &FSStore{
+		commonStore: &commonStore{
+			compressionType: compressionType,
+			extension:       extension,
+			baseContext:     context.Background(),
+		},
+		fsys:    fsys,
+		baseURL: baseURL,
+	}
+}
+
+func (s *FSStore) OpenObject(ctx context.Context, name string) (out io.ReadCloser, err error) {
+	return s.OpenObjectWithCompression(ctx, name, s.compressionType)
+}
+
+func (s *FSStore) OpenObjectWithCompression(ctx context.Context, name string, compressionType string) (out io.ReadCloser, err error) {
+	file, err := s.fsys.Open(s.ObjectPath(name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return s.uncompressedReaderWith(ctx, file, compressionType)
+}
+
+// OpenObjectIfModifiedSince considers files without modification time, like the ones of an
+// `embed.FS`, always modified.
+func (s *FSStore) OpenObjectIfModifiedSince(ctx context.Context, name string, since time.Time) (io.ReadCloser, bool, error) {
+	info, err := fs.Stat(s.fsys, s.ObjectPath(name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, false, ErrNotFound
+		}
+		return nil, false, err
+	}
+
+	if !info.ModTime().IsZero() && !info.ModTime().After(since) {
+		return nil, false, nil
+	}
+
+	return openedIfModified(s.OpenObject(ctx, name))
+}
+
+func (s *FSStore) FileExists(ctx context.Context, base string) (bool, error) {
+	info, err := fs.Stat(s.fsys, s.ObjectPath(base))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return !info.IsDir(), nil
+}
+
+func (s *FSStore) ObjectPath(base string) string {
+	return s.pathWithExt(base)
+}
+
+func (s *FSStore) ObjectURL(base string) string {
+	return objectURL(s.baseURL, s.ObjectPath(base))
+}
+
+func (s *FSStore) ObjectAttributes(ctx context.Context, base string) (*ObjectAttributes, error) {
+	info, err := fs.Stat(s.fsys, s.ObjectPath(base))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &ObjectAttributes{
+		LastModified: info.ModTime(),
+		Size:         info.Size(),
+	}, nil
+}
+
+func (s *FSStore) WriteObject(ctx context.Context, base string, f io.Reader) error {
+	return s.readOnly("write", base)
+}
+
+func (s *FSStore) PushLocalFile(ctx context.Context, localFile, toBaseName string) error {
+	return s.readOnly("push", toBaseName)
+}
+
+func (s *FSStore) PushLocalFiles(ctx context.Context, files map[string]string, concurrency int) error {
+	return fmt.Errorf("fs store is read-only, cannot push %d files: %w", len(files), ErrNotSupported)
+}
+
+func (s *FSStore) WriteFrom(ctx context.Context, base string, src Store, srcName string) error {
+	return s.readOnly("write", base)
+}
+
+func (s *FSStore) CopyObject(ctx context.Context, src, dest string) error {
+	return s.readOnly("copy to", dest)
+}
+
+func (s *FSStore) Touch(ctx context.Context, base string) error {
+	return s.readOnly("touch", base)
+}
+
+func (s *FSStore) SetObjectMetadata(ctx context.Context, base string, md map[string]string) error {
+	return s.readOnly("set metadata of", base)
+}
+
+// GetObjectMetadata always returns an empty map, files of a `fs.FS` having no metadata.
+func (s *FSStore) GetObjectMetadata(ctx context.Context, base string) (map[string]string, error) {
+	exists, err := s.FileExists(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	return map[string]string{}, nil
+}
+
+func (s *FSStore) SupportsConcurrentWrites() bool {
+	return false
+}
+
+func (s *FSStore) WalkFrom(ctx context.Context, prefix, startingPoint string, f func(filename string) (err error)) error {
+	return commonWalkFrom(s, ctx, prefix, startingPoint, f)
+}
+
+func (s *FSStore) Walk(ctx context.Context, prefix string, f func(filename string) (err error)) error {
+	// Only the directory holding the files starting with `prefix` needs to be walked
+	root := "."
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		root = prefix[:i]
+	}
+
+	err := fs.WalkDir(s.fsys, root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		if entry.IsDir() {
+			// Skips the directories that can neither hold nor lead to files starting with `prefix`
+			if filePath != root && !strings.HasPrefix(filePath+"/", prefix) && !strings.HasPrefix(prefix, filePath+"/") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(filePath, prefix) {
+			return nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		return f(strings.TrimSuffix(filePath, s.pathWithExt("")))
+	})
+	if errors.Is(err, StopIteration) {
+		return nil
+	}
+	return err
+}
+
+func (s *FSStore) ListFiles(ctx context.Context, prefix string, max int) ([]string, error) {
+	return listFiles(ctx, s, prefix, max)
+}
+
+func (s *FSStore) ListSubPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	// `prefix` is split into the directory to read and the prefix of the entries within it
+	dir, namePrefix := path.Split(prefix)
+
+	readDir := strings.TrimSuffix(dir, "/")
+	if readDir == "" {
+		readDir = "."
+	}
+
+	entries, err := fs.ReadDir(s.fsys, readDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("reading directory: %w", err)
+	}
+
+	out := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), namePrefix) {
+			out = append(out, dir+entry.Name()+"/")
+		}
+	}
+
+	// `fs.ReadDir` already sorts entries by name
+	return out, nil
+}
+
+func (s *FSStore) DeleteObject(ctx context.Context, base string) error {
+	return s.readOnly("delete", base)
+}
+
+func (s *FSStore) DeleteObjectsUnderPrefix(ctx context.Context, prefix string, force bool) (int, error) {
+	return 0, fmt.Errorf("fs store is read-only, cannot delete objects under prefix %q: %w", prefix, ErrNotSupported)
+}
+
+func (s *FSStore) BaseURL() *url.URL {
+	return s.baseURL
+}
+
+func (s *FSStore) SubStore(subFolder string) (Store, error) {
+	subFolder = strings.Trim(subFolder, "/")
+
+	sub, err := fs.Sub(s.fsys, subFolder)
+	if err != nil {
+		return nil, fmt.Errorf("fs store sub folder %q: %w", subFolder, err)
+	}
+
+	baseURL := *s.baseURL
+	baseURL.Path = path.Join(s.baseURL.Path, subFolder)
+	return newFSStore(sub, &baseURL, s.extension, s.compressionType), nil
+}
+
+func (s *FSStore) readOnly(op, name string) error {
+	return fmt.Errorf("fs store is read-only, cannot %s object %q: %w", op, name, ErrNotSupported)
+}
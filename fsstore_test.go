@@ -0,0 +1,105 @@
+package dstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFSStore(t *testing.T) {
+	ctx := context.Background()
+
+	fsys := fstest.MapFS{
+		"0000/a.json":        {Data: []byte("a")},
+		"0000/b.json":        {Data: []byte("b")},
+		"0000/nested/c.json": {Data: []byte("c")},
+		"0001/d.json":        {Data: []byte("d")},
+		"other.json":         {Data: []byte("other")},
+	}
+	store := NewFSStore(fsys, "json", "")
+
+	content, err := ReadObjectString(ctx, store, "0000/nested/c")
+	require.NoError(t, err)
+	assert.Equal(t, "c", content)
+
+	_, err = store.OpenObject(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	exists, err := store.FileExists(ctx, "0001/d")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = store.FileExists(ctx, "0001")
+	require.NoError(t, err)
+	assert.False(t, exists, "directories are not objects")
+
+	attrs, err := store.ObjectAttributes(ctx, "other")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), attrs.Size)
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0000/a", "0000/b", "0000/nested/c", "0001/d", "other"}, files)
+
+	files, err = store.ListFiles(ctx, "0000/", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0000/a", "0000/b", "0000/nested/c"}, files)
+
+	files, err = store.ListFiles(ctx, "000", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0000/a", "0000/b", "0000/nested/c", "0001/d"}, files)
+
+	var walked []string
+	require.NoError(t, store.WalkFrom(ctx, "0000/", "0000/b", func(filename string) error {
+		walked = append(walked, filename)
+		return nil
+	}))
+	assert.Equal(t, []string{"0000/b", "0000/nested/c"}, walked)
+
+	subPrefixes, err := store.ListSubPrefixes(ctx, "0000/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0000/nested/"}, subPrefixes)
+
+	sub, err := store.SubStore("0000")
+	require.NoError(t, err)
+	files, err = sub.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "nested/c"}, files)
+	assert.Equal(t, "fs:///0000/a.json", sub.ObjectURL("a"))
+}
+
+func TestFSStore_Compressed(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte("compressed content"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	store := NewFSStore(fstest.MapFS{"file.gz": {Data: buf.Bytes()}}, "gz", "gzip")
+
+	content, err := ReadObjectString(context.Background(), store, "file")
+	require.NoError(t, err)
+	assert.Equal(t, "compressed content", content)
+}
+
+func TestFSStore_ReadOnly(t *testing.T) {
+	ctx := context.Background()
+	store := NewFSStore(fstest.MapFS{"file": {Data: []byte("content")}}, "", "")
+
+	assert.ErrorIs(t, WriteObjectString(ctx, store, "new", "content"), ErrNotSupported)
+	assert.ErrorIs(t, store.CopyObject(ctx, "file", "copy"), ErrNotSupported)
+	assert.ErrorIs(t, Touch(ctx, store, "file"), ErrNotSupported)
+	assert.ErrorIs(t, store.DeleteObject(ctx, "file"), ErrNotSupported)
+
+	_, err := DeleteObjectsUnderPrefix(ctx, store, "", true)
+	assert.ErrorIs(t, err, ErrNotSupported)
+
+	content, err := ReadObjectString(ctx, store, "file")
+	require.NoError(t, err)
+	assert.Equal(t, "content", content)
+}
@@ -1,9 +1,11 @@
 package dstore
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"net/http"
 	"net/url"
@@ -11,12 +13,15 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/googleapis/gax-go/v2"
 	"go.uber.org/zap"
+	"golang.org/x/oauth2"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
 //
@@ -28,6 +33,16 @@ type GSStore struct {
 	baseURL     *url.URL
 	client      *storage.Client
 	userProject string
+	sendCRC32C  bool
+	readChunk   int64
+
+	// acl is the canned ACL whose predefined ACL is set on written objects, see `WithObjectACL`
+	acl string
+
+	// Used to build one-off clients for credentials overrides, see `WithRequestCredentials`
+	httpClient *http.Client
+	userAgent  string
+
 	*commonStore
 }
 
@@ -40,8 +55,36 @@ func (s *GSStore) Clone(ctx context.Context, opts ...Option) (Store, error) {
 	return newGSStoreContext(ctx, s.baseURL, s.extension, s.compressionType, s.overwrite, opts...)
 }
 
+func (s *GSStore) Rebase(ctx context.Context, baseURL string, opts ...Option) (Store, error) {
+	return s.rebase(ctx, baseURL, func(config *config) {
+		config.gcsSendCRC32C = s.sendCRC32C
+		config.gcsReadChunk = s.readChunk
+		config.objectACL = s.acl
+	}, opts)
+}
+
 func newGSStoreContext(ctx context.Context, baseURL *url.URL, extension, compressionType string, overwrite bool, opts ...Option) (*GSStore, error) {
-	client, err := storage.NewClient(ctx)
+	conf := config{}
+	for _, opt := range opts {
+		opt.apply(&conf)
+	}
+	if conf.err != nil {
+		return nil, conf.err
+	}
+	baseURL = withDefaultPrefix(baseURL, conf.defaultPrefix)
+
+	if _, found := gcsPredefinedACLs[conf.objectACL]; conf.objectACL != "" && !found {
+		return nil, fmt.Errorf("invalid object ACL %q for Google Storage, expected one of private, public-read, authenticated-read, bucket-owner-read, bucket-owner-full-control", conf.objectACL)
+	}
+
+	clientOpts := []option.ClientOption{option.WithUserAgent(conf.userAgentOrDefault())}
+	if conf.httpClient != nil {
+		// The Google SDK does not layer its authentication on top of a custom client, the
+		// provided client is expected to authenticate requests itself.
+		clientOpts = append(clientOpts, option.WithHTTPClient(conf.httpClient))
+	}
+
+	client, err := storage.NewClient(ctx, clientOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -49,19 +92,36 @@ func newGSStoreContext(ctx context.Context, baseURL *url.URL, extension, compres
 
 	client.SetRetry(storage.WithBackoff(gax.Backoff{}))
 
-	conf := config{}
-	for _, opt := range opts {
-		opt.apply(&conf)
-	}
-
 	common := &commonStore{
 		compressionType:           compressionType,
 		extension:                 extension,
 		overwrite:                 overwrite,
+		skipDirectoryMarkers:      conf.skipDirectoryMarkers,
+		sizeValidation:            conf.sizeValidation,
+		listPageSize:              conf.listPageSize,
+		sharder:                   conf.sharder,
+		objectPathFunc:            conf.objectPathFunc,
+		keySeparator:              conf.keySeparator,
 		uncompressedReadCallback:  conf.uncompressedReadCallback,
 		compressedReadCallback:    conf.compressedReadCallback,
 		uncompressedWriteCallback: conf.uncompressedWriteCallback,
 		compressedWriteCallback:   conf.compressedWriteCallback,
+		writeStatsCallback:        conf.writeStatsCallback,
+		overwriteSkipCallback:     conf.overwriteSkipCallback,
+		baseContext:               conf.baseContextOr(ctx),
+		uploadBuffers:             conf.uploadBuffers,
+		keepLocalAfterPush:        conf.keepLocalAfterPush,
+		clampFutureMTimes:         conf.clampFutureMTimes,
+		errorOnEmptyWrite:         conf.errorOnEmptyWrite,
+		deleteIgnoreNotFound:      conf.deleteIgnoreNotFound,
+		walkProgressCallback:      conf.walkProgressCallback,
+		operationTimeout:          conf.operationTimeout,
+		existenceCache:            newExistenceCache(conf.existenceCacheTTL),
+		existenceBloom:            newExistenceBloom(conf.existenceBloomHint, conf.existenceBloomHintMaxAge),
+		zstdDecoders:              zstdDecoderPoolFor(conf.zstdDecoderConcurrency, conf.zstdMaxIdleDecoders),
+		postWriteHook:             conf.postWriteHook,
+		retryObserver:             conf.retryObserver,
+		compressionDetection:      conf.compressionDetection,
 	}
 
 	return &GSStore{
@@ -69,10 +129,19 @@ func newGSStoreContext(ctx context.Context, baseURL *url.URL, extension, compres
 		client:      client,
 		commonStore: common,
 		userProject: userProject,
+		sendCRC32C:  conf.gcsSendCRC32C,
+		readChunk:   conf.gcsReadChunk,
+		httpClient:  conf.httpClient,
+		userAgent:   conf.userAgentOrDefault(),
+		acl:         conf.objectACL,
 	}, nil
 }
 
 func (s *GSStore) SubStore(subFolder string) (Store, error) {
+	if err := s.subStoreErr(subFolder); err != nil {
+		return nil, err
+	}
+
 	url, err := url.Parse(s.baseURL.String())
 	if err != nil {
 		return nil, fmt.Errorf("gs store parsing base url: %w", err)
@@ -84,14 +153,57 @@ func (s *GSStore) SubStore(subFolder string) (Store, error) {
 		client:      s.client,
 		commonStore: s.commonStore,
 		userProject: s.userProject,
+		sendCRC32C:  s.sendCRC32C,
+		readChunk:   s.readChunk,
+		httpClient:  s.httpClient,
+		userAgent:   s.userAgent,
+		acl:         s.acl,
 	}, nil
 }
 
-func (s *GSStore) bucket() *storage.BucketHandle {
+// bucketFor returns the bucket handle to use for an operation, backed by a one-off client using
+// the overridden credentials when the context carries some, see `WithRequestCredentials`. The
+// returned func closes that one-off client, it must be called once the operation is done with
+// the bucket.
+func (s *GSStore) bucketFor(ctx context.Context) (*storage.BucketHandle, func(), error) {
+	client := s.client
+	closeClient := func() {}
+
+	if creds := requestCredentialsFromContext(ctx); creds != nil {
+		if creds.GCS == nil {
+			return nil, nil, missingRequestCredentials("GCS")
+		}
+
+		clientOpts := []option.ClientOption{option.WithUserAgent(s.userAgent)}
+		if s.httpClient != nil {
+			// A custom client is not authenticated by the SDK, the token is layered on its transport
+			httpClient := *s.httpClient
+			httpClient.Transport = &oauth2.Transport{Source: creds.GCS, Base: s.httpClient.Transport}
+			clientOpts = append(clientOpts, option.WithHTTPClient(&httpClient))
+		} else {
+			clientOpts = append(clientOpts, option.WithTokenSource(creds.GCS))
+		}
+
+		var err error
+		client, err = storage.NewClient(ctx, clientOpts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("creating client for request credentials: %w", err)
+		}
+		client.SetRetry(storage.WithBackoff(gax.Backoff{}))
+
+		// Releases the connections the one-off client keeps open
+		oneOff := client
+		closeClient = func() {
+			if err := oneOff.Close(); err != nil {
+				zlog.Debug("closing request credentials client", zap.Error(err))
+			}
+		}
+	}
+
 	if s.userProject != "" {
-		return s.client.Bucket(s.baseURL.Host).UserProject(s.userProject)
+		return client.Bucket(s.baseURL.Host).UserProject(s.userProject), closeClient, nil
 	}
-	return s.client.Bucket(s.baseURL.Host)
+	return client.Bucket(s.baseURL.Host), closeClient, nil
 }
 
 func (s *GSStore) BaseURL() *url.URL {
@@ -99,70 +211,289 @@ func (s *GSStore) BaseURL() *url.URL {
 }
 
 func (s *GSStore) ObjectPath(name string) string {
-	return path.Join(strings.TrimLeft(s.baseURL.Path, "/"), s.pathWithExt(name))
+	return path.Join(strings.TrimLeft(s.baseURL.Path, "/"), s.shardedPathWithExt(name))
 }
 
 func (s *GSStore) ObjectURL(name string) string {
-	return fmt.Sprintf("%s/%s", strings.TrimRight(s.baseURL.String(), "/"), strings.TrimLeft(s.pathWithExt(name), "/"))
+	return objectURL(s.baseURL, s.shardedPathWithExt(name))
+}
+
+func (s *GSStore) SupportsConcurrentWrites() bool {
+	return true
 }
 
 func (s *GSStore) toBaseName(filename string) string {
-	return strings.TrimPrefix(strings.TrimSuffix(filename, s.pathWithExt("")), strings.TrimLeft(s.baseURL.Path, "/")+"/")
+	return s.unflatKey(strings.TrimPrefix(strings.TrimSuffix(filename, s.pathWithExt("")), strings.TrimLeft(s.baseURL.Path, "/")+"/"))
 }
 
 func (s *GSStore) CopyObject(ctx context.Context, src, dest string) error {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
 	srcPath := s.ObjectPath(src)
-	srcObj := s.bucket().Object(srcPath)
+	bucket, closeClient, err := s.bucketFor(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	srcObj := bucket.Object(srcPath)
 
 	destPath := s.ObjectPath(dest)
-	_, err := s.bucket().Object(destPath).CopierFrom(srcObj).Run(ctx)
-	return err
+	if _, err = bucket.Object(destPath).CopierFrom(srcObj).Run(ctx); err != nil {
+		return gcsError(err)
+	}
+
+	s.existenceBloom.add(s.ObjectURL(dest))
+	return nil
+}
+
+func (s *GSStore) SetObjectMetadata(ctx context.Context, base string, md map[string]string) error {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	bucket, closeClient, err := s.bucketFor(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+
+	// The metadata update is a patch, keys not part of it are kept
+	if _, err := bucket.Object(s.ObjectPath(base)).Update(ctx, storage.ObjectAttrsToUpdate{Metadata: md}); err != nil {
+		return fmt.Errorf("setting metadata of object %q: %w", base, gcsError(err))
+	}
+	return nil
+}
+
+func (s *GSStore) GetObjectMetadata(ctx context.Context, base string) (map[string]string, error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	bucket, closeClient, err := s.bucketFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer closeClient()
+
+	attrs, err := bucket.Object(s.ObjectPath(base)).Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	md := map[string]string{}
+	for key, value := range attrs.Metadata {
+		md[key] = value
+	}
+	return md, nil
+}
+
+// Touch rewrites the object's metadata unchanged, which bumps its last modified time.
+func (s *GSStore) Touch(ctx context.Context, base string) error {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	bucket, closeClient, err := s.bucketFor(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	obj := bucket.Object(s.ObjectPath(base))
+
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	metadata := attrs.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+
+	if _, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{Metadata: metadata}); err != nil {
+		return fmt.Errorf("touching object %q: %w", base, gcsError(err))
+	}
+	return nil
 }
 
 func (s *GSStore) WriteObject(ctx context.Context, base string, f io.Reader) (err error) {
+	return s.writeObject(ctx, base, f, -1)
+}
+
+func (s *GSStore) WriteObjectSized(ctx context.Context, base string, f io.Reader, size int64) (err error) {
+	return s.writeObject(ctx, base, f, size)
+}
+
+func (s *GSStore) WriteObjectSeekable(ctx context.Context, base string, rs io.ReadSeeker) error {
+	return writeObjectSeekable(ctx, s, base, rs, storage.ShouldRetry, s.observeRetry)
+}
+
+// writeObject uploads the object, `size` is the known uncompressed size of the content
+// or -1 if unknown, the upload being tuned with the size stored, see `storedSizeBound`.
+func (s *GSStore) writeObject(ctx context.Context, base string, f io.Reader, size int64) (err error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	size = s.storedSizeBound(size)
+
 	ctx = withFileName(ctx, base)
 	ctx = withStoreType(ctx, "gstore")
 	ctx = withLogger(ctx, zlog, tracer)
 
+	if err := s.ensureWritable(); err != nil {
+		return err
+	}
+
+	f, err = s.nonEmptySource(f)
+	if err != nil {
+		return err
+	}
+
 	path := s.ObjectPath(base)
 
-	object := s.bucket().Object(path)
+	bucket, closeClient, err := s.bucketFor(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	object := bucket.Object(path)
 
 	if !s.overwrite {
 		object = object.If(storage.Conditions{DoesNotExist: true})
 	}
-	w := object.NewWriter(ctx)
+
+	writerCtx, timer := s.callTimer(ctx)
+	defer timer.release()
+
+	w := object.NewWriter(writerCtx)
 	w.ContentType = "application/octet-stream"
 	w.CacheControl = "public, max-age=86400"
+	w.PredefinedACL = gcsPredefinedACLs[s.acl]
+	w.Metadata = s.compressionMetadata(ctx, CompressionMetadataKey)
+	if size >= 0 && size < googleapi.DefaultUploadChunkSize {
+		// Avoids allocating the full default chunk buffer for small objects, the
+		// value is rounded up by the library to the next valid chunk size.
+		w.ChunkSize = int(size) + 1
+	}
 
-	if err := s.compressedCopy(ctx, w, f); err != nil {
-		return err
+	var stats writeStats
+	if s.sendCRC32C {
+		// The checksum is part of the upload's metadata sent on first write, the full
+		// content must then be known before starting the upload.
+		buffer := bytes.NewBuffer(nil)
+		if stats, err = s.compressedCopyWithStats(ctx, buffer, f); err != nil {
+			return err
+		}
+
+		if err := writeWithCRC32C(w, buffer.Bytes(), crc32.Checksum(buffer.Bytes(), crc32cTable)); err != nil {
+			return err
+		}
+	} else {
+		if stats, err = s.compressedCopyWithStats(ctx, w, f); err != nil {
+			return err
+		}
 	}
 
-	if err := w.Close(); err != nil {
-		if s.overwrite {
+	timer.start()
+	err = timer.err(gcsError(w.Close()))
+	timer.stop()
+	if err != nil {
+		if s.overwrite || !errors.Is(err, ErrPreconditionFailed) {
 			return err
 		}
-		silenced := silencePreconditionError(err)
+
+		// The `DoesNotExist` condition failed, the object already exists and is kept
 		if warnSilenced {
-			zlog.Info("silenced precondition error", zap.Error(err), zap.NamedError("silenced", silenced), zap.String("path", path))
+			zlog.Info("silenced precondition error", zap.Error(err), zap.String("path", path))
 		}
-		return silenced
+		s.reportOverwriteSkip(ctx, base)
+		return nil
 	}
 
+	s.reportWriteStats(ctx, stats)
+	s.reportWritten(ctx, base, s.ObjectURL(base), func(_ context.Context, base string) (*ObjectAttributes, error) {
+		// The attributes of the object written are known once the writer is closed
+		attrs := w.Attrs()
+		return &ObjectAttributes{LastModified: s.clampedMTime(base, attrs.Updated), Size: attrs.Size}, nil
+	})
 	return nil
 }
 
-func silencePreconditionError(err error) error {
-	if e, ok := err.(*googleapi.Error); ok {
-		if e.Code == http.StatusPreconditionFailed {
-			return nil
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// writeWithCRC32C writes `content` to `w` along with its `checksum`, Google Storage
+// rejects the upload when closing `w` if the checksum does not match the received content.
+func writeWithCRC32C(w *storage.Writer, content []byte, checksum uint32) error {
+	w.CRC32C = checksum
+	w.SendCRC32C = true
+
+	_, err := w.Write(content)
+	return err
+}
+
+// gcsError maps the Google Storage errors having a dstore equivalent to it: missing objects to
+// `ErrNotFound`, failed preconditions to `ErrPreconditionFailed` and conflicts to
+// `ErrAlreadyExists`, the `*googleapi.Error` of the latter two remaining available through
+// `errors.As`. Other errors are returned as-is.
+func gcsError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return ErrNotFound
+	}
+
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch gerr.Code {
+		case http.StatusPreconditionFailed:
+			return &kindError{kind: ErrPreconditionFailed, err: err}
+		case http.StatusConflict:
+			return &kindError{kind: ErrAlreadyExists, err: err}
 		}
 	}
 	return err
 }
 
 func (s *GSStore) OpenObject(ctx context.Context, name string) (out io.ReadCloser, err error) {
+	return s.openObject(ctx, name, s.compressionType, true, time.Time{})
+}
+
+func (s *GSStore) OpenObjectIfModifiedSince(ctx context.Context, name string, since time.Time) (io.ReadCloser, bool, error) {
+	return openedIfModified(s.openObject(ctx, name, s.compressionType, true, since))
+}
+
+func (s *GSStore) OpenObjectWithCompression(ctx context.Context, name string, compressionType string) (out io.ReadCloser, err error) {
+	return s.openObject(ctx, name, compressionType, false, time.Time{})
+}
+
+// openObject opens the object, when `since` is not zero only if it was modified after `since`,
+// `errNotModified` being returned otherwise. The compression recorded in the object's metadata,
+// if any, replaces `compressionType` when `detectCompression` is set, see
+// `WithCompressionDetectionOnWrite`.
+func (s *GSStore) openObject(ctx context.Context, name string, compressionType string, detectCompression bool, since time.Time) (out io.ReadCloser, err error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	ctx, timer := s.callTimer(ctx)
+	closeClient := func() {}
+	defer func() {
+		// The operation lasts until the returned reader is closed
+		if err != nil {
+			timer.release()
+			cancelOperation()
+			closeClient()
+			return
+		}
+		out = wrapReadCloser(out, func() {
+			timer.release()
+			cancelOperation()
+			closeClient()
+		})
+	}()
+
 	ctx = withStoreType(ctx, "gstore")
 	ctx = withLogger(ctx, zlog, tracer)
 
@@ -172,16 +503,64 @@ func (s *GSStore) OpenObject(ctx context.Context, name string) (out io.ReadClose
 	if tracer.Enabled() {
 		zlog.Debug("opening dstore file", zap.String("path", path))
 	}
-	reader, err := s.bucket().Object(path).NewReader(ctx)
+	bucket, closeBucketClient, err := s.bucketFor(ctx)
 	if err != nil {
-		if err == storage.ErrObjectNotExist {
-			return nil, ErrNotFound
+		return nil, err
+	}
+	closeClient = closeBucketClient
+	object := bucket.Object(path)
+	detectCompression = detectCompression && s.compressionDetection
+	if !since.IsZero() || detectCompression {
+		// GCS has no last modified time condition, the object is only read if its current
+		// generation, checked first, is newer than `since`. The metadata, holding the detected
+		// compression, is only returned with the attributes too.
+		timer.start()
+		attrs, err := object.Attrs(ctx)
+		timer.stop()
+		if err != nil {
+			if errors.Is(err, storage.ErrObjectNotExist) {
+				return nil, ErrNotFound
+			}
+			return nil, timer.err(gcsError(err))
+		}
+		if !since.IsZero() && !attrs.Updated.After(since) {
+			return nil, errNotModified
 		}
+		if detectCompression {
+			compressionType = detectedCompression(attrs.Metadata, CompressionMetadataKey, compressionType)
+		}
+		object = object.Generation(attrs.Generation)
+	}
 
-		return nil, err
+	var reader io.ReadCloser
+	var size int64
+	if s.readChunk > 0 {
+		timer.start()
+		chunked, err := newGSChunkedReader(ctx, object, s.readChunk)
+		timer.stop()
+		if err != nil {
+			if errors.Is(err, storage.ErrObjectNotExist) {
+				return nil, ErrNotFound
+			}
+
+			return nil, timer.err(gcsError(err))
+		}
+		reader, size = chunked, chunked.size
+	} else {
+		timer.start()
+		single, err := object.NewReader(ctx)
+		timer.stop()
+		if err != nil {
+			if errors.Is(err, storage.ErrObjectNotExist) {
+				return nil, ErrNotFound
+			}
+
+			return nil, timer.err(gcsError(err))
+		}
+		reader, size = single, single.Attrs.Size
 	}
 
-	out, err = s.uncompressedReader(ctx, reader)
+	out, err = s.uncompressedReaderWith(ctx, s.sizeValidatedReader(reader, size), compressionType)
 	if tracer.Enabled() {
 		out = wrapReadCloser(out, func() {
 			zlog.Debug("closing dstore file", zap.String("path", path))
@@ -190,47 +569,216 @@ func (s *GSStore) OpenObject(ctx context.Context, name string) (out io.ReadClose
 	return
 }
 
+// PeekObject fetches only the first `n` bytes with a ranged request on stores without
+// compression, streaming through `OpenObject` otherwise or when the object is recorded as
+// compressed.
+func (s *GSStore) PeekObject(ctx context.Context, name string, n int) ([]byte, error) {
+	if s.compressionType != "" {
+		return peekObject(ctx, s, name, n)
+	}
+	if n <= 0 {
+		return []byte{}, nil
+	}
+
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	bucket, closeClient, err := s.bucketFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer closeClient()
+
+	ctx, timer := s.callTimer(ctx)
+	defer timer.release()
+
+	object, recordedCompression, err := s.recordedCompressionOf(ctx, timer, bucket.Object(s.ObjectPath(name)))
+	if err != nil {
+		return nil, err
+	}
+	if recordedCompression != "" {
+		return peekObject(ctx, s, name, n)
+	}
+
+	timer.start()
+	rangeReader, err := object.NewRangeReader(ctx, 0, int64(n))
+	timer.stop()
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, ErrNotFound
+		}
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == http.StatusRequestedRangeNotSatisfiable {
+			// The object is empty, no range of it is satisfiable
+			return []byte{}, nil
+		}
+		return nil, timer.err(gcsError(err))
+	}
+
+	reader, err := s.uncompressedReaderWith(ctx, rangeReader, "")
+	if err != nil {
+		return nil, err
+	}
+	return readPeeked(reader, n)
+}
+
+func (s *GSStore) readRange(ctx context.Context, name string, offset, length int64) ([]byte, string, error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	bucket, closeClient, err := s.bucketFor(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer closeClient()
+
+	ctx, timer := s.callTimer(ctx)
+	defer timer.release()
+
+	object, recordedCompression, err := s.recordedCompressionOf(ctx, timer, bucket.Object(s.ObjectPath(name)))
+	if err != nil || recordedCompression != "" {
+		return nil, recordedCompression, err
+	}
+
+	timer.start()
+	rangeReader, err := object.NewRangeReader(ctx, offset, length)
+	timer.stop()
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, "", ErrNotFound
+		}
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == http.StatusRequestedRangeNotSatisfiable {
+			// The range starts past the end of the object
+			return []byte{}, "", nil
+		}
+		return nil, "", timer.err(gcsError(err))
+	}
+	defer rangeReader.Close()
+
+	content, err := io.ReadAll(rangeReader)
+	return content, "", err
+}
+
+// recordedCompressionOf returns the compression recorded for `object`, see
+// `commonStore.recordedCompression`. GCS only returning the metadata with the attributes, they
+// are fetched first when the store honors recorded compressions, the returned handle being
+// pinned to the generation checked.
+func (s *GSStore) recordedCompressionOf(ctx context.Context, timer *callTimer, object *storage.ObjectHandle) (*storage.ObjectHandle, string, error) {
+	if !s.compressionDetection {
+		return object, "", nil
+	}
+
+	timer.start()
+	attrs, err := object.Attrs(ctx)
+	timer.stop()
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, "", ErrNotFound
+		}
+		return nil, "", timer.err(gcsError(err))
+	}
+	return object.Generation(attrs.Generation), s.recordedCompression(attrs.Metadata, CompressionMetadataKey), nil
+}
+
 func (s *GSStore) DeleteObject(ctx context.Context, base string) error {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
 	path := s.ObjectPath(base)
-	err := s.bucket().Object(path).Delete(ctx)
+	bucket, closeClient, err := s.bucketFor(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	ctx, timer := s.callTimer(ctx)
+	defer timer.release()
+
+	timer.start()
+	err = bucket.Object(path).Delete(ctx)
+	timer.stop()
 	if errors.Is(err, storage.ErrObjectNotExist) {
-		return ErrNotFound
+		return s.deleteResult(ErrNotFound)
 	}
-	return err
+	return timer.err(gcsError(err))
 }
 
 func (s *GSStore) FileExists(ctx context.Context, base string) (bool, error) {
+	if s.existenceBloom.definitelyAbsent(ctx, s, base) {
+		return false, nil
+	}
+	return s.fileExists(ctx, base)
+}
+
+// fileExists checks the existence of the object with the backend, regardless of the existence
+// bloom hint, see `WithExistenceBloomHint`
+func (s *GSStore) fileExists(ctx context.Context, base string) (bool, error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
 	path := s.ObjectPath(base)
 
-	_, err := s.bucket().Object(path).Attrs(ctx)
+	bucket, closeClient, err := s.bucketFor(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer closeClient()
+	ctx, timer := s.callTimer(ctx)
+	defer timer.release()
+
+	timer.start()
+	_, err = bucket.Object(path).Attrs(ctx)
+	timer.stop()
 	if err != nil {
-		if err == storage.ErrObjectNotExist {
+		if errors.Is(err, storage.ErrObjectNotExist) {
 			return false, nil
 		}
 
-		return false, err
+		return false, timer.err(gcsError(err))
 	}
 	return true, nil
 }
 
 func (s *GSStore) ObjectAttributes(ctx context.Context, base string) (*ObjectAttributes, error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
 	path := s.ObjectPath(base)
 
-	attrs, err := s.bucket().Object(path).Attrs(ctx)
+	bucket, closeClient, err := s.bucketFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer closeClient()
+	ctx, timer := s.callTimer(ctx)
+	defer timer.release()
+
+	timer.start()
+	attrs, err := bucket.Object(path).Attrs(ctx)
+	timer.stop()
 	if err != nil {
-		if err == storage.ErrObjectNotExist {
+		if errors.Is(err, storage.ErrObjectNotExist) {
 			return nil, ErrNotFound
 		}
 
-		return nil, err
+		return nil, timer.err(gcsError(err))
 	}
 
 	return &ObjectAttributes{
-		LastModified: attrs.Updated,
+		LastModified: s.clampedMTime(base, attrs.Updated),
 		Size:         attrs.Size,
 	}, nil
 }
 
+func (s *GSStore) WriteFrom(ctx context.Context, base string, src Store, srcName string) error {
+	return writeFrom(ctx, s, base, src, srcName)
+}
+
+// OpenObjectSeekable is not supported on Google Storage stores.
+func (s *GSStore) OpenObjectSeekable(_ context.Context, _ string) (io.ReadSeekCloser, error) {
+	return nil, fmt.Errorf("seeking Google Storage objects: %w", ErrNotSupported)
+}
+
 func (s *GSStore) PushLocalFile(ctx context.Context, localFile, toBaseName string) error {
 	remove, err := pushLocalFile(ctx, s, localFile, toBaseName)
 	if err != nil {
@@ -243,23 +791,153 @@ func (s *GSStore) ListFiles(ctx context.Context, prefix string, max int) ([]stri
 	return listFiles(ctx, s, prefix, max)
 }
 
+func (s *GSStore) ListSubPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	if s.isSharded() || s.keySeparator != "" {
+		// Physical keys do not follow the logical names, the sub-prefixes are derived from them
+		return listSubPrefixes(ctx, s, prefix)
+	}
+
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	basePrefix := strings.TrimLeft(s.baseURL.Path, "/") + "/"
+	q := &storage.Query{
+		Prefix:    s.listPrefix(prefix),
+		Delimiter: "/",
+	}
+	q.SetAttrSelection([]string{"Name"})
+
+	bucket, closeClient, err := s.bucketFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer closeClient()
+	ctx, timer := s.callTimer(ctx)
+	defer timer.release()
+
+	it := bucket.Objects(ctx, q)
+	if s.listPageSize > 0 {
+		it.PageInfo().MaxSize = s.listPageSize
+	}
+
+	out := []string{}
+	for {
+		timer.start()
+		attrs, err := it.Next()
+		timer.stop()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, timer.err(gcsError(err))
+		}
+
+		// With a delimiter, sub-prefixes are yielded as synthetic entries having only `Prefix` set
+		if attrs.Prefix != "" {
+			out = append(out, strings.TrimPrefix(attrs.Prefix, basePrefix))
+		}
+	}
+
+	// Listings are in lexicographical order, and so are the sub-prefixes
+	return out, nil
+}
+
 func (s *GSStore) Walk(ctx context.Context, prefix string, f func(filename string) (err error)) error {
-	return s.WalkFrom(ctx, prefix, "", f)
+	if s.isSharded() {
+		return s.shardedWalk(ctx, prefix, func(ctx context.Context, prefix string, f func(filename string) error) error {
+			return s.walkFrom(ctx, prefix, "", f)
+		}, f)
+	}
+	return s.walkFrom(ctx, prefix, "", f)
 }
 
 func (s *GSStore) WalkFrom(ctx context.Context, prefix, startingPoint string, f func(filename string) (err error)) error {
-	q := &storage.Query{}
+	if s.isSharded() {
+		return commonWalkFrom(s, ctx, prefix, startingPoint, f)
+	}
+	return s.walkFrom(ctx, prefix, startingPoint, f)
+}
 
-	q.SetAttrSelection([]string{"Name"}) // only fetch the name, 25% faster
-	q.Prefix = strings.TrimLeft(s.baseURL.Path, "/") + "/"
+// listPrefix returns the object name prefix listing the objects under `prefix`
+func (s *GSStore) listPrefix(prefix string) string {
+	prefix = s.flatKey(prefix)
+	p := strings.TrimLeft(s.baseURL.Path, "/") + "/"
 	if prefix != "" {
-		q.Prefix = filepath.Join(q.Prefix, prefix)
+		p = filepath.Join(p, prefix)
 		// join cleans the string and will remove the trailing / in the prefix if present.
 		// adding it back to prevent false positive matches
 		if prefix[len(prefix)-1:] == "/" {
-			q.Prefix = q.Prefix + "/"
+			p = p + "/"
 		}
 	}
+	return p
+}
+
+// HasAnyFiles lists objects under `prefix` by pages of a single object, stopping at the first
+// file.
+func (s *GSStore) HasAnyFiles(ctx context.Context, prefix string) (bool, error) {
+	if s.isSharded() {
+		return hasAnyFiles(ctx, s, prefix)
+	}
+
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	q := &storage.Query{Prefix: s.listPrefix(prefix)}
+	q.SetAttrSelection([]string{"Name"})
+
+	bucket, closeClient, err := s.bucketFor(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer closeClient()
+
+	ctx, timer := s.callTimer(ctx)
+	defer timer.release()
+
+	it := bucket.Objects(ctx, q)
+	it.PageInfo().MaxSize = 1
+	for {
+		timer.start()
+		attrs, err := it.Next()
+		timer.stop()
+		if err == iterator.Done {
+			return false, nil
+		}
+		if err != nil {
+			return false, timer.err(gcsError(err))
+		}
+
+		if !s.isSkippedDirectoryMarker(attrs.Name) {
+			return true, nil
+		}
+	}
+}
+
+func (s *GSStore) walkFrom(ctx context.Context, prefix, startingPoint string, f func(filename string) (err error)) error {
+	// Only fetches the name, 25% faster
+	return s.walkObjectsFrom(ctx, prefix, startingPoint, []string{"Name"}, func(file FileWithAttrs) error {
+		return f(file.Name)
+	})
+}
+
+func (s *GSStore) walkWithAttributes(ctx context.Context, prefix string, f func(file FileWithAttrs) error) error {
+	if s.isSharded() {
+		return walkWithObjectAttributes(ctx, s, prefix, f)
+	}
+	return s.walkObjectsFrom(ctx, prefix, "", []string{"Name", "Size", "Updated"}, f)
+}
+
+// walkObjectsFrom walks the objects fetching only the `attrSelection` attributes of each, the
+// others being left zero
+func (s *GSStore) walkObjectsFrom(ctx context.Context, prefix, startingPoint string, attrSelection []string, f func(file FileWithAttrs) error) error {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	q := &storage.Query{}
+
+	q.SetAttrSelection(attrSelection)
+	q.Prefix = s.listPrefix(prefix)
 
 	if startingPoint != "" {
 		if !strings.HasPrefix(startingPoint, prefix) {
@@ -271,24 +949,60 @@ func (s *GSStore) WalkFrom(ctx context.Context, prefix, startingPoint string, f
 		// "original prefix" from the "startingPoint" and append it to the real "final" prefix instead.
 		relativeStartingPoint := strings.TrimPrefix(startingPoint, prefix)
 
-		q.StartOffset = filepath.Join(q.Prefix, relativeStartingPoint)
+		if s.keySeparator != "" {
+			// Flat keys are not `/` delimited, joining them would insert one
+			q.StartOffset = q.Prefix + s.flatKey(relativeStartingPoint)
+		} else {
+			q.StartOffset = filepath.Join(q.Prefix, relativeStartingPoint)
+		}
 	}
 
 	if tracer.Enabled() {
 		zlog.Info("walking files from", zap.String("original_prefix", prefix), zap.String("prefix", q.Prefix), zap.String("start_offset", q.StartOffset))
 	}
 
-	it := s.bucket().Objects(ctx, q)
+	bucket, closeClient, err := s.bucketFor(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	ctx, timer := s.callTimer(ctx)
+	defer timer.release()
+
+	it := bucket.Objects(ctx, q)
+	if s.listPageSize > 0 {
+		it.PageInfo().MaxSize = s.listPageSize
+	}
+
+	progress := s.newWalkProgress(ctx)
+	defer progress.flush()
 
 	for {
+		timer.start()
 		attrs, err := it.Next()
+		timer.stop()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return err
+			return timer.err(gcsError(err))
+		}
+
+		progress.fileSeen()
+		if it.PageInfo().Remaining() == 0 {
+			// Last object of the page fetched
+			progress.flush()
 		}
-		if err := f(s.toBaseName(attrs.Name)); err != nil {
+
+		if s.isSkippedDirectoryMarker(attrs.Name) {
+			continue
+		}
+		filename := s.toBaseName(attrs.Name)
+		file := FileWithAttrs{Name: filename, ObjectAttributes: ObjectAttributes{
+			Size:         attrs.Size,
+			LastModified: s.clampedMTime(filename, attrs.Updated),
+		}}
+		if err := f(file); err != nil {
 			if errors.Is(err, StopIteration) {
 				return nil
 			}
@@ -297,3 +1011,73 @@ func (s *GSStore) WalkFrom(ctx context.Context, prefix, startingPoint string, f
 	}
 	return nil
 }
+
+// gsChunkedReader reads an object by sequential ranged requests of `chunkSize` bytes, each
+// chunk being requested only once the previous one was fully consumed. All the chunks are
+// read from the generation of the object seen by the first request.
+type gsChunkedReader struct {
+	ctx       context.Context
+	object    *storage.ObjectHandle
+	chunkSize int64
+	size      int64
+	offset    int64
+	current   *storage.Reader
+}
+
+func newGSChunkedReader(ctx context.Context, object *storage.ObjectHandle, chunkSize int64) (*gsChunkedReader, error) {
+	first, err := object.NewRangeReader(ctx, 0, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gsChunkedReader{
+		ctx:       ctx,
+		object:    object.Generation(first.Attrs.Generation),
+		chunkSize: chunkSize,
+		size:      first.Attrs.Size,
+		current:   first,
+	}, nil
+}
+
+func (r *gsChunkedReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.offset >= r.size {
+				return 0, io.EOF
+			}
+
+			next, err := r.object.NewRangeReader(r.ctx, r.offset, r.chunkSize)
+			if err != nil {
+				return 0, fmt.Errorf("reading chunk at offset %d: %w", r.offset, err)
+			}
+			r.current = next
+		}
+
+		n, err := r.current.Read(p)
+		r.offset += int64(n)
+		if err == io.EOF {
+			closeErr := r.current.Close()
+			r.current = nil
+			if closeErr != nil {
+				return n, closeErr
+			}
+			if r.offset < r.size {
+				err = nil
+			}
+		}
+
+		if n > 0 || err != nil || len(p) == 0 {
+			return n, err
+		}
+	}
+}
+
+func (r *gsChunkedReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
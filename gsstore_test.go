@@ -0,0 +1,306 @@
+package dstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+)
+
+func TestGSStore_WithGCSSendCRC32C(t *testing.T) {
+	baseURL := os.Getenv("STORETESTS_GS_STORE_URL")
+	if baseURL == "" {
+		t.Skip("You must provide a valid Google Storage Bucket via STORETESTS_GS_STORE_URL environment variable to execute those tests")
+		return
+	}
+
+	ctx := context.Background()
+	storeURL, err := url.Parse(fmt.Sprintf("%s/dstore-crc32c-tests-%d", strings.TrimSuffix(baseURL, "/"), time.Now().UnixNano()))
+	require.NoError(t, err)
+
+	store, err := NewGSStore(storeURL, "", "zstd", true, WithGCSSendCRC32C())
+	require.NoError(t, err)
+	defer DeleteObjectsUnderPrefix(ctx, store, "", true)
+
+	require.NoError(t, store.WriteObject(ctx, "valid", strings.NewReader("some content")))
+
+	reader, err := store.OpenObject(ctx, "valid")
+	require.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.Equal(t, "some content", string(content))
+
+	// Simulates a corruption on the wire, the checksum not matching the content received
+	bucket, closeClient, err := store.bucketFor(ctx)
+	require.NoError(t, err)
+	defer closeClient()
+	w := bucket.Object(store.ObjectPath("corrupted")).NewWriter(ctx)
+	content = []byte("some content")
+	require.NoError(t, writeWithCRC32C(w, content, crc32.Checksum(content, crc32cTable)+1))
+	assert.Error(t, w.Close(), "upload with a mismatching checksum should be rejected")
+
+	exists, err := store.FileExists(ctx, "corrupted")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestGSStore_WithGCSReadChunkSize(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 40*1024)
+	transport := &rangeTransport{content: content}
+
+	baseURL, err := url.Parse("gs://bucket/path")
+	require.NoError(t, err)
+	store, err := NewGSStore(baseURL, "", "", false, WithGCSReadChunkSize(256*1024), WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	reader, err := store.OpenObject(context.Background(), "object")
+	require.NoError(t, err)
+	read, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+	assert.Equal(t, content, read)
+	assert.Equal(t, []string{"bytes=0-262143", "bytes=262144-524287", "bytes=524288-786431"}, transport.ranges)
+}
+
+func TestGSStore_WithOperationTimeout(t *testing.T) {
+	baseURL, err := url.Parse("gs://bucket/path")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		call func(ctx context.Context, store *GSStore) error
+	}{
+		{"attributes", func(ctx context.Context, store *GSStore) error {
+			_, err := store.ObjectAttributes(ctx, "object")
+			return err
+		}},
+		{"open", func(ctx context.Context, store *GSStore) error {
+			_, err := store.OpenObject(ctx, "object")
+			return err
+		}},
+		{"delete", func(ctx context.Context, store *GSStore) error {
+			return store.DeleteObject(ctx, "object")
+		}},
+		{"walk", func(ctx context.Context, store *GSStore) error {
+			return store.Walk(ctx, "", func(string) error { return nil })
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := &blockingTransport{inFlight: make(chan struct{})}
+			store, err := NewGSStore(baseURL, "", "", false, WithOperationTimeout(50*time.Millisecond), WithHTTPClient(&http.Client{Transport: transport}))
+			require.NoError(t, err)
+
+			start := time.Now()
+			err = test.call(context.Background(), store)
+			require.Error(t, err)
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			assert.Less(t, time.Since(start), 5*time.Second)
+		})
+	}
+
+	t.Run("near deadline context", func(t *testing.T) {
+		transport := &blockingTransport{inFlight: make(chan struct{})}
+		store, err := NewGSStore(baseURL, "", "", false, WithOperationTimeout(time.Minute), WithHTTPClient(&http.Client{Transport: transport}))
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err = store.ObjectAttributes(ctx, "object")
+		require.Error(t, err)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+}
+
+func TestWithGCSReadChunkSize_Invalid(t *testing.T) {
+	baseURL, err := url.Parse("gs://bucket/path")
+	require.NoError(t, err)
+
+	client := WithHTTPClient(&http.Client{Transport: &rangeTransport{}})
+	for _, n := range []int{0, 1000} {
+		_, err := NewGSStore(baseURL, "", "", false, WithGCSReadChunkSize(n), client)
+		assert.Error(t, err, n)
+	}
+
+	_, err = NewGSStore(baseURL, "", "", false, WithGCSReadChunkSize(512*1024), client)
+	assert.NoError(t, err)
+}
+
+// rangeTransport serves `content` as a Google Storage object honoring the requested ranges,
+// recording them.
+type rangeTransport struct {
+	content []byte
+	header  http.Header
+
+	lock   sync.Mutex
+	ranges []string
+}
+
+func (t *rangeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rangeHeader := req.Header.Get("Range")
+
+	t.lock.Lock()
+	t.ranges = append(t.ranges, rangeHeader)
+	t.lock.Unlock()
+
+	header := t.header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if rangeHeader == "" {
+		return &http.Response{StatusCode: http.StatusOK, Header: header, ContentLength: int64(len(t.content)), Body: io.NopCloser(bytes.NewReader(t.content)), Request: req}, nil
+	}
+
+	var start, end int
+	if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end); err != nil {
+		return nil, fmt.Errorf("unexpected range %q: %w", rangeHeader, err)
+	}
+	if end >= len(t.content) {
+		end = len(t.content) - 1
+	}
+
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(t.content)))
+	header.Set("X-Goog-Generation", "1")
+	return &http.Response{
+		StatusCode:    http.StatusPartialContent,
+		Header:        header,
+		ContentLength: int64(end - start + 1),
+		Body:          io.NopCloser(bytes.NewReader(t.content[start : end+1])),
+		Request:       req,
+	}, nil
+}
+
+type userProjectTransport struct {
+	lock         sync.Mutex
+	userProjects []string
+}
+
+func (t *userProjectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	userProject := req.URL.Query().Get("userProject")
+	if userProject == "" {
+		userProject = req.Header.Get("X-Goog-User-Project")
+	}
+
+	t.lock.Lock()
+	t.userProjects = append(t.userProjects, userProject)
+	t.lock.Unlock()
+
+	header := http.Header{}
+	header.Set("X-Goog-Generation", "1")
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		ContentLength: 7,
+		Body:          io.NopCloser(strings.NewReader("content")),
+		Request:       req,
+	}, nil
+}
+
+func TestNewStoreFromFileURL_GSUserProject(t *testing.T) {
+	transport := &userProjectTransport{}
+
+	store, filename, err := NewStoreFromFileURL("gs://bucket/path/file?project=billing", WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+	assert.Equal(t, "file", filename)
+
+	gsStore, ok := store.(*GSStore)
+	require.True(t, ok)
+	assert.Equal(t, "billing", gsStore.userProject)
+	assert.Equal(t, "project=billing", gsStore.BaseURL().RawQuery)
+
+	content, err := ReadObjectString(context.Background(), store, filename)
+	require.NoError(t, err)
+	assert.Equal(t, "content", content)
+
+	require.NotEmpty(t, transport.userProjects)
+	for _, userProject := range transport.userProjects {
+		assert.Equal(t, "billing", userProject, "reads of requester-pays buckets must be billed to the user project")
+	}
+}
+
+func TestGCSError(t *testing.T) {
+	assert.NoError(t, gcsError(nil))
+	assert.ErrorIs(t, gcsError(storage.ErrObjectNotExist), ErrNotFound)
+	assert.ErrorIs(t, gcsError(fmt.Errorf("reading: %w", storage.ErrObjectNotExist)), ErrNotFound)
+
+	err := gcsError(&googleapi.Error{Code: http.StatusPreconditionFailed, Message: "Precondition Failed"})
+	assert.ErrorIs(t, err, ErrPreconditionFailed)
+	assert.NotErrorIs(t, err, ErrAlreadyExists)
+	var gerr *googleapi.Error
+	require.ErrorAs(t, err, &gerr)
+	assert.Equal(t, http.StatusPreconditionFailed, gerr.Code)
+
+	assert.ErrorIs(t, gcsError(&googleapi.Error{Code: http.StatusConflict}), ErrAlreadyExists)
+
+	other := &googleapi.Error{Code: http.StatusForbidden}
+	assert.Equal(t, error(other), gcsError(other))
+}
+
+// preconditionFailedTransport rejects every upload with a failed precondition, as Google Storage
+// does for a `DoesNotExist` write of an existing object
+type preconditionFailedTransport struct {
+	lock    sync.Mutex
+	uploads int
+}
+
+func (t *preconditionFailedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+
+	t.lock.Lock()
+	t.uploads++
+	t.lock.Unlock()
+
+	body := `{"error":{"code":412,"message":"Precondition Failed","errors":[{"reason":"conditionNotMet","message":"Precondition Failed"}]}}`
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return &http.Response{
+		StatusCode:    http.StatusPreconditionFailed,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		Request:       req,
+	}, nil
+}
+
+func TestGSStore_WriteObject_PreconditionFailed(t *testing.T) {
+	ctx := context.Background()
+	storeURL, err := url.Parse("gs://bucket/path")
+	require.NoError(t, err)
+
+	transport := &preconditionFailedTransport{}
+	store, err := NewGSStore(storeURL, "", "", true, WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	err = store.WriteObject(ctx, "file", strings.NewReader("content"))
+	assert.ErrorIs(t, err, ErrPreconditionFailed)
+	var gerr *googleapi.Error
+	assert.ErrorAs(t, err, &gerr)
+
+	// Without overwrite, the existing object is kept and the failed precondition is not an error
+	store, err = NewGSStore(storeURL, "", "", false, WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+	assert.NoError(t, store.WriteObject(ctx, "file", strings.NewReader("content")))
+	assert.Equal(t, 2, transport.uploads)
+}
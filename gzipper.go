@@ -1,6 +1,7 @@
 package dstore
 
 import (
+	"compress/bzip2"
 	"compress/gzip"
 	"io"
 )
@@ -34,3 +35,20 @@ func (g *GZipReadCloser) Close() error {
 	}
 	return err1
 }
+
+// bzip2ReadCloser decompresses bzip2 content read from `src`, closing `src` when closed
+type bzip2ReadCloser struct {
+	src io.ReadCloser
+	io.Reader
+}
+
+func newBZip2ReadCloser(src io.ReadCloser) *bzip2ReadCloser {
+	return &bzip2ReadCloser{
+		src:    src,
+		Reader: bzip2.NewReader(src),
+	}
+}
+
+func (b *bzip2ReadCloser) Close() error {
+	return b.src.Close()
+}
@@ -1,11 +1,14 @@
 package dstore
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net/url"
 	"os"
 	"path"
@@ -23,71 +26,140 @@ import (
 type LocalStore struct {
 	baseURL  *url.URL
 	basePath string
+	fsync    bool
+
+	skipDecompressionIfPlain bool
+	writeBufferSize          int
 	*commonStore
 }
 
+// syncFile flushes `file` to stable storage, a variable so tests can observe the calls
+var syncFile = func(file *os.File) error {
+	return file.Sync()
+}
+
+// localFileWriter returns the writer through which the content of `file` is written, a variable
+// so tests can observe the writes reaching the file
+var localFileWriter = func(file *os.File) io.Writer {
+	return file
+}
+
 func NewLocalStore(baseURL *url.URL, extension, compressionType string, overwrite bool, opts ...Option) (*LocalStore, error) {
 	ctx := context.Background()
 	return newLocalStoreContext(ctx, baseURL, extension, compressionType, overwrite, opts...)
 }
 
-func newLocalStoreContext(_ context.Context, baseURL *url.URL, extension, compressionType string, overwrite bool, opts ...Option) (*LocalStore, error) {
-	rand.Seed(time.Now().UnixNano())
+func newLocalStoreContext(ctx context.Context, baseURL *url.URL, extension, compressionType string, overwrite bool, opts ...Option) (*LocalStore, error) {
+	conf := config{}
+	for _, opt := range opts {
+		opt.apply(&conf)
+	}
+	if conf.err != nil {
+		return nil, conf.err
+	}
+	baseURL = withDefaultPrefix(baseURL, conf.defaultPrefix)
+
 	basePath := filepath.Clean(baseURL.Path)
 	zlog.Debug("sanitized base path", zap.String("original_base_path", baseURL.Path), zap.String("sanitized_base_path", basePath))
 
 	myBaseURL := *baseURL
 	myBaseURL.Scheme = "file"
 
-	info, err := os.Stat(basePath)
-	if err != nil {
-		if err := os.MkdirAll(basePath, os.ModePerm); err != nil {
-			return nil, fmt.Errorf("unable to create base path %q: %w", basePath, err)
-		}
-	} else if !info.IsDir() {
-		return nil, fmt.Errorf("received base path is a file, expecting it to be a directory")
-	}
-
-	conf := config{}
-	for _, opt := range opts {
-		opt.apply(&conf)
+	if err := ensureLocalBasePath(basePath); err != nil {
+		return nil, err
 	}
 
 	common := &commonStore{
 		compressionType:           compressionType,
 		extension:                 extension,
 		overwrite:                 overwrite,
+		skipDirectoryMarkers:      conf.skipDirectoryMarkers,
+		sizeValidation:            conf.sizeValidation,
+		listPageSize:              conf.listPageSize,
+		sharder:                   conf.sharder,
+		objectPathFunc:            conf.objectPathFunc,
+		keySeparator:              conf.keySeparator,
 		uncompressedReadCallback:  conf.uncompressedReadCallback,
 		compressedReadCallback:    conf.compressedReadCallback,
 		uncompressedWriteCallback: conf.uncompressedWriteCallback,
 		compressedWriteCallback:   conf.compressedWriteCallback,
+		writeStatsCallback:        conf.writeStatsCallback,
+		overwriteSkipCallback:     conf.overwriteSkipCallback,
+		baseContext:               conf.baseContextOr(ctx),
+		uploadBuffers:             conf.uploadBuffers,
+		keepLocalAfterPush:        conf.keepLocalAfterPush,
+		clampFutureMTimes:         conf.clampFutureMTimes,
+		errorOnEmptyWrite:         conf.errorOnEmptyWrite,
+		deleteIgnoreNotFound:      conf.deleteIgnoreNotFound,
+		walkProgressCallback:      conf.walkProgressCallback,
+		operationTimeout:          conf.operationTimeout,
+		existenceCache:            newExistenceCache(conf.existenceCacheTTL),
+		existenceBloom:            newExistenceBloom(conf.existenceBloomHint, conf.existenceBloomHintMaxAge),
+		zstdDecoders:              zstdDecoderPoolFor(conf.zstdDecoderConcurrency, conf.zstdMaxIdleDecoders),
+		postWriteHook:             conf.postWriteHook,
+		retryObserver:             conf.retryObserver,
+		compressionDetection:      conf.compressionDetection,
 	}
 
 	return &LocalStore{
 		basePath:    basePath,
 		baseURL:     &myBaseURL,
+		fsync:       conf.localFsync,
 		commonStore: common,
+
+		skipDecompressionIfPlain: conf.localSkipDecompressionIfPlain,
+		writeBufferSize:          conf.localWriteBufferSize,
 	}, nil
 }
 
+// ensureLocalBasePath creates the directory `basePath` when missing, erroring if it is a file
+func ensureLocalBasePath(basePath string) error {
+	info, err := os.Stat(basePath)
+	if err != nil {
+		if err := os.MkdirAll(basePath, os.ModePerm); err != nil {
+			return fmt.Errorf("unable to create base path %q: %w", basePath, err)
+		}
+	} else if !info.IsDir() {
+		return fmt.Errorf("received base path is a file, expecting it to be a directory")
+	}
+
+	return nil
+}
+
 func (s *LocalStore) Clone(ctx context.Context, opts ...Option) (Store, error) {
 	return newLocalStoreContext(ctx, s.baseURL, s.extension, s.compressionType, s.overwrite, opts...)
 }
 
+func (s *LocalStore) Rebase(ctx context.Context, baseURL string, opts ...Option) (Store, error) {
+	return s.rebase(ctx, baseURL, func(config *config) {
+		config.localFsync = s.fsync
+		config.localSkipDecompressionIfPlain = s.skipDecompressionIfPlain
+		config.localWriteBufferSize = s.writeBufferSize
+	}, opts)
+}
+
 func (s *LocalStore) SubStore(subFolder string) (Store, error) {
-	basePath := s.baseURL.Path
-	newPath := path.Join(basePath, subFolder)
-	url, err := url.Parse(newPath)
-	if err != nil {
-		return nil, fmt.Errorf("local store parsing base url: %w", err)
+	if err := s.subStoreErr(subFolder); err != nil {
+		return nil, err
 	}
 
-	ls, err := NewLocalStore(url, s.extension, s.compressionType, s.overwrite)
-	if err != nil {
+	url := *s.baseURL
+	url.Path = path.Join(url.Path, subFolder)
+
+	basePath := filepath.Clean(url.Path)
+	if err := ensureLocalBasePath(basePath); err != nil {
 		return nil, err
 	}
 
-	return ls, nil
+	return &LocalStore{
+		basePath:    basePath,
+		baseURL:     &url,
+		fsync:       s.fsync,
+		commonStore: s.commonStore,
+
+		skipDecompressionIfPlain: s.skipDecompressionIfPlain,
+		writeBufferSize:          s.writeBufferSize,
+	}, nil
 }
 
 func (s *LocalStore) BaseURL() *url.URL {
@@ -98,14 +170,62 @@ func (s *LocalStore) ListFiles(ctx context.Context, prefix string, max int) ([]s
 	return listFiles(ctx, s, prefix, max)
 }
 
+func (s *LocalStore) ListSubPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	if s.isSharded() || s.keySeparator != "" {
+		// Physical keys do not follow the logical names, the sub-prefixes are derived from them
+		return listSubPrefixes(ctx, s, prefix)
+	}
+
+	// `prefix` is split into the directory to read and the prefix of the entries within it
+	dir, namePrefix := path.Split(prefix)
+
+	entries, err := os.ReadDir(filepath.Join(s.basePath, filepath.FromSlash(dir)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("reading directory: %w", err)
+	}
+
+	out := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), namePrefix) {
+			out = append(out, dir+entry.Name()+"/")
+		}
+	}
+
+	// `os.ReadDir` already sorts entries by name
+	return out, nil
+}
+
 func (s *LocalStore) WalkFrom(ctx context.Context, prefix, startingPoint string, f func(filename string) (err error)) error {
 	return commonWalkFrom(s, ctx, prefix, startingPoint, f)
 }
 
 func (s *LocalStore) Walk(ctx context.Context, prefix string, f func(filename string) (err error)) error {
+	if s.isSharded() {
+		return s.shardedWalk(ctx, prefix, s.walk, f)
+	}
+	return s.walk(ctx, prefix, f)
+}
+
+func (s *LocalStore) walk(ctx context.Context, prefix string, f func(filename string) (err error)) error {
+	return s.walkAttributes(ctx, prefix, func(file FileWithAttrs) error {
+		return f(file.Name)
+	})
+}
+
+func (s *LocalStore) walkWithAttributes(ctx context.Context, prefix string, f func(file FileWithAttrs) error) error {
+	if s.isSharded() {
+		return walkWithObjectAttributes(ctx, s, prefix, f)
+	}
+	return s.walkAttributes(ctx, prefix, f)
+}
+
+func (s *LocalStore) walkAttributes(ctx context.Context, prefix string, f func(file FileWithAttrs) error) error {
 	fullPath := s.basePath + "/"
 	if prefix != "" {
-		fullPath += prefix
+		fullPath += s.flatKey(prefix)
 	}
 
 	walkPath := fullPath
@@ -118,6 +238,9 @@ func (s *LocalStore) Walk(ctx context.Context, prefix string, f func(filename st
 		zlog.Debug("walking files", zap.String("walk_path", walkPath))
 	}
 
+	progress := s.newWalkProgress(ctx)
+	defer progress.flush()
+
 	err := filepath.Walk(walkPath, func(infoPath string, info os.FileInfo, err error) error {
 		if strings.HasSuffix(infoPath, ".tmp") {
 			// Early exits to avoid races with half-written `.tmp`
@@ -125,6 +248,9 @@ func (s *LocalStore) Walk(ctx context.Context, prefix string, f func(filename st
 			// below.  Only for local ones, as other stores are atomic.
 			return nil
 		}
+		if isLocalMetadataSidecar(infoPath) {
+			return nil
+		}
 		if err != nil {
 			if os.IsNotExist(err) {
 				return nil
@@ -142,15 +268,20 @@ func (s *LocalStore) Walk(ctx context.Context, prefix string, f func(filename st
 			return nil
 		}
 
-		if err := f(s.toBaseName(infoPath)); err != nil {
-			if errors.Is(err, StopIteration) {
-				return nil
-			}
+		if err := s.operationErr(ctx); err != nil {
 			return err
 		}
 
-		return nil
+		progress.fileSeen()
+		filename := s.toBaseName(infoPath)
+		return f(FileWithAttrs{Name: filename, ObjectAttributes: ObjectAttributes{
+			Size:         info.Size(),
+			LastModified: s.clampedMTime(filename, info.ModTime()),
+		}})
 	})
+	if errors.Is(err, StopIteration) {
+		return nil
+	}
 	return err
 }
 
@@ -159,6 +290,18 @@ func (s *LocalStore) WriteObject(ctx context.Context, base string, reader io.Rea
 	ctx = withStoreType(ctx, "localstore")
 	ctx = withLogger(ctx, zlog, tracer)
 
+	if err := s.ensureWritable(); err != nil {
+		return err
+	}
+	if err := s.operationErr(ctx); err != nil {
+		return err
+	}
+
+	reader, err = s.nonEmptySource(s.cancellableSource(ctx, reader))
+	if err != nil {
+		return err
+	}
+
 	destPath := s.ObjectPath(base)
 
 	tempPath := destPath + "." + randomString(8) + ".tmp"
@@ -168,25 +311,143 @@ func (s *LocalStore) WriteObject(ctx context.Context, base string, reader io.Rea
 		return fmt.Errorf("ensuring directory exists (mkdir -p) %q: %w", targetDir, err)
 	}
 
-	file, err := os.Create(tempPath)
+	// O_EXCL guarantees two writers never share the same temporary file, should the random suffix ever collide
+	file, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
 		return fmt.Errorf("unable to create file %q: %w", tempPath, err)
 	}
+	defer func() {
+		// A failed write must not leave its partial temporary file behind
+		if err != nil {
+			file.Close()
+			os.Remove(tempPath)
+		}
+	}()
+
+	destination := localFileWriter(file)
+	var buffered *bufio.Writer
+	if s.writeBufferSize > 0 {
+		// Hiding `ReadFrom` of the file keeps `bufio.Writer` from handing the copy over to it unbuffered
+		buffered = bufio.NewWriterSize(struct{ io.Writer }{destination}, s.writeBufferSize)
+		destination = buffered
+	}
 
-	if err := s.compressedCopy(ctx, file, reader); err != nil {
+	stats, err := s.compressedCopyWithStats(ctx, destination, reader)
+	if err != nil {
 		return err
 	}
-	if err := file.Close(); err != nil {
+	if buffered != nil {
+		if err = buffered.Flush(); err != nil {
+			return fmt.Errorf("flushing file %q: %w", tempPath, err)
+		}
+	}
+	if s.fsync {
+		if err := syncFile(file); err != nil {
+			return fmt.Errorf("sync file %q: %w", tempPath, err)
+		}
+	}
+	if err = file.Close(); err != nil {
 		return err
 	}
 
-	if err := os.Rename(tempPath, destPath); err != nil {
+	if err = os.Rename(tempPath, destPath); err != nil {
 		return fmt.Errorf("rename: %w", err)
 	}
 
+	// The metadata of the previous content, if any, does not apply to the new one
+	os.Remove(destPath + localMetadataSuffix)
+	if metadata := s.compressionMetadata(ctx, CompressionMetadataKey); metadata != nil {
+		if err := s.SetObjectMetadata(ctx, base, metadata); err != nil {
+			return err
+		}
+	}
+
+	if s.fsync {
+		if err := syncDir(targetDir); err != nil {
+			return err
+		}
+	}
+
+	s.reportWriteStats(ctx, stats)
+	s.reportWritten(ctx, base, s.ObjectURL(base), s.ObjectAttributes)
 	return nil
 }
 
+func (s *LocalStore) WriteObjectSeekable(ctx context.Context, base string, rs io.ReadSeeker) error {
+	return writeObjectSeekable(ctx, s, base, rs, nil, s.observeRetry)
+}
+
+func (s *LocalStore) Touch(ctx context.Context, base string) error {
+	now := time.Now()
+	if err := os.Chtimes(s.ObjectPath(base), now, now); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("touching object %q: %w", base, err)
+	}
+	return nil
+}
+
+// localMetadataSuffix is appended to the path of an object to form the path of the sidecar file
+// holding its metadata, see `SetObjectMetadata`. Sidecar files are not walked.
+const localMetadataSuffix = ".meta.json"
+
+// isLocalMetadataSidecar reports whether `path` is the metadata sidecar file of an object, an
+// object whose name merely ends with `localMetadataSuffix` having no object beside it
+func isLocalMetadataSidecar(path string) bool {
+	if !strings.HasSuffix(path, localMetadataSuffix) {
+		return false
+	}
+
+	info, err := os.Stat(strings.TrimSuffix(path, localMetadataSuffix))
+	return err == nil && !info.IsDir()
+}
+
+func (s *LocalStore) SetObjectMetadata(ctx context.Context, base string, md map[string]string) error {
+	metadata, err := s.GetObjectMetadata(ctx, base)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range md {
+		metadata[key] = value
+	}
+
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("encoding metadata of object %q: %w", base, err)
+	}
+
+	if err := os.WriteFile(s.ObjectPath(base)+localMetadataSuffix, content, 0644); err != nil {
+		return fmt.Errorf("setting metadata of object %q: %w", base, err)
+	}
+	return nil
+}
+
+func (s *LocalStore) GetObjectMetadata(ctx context.Context, base string) (map[string]string, error) {
+	path := s.ObjectPath(base)
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	md := map[string]string{}
+	content, err := os.ReadFile(path + localMetadataSuffix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return md, nil
+		}
+		return nil, fmt.Errorf("reading metadata of object %q: %w", base, err)
+	}
+
+	if err := json.Unmarshal(content, &md); err != nil {
+		return nil, fmt.Errorf("decoding metadata of object %q: %w", base, err)
+	}
+	return md, nil
+}
+
 func (s *LocalStore) CopyObject(ctx context.Context, src, dest string) error {
 	reader, err := s.OpenObject(ctx, src)
 	if err != nil {
@@ -198,6 +459,43 @@ func (s *LocalStore) CopyObject(ctx context.Context, src, dest string) error {
 }
 
 func (s *LocalStore) OpenObject(ctx context.Context, name string) (out io.ReadCloser, err error) {
+	return s.openObject(ctx, name, s.compressionType, true, time.Time{})
+}
+
+func (s *LocalStore) OpenObjectIfModifiedSince(ctx context.Context, name string, since time.Time) (io.ReadCloser, bool, error) {
+	return openedIfModified(s.openObject(ctx, name, s.compressionType, true, since))
+}
+
+func (s *LocalStore) readRange(ctx context.Context, name string, offset, length int64) ([]byte, string, error) {
+	file, err := os.Open(s.ObjectPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, "", ErrNotFound
+		}
+		return nil, "", err
+	}
+	defer file.Close()
+
+	recordedCompression := ""
+	if s.compressionDetection {
+		if metadata, err := s.GetObjectMetadata(ctx, name); err == nil {
+			recordedCompression = s.recordedCompression(metadata, CompressionMetadataKey)
+		}
+	}
+
+	content, err := io.ReadAll(io.NewSectionReader(file, offset, length))
+	return content, recordedCompression, err
+}
+
+func (s *LocalStore) OpenObjectWithCompression(ctx context.Context, name string, compressionType string) (out io.ReadCloser, err error) {
+	return s.openObject(ctx, name, compressionType, false, time.Time{})
+}
+
+// openObject opens the object, when `since` is not zero only if it was modified after `since`,
+// `errNotModified` being returned otherwise. The compression recorded in the object's metadata,
+// if any, replaces `compressionType` when `detectCompression` is set, see
+// `WithCompressionDetectionOnWrite`.
+func (s *LocalStore) openObject(ctx context.Context, name string, compressionType string, detectCompression bool, since time.Time) (out io.ReadCloser, err error) {
 	ctx = withStoreType(ctx, "localstore")
 	ctx = withLogger(ctx, zlog, tracer)
 
@@ -207,17 +505,53 @@ func (s *LocalStore) OpenObject(ctx context.Context, name string) (out io.ReadCl
 	if tracer.Enabled() {
 		zlog.Debug("opening dstore file", zap.String("path", path))
 	}
+	if err := s.operationErr(ctx); err != nil {
+		return nil, err
+	}
 
 	file, err := os.Open(path)
 	if err != nil {
-		if strings.ContainsAny(err.Error(), "no such file or directory") {
+		if os.IsNotExist(err) {
 			return nil, ErrNotFound
 		}
 		return nil, err
 	}
 
+	if !since.IsZero() {
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if !info.ModTime().After(since) {
+			file.Close()
+			return nil, errNotModified
+		}
+	}
+
+	expectedSize := int64(-1)
+	if s.sizeValidation {
+		if info, err := file.Stat(); err == nil {
+			expectedSize = info.Size()
+		}
+	}
+
+	if detectCompression && s.compressionDetection {
+		if metadata, err := s.GetObjectMetadata(ctx, name); err == nil {
+			compressionType = detectedCompression(metadata, CompressionMetadataKey, compressionType)
+		}
+	}
+
 	reader := NewBufferedFileReadCloser(file)
-	out, err = s.uncompressedReader(ctx, reader)
+	if s.skipDecompressionIfPlain && compressionType != "" {
+		// A short or failed peek leaves less bytes than the magic, reading the file as-is
+		header, _ := reader.reader.Peek(4)
+		if !hasCompressionMagic(header, compressionType) {
+			compressionType = ""
+		}
+	}
+
+	out, err = s.uncompressedReaderWith(ctx, s.sizeValidatedReader(s.cancellableReadCloser(ctx, reader), expectedSize), compressionType)
 	if tracer.Enabled() {
 		out = wrapReadCloser(out, func() {
 			zlog.Debug("closing dstore file", zap.String("path", path))
@@ -226,31 +560,60 @@ func (s *LocalStore) OpenObject(ctx context.Context, name string) (out io.ReadCl
 	return
 }
 
+// OpenObjectSeekable opens the object for random access, only supported when the store is
+// not compressed.
+func (s *LocalStore) OpenObjectSeekable(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	if s.compressionType != "" {
+		return nil, fmt.Errorf("seeking %s compressed objects: %w", s.compressionType, ErrNotSupported)
+	}
+
+	file, err := os.Open(s.ObjectPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return s.seekableReader(ctx, file), nil
+}
+
 func (s *LocalStore) toBaseName(filename string) string {
 	baseName := strings.TrimPrefix(strings.TrimSuffix(filename, s.pathWithExt("")), s.basePath)
 	baseName = strings.TrimPrefix(baseName, "/")
 
-	return baseName
+	return s.unflatKey(baseName)
 }
 
 func (s *LocalStore) ObjectPath(name string) string {
-	return path.Join(s.basePath, s.pathWithExt(name))
+	return path.Join(s.basePath, s.shardedPathWithExt(name))
 }
 
 func (s *LocalStore) ObjectURL(name string) string {
-	return fmt.Sprintf("%s/%s", strings.TrimRight(s.baseURL.String(), "/"), strings.TrimLeft(s.pathWithExt(name), "/"))
+	return objectURL(s.baseURL, s.shardedPathWithExt(name))
+}
+
+func (s *LocalStore) SupportsConcurrentWrites() bool {
+	return false
 }
 
 func (s *LocalStore) DeleteObject(ctx context.Context, base string) error {
 	path := s.ObjectPath(base)
 	err := os.Remove(path)
 	if os.IsNotExist(err) {
-		return ErrNotFound
+		return s.deleteResult(ErrNotFound)
+	}
+	if err == nil {
+		os.Remove(path + localMetadataSuffix)
 	}
 	return err
 }
 
 func (s *LocalStore) FileExists(ctx context.Context, base string) (bool, error) {
+	if s.existenceBloom.definitelyAbsent(ctx, s, base) {
+		return false, nil
+	}
+
 	path := s.ObjectPath(base)
 
 	_, err := os.Stat(path)
@@ -277,11 +640,15 @@ func (s *LocalStore) ObjectAttributes(ctx context.Context, base string) (*Object
 	}
 
 	return &ObjectAttributes{
-		LastModified: info.ModTime(),
+		LastModified: s.clampedMTime(base, info.ModTime()),
 		Size:         info.Size(),
 	}, nil
 }
 
+func (s *LocalStore) WriteFrom(ctx context.Context, base string, src Store, srcName string) error {
+	return writeFrom(ctx, s, base, src, srcName)
+}
+
 func (s *LocalStore) PushLocalFile(ctx context.Context, localFile, toBaseName string) error {
 	remove, err := pushLocalFile(ctx, s, localFile, toBaseName)
 	if err != nil {
@@ -290,12 +657,50 @@ func (s *LocalStore) PushLocalFile(ctx context.Context, localFile, toBaseName st
 	return remove()
 }
 
+// syncDir flushes the directory entries of `dir`, making a rename within it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("open directory %q: %w", dir, err)
+	}
+	defer d.Close()
+
+	if err := syncFile(d); err != nil {
+		return fmt.Errorf("sync directory %q: %w", dir, err)
+	}
+	return nil
+}
+
+var compressionMagics = map[string][]byte{
+	"gzip":  {0x1f, 0x8b},
+	"zstd":  {0x28, 0xb5, 0x2f, 0xfd},
+	"bzip2": []byte("BZh"),
+}
+
+// hasCompressionMagic returns true when `header` starts with the magic bytes of
+// `compressionType`, or when those magic bytes are unknown.
+func hasCompressionMagic(header []byte, compressionType string) bool {
+	magic, known := compressionMagics[compressionType]
+	if !known {
+		return true
+	}
+
+	return bytes.HasPrefix(header, magic)
+}
+
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
+// randomString returns a string of `n` letters drawn from `crypto/rand`, so that temporary
+// file names do not collide across processes started at the same time.
 func randomString(n int) string {
+	random := make([]byte, n)
+	if _, err := rand.Read(random); err != nil {
+		panic(fmt.Errorf("reading random bytes: %w", err))
+	}
+
 	b := make([]rune, n)
 	for i := range b {
-		b[i] = letterRunes[rand.Intn(len(letterRunes))]
+		b[i] = letterRunes[int(random[i])%len(letterRunes)]
 	}
 	return string(b)
 }
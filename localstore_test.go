@@ -1,11 +1,21 @@
 package dstore
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"math"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -47,3 +57,944 @@ func TestNewLocalStore_SubStore(t *testing.T) {
 	require.True(t, strings.HasSuffix(sub.BaseURL().Path, "sub-folder"))
 
 }
+
+func TestNewLocalStore_OpenObjectWithCompression(t *testing.T) {
+	dir := t.TempDir()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte("legacy content"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "legacy.jsonl.gz"), buf.Bytes(), 0644))
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "zstd", false)
+	require.NoError(t, err)
+
+	reader, err := OpenObjectWithCompression(context.Background(), store, "legacy.jsonl.gz", "gzip")
+	require.NoError(t, err)
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "legacy content", string(content))
+
+	raw, err := OpenObjectWithCompression(context.Background(), store, "legacy.jsonl.gz", "")
+	require.NoError(t, err)
+	defer raw.Close()
+
+	rawContent, err := io.ReadAll(raw)
+	require.NoError(t, err)
+	assert.Equal(t, buf.Bytes(), rawContent)
+}
+
+func TestNewLocalStore_OpenObjectSeekable(t *testing.T) {
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: t.TempDir()}, "", "", false)
+	require.NoError(t, err)
+	require.NoError(t, store.WriteObject(context.Background(), "file", strings.NewReader("0123456789")))
+
+	reader, err := store.OpenObjectSeekable(context.Background(), "file")
+	require.NoError(t, err)
+	defer reader.Close()
+
+	assertSeekRead(t, reader, 5, io.SeekStart, "567")
+	assertSeekRead(t, reader, -2, io.SeekEnd, "89")
+	assertSeekRead(t, reader, -9, io.SeekCurrent, "123")
+
+	_, err = store.OpenObjectSeekable(context.Background(), "missing")
+	assert.Equal(t, ErrNotFound, err)
+
+	compressed, err := NewLocalStore(&url.URL{Scheme: "file", Path: t.TempDir()}, "", "zstd", false)
+	require.NoError(t, err)
+
+	_, err = compressed.OpenObjectSeekable(context.Background(), "file")
+	assert.ErrorIs(t, err, ErrNotSupported)
+}
+
+func assertSeekRead(t *testing.T, reader io.ReadSeeker, offset int64, whence int, expected string) {
+	t.Helper()
+
+	_, err := reader.Seek(offset, whence)
+	require.NoError(t, err)
+
+	buf := make([]byte, len(expected))
+	_, err = io.ReadFull(reader, buf)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(buf))
+}
+
+func TestNewLocalStore_WithWriteStats(t *testing.T) {
+	var calls int
+	var uncompressed, compressed int64
+	var summedCompressed int
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: t.TempDir()}, "", "gzip", false,
+		WithCompressedWriteCallback(func(ctx context.Context, n int) { summedCompressed += n }),
+		WithWriteStats(func(ctx context.Context, u, c int64) {
+			calls++
+			uncompressed, compressed = u, c
+		}),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, store.WriteObject(context.Background(), "file", strings.NewReader(strings.Repeat("a", 2048))))
+
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, int64(2048), uncompressed)
+	assert.Equal(t, int64(summedCompressed), compressed)
+
+	attrs, err := store.ObjectAttributes(context.Background(), "file")
+	require.NoError(t, err)
+	assert.Equal(t, attrs.Size, compressed)
+}
+
+func TestNewLocalStore_WithWriteStats_SubStore(t *testing.T) {
+	ctx := context.Background()
+
+	var written []int64
+	var skipped []string
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: t.TempDir()}, "", "", false,
+		WithWriteStats(func(ctx context.Context, uncompressed, compressed int64) { written = append(written, uncompressed) }),
+		WithOverwriteSkipLogger(func(ctx context.Context, name string) { skipped = append(skipped, name) }),
+	)
+	require.NoError(t, err)
+
+	sub, err := store.SubStore("sub")
+	require.NoError(t, err)
+
+	require.NoError(t, WriteObjectString(ctx, sub, "file", "content"))
+	assert.Equal(t, []int64{7}, written)
+
+	// Local stores always overwrite, stores rebased from the sub store skip overwrites
+	rebased, err := sub.(Rebasable).Rebase(ctx, "memory://memory")
+	require.NoError(t, err)
+	require.NoError(t, WriteObjectString(ctx, rebased, "file", "content"))
+	require.NoError(t, WriteObjectString(ctx, rebased, "file", "other content"))
+	assert.Equal(t, []string{"file"}, skipped)
+}
+
+func TestNewLocalStore_WithPrefixSharding(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	sharder, err := HexHashSharder(2)
+	require.NoError(t, err)
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "dbin", "", false, WithPrefixSharding(sharder))
+	require.NoError(t, err)
+
+	names := []string{"0000000100", "0000000200", "0000000300", "other"}
+	for _, name := range names {
+		require.NoError(t, store.WriteObject(ctx, name, strings.NewReader(name)))
+
+		assert.Equal(t, filepath.Join(dir, sharder(name), name+".dbin"), store.ObjectPath(name))
+		_, err := os.Stat(store.ObjectPath(name))
+		require.NoError(t, err)
+	}
+
+	reader, err := store.OpenObject(ctx, "0000000200")
+	require.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.Equal(t, "0000000200", string(content))
+
+	files, err := store.ListFiles(ctx, "", math.MaxInt64)
+	require.NoError(t, err)
+	assert.Equal(t, names, files)
+
+	files, err = store.ListFiles(ctx, "00000", math.MaxInt64)
+	require.NoError(t, err)
+	assert.Equal(t, names[:3], files)
+
+	var walked []string
+	require.NoError(t, store.WalkFrom(ctx, "00000", "0000000200", func(filename string) error {
+		walked = append(walked, filename)
+		return nil
+	}))
+	assert.Equal(t, names[1:3], walked)
+
+	require.NoError(t, store.WriteObject(ctx, "eth/mainnet/0001", strings.NewReader("block")))
+	prefixes, err := store.ListSubPrefixes(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eth/"}, prefixes, "sub-prefixes are the logical ones, not the shard directories")
+
+	prefixes, err = store.ListSubPrefixes(ctx, "eth/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eth/mainnet/"}, prefixes)
+}
+
+func TestNewLocalStore_WithPrefixSharding_SubStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	sharder, err := HexHashSharder(2)
+	require.NoError(t, err)
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "dbin", "", false, WithPrefixSharding(sharder))
+	require.NoError(t, err)
+
+	sub, err := store.SubStore("sub")
+	require.NoError(t, err)
+
+	require.NoError(t, WriteObjectString(ctx, sub, "0000000100", "content"))
+	assert.Equal(t, filepath.Join(dir, "sub", sharder("0000000100"), "0000000100.dbin"), sub.ObjectPath("0000000100"))
+	_, err = os.Stat(sub.ObjectPath("0000000100"))
+	require.NoError(t, err)
+
+	files, err := sub.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0000000100"}, files)
+}
+
+func TestNewLocalStore_WithObjectPathFunc(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	pathFunc, err := ZeroPaddedBucketPathFunc(5, 2, 1)
+	require.NoError(t, err)
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "dbin.zst", "", false, WithObjectPathFunc(pathFunc))
+	require.NoError(t, err)
+
+	names := []string{"100", "12345", "9000"}
+	for _, name := range names {
+		require.NoError(t, WriteObjectString(ctx, store, name, "content "+name))
+	}
+
+	assert.Equal(t, filepath.Join(dir, "0", "0", "100.dbin.zst"), store.ObjectPath("100"))
+	for _, physical := range []string{"0/0/100.dbin.zst", "1/2/12345.dbin.zst", "0/9/9000.dbin.zst"} {
+		_, err := os.Stat(filepath.Join(dir, physical))
+		require.NoError(t, err, physical)
+	}
+
+	content, err := ReadObjectString(ctx, store, "100")
+	require.NoError(t, err)
+	assert.Equal(t, "content 100", content)
+
+	// A file not laid out by the transform is not yielded
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stray.dbin.zst"), nil, 0644))
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"100", "12345", "9000"}, files)
+
+	files, err = store.ListFiles(ctx, "1", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"100", "12345"}, files)
+}
+
+func TestNewLocalStore_WithObjectPathFunc_SubStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	pathFunc, err := ZeroPaddedBucketPathFunc(5, 2, 1)
+	require.NoError(t, err)
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "dbin.zst", "", false, WithObjectPathFunc(pathFunc))
+	require.NoError(t, err)
+
+	sub, err := store.SubStore("sub")
+	require.NoError(t, err)
+
+	require.NoError(t, WriteObjectString(ctx, sub, "12345", "content"))
+	_, err = os.Stat(filepath.Join(dir, "sub", "1", "2", "12345.dbin.zst"))
+	require.NoError(t, err)
+
+	files, err := sub.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"12345"}, files)
+}
+
+func TestNewLocalStore_WithDefaultPrefix(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "", false, WithDefaultPrefix("p"))
+	require.NoError(t, err)
+
+	require.NoError(t, WriteObjectString(ctx, store, "x", "content"))
+	assert.Equal(t, filepath.Join(dir, "p", "x"), store.ObjectPath("x"))
+	_, err = os.Stat(filepath.Join(dir, "p", "x"))
+	require.NoError(t, err)
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"x"}, files)
+
+	sub, err := store.SubStore("sub")
+	require.NoError(t, err)
+	require.NoError(t, WriteObjectString(ctx, sub, "x", "content"))
+	_, err = os.Stat(filepath.Join(dir, "p", "sub", "x"))
+	require.NoError(t, err)
+
+	files, err = sub.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"x"}, files)
+}
+
+func TestNewLocalStore_WithSizeValidation_SubStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "", false, WithSizeValidation())
+	require.NoError(t, err)
+
+	sub, err := store.SubStore("sub")
+	require.NoError(t, err)
+	require.NoError(t, WriteObjectString(ctx, sub, "file", "some content"))
+
+	reader, err := sub.OpenObject(ctx, "file")
+	require.NoError(t, err)
+	defer reader.Close()
+
+	// Truncated after the size was captured by the open
+	require.NoError(t, os.Truncate(filepath.Join(dir, "sub", "file"), 4))
+
+	_, err = io.ReadAll(reader)
+	assert.ErrorIs(t, err, ErrShortRead)
+}
+
+func TestNewLocalStore_WithClampFutureMTimes(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	future := time.Now().Add(24 * time.Hour)
+
+	clamping, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "", false, WithClampFutureMTimes())
+	require.NoError(t, err)
+	require.NoError(t, WriteObjectString(ctx, clamping, "skewed", "content"))
+	require.NoError(t, os.Chtimes(clamping.ObjectPath("skewed"), future, future))
+
+	attrs, err := clamping.ObjectAttributes(ctx, "skewed")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), attrs.LastModified, FutureMTimeSkew)
+
+	// A last modified time within the tolerated skew is kept as is
+	nearFuture := time.Now().Add(FutureMTimeSkew / 2).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(clamping.ObjectPath("skewed"), nearFuture, nearFuture))
+	attrs, err = clamping.ObjectAttributes(ctx, "skewed")
+	require.NoError(t, err)
+	assert.True(t, nearFuture.Equal(attrs.LastModified))
+
+	require.NoError(t, os.Chtimes(clamping.ObjectPath("skewed"), future, future))
+	plain, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "", false)
+	require.NoError(t, err)
+	attrs, err = plain.ObjectAttributes(ctx, "skewed")
+	require.NoError(t, err)
+	assert.True(t, future.Equal(attrs.LastModified))
+}
+
+func TestNewLocalStore_DownloadTo(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: t.TempDir()}, "", "zstd", false)
+	require.NoError(t, err)
+
+	payload := strings.Repeat("some content ", 1000)
+	require.NoError(t, WriteObjectString(ctx, store, "payload", payload))
+
+	var out bytes.Buffer
+	written, err := DownloadTo(ctx, store, "payload", &out)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(payload)), written)
+	assert.Equal(t, payload, out.String())
+
+	_, err = DownloadTo(ctx, store, "missing", &out)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestNewLocalStore_UploadFrom(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	payload := bytes.Repeat([]byte("0123456789"), 300*1024)
+	localFile := filepath.Join(t.TempDir(), "payload")
+	require.NoError(t, os.WriteFile(localFile, payload, 0644))
+
+	file, err := os.Open(localFile)
+	require.NoError(t, err)
+	defer file.Close()
+
+	for _, compression := range []string{"", "zstd"} {
+		store, err := NewLocalStore(&url.URL{Scheme: "file", Path: filepath.Join(dir, "compression-"+compression)}, "", compression, false)
+		require.NoError(t, err)
+
+		require.NoError(t, UploadFrom(ctx, store, "payload", file, int64(len(payload))))
+
+		var out bytes.Buffer
+		_, err = DownloadTo(ctx, store, "payload", &out)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(payload, out.Bytes()), "compression %q", compression)
+	}
+}
+
+func TestNewLocalStore_WithErrorOnEmptyWrite(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "gzip", false, WithErrorOnEmptyWrite())
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, store.WriteObject(ctx, "empty", strings.NewReader("")), ErrEmptyObject)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "no file, temporary or not, should be left behind")
+}
+
+func TestZeroPaddedBucketPathFunc(t *testing.T) {
+	fn, err := ZeroPaddedBucketPathFunc(10, 2, 2)
+	require.NoError(t, err)
+
+	assert.Equal(t, "00/00/100", fn("100"))
+	assert.Equal(t, "12/34/1234567890", fn("1234567890"))
+
+	_, err = ZeroPaddedBucketPathFunc(3, 2, 2)
+	assert.Error(t, err)
+}
+
+func TestHexHashSharder(t *testing.T) {
+	sharder, err := HexHashSharder(2)
+	require.NoError(t, err)
+
+	assert.Len(t, sharder("name"), 2)
+	assert.Equal(t, sharder("name"), sharder("name"))
+
+	_, err = HexHashSharder(0)
+	assert.Error(t, err)
+}
+
+func TestNewLocalStore_ConcurrentWritesSameName(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "", true)
+	require.NoError(t, err)
+
+	const writers = 64
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- store.WriteObject(context.Background(), "same", strings.NewReader("content"))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "no temporary file should be left behind")
+	assert.Equal(t, "same", entries[0].Name())
+
+	content, err := ReadObjectString(context.Background(), store, "same")
+	require.NoError(t, err)
+	assert.Equal(t, "content", content)
+}
+
+func TestRandomString(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		value := randomString(8)
+		require.Len(t, value, 8)
+		assert.False(t, seen[value], "random string %q generated twice", value)
+		seen[value] = true
+	}
+}
+
+func TestNewLocalStore_Touch(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: t.TempDir()}, "", "gzip", false)
+	require.NoError(t, err)
+
+	require.NoError(t, WriteObjectString(ctx, store, "file", "some content"))
+
+	old := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(store.ObjectPath("file"), old, old))
+
+	before, err := os.ReadFile(store.ObjectPath("file"))
+	require.NoError(t, err)
+
+	require.NoError(t, Touch(ctx, store, "file"))
+
+	attrs, err := store.ObjectAttributes(ctx, "file")
+	require.NoError(t, err)
+	assert.True(t, attrs.LastModified.After(old), "last modified %s should be after %s", attrs.LastModified, old)
+
+	after, err := os.ReadFile(store.ObjectPath("file"))
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	assert.ErrorIs(t, Touch(ctx, store, "missing"), ErrNotFound)
+}
+
+func TestNewLocalStore_BZip2(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewStore("file://"+dir, "bz2", "bzip2", false)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file.bz2"), bzip2Content, 0644))
+
+	content, err := ReadObjectString(ctx, store, "file")
+	require.NoError(t, err)
+	assert.Equal(t, "some bzip2 content", content)
+
+	err = WriteObjectString(ctx, store, "written", "content")
+	assert.ErrorIs(t, err, ErrNotSupported)
+
+	_, err = os.Stat(filepath.Join(dir, "written.bz2"))
+	assert.True(t, os.IsNotExist(err), "no file should be created by a refused write")
+}
+
+func TestNewLocalStore_WithLocalFsync(t *testing.T) {
+	var synced []string
+	defer func(original func(file *os.File) error) { syncFile = original }(syncFile)
+	syncFile = func(file *os.File) error {
+		synced = append(synced, file.Name())
+		return file.Sync()
+	}
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "", false)
+	require.NoError(t, err)
+	require.NoError(t, WriteObjectString(ctx, store, "sub/unsynced", "content"))
+	assert.Empty(t, synced)
+
+	store, err = NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "", false, WithLocalFsync())
+	require.NoError(t, err)
+	require.NoError(t, WriteObjectString(ctx, store, "sub/synced", "content"))
+
+	require.Len(t, synced, 2)
+	assert.True(t, strings.HasPrefix(synced[0], filepath.Join(dir, "sub", "synced")+"."), "temporary file should be synced first, got %q", synced[0])
+	assert.True(t, strings.HasSuffix(synced[0], ".tmp"))
+	assert.Equal(t, filepath.Join(dir, "sub"), synced[1], "parent directory should be synced after rename")
+
+	content, err := ReadObjectString(ctx, store, "sub/synced")
+	require.NoError(t, err)
+	assert.Equal(t, "content", content)
+}
+
+func TestNewLocalStore_WithCompressionDetectionOnWrite(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	baseURL := &url.URL{Scheme: "file", Path: dir}
+
+	zstdWriter, err := NewLocalStore(baseURL, "", "zstd", false, WithCompressionDetectionOnWrite())
+	require.NoError(t, err)
+	require.NoError(t, WriteObjectString(ctx, zstdWriter, "zstd", "zstd content"))
+
+	plainWriter, err := NewLocalStore(baseURL, "", "", false, WithCompressionDetectionOnWrite())
+	require.NoError(t, err)
+	require.NoError(t, WriteObjectString(ctx, plainWriter, "plain", "plain content"))
+
+	unrecordedWriter, err := NewLocalStore(baseURL, "", "gzip", false)
+	require.NoError(t, err)
+	require.NoError(t, WriteObjectString(ctx, unrecordedWriter, "unrecorded", "gzip content"))
+
+	metadata, err := GetObjectMetadata(ctx, zstdWriter, "zstd")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{CompressionMetadataKey: "zstd"}, metadata)
+
+	reader, err := NewLocalStore(baseURL, "", "gzip", false, WithCompressionDetectionOnWrite())
+	require.NoError(t, err)
+
+	for name, expected := range map[string]string{"zstd": "zstd content", "plain": "plain content", "unrecorded": "gzip content"} {
+		content, err := ReadObjectString(ctx, reader, name)
+		require.NoError(t, err, name)
+		assert.Equal(t, expected, content, "the recorded compression, or the configured one, should be used for %q", name)
+	}
+
+	files, err := reader.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"plain", "unrecorded", "zstd"}, files, "metadata sidecars should not be listed")
+
+	// The compression explicitly requested is used as-is
+	raw, err := OpenObjectWithCompression(ctx, reader, "plain", "")
+	require.NoError(t, err)
+	content, err := io.ReadAll(raw)
+	require.NoError(t, err)
+	require.NoError(t, raw.Close())
+	assert.Equal(t, "plain content", string(content))
+
+	// Without the option, the configured compression is always used
+	undetecting, err := NewLocalStore(baseURL, "", "gzip", false)
+	require.NoError(t, err)
+	_, err = ReadObjectString(ctx, undetecting, "zstd")
+	assert.Error(t, err)
+}
+
+// writeCounter counts the writes reaching the underlying file
+type writeCounter struct {
+	io.Writer
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Writer.Write(p)
+}
+
+func TestNewLocalStore_WithLocalWriteBufferSize(t *testing.T) {
+	var counter *writeCounter
+	defer func(original func(file *os.File) io.Writer) { localFileWriter = original }(localFileWriter)
+	localFileWriter = func(file *os.File) io.Writer {
+		counter = &writeCounter{Writer: file}
+		return counter
+	}
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	content := strings.Repeat("0123456789", 1000)
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "", false)
+	require.NoError(t, err)
+	require.NoError(t, store.WriteObject(ctx, "unbuffered", iotest.OneByteReader(strings.NewReader(content))))
+	assert.Equal(t, len(content), counter.writes, "each small read should be a write without buffering")
+
+	store, err = NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "", false, WithLocalWriteBufferSize(4096))
+	require.NoError(t, err)
+	require.NoError(t, store.WriteObject(ctx, "buffered", iotest.OneByteReader(strings.NewReader(content))))
+	assert.Equal(t, 3, counter.writes, "writes should be grouped in chunks of the buffer size")
+
+	written, err := ReadObjectString(ctx, store, "buffered")
+	require.NoError(t, err)
+	assert.Equal(t, content, written)
+}
+
+// readerFromRecorder is a destination implementing `io.ReaderFrom`, recording its use
+type readerFromRecorder struct {
+	bytes.Buffer
+	readFromCalls int
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFromCalls++
+	return r.Buffer.ReadFrom(src)
+}
+
+// writerToSource is a source implementing `io.WriterTo`, recording its use
+type writerToSource struct {
+	content      string
+	writeToCalls int
+}
+
+func (s *writerToSource) Read(p []byte) (int, error) {
+	panic("Read should not be called when WriteTo is available")
+}
+
+func (s *writerToSource) WriteTo(w io.Writer) (int64, error) {
+	s.writeToCalls++
+	n, err := io.WriteString(w, s.content)
+	return int64(n), err
+}
+
+func TestNewLocalStore_WriterToFastPath(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: t.TempDir()}, "", "", false)
+	require.NoError(t, err)
+
+	source := &writerToSource{content: "some content"}
+	require.NoError(t, store.WriteObject(ctx, "file", source))
+	assert.Equal(t, 1, source.writeToCalls)
+
+	reader, err := store.OpenObject(ctx, "file")
+	require.NoError(t, err)
+	defer reader.Close()
+
+	_, isWriterTo := reader.(io.WriterTo)
+	require.True(t, isWriterTo, "local uncompressed reader should implement io.WriterTo")
+
+	destination := &readerFromRecorder{}
+	_, err = io.Copy(destination, reader)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, destination.readFromCalls)
+	assert.Equal(t, "some content", destination.String())
+}
+
+func TestNewLocalStore_OpenObjectIfModifiedSince(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: t.TempDir()}, "", "", true)
+	require.NoError(t, err)
+
+	require.NoError(t, WriteObjectString(ctx, store, "file", "before"))
+	attrs, err := store.ObjectAttributes(ctx, "file")
+	require.NoError(t, err)
+
+	reader, modified, err := store.OpenObjectIfModifiedSince(ctx, "file", attrs.LastModified)
+	require.NoError(t, err)
+	assert.False(t, modified)
+	assert.Nil(t, reader)
+
+	reader, modified, err = store.OpenObjectIfModifiedSince(ctx, "file", attrs.LastModified.Add(-time.Second))
+	require.NoError(t, err)
+	assert.True(t, modified)
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.Equal(t, "before", string(content))
+
+	require.NoError(t, WriteObjectString(ctx, store, "file", "after"))
+	require.NoError(t, os.Chtimes(store.ObjectPath("file"), time.Now(), attrs.LastModified.Add(time.Second)))
+
+	reader, modified, err = store.OpenObjectIfModifiedSince(ctx, "file", attrs.LastModified)
+	require.NoError(t, err)
+	assert.True(t, modified)
+	content, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.Equal(t, "after", string(content))
+
+	_, _, err = store.OpenObjectIfModifiedSince(ctx, "missing", attrs.LastModified)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestNewLocalStore_PushLocalFiles(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: t.TempDir()}, "", "", false)
+	require.NoError(t, err)
+
+	sourceDir := t.TempDir()
+	files := map[string]string{}
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("file-%02d", i)
+		localFile := filepath.Join(sourceDir, name)
+		require.NoError(t, os.WriteFile(localFile, []byte(name), 0644))
+		files[localFile] = name
+	}
+
+	require.NoError(t, PushLocalFiles(ctx, store, files, 3))
+
+	for localFile, name := range files {
+		_, err := os.Stat(localFile)
+		assert.True(t, os.IsNotExist(err), "local file %q should have been removed", localFile)
+
+		content, err := ReadObjectString(ctx, store, name)
+		require.NoError(t, err)
+		assert.Equal(t, name, content)
+	}
+
+	// A failing push is reported without preventing the other ones
+	kept := filepath.Join(sourceDir, "kept")
+	require.NoError(t, os.WriteFile(kept, []byte("kept"), 0644))
+	missing := filepath.Join(sourceDir, "missing")
+
+	err = PushLocalFiles(ctx, store, map[string]string{kept: "kept", missing: "missing"}, 2)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), missing)
+
+	content, err := ReadObjectString(ctx, store, "kept")
+	require.NoError(t, err)
+	assert.Equal(t, "kept", content)
+
+	exists, err := store.FileExists(ctx, "missing")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+// slowReader yields one byte of `content` per read, each read taking `delay`
+type slowReader struct {
+	content []byte
+	delay   time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.content) == 0 {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	time.Sleep(r.delay)
+	p[0] = r.content[0]
+	r.content = r.content[1:]
+	return 1, nil
+}
+
+func TestNewLocalStore_WriteObjectWithDeadline(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "", true)
+	require.NoError(t, err)
+
+	start := time.Now()
+	err = WriteObjectWithDeadline(ctx, store, "slow", &slowReader{content: bytes.Repeat([]byte("a"), 100), delay: 10 * time.Millisecond}, time.Now().Add(50*time.Millisecond))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	exists, err := store.FileExists(ctx, "slow")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "no partial file should be left behind")
+
+	require.NoError(t, WriteObjectWithDeadline(ctx, store, "fast", strings.NewReader("content"), time.Now().Add(time.Minute)))
+	content, err := ReadObjectString(ctx, store, "fast")
+	require.NoError(t, err)
+	assert.Equal(t, "content", content)
+}
+
+func TestNewLocalStore_WithPostWriteHook(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	var written []string
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "", true, WithPostWriteHook(func(ctx context.Context, name string, attrs *ObjectAttributes) {
+		// The object is in place when the hook runs
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(7), attrs.Size)
+
+		written = append(written, name)
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, WriteObjectString(ctx, store, "file", "content"))
+	assert.Error(t, store.WriteObject(ctx, "failed", &failingReader{content: strings.NewReader("partial"), err: errors.New("read failure")}))
+
+	assert.Equal(t, []string{"file"}, written)
+}
+
+func TestNewLocalStore_WithLocalSkipDecompressionIfPlain(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "gzip", false, WithLocalSkipDecompressionIfPlain())
+	require.NoError(t, err)
+
+	require.NoError(t, WriteObjectString(ctx, store, "compressed", "compressed content"))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "plain"), []byte("gunzipped by hand"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tiny"), []byte("x"), 0644))
+
+	for name, expected := range map[string]string{"compressed": "compressed content", "plain": "gunzipped by hand", "tiny": "x"} {
+		content, err := ReadObjectString(ctx, store, name)
+		require.NoError(t, err, name)
+		assert.Equal(t, expected, content, name)
+	}
+
+	strict, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "gzip", false)
+	require.NoError(t, err)
+
+	_, err = ReadObjectString(ctx, strict, "plain")
+	assert.Error(t, err, "without the option, a plain file fails to decompress")
+}
+
+func TestNewLocalStore_ObjectMetadata(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "dbin", "zstd", true)
+	require.NoError(t, err)
+
+	require.NoError(t, WriteObjectString(ctx, store, "0000/file", "content"))
+	require.NoError(t, SetObjectMetadata(ctx, store, "0000/file", map[string]string{"producer_version": "1.2.0", "schema_id": "7"}))
+	require.NoError(t, SetObjectMetadata(ctx, store, "0000/file", map[string]string{"schema_id": "8"}))
+
+	md, err := GetObjectMetadata(ctx, store, "0000/file")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"producer_version": "1.2.0", "schema_id": "8"}, md)
+
+	_, err = os.Stat(filepath.Join(dir, "0000", "file.dbin"+localMetadataSuffix))
+	require.NoError(t, err, "metadata is kept in a sidecar file")
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0000/file"}, files, "sidecar files are not walked")
+
+	plain, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "", true)
+	require.NoError(t, err)
+	require.NoError(t, WriteObjectString(ctx, plain, "notes.meta.json", "{}"))
+
+	files, err = plain.ListFiles(ctx, "notes", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"notes.meta.json"}, files, "objects named like sidecar files are walked")
+
+	_, err = GetObjectMetadata(ctx, store, "0000/missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, store.DeleteObject(ctx, "0000/file"))
+	_, err = os.Stat(filepath.Join(dir, "0000", "file.dbin"+localMetadataSuffix))
+	assert.True(t, os.IsNotExist(err), "the sidecar file is deleted with the object")
+}
+
+func TestNewLocalStore_WithKeySeparator(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "", false, WithKeySeparator("-"))
+	require.NoError(t, err)
+
+	require.NoError(t, store.WriteObject(ctx, "a/b/c", strings.NewReader("abc")))
+	require.NoError(t, store.WriteObject(ctx, "a/d", strings.NewReader("ad")))
+	require.NoError(t, store.WriteObject(ctx, "e", strings.NewReader("e")))
+
+	assert.Equal(t, filepath.Join(dir, "a-b-c"), store.ObjectPath("a/b/c"))
+	content, err := os.ReadFile(filepath.Join(dir, "a-b-c"))
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(content))
+
+	files, err := store.ListFiles(ctx, "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/b/c", "a/d", "e"}, files)
+
+	files, err = store.ListFiles(ctx, "a/b/", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/b/c"}, files)
+
+	files, err = store.ListFiles(ctx, "a/", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/b/c", "a/d"}, files)
+
+	read, err := ReadObjectString(ctx, store, "a/b/c")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", read)
+
+	prefixes, err := store.ListSubPrefixes(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/"}, prefixes)
+
+	prefixes, err = store.ListSubPrefixes(ctx, "a/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/b/"}, prefixes)
+
+	_, err = store.SubStore("a")
+	assert.ErrorIs(t, err, ErrNotSupported)
+}
+
+func TestNewLocalStore_WithExistenceBloomHint_SubStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := NewLocalStore(&url.URL{Scheme: "file", Path: dir}, "", "", false, WithExistenceBloomHint(time.Minute))
+	require.NoError(t, err)
+	require.NoError(t, store.WriteObject(ctx, "sub/file", strings.NewReader("content")))
+
+	sub, err := store.SubStore("sub")
+	require.NoError(t, err)
+
+	// Each store has its own filter, built from its own listing, objects written through one
+	// store are added to the filters of the other
+	exists, err := sub.FileExists(ctx, "file")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = store.FileExists(ctx, "sub/file")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Len(t, store.existenceBloom.filters, 2)
+
+	require.NoError(t, sub.WriteObject(ctx, "later", strings.NewReader("content")))
+	exists, err = store.FileExists(ctx, "sub/later")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
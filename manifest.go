@@ -0,0 +1,411 @@
+package dstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// manifestUpdateBatchSize is the number of changes, files written or deleted, a
+// `ManifestAcceleratedStore` updating its manifest on writes holds before rewriting it
+const manifestUpdateBatchSize = 256
+
+// NewManifestAcceleratedStore wraps `inner` so that walks, and the listings built on them, are
+// served from the manifest object `manifestName` of `inner` when present, instead of listing
+// `inner`. The manifest holds the name of each file of the store, one per line, as written by
+// producers of stores too large to be listed efficiently. When the manifest is missing, or older
+// than `maxAge` (0 never considering it stale), walks fall back to listing `inner`. The manifest
+// itself is never walked.
+//
+// The manifest is only as consistent as its producer keeps it: files written, or deleted, since
+// it was last updated are respectively missing from, or still yielded by, walks served from it.
+// `maxAge` bounds that lag when the manifest is refreshed periodically.
+//
+// With `updateOnWrite`, the files written, and deleted, through the returned store are added to,
+// and removed from, its manifest when it exists. The changes are batched, walks of the store
+// seeing them right away, the manifest being rewritten once enough of them accumulated and on
+// `FlushManifest`, failures to rewrite it being logged and retried with the next batch rather
+// than failing the write. Updates are serialized within the store only, concurrent writers of
+// the same manifest can lose each other's updates. The inner store must allow overwrites.
+func NewManifestAcceleratedStore(inner Store, manifestName string, maxAge time.Duration, updateOnWrite bool) *ManifestAcceleratedStore {
+	return &ManifestAcceleratedStore{
+		Store:         inner,
+		manifestName:  manifestName,
+		maxAge:        maxAge,
+		updateOnWrite: updateOnWrite,
+		pending:       map[string]bool{},
+	}
+}
+
+type ManifestAcceleratedStore struct {
+	Store
+
+	manifestName  string
+	maxAge        time.Duration
+	updateOnWrite bool
+
+	lock            sync.Mutex
+	pending         map[string]bool // by file name, true when written and false when deleted since the last manifest update
+	pendingPrefixes []string        // deleted since the last manifest update, applied before `pending`
+}
+
+// RefreshManifest writes the manifest from a listing of the inner store, creating it if missing.
+func (s *ManifestAcceleratedStore) RefreshManifest(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var names []string
+	err := s.Store.Walk(ctx, "", func(filename string) error {
+		if filename != s.manifestName {
+			names = append(names, filename)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing files: %w", err)
+	}
+
+	if err := s.writeManifest(ctx, names); err != nil {
+		return err
+	}
+
+	// The listing holds the changes made so far
+	s.clearPending()
+	return nil
+}
+
+// FlushManifest writes to the manifest the changes of the files written and deleted through the
+// store not written to it yet, see `NewManifestAcceleratedStore`. A missing manifest is left
+// missing.
+func (s *ManifestAcceleratedStore) FlushManifest(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.flushPending(ctx)
+}
+
+func (s *ManifestAcceleratedStore) Walk(ctx context.Context, prefix string, f func(filename string) (err error)) error {
+	names, found, err := s.readManifest(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return s.Store.Walk(ctx, prefix, func(filename string) error {
+			if filename == s.manifestName {
+				return nil
+			}
+			return f(filename)
+		})
+	}
+
+	s.lock.Lock()
+	names = s.applyPending(names)
+	s.lock.Unlock()
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := f(name); err != nil {
+			if errors.Is(err, StopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ManifestAcceleratedStore) WalkFrom(ctx context.Context, prefix, startingPoint string, f func(filename string) (err error)) error {
+	return commonWalkFrom(s, ctx, prefix, startingPoint, f)
+}
+
+func (s *ManifestAcceleratedStore) ListFiles(ctx context.Context, prefix string, max int) ([]string, error) {
+	return listFiles(ctx, s, prefix, max)
+}
+
+func (s *ManifestAcceleratedStore) OpenObjectWithCompression(ctx context.Context, name string, compressionType string) (io.ReadCloser, error) {
+	return OpenObjectWithCompression(ctx, s.Store, name, compressionType)
+}
+
+func (s *ManifestAcceleratedStore) OpenObjectIfModifiedSince(ctx context.Context, name string, since time.Time) (io.ReadCloser, bool, error) {
+	return OpenObjectIfModifiedSince(ctx, s.Store, name, since)
+}
+
+func (s *ManifestAcceleratedStore) DownloadTo(ctx context.Context, name string, w io.Writer) (int64, error) {
+	return DownloadTo(ctx, s.Store, name, w)
+}
+
+func (s *ManifestAcceleratedStore) PeekObject(ctx context.Context, name string, n int) ([]byte, error) {
+	return PeekObject(ctx, s.Store, name, n)
+}
+
+func (s *ManifestAcceleratedStore) WriteFrom(ctx context.Context, base string, src Store, srcName string) error {
+	// Goes through this store's `CopyObject` or `WriteObject`, which update the manifest
+	return writeFrom(ctx, s, base, src, srcName)
+}
+
+func (s *ManifestAcceleratedStore) WriteObject(ctx context.Context, base string, f io.Reader) error {
+	return s.written(ctx, s.Store.WriteObject(ctx, base, f), base)
+}
+
+func (s *ManifestAcceleratedStore) WriteObjectSized(ctx context.Context, base string, f io.Reader, size int64) error {
+	return s.written(ctx, WriteObjectSized(ctx, s.Store, base, f, size), base)
+}
+
+func (s *ManifestAcceleratedStore) UploadFrom(ctx context.Context, base string, r io.ReaderAt, size int64) error {
+	return s.written(ctx, UploadFrom(ctx, s.Store, base, r, size), base)
+}
+
+func (s *ManifestAcceleratedStore) WriteObjectSeekable(ctx context.Context, base string, rs io.ReadSeeker) error {
+	return s.written(ctx, WriteObjectSeekable(ctx, s.Store, base, rs), base)
+}
+
+func (s *ManifestAcceleratedStore) PushLocalFile(ctx context.Context, localFile, toBaseName string) error {
+	return s.written(ctx, s.Store.PushLocalFile(ctx, localFile, toBaseName), toBaseName)
+}
+
+func (s *ManifestAcceleratedStore) CopyObject(ctx context.Context, src, dest string) error {
+	return s.written(ctx, s.Store.CopyObject(ctx, src, dest), dest)
+}
+
+func (s *ManifestAcceleratedStore) Touch(ctx context.Context, base string) error {
+	return Touch(ctx, s.Store, base)
+}
+
+func (s *ManifestAcceleratedStore) SetObjectMetadata(ctx context.Context, base string, md map[string]string) error {
+	return SetObjectMetadata(ctx, s.Store, base, md)
+}
+
+func (s *ManifestAcceleratedStore) GetObjectMetadata(ctx context.Context, base string) (map[string]string, error) {
+	return GetObjectMetadata(ctx, s.Store, base)
+}
+
+func (s *ManifestAcceleratedStore) DeleteObject(ctx context.Context, base string) error {
+	err := s.Store.DeleteObject(ctx, base)
+	if err != nil || !s.updateOnWrite || base == s.manifestName {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pending[base] = false
+	s.flushPendingIfFull(ctx)
+	return nil
+}
+
+func (s *ManifestAcceleratedStore) DeleteObjectsUnderPrefix(ctx context.Context, prefix string, force bool) (int, error) {
+	deleted, err := DeleteObjectsUnderPrefix(ctx, s.Store, prefix, force)
+	if err != nil || !s.updateOnWrite || strings.HasPrefix(s.manifestName, prefix) {
+		// The manifest itself is gone when under the prefix
+		return deleted, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for name := range s.pending {
+		if strings.HasPrefix(name, prefix) {
+			delete(s.pending, name)
+		}
+	}
+	s.pendingPrefixes = append(s.pendingPrefixes, prefix)
+	s.flushPendingIfFull(ctx)
+	return deleted, nil
+}
+
+func (s *ManifestAcceleratedStore) SubStore(subFolder string) (Store, error) {
+	sub, err := s.Store.SubStore(subFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	// The sub-store is walked from its own manifest, if any
+	return NewManifestAcceleratedStore(sub, s.manifestName, s.maxAge, s.updateOnWrite), nil
+}
+
+// written adds `base` to the manifest changes after a successful write, when updating the
+// manifest on writes
+func (s *ManifestAcceleratedStore) written(ctx context.Context, err error, base string) error {
+	if err != nil || !s.updateOnWrite || base == s.manifestName {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pending[base] = true
+	s.flushPendingIfFull(ctx)
+	return nil
+}
+
+// flushPendingIfFull writes the pending changes to the manifest once `manifestUpdateBatchSize`
+// of them accumulated, keeping them for the next attempt on failure. The lock must be held.
+func (s *ManifestAcceleratedStore) flushPendingIfFull(ctx context.Context) {
+	if len(s.pending)+len(s.pendingPrefixes) < manifestUpdateBatchSize {
+		return
+	}
+
+	if err := s.flushPending(ctx); err != nil {
+		zlog.Warn("unable to update manifest, retrying with the next changes", zap.String("manifest", s.manifestName), zap.Error(err))
+	}
+}
+
+// flushPending rewrites the manifest with the pending changes applied, leaving a missing
+// manifest missing as it can't be created from the names of the files written. The lock must be
+// held.
+func (s *ManifestAcceleratedStore) flushPending(ctx context.Context) error {
+	if len(s.pending) == 0 && len(s.pendingPrefixes) == 0 {
+		return nil
+	}
+
+	reader, err := s.Store.OpenObject(ctx, s.manifestName)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			s.clearPending()
+			return nil
+		}
+		return fmt.Errorf("opening manifest %q: %w", s.manifestName, err)
+	}
+
+	content, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return fmt.Errorf("reading manifest %q: %w", s.manifestName, err)
+	}
+
+	var names []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	if err := s.writeManifest(ctx, s.applyPending(names)); err != nil {
+		return err
+	}
+
+	s.clearPending()
+	return nil
+}
+
+// applyPending returns the sorted `names` of the manifest with the pending changes applied. The
+// lock must be held.
+func (s *ManifestAcceleratedStore) applyPending(names []string) []string {
+	if len(s.pending) == 0 && len(s.pendingPrefixes) == 0 {
+		return names
+	}
+
+	out := make([]string, 0, len(names)+len(s.pending))
+	for _, name := range names {
+		if _, changed := s.pending[name]; changed || hasAnyPrefix(name, s.pendingPrefixes) {
+			continue
+		}
+		out = append(out, name)
+	}
+	for name, written := range s.pending {
+		if written {
+			out = append(out, name)
+		}
+	}
+	return sortedUniqueNames(out)
+}
+
+func (s *ManifestAcceleratedStore) clearPending() {
+	s.pending = map[string]bool{}
+	s.pendingPrefixes = nil
+}
+
+// readManifest returns the sorted names of the manifest, `found` being false when it's missing
+// or stale
+func (s *ManifestAcceleratedStore) readManifest(ctx context.Context) (names []string, found bool, err error) {
+	if s.maxAge > 0 {
+		attrs, err := s.Store.ObjectAttributes(ctx, s.manifestName)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return nil, false, nil
+			}
+			return nil, false, fmt.Errorf("reading attributes of manifest %q: %w", s.manifestName, err)
+		}
+
+		if time.Since(attrs.LastModified) > s.maxAge {
+			zlog.Debug("manifest is stale, listing store")
+			return nil, false, nil
+		}
+	}
+
+	reader, err := s.Store.OpenObject(ctx, s.manifestName)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("opening manifest %q: %w", s.manifestName, err)
+	}
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" {
+			names = append(names, name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, fmt.Errorf("reading manifest %q: %w", s.manifestName, err)
+	}
+
+	return sortedUniqueNames(names), true, nil
+}
+
+func (s *ManifestAcceleratedStore) writeManifest(ctx context.Context, names []string) error {
+	if configured, ok := s.Store.(interface{ commonConfig() *commonStore }); ok && !configured.commonConfig().overwrite {
+		return fmt.Errorf("writing manifest %q: inner store does not allow overwrites: %w", s.manifestName, ErrNotSupported)
+	}
+
+	names = sortedUniqueNames(names)
+	content := strings.Join(names, "\n")
+	if len(names) > 0 {
+		content += "\n"
+	}
+
+	if err := s.Store.WriteObject(ctx, s.manifestName, strings.NewReader(content)); err != nil {
+		return fmt.Errorf("writing manifest %q: %w", s.manifestName, err)
+	}
+	return nil
+}
+
+func sortedUniqueNames(names []string) []string {
+	sort.Strings(names)
+
+	out := names[:0]
+	for _, name := range names {
+		if len(out) > 0 && name == out[len(out)-1] {
+			continue
+		}
+		out = append(out, name)
+	}
+	return out
+}
+
+func hasAnyPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package dstore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifestAcceleratedStore_ManifestPresent(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestMemoryStore(t, "a/1", "a/2", "b/1")
+	require.NoError(t, inner.WriteObject(ctx, "manifest", strings.NewReader("b/1\na/2\n\na/1\na/3\n")))
+
+	recording := NewRecordingStore(inner)
+	store := NewManifestAcceleratedStore(recording, "manifest", 0, false)
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/1", "a/2", "a/3", "b/1"}, files, "files should be the sorted ones of the manifest, even when lagging")
+
+	files, err = store.ListFiles(ctx, "a/", 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/1", "a/2"}, files)
+
+	var walked []string
+	require.NoError(t, store.WalkFrom(ctx, "a/", "a/2", func(filename string) error {
+		walked = append(walked, filename)
+		return nil
+	}))
+	assert.Equal(t, []string{"a/2", "a/3"}, walked)
+
+	assert.Equal(t, 0, recording.Count("Walk"), "the store should not be listed")
+	assert.Equal(t, 3, recording.Count("OpenObject"))
+}
+
+func TestManifestAcceleratedStore_ManifestAbsent(t *testing.T) {
+	ctx := context.Background()
+	recording := NewRecordingStore(newTestMemoryStore(t, "a/1", "a/2", "b/1"))
+	store := NewManifestAcceleratedStore(recording, "manifest", 0, false)
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/1", "a/2", "b/1"}, files)
+	assert.Equal(t, 1, recording.Count("Walk"), "the store should be listed")
+}
+
+func TestManifestAcceleratedStore_ManifestStale(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestMemoryStore(t, "a/1", "a/2")
+	require.NoError(t, inner.WriteObject(ctx, "manifest", strings.NewReader("a/1\n")))
+	inner.modified["manifest"] = time.Now().Add(-2 * time.Hour)
+
+	recording := NewRecordingStore(inner)
+	store := NewManifestAcceleratedStore(recording, "manifest", time.Hour, false)
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/1", "a/2"}, files, "the manifest itself should not be walked")
+	assert.Equal(t, 1, recording.Count("Walk"))
+
+	store = NewManifestAcceleratedStore(recording, "manifest", 3*time.Hour, false)
+	files, err = store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/1"}, files, "a fresh manifest should be used")
+	assert.Equal(t, 1, recording.Count("Walk"))
+}
+
+func TestManifestAcceleratedStore_UpdateOnWrite(t *testing.T) {
+	ctx := context.Background()
+	inner, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "", true)
+	require.NoError(t, err)
+
+	store := NewManifestAcceleratedStore(inner, "manifest", 0, true)
+
+	// Without manifest, writes don't create one
+	require.NoError(t, store.WriteObject(ctx, "a/1", strings.NewReader("1")))
+	exists, err := inner.FileExists(ctx, "manifest")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, store.RefreshManifest(ctx))
+	content, err := ReadObjectString(ctx, inner, "manifest")
+	require.NoError(t, err)
+	assert.Equal(t, "a/1\n", content)
+
+	require.NoError(t, store.WriteObject(ctx, "b/1", strings.NewReader("1")))
+	require.NoError(t, store.CopyObject(ctx, "a/1", "a/2"))
+	require.NoError(t, store.DeleteObject(ctx, "a/1"))
+
+	// Walks see the changes before they are written to the manifest
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a/2", "b/1"}, files)
+
+	content, err = ReadObjectString(ctx, inner, "manifest")
+	require.NoError(t, err)
+	assert.Equal(t, "a/1\n", content, "changes should be batched")
+
+	require.NoError(t, store.FlushManifest(ctx))
+	content, err = ReadObjectString(ctx, inner, "manifest")
+	require.NoError(t, err)
+	assert.Equal(t, "a/2\nb/1\n", content)
+
+	// The manifest is rewritten once a batch of changes accumulated
+	for i := 0; i < manifestUpdateBatchSize; i++ {
+		require.NoError(t, store.WriteObject(ctx, fmt.Sprintf("c/%04d", i), strings.NewReader("1")))
+	}
+	_, err = DeleteObjectsUnderPrefix(ctx, store, "a/", true)
+	require.NoError(t, err)
+	content, err = ReadObjectString(ctx, inner, "manifest")
+	require.NoError(t, err)
+	assert.Equal(t, manifestUpdateBatchSize+2, strings.Count(content, "\n"))
+
+	files, err = store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Len(t, files, manifestUpdateBatchSize+1)
+	assert.Equal(t, "b/1", files[0])
+
+	readOnly := NewManifestAcceleratedStore(newTestMemoryStore(t), "manifest", 0, false)
+	assert.ErrorIs(t, readOnly.RefreshManifest(ctx), ErrNotSupported, "manifest can't be refreshed without overwrites")
+}
+
+func TestManifestAcceleratedStore_UpdateFailureKeepsWrite(t *testing.T) {
+	ctx := context.Background()
+
+	// Without overwrites, the manifest can't be rewritten
+	inner := newTestMemoryStore(t)
+	require.NoError(t, inner.WriteObject(ctx, "manifest", strings.NewReader("")))
+	store := NewManifestAcceleratedStore(inner, "manifest", 0, true)
+
+	for i := 0; i < manifestUpdateBatchSize; i++ {
+		require.NoError(t, store.WriteObject(ctx, fmt.Sprintf("a/%04d", i), strings.NewReader("1")), "manifest failures should not fail writes")
+	}
+	assert.ErrorIs(t, store.FlushManifest(ctx), ErrNotSupported)
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Len(t, files, manifestUpdateBatchSize, "changes should be kept for the next update")
+}
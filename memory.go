@@ -3,10 +3,12 @@ package dstore
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -21,72 +23,245 @@ type MemoryStore struct {
 
 	data     map[string][]byte
 	modified map[string]time.Time
+	metadata map[string]map[string]string
 
 	lock sync.RWMutex
 }
 
 func (m *MemoryStore) OpenObject(ctx context.Context, name string) (out io.ReadCloser, err error) {
+	return m.openObject(ctx, name, m.compressionType, true)
+}
+
+func (m *MemoryStore) OpenObjectIfModifiedSince(ctx context.Context, name string, since time.Time) (io.ReadCloser, bool, error) {
+	m.lock.RLock()
+	modified, found := m.modified[m.key(name)]
+	m.lock.RUnlock()
+
+	if found && !modified.After(since) {
+		return nil, false, nil
+	}
+
+	return openedIfModified(m.OpenObject(ctx, name))
+}
+
+func (m *MemoryStore) OpenObjectWithCompression(ctx context.Context, name string, compressionType string) (out io.ReadCloser, err error) {
+	return m.openObject(ctx, name, compressionType, false)
+}
+
+// openObject opens the object, decoding it with the compression recorded in its metadata, if
+// any, instead of `compressionType` when `detectCompression` is set, see
+// `WithCompressionDetectionOnWrite`.
+func (m *MemoryStore) openObject(ctx context.Context, name string, compressionType string, detectCompression bool) (out io.ReadCloser, err error) {
+	ctx = withFileName(ctx, m.ObjectPath(name))
+	ctx = withStoreType(ctx, "memory")
+
+	if err := m.operationErr(ctx); err != nil {
+		return nil, err
+	}
+
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	if _, ok := m.data[name]; !ok {
+	key := m.key(name)
+	data, ok := m.data[key]
+	if !ok {
 		return nil, ErrNotFound
 	}
 
-	reader := io.NopCloser(bytes.NewReader(m.data[name]))
-	out, err = m.uncompressedReader(ctx, reader)
+	if detectCompression && m.compressionDetection {
+		compressionType = detectedCompression(m.metadata[key], CompressionMetadataKey, compressionType)
+	}
+
+	reader := m.cancellableReadCloser(ctx, io.NopCloser(bytes.NewReader(data)))
+	out, err = m.uncompressedReaderWith(ctx, m.sizeValidatedReader(reader, int64(len(data))), compressionType)
 	return
 }
 
+// OpenObjectSeekable opens the object for random access, only supported when the store is
+// not compressed.
+func (m *MemoryStore) OpenObjectSeekable(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	if m.compressionType != "" {
+		return nil, fmt.Errorf("seeking %s compressed objects: %w", m.compressionType, ErrNotSupported)
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	data, ok := m.data[m.key(name)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return m.seekableReader(ctx, nopSeekCloser{bytes.NewReader(data)}), nil
+}
+
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
 func (m *MemoryStore) WriteObject(ctx context.Context, base string, f io.Reader) (err error) {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+	ctx = withFileName(ctx, base)
+	ctx = withStoreType(ctx, "memory")
 
-	if _, exists := m.data[base]; !m.overwrite && exists {
-		return nil
+	if err := m.ensureWritable(); err != nil {
+		return err
+	}
+	if err := m.operationErr(ctx); err != nil {
+		return err
 	}
 
-	w := bytes.NewBuffer(nil)
-	if err := m.compressedCopy(ctx, w, f); err != nil {
+	attrs, stats, err := m.writeObject(ctx, base, m.cancellableSource(ctx, f))
+	if err != nil {
 		return err
 	}
 
-	m.data[base] = w.Bytes()
-	m.modified[base] = time.Now()
+	// Callbacks are invoked without the lock held, they may use the store
+	if attrs == nil {
+		m.reportOverwriteSkip(ctx, base)
+		return nil
+	}
 
+	m.reportWriteStats(ctx, stats)
+	m.reportWritten(ctx, base, m.ObjectURL(base), func(context.Context, string) (*ObjectAttributes, error) { return attrs, nil })
 	return nil
 }
 
-func (m *MemoryStore) FileExists(_ context.Context, base string) (bool, error) {
+// writeObject stores the object, returning its attributes or nil if the write was skipped. The
+// content is compressed without the lock held, the write callbacks invoked meanwhile may use the
+// store.
+func (m *MemoryStore) writeObject(ctx context.Context, base string, f io.Reader) (attrs *ObjectAttributes, stats writeStats, err error) {
+	key := m.key(base)
+	if !m.overwrite && m.exists(key) {
+		return nil, stats, nil
+	}
+
+	f, err = m.nonEmptySource(f)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	w := bytes.NewBuffer(nil)
+	stats, err = m.compressedCopyWithStats(ctx, w, f)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, exists := m.data[key]; !m.overwrite && exists {
+		// Written concurrently meanwhile
+		return nil, stats, nil
+	}
+
+	now := time.Now()
+	m.data[key] = w.Bytes()
+	m.modified[key] = now
+	delete(m.metadata, key)
+	if metadata := m.compressionMetadata(ctx, CompressionMetadataKey); metadata != nil {
+		m.metadata[key] = metadata
+	}
+
+	return &ObjectAttributes{LastModified: m.clampedMTime(base, now), Size: int64(len(w.Bytes()))}, stats, nil
+}
+
+func (m *MemoryStore) WriteObjectSeekable(ctx context.Context, base string, rs io.ReadSeeker) error {
+	return writeObjectSeekable(ctx, m, base, rs, nil, m.observeRetry)
+}
+
+func (m *MemoryStore) FileExists(ctx context.Context, base string) (bool, error) {
+	if m.existenceBloom.definitelyAbsent(ctx, m, base) {
+		return false, nil
+	}
+
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	_, exists := m.data[base]
+	_, exists := m.data[m.key(base)]
 	return exists, nil
 }
 
+// exists returns true if an object is kept under `key`.
+func (m *MemoryStore) exists(key string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	_, exists := m.data[key]
+	return exists
+}
+
+// key returns the key under which the object `base` is kept, its `ObjectPath` like the object
+// keys of the other stores: under the base path, sharded or transformed, flattened by the key
+// separator and with the store's extension, as configured.
+func (m *MemoryStore) key(base string) string {
+	return m.ObjectPath(base)
+}
+
+// toBaseName reverses `key`, `found` being false when `key` is not the key of any object name
+// of the store.
+func (m *MemoryStore) toBaseName(key string) (name string, found bool) {
+	basePath := strings.Trim(m.baseURL.Path, "/")
+	if basePath != "" {
+		if !strings.HasPrefix(key, basePath+"/") {
+			return "", false
+		}
+		key = strings.TrimPrefix(key, basePath+"/")
+	}
+
+	name = strings.TrimSuffix(m.unflatKey(key), m.pathWithExt(""))
+	if m.isSharded() {
+		return m.unshardedName(name)
+	}
+	return name, true
+}
+
 func (m *MemoryStore) ObjectPath(name string) string {
-	return path.Join(strings.TrimLeft(m.baseURL.Path, "/"), m.pathWithExt(name))
+	return path.Join(strings.TrimLeft(m.baseURL.Path, "/"), m.shardedPathWithExt(name))
 }
 
 func (m *MemoryStore) ObjectURL(name string) string {
-	return fmt.Sprintf("%s/%s", strings.TrimRight(m.baseURL.String(), "/"), strings.TrimLeft(m.pathWithExt(name), "/"))
+	return objectURL(m.baseURL, m.shardedPathWithExt(name))
+}
+
+func (m *MemoryStore) SupportsConcurrentWrites() bool {
+	return true
 }
 
 func (m *MemoryStore) ObjectAttributes(_ context.Context, base string) (*ObjectAttributes, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	if !m.modified[base].IsZero() {
+	key := m.key(base)
+	if !m.modified[key].IsZero() {
 		return &ObjectAttributes{
-			LastModified: m.modified[base],
-			Size:         int64(len(m.data[base])),
+			LastModified: m.clampedMTime(base, m.modified[key]),
+			Size:         int64(len(m.data[key])),
 		}, nil
 	}
 
 	return nil, ErrNotFound
 }
 
+func (m *MemoryStore) readRange(_ context.Context, name string, offset, length int64) ([]byte, string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	key := m.key(name)
+	if m.modified[key].IsZero() {
+		return nil, "", ErrNotFound
+	}
+
+	content := m.data[key]
+	start, end := clampRange(offset, len(content)), clampRange(offset+length, len(content))
+	return append([]byte(nil), content[start:end]...), m.recordedCompression(m.metadata[key], CompressionMetadataKey), nil
+}
+
+func (m *MemoryStore) WriteFrom(ctx context.Context, base string, src Store, srcName string) error {
+	return writeFrom(ctx, m, base, src, srcName)
+}
+
 func (m *MemoryStore) PushLocalFile(ctx context.Context, localFile, toBaseName string) (err error) {
 	remove, err := pushLocalFile(ctx, m, localFile, toBaseName)
 	if err != nil {
@@ -99,32 +274,143 @@ func (m *MemoryStore) CopyObject(_ context.Context, src, dest string) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	if _, ok := m.data[src]; !ok {
+	data, ok := m.data[m.key(src)]
+	if !ok {
+		return ErrNotFound
+	}
+
+	m.data[m.key(dest)] = data
+	m.modified[m.key(dest)] = time.Now()
+	delete(m.metadata, m.key(dest))
+	m.existenceBloom.add(m.ObjectURL(dest))
+	return nil
+}
+
+func (m *MemoryStore) Touch(_ context.Context, base string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := m.key(base)
+	if _, ok := m.data[key]; !ok {
+		return ErrNotFound
+	}
+
+	m.modified[key] = time.Now()
+	return nil
+}
+
+func (m *MemoryStore) SetObjectMetadata(_ context.Context, base string, md map[string]string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := m.key(base)
+	if _, ok := m.data[key]; !ok {
 		return ErrNotFound
 	}
 
-	m.data[dest] = m.data[src]
+	metadata := map[string]string{}
+	for k, v := range m.metadata[key] {
+		metadata[k] = v
+	}
+	for k, v := range md {
+		metadata[k] = v
+	}
+	m.metadata[key] = metadata
 	return nil
 }
 
-func (m *MemoryStore) WalkFrom(_ context.Context, prefix, startingPoint string, f func(filename string) (err error)) error {
-	panic("not yet supported for this store type")
+func (m *MemoryStore) GetObjectMetadata(_ context.Context, base string) (map[string]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	key := m.key(base)
+	if _, ok := m.data[key]; !ok {
+		return nil, ErrNotFound
+	}
+
+	md := map[string]string{}
+	for k, v := range m.metadata[key] {
+		md[k] = v
+	}
+	return md, nil
+}
+
+func (m *MemoryStore) WalkFrom(ctx context.Context, prefix, startingPoint string, f func(filename string) (err error)) error {
+	return commonWalkFrom(m, ctx, prefix, startingPoint, f)
 }
 
 func (m *MemoryStore) Walk(ctx context.Context, prefix string, f func(filename string) (err error)) error {
-	panic("not yet supported for this store type")
+	return m.walkWithAttributes(ctx, prefix, func(file FileWithAttrs) error {
+		return f(file.Name)
+	})
+}
+
+func (m *MemoryStore) walkWithAttributes(ctx context.Context, prefix string, f func(file FileWithAttrs) error) error {
+	m.lock.RLock()
+	var files []FileWithAttrs
+	for key, content := range m.data {
+		name, found := m.toBaseName(key)
+		if found && strings.HasPrefix(name, prefix) {
+			files = append(files, FileWithAttrs{Name: name, ObjectAttributes: ObjectAttributes{
+				Size:         int64(len(content)),
+				LastModified: m.clampedMTime(name, m.modified[key]),
+			}})
+		}
+	}
+	m.lock.RUnlock()
+
+	// The lock is released before invoking the callback so that it's free to operate on the store
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	progress := m.newWalkProgress(ctx)
+	defer progress.flush()
+
+	for _, file := range files {
+		if err := m.operationErr(ctx); err != nil {
+			return err
+		}
+
+		progress.fileSeen()
+		if err := f(file); err != nil {
+			if errors.Is(err, StopIteration) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
 }
 
 func (m *MemoryStore) ListFiles(ctx context.Context, prefix string, max int) ([]string, error) {
-	panic("not yet supported for this store type")
+	return listFiles(ctx, m, prefix, max)
+}
+
+func (m *MemoryStore) ListSubPrefixes(_ context.Context, prefix string) ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	names := make([]string, 0, len(m.data))
+	for key := range m.data {
+		if name, found := m.toBaseName(key); found {
+			names = append(names, name)
+		}
+	}
+
+	return subPrefixesOf(names, prefix), nil
 }
 
 func (m *MemoryStore) DeleteObject(ctx context.Context, base string) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	delete(m.data, base)
-	delete(m.modified, base)
+	key := m.key(base)
+	if _, exists := m.data[key]; !exists {
+		return m.deleteResult(ErrNotFound)
+	}
+
+	delete(m.data, key)
+	delete(m.modified, key)
+	delete(m.metadata, key)
 	return nil
 }
 
@@ -133,27 +419,41 @@ func (m *MemoryStore) BaseURL() *url.URL {
 }
 
 func (m *MemoryStore) SubStore(subFolder string) (Store, error) {
+	if err := m.subStoreErr(subFolder); err != nil {
+		return nil, err
+	}
+
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	newFiles := map[string][]byte{}
-	newModified := map[string]time.Time{}
+	// The sub store holds a copy of the objects under the same base URL, the existence bloom
+	// hint of the parent store cannot answer for it
+	common := *m.commonStore
+	common.existenceBloom = newExistenceBloom(m.existenceBloom != nil, m.existenceBloom.maxAgeOrZero())
 
-	for k, v := range m.data {
-		if !strings.HasPrefix(k, subFolder) {
+	sub := &MemoryStore{
+		commonStore: &common,
+		baseURL:     m.baseURL,
+		data:        map[string][]byte{},
+		modified:    map[string]time.Time{},
+		metadata:    map[string]map[string]string{},
+	}
+
+	for key, content := range m.data {
+		name, found := m.toBaseName(key)
+		if !found || !strings.HasPrefix(name, subFolder) {
 			continue
 		}
 
-		newFiles[strings.TrimPrefix(k, subFolder)] = v
-		newModified[strings.TrimPrefix(k, subFolder)] = m.modified[k]
+		subKey := sub.key(strings.TrimPrefix(name, subFolder))
+		sub.data[subKey] = content
+		sub.modified[subKey] = m.modified[key]
+		if md, found := m.metadata[key]; found {
+			sub.metadata[subKey] = md
+		}
 	}
 
-	return &MemoryStore{
-		commonStore: m.commonStore,
-		baseURL:     m.baseURL,
-		data:        newFiles,
-		modified:    newModified,
-	}, nil
+	return sub, nil
 }
 
 func (m *MemoryStore) Clone(ctx context.Context, opts ...Option) (Store, error) {
@@ -167,28 +467,59 @@ func (m *MemoryStore) Clone(ctx context.Context, opts ...Option) (Store, error)
 
 	ms.data = m.data
 	ms.modified = m.modified
+	ms.metadata = m.metadata
 
 	return ms, nil
 }
 
+func (m *MemoryStore) Rebase(ctx context.Context, baseURL string, opts ...Option) (Store, error) {
+	return m.rebase(ctx, baseURL, nil, opts)
+}
+
 func NewMemoryStore(baseURL *url.URL, extension, compressionType string, overwrite bool, opts ...Option) (*MemoryStore, error) {
 	return newMemoryStoreContext(context.Background(), baseURL, extension, compressionType, overwrite, opts...)
 }
 
-func newMemoryStoreContext(_ context.Context, baseURL *url.URL, extension, compressionType string, overwrite bool, opts ...Option) (*MemoryStore, error) {
+func newMemoryStoreContext(ctx context.Context, baseURL *url.URL, extension, compressionType string, overwrite bool, opts ...Option) (*MemoryStore, error) {
 	conf := config{}
 	for _, opt := range opts {
 		opt.apply(&conf)
 	}
+	if conf.err != nil {
+		return nil, conf.err
+	}
+	baseURL = withDefaultPrefix(baseURL, conf.defaultPrefix)
 
 	common := &commonStore{
 		compressionType:           compressionType,
 		extension:                 extension,
 		overwrite:                 overwrite,
+		skipDirectoryMarkers:      conf.skipDirectoryMarkers,
+		sizeValidation:            conf.sizeValidation,
+		listPageSize:              conf.listPageSize,
+		sharder:                   conf.sharder,
+		objectPathFunc:            conf.objectPathFunc,
+		keySeparator:              conf.keySeparator,
 		uncompressedReadCallback:  conf.uncompressedReadCallback,
 		compressedReadCallback:    conf.compressedReadCallback,
 		uncompressedWriteCallback: conf.uncompressedWriteCallback,
 		compressedWriteCallback:   conf.compressedWriteCallback,
+		writeStatsCallback:        conf.writeStatsCallback,
+		overwriteSkipCallback:     conf.overwriteSkipCallback,
+		baseContext:               conf.baseContextOr(ctx),
+		uploadBuffers:             conf.uploadBuffers,
+		keepLocalAfterPush:        conf.keepLocalAfterPush,
+		clampFutureMTimes:         conf.clampFutureMTimes,
+		errorOnEmptyWrite:         conf.errorOnEmptyWrite,
+		deleteIgnoreNotFound:      conf.deleteIgnoreNotFound,
+		walkProgressCallback:      conf.walkProgressCallback,
+		operationTimeout:          conf.operationTimeout,
+		existenceCache:            newExistenceCache(conf.existenceCacheTTL),
+		existenceBloom:            newExistenceBloom(conf.existenceBloomHint, conf.existenceBloomHintMaxAge),
+		zstdDecoders:              zstdDecoderPoolFor(conf.zstdDecoderConcurrency, conf.zstdMaxIdleDecoders),
+		postWriteHook:             conf.postWriteHook,
+		retryObserver:             conf.retryObserver,
+		compressionDetection:      conf.compressionDetection,
 	}
 
 	return &MemoryStore{
@@ -196,5 +527,6 @@ func newMemoryStoreContext(_ context.Context, baseURL *url.URL, extension, compr
 		baseURL:     baseURL,
 		data:        map[string][]byte{},
 		modified:    map[string]time.Time{},
+		metadata:    map[string]map[string]string{},
 	}, nil
 }
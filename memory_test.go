@@ -0,0 +1,934 @@
+package dstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMemoryStore(t *testing.T, files ...string) *MemoryStore {
+	t.Helper()
+
+	store, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "", false)
+	require.NoError(t, err)
+
+	for _, file := range files {
+		require.NoError(t, store.WriteObject(context.Background(), file, strings.NewReader(file)))
+	}
+
+	return store
+}
+
+func TestMemoryStore_DeleteObjectsUnderPrefix(t *testing.T) {
+	ctx := context.Background()
+	store := newTestMemoryStore(t, "0000/a", "0000/b", "0001/a", "other")
+
+	deleted, err := DeleteObjectsUnderPrefix(ctx, store, "0000/", false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	files, err := store.ListFiles(ctx, "", math.MaxInt64)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0001/a", "other"}, files)
+}
+
+func TestMemoryStore_DeleteObjectsUnderPrefix_EmptyPrefix(t *testing.T) {
+	ctx := context.Background()
+	store := newTestMemoryStore(t, "0000/a", "other")
+
+	_, err := DeleteObjectsUnderPrefix(ctx, store, "", false)
+	require.Error(t, err)
+
+	files, err := store.ListFiles(ctx, "", math.MaxInt64)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	deleted, err := DeleteObjectsUnderPrefix(ctx, store, "", true)
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	files, err = store.ListFiles(ctx, "", math.MaxInt64)
+	require.NoError(t, err)
+	assert.Len(t, files, 0)
+}
+
+func TestMemoryStore_OpenObjectSeekable(t *testing.T) {
+	store := newTestMemoryStore(t)
+	require.NoError(t, store.WriteObject(context.Background(), "file", strings.NewReader("0123456789")))
+
+	reader, err := store.OpenObjectSeekable(context.Background(), "file")
+	require.NoError(t, err)
+	defer reader.Close()
+
+	assertSeekRead(t, reader, 7, io.SeekStart, "789")
+	assertSeekRead(t, reader, 0, io.SeekStart, "01")
+	assertSeekRead(t, reader, 3, io.SeekCurrent, "56")
+
+	_, err = store.OpenObjectSeekable(context.Background(), "missing")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestMemoryStore_WithOverwriteSkipLogger(t *testing.T) {
+	ctx := context.Background()
+
+	var skipped []string
+	var skippedFromContext []string
+	store, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "", false, WithOverwriteSkipLogger(func(ctx context.Context, name string) {
+		skipped = append(skipped, name)
+		skippedFromContext = append(skippedFromContext, FileNameFromContext(ctx))
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, store.WriteObject(ctx, "file", strings.NewReader("first")))
+	assert.Empty(t, skipped)
+
+	require.NoError(t, store.WriteObject(ctx, "file", strings.NewReader("second")))
+	assert.Equal(t, []string{"file"}, skipped)
+	assert.Equal(t, []string{"file"}, skippedFromContext)
+
+	store.SetOverwrite(true)
+	require.NoError(t, store.WriteObject(ctx, "file", strings.NewReader("third")))
+	assert.Len(t, skipped, 1)
+}
+
+func TestMemoryStore_CallbacksUsingStore(t *testing.T) {
+	ctx := context.Background()
+
+	var store *MemoryStore
+	var existing []bool
+	useStore := func(ctx context.Context, name string) {
+		exists, err := store.FileExists(ctx, "file")
+		require.NoError(t, err)
+		existing = append(existing, exists)
+	}
+
+	store, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "", false,
+		WithOverwriteSkipLogger(useStore),
+		WithCompressedWriteCallback(func(ctx context.Context, n int) { useStore(ctx, "") }),
+	)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		require.NoError(t, store.WriteObject(ctx, "file", strings.NewReader("first")))
+		require.NoError(t, store.WriteObject(ctx, "file", strings.NewReader("second")))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("callbacks using the store should not deadlock")
+	}
+	assert.Equal(t, []bool{false, true}, existing, "written once, then skipped")
+}
+
+func TestMemoryStore_WalkFrom(t *testing.T) {
+	store := newTestMemoryStore(t, "0000/a", "0000/b", "0001/a", "0001/b")
+
+	tests := []struct {
+		name          string
+		prefix        string
+		startingPoint string
+		expected      []string
+	}{
+		{"empty prefix and starting point", "", "", []string{"0000/a", "0000/b", "0001/a", "0001/b"}},
+		{"empty prefix", "", "0001", []string{"0001/a", "0001/b"}},
+		{"starting point matches exactly", "0000", "0000/b", []string{"0000/b"}},
+		{"starting point equals prefix", "0001/a", "0001/a", []string{"0001/a"}},
+		{"starting point beyond all files", "", "0002", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var seen []string
+			err := store.WalkFrom(context.Background(), test.prefix, test.startingPoint, func(filename string) error {
+				seen = append(seen, filename)
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, seen)
+		})
+	}
+}
+
+func TestMemoryStore_WalkFrom_StartingPointOutsidePrefix(t *testing.T) {
+	store := newTestMemoryStore(t, "0000/a")
+
+	err := store.WalkFrom(context.Background(), "0001", "0000/a", func(filename string) error { return nil })
+	assert.Error(t, err)
+}
+
+func TestMemoryStore_StatObject(t *testing.T) {
+	ctx := context.Background()
+	store := newTestMemoryStore(t, "present")
+
+	exists, attrs, err := StatObject(ctx, store, "present")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	require.NotNil(t, attrs)
+	assert.Equal(t, int64(len("present")), attrs.Size)
+
+	exists, attrs, err = StatObject(ctx, store, "absent")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Nil(t, attrs)
+}
+
+func TestMemoryStore_WriteFrom_Transcoding(t *testing.T) {
+	ctx := context.Background()
+
+	src, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/src"}, "", "gzip", false)
+	require.NoError(t, err)
+	dst, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/dst"}, "", "zstd", false)
+	require.NoError(t, err)
+
+	require.NoError(t, WriteObjectString(ctx, src, "file", "some content"))
+	require.NoError(t, dst.WriteFrom(ctx, "copied", src, "file"))
+
+	content, err := ReadObjectString(ctx, dst, "copied")
+	require.NoError(t, err)
+	assert.Equal(t, "some content", content)
+
+	raw, err := OpenObjectWithCompression(ctx, dst, "copied", "")
+	require.NoError(t, err)
+	defer raw.Close()
+
+	decoder, err := zstd.NewReader(raw)
+	require.NoError(t, err)
+	defer decoder.Close()
+
+	decoded, err := io.ReadAll(decoder)
+	require.NoError(t, err)
+	assert.Equal(t, "some content", string(decoded), "destination should be zstd compressed exactly once")
+}
+
+func TestMemoryStore_WriteFrom_SameStoreCopiesServerSide(t *testing.T) {
+	ctx := context.Background()
+
+	writes := 0
+	store, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "gzip", false, WithWriteStats(func(ctx context.Context, uncompressed, compressed int64) {
+		writes++
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, WriteObjectString(ctx, store, "file", "some content"))
+	require.NoError(t, store.WriteFrom(ctx, "copied", store, "file"))
+	assert.Equal(t, 1, writes, "copy within the same store should not re-encode content")
+
+	content, err := ReadObjectString(ctx, store, "copied")
+	require.NoError(t, err)
+	assert.Equal(t, "some content", content)
+}
+
+func TestMemoryStore_WriteFrom_NotFound(t *testing.T) {
+	src := newTestMemoryStore(t)
+	dst := newTestMemoryStore(t)
+
+	err := dst.WriteFrom(context.Background(), "copied", src, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryStore_Touch(t *testing.T) {
+	ctx := context.Background()
+	store := newTestMemoryStore(t, "file")
+
+	old := time.Now().Add(-24 * time.Hour)
+	store.modified["file"] = old
+
+	require.NoError(t, Touch(ctx, store, "file"))
+
+	attrs, err := store.ObjectAttributes(ctx, "file")
+	require.NoError(t, err)
+	assert.True(t, attrs.LastModified.After(old))
+
+	content, err := ReadObjectString(ctx, store, "file")
+	require.NoError(t, err)
+	assert.Equal(t, "file", content)
+
+	assert.ErrorIs(t, Touch(ctx, store, "missing"), ErrNotFound)
+}
+
+func TestMemoryStore_ListFilesGlob(t *testing.T) {
+	store := newTestMemoryStore(t,
+		"blk-0001.dbin.zst",
+		"blk-0002.dbin.zst",
+		"blk-0002.json",
+		"blk-0003.dbin.zst",
+		"idx-0001.dbin.zst",
+		"sub/blk-0004.dbin.zst",
+	)
+
+	tests := []struct {
+		pattern  string
+		max      int
+		expected []string
+	}{
+		{"blk-*.dbin.zst", -1, []string{"blk-0001.dbin.zst", "blk-0002.dbin.zst", "blk-0003.dbin.zst"}},
+		{"blk-*.dbin.zst", 2, []string{"blk-0001.dbin.zst", "blk-0002.dbin.zst"}},
+		{"blk-000?.json", -1, []string{"blk-0002.json"}},
+		{"[bi]*-0001.dbin.zst", -1, []string{"blk-0001.dbin.zst", "idx-0001.dbin.zst"}},
+		{"*/blk-*", -1, []string{"sub/blk-0004.dbin.zst"}},
+		{"blk-0002.json", -1, []string{"blk-0002.json"}},
+		{"none-*", -1, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			files, err := ListFilesGlob(context.Background(), store, test.pattern, test.max)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, files)
+		})
+	}
+
+	_, err := ListFilesGlob(context.Background(), store, "blk-[", -1)
+	assert.Error(t, err)
+}
+
+func TestGlobLiteralPrefix(t *testing.T) {
+	assert.Equal(t, "blk-", globLiteralPrefix("blk-*.dbin.zst"))
+	assert.Equal(t, "a/b", globLiteralPrefix("a/b?c"))
+	assert.Equal(t, "", globLiteralPrefix("[ab]c"))
+	assert.Equal(t, "file", globLiteralPrefix("file"))
+}
+
+func TestMemoryStore_ExtensionLikeLocal(t *testing.T) {
+	ctx := context.Background()
+
+	memory, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "dbin.zst", "zstd", false)
+	require.NoError(t, err)
+	local, err := NewLocalStore(&url.URL{Scheme: "file", Path: t.TempDir()}, "dbin.zst", "zstd", false)
+	require.NoError(t, err)
+
+	for _, store := range []Store{memory, local} {
+		for _, name := range []string{"0000000100", "0000000200", "other"} {
+			require.NoError(t, WriteObjectString(ctx, store, name, "content "+name))
+		}
+
+		content, err := ReadObjectString(ctx, store, "0000000100")
+		require.NoError(t, err)
+		assert.Equal(t, "content 0000000100", content)
+
+		exists, err := store.FileExists(ctx, "0000000200")
+		require.NoError(t, err)
+		assert.True(t, exists)
+
+		exists, err = store.FileExists(ctx, "0000000200.dbin.zst")
+		require.NoError(t, err)
+		assert.False(t, exists)
+
+		files, err := store.ListFiles(ctx, "0000000", -1)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"0000000100", "0000000200"}, files)
+
+		require.NoError(t, store.CopyObject(ctx, "other", "copied"))
+		_, err = store.ObjectAttributes(ctx, "copied")
+		require.NoError(t, err)
+
+		require.NoError(t, store.DeleteObject(ctx, "other"))
+		files, err = store.ListFiles(ctx, "", -1)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"0000000100", "0000000200", "copied"}, files)
+	}
+
+	assert.Contains(t, memory.data, "0000000100.dbin.zst")
+}
+
+func TestMemoryStore_WithPrefixSharding(t *testing.T) {
+	ctx := context.Background()
+	sharder, err := HexHashSharder(2)
+	require.NoError(t, err)
+
+	store, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/base"}, "dbin", "", false, WithPrefixSharding(sharder), WithDefaultPrefix("p"))
+	require.NoError(t, err)
+
+	names := []string{"0000000100", "0000000200", "other"}
+	for _, name := range names {
+		require.NoError(t, WriteObjectString(ctx, store, name, "content "+name))
+
+		assert.Equal(t, "base/p/"+sharder(name)+"/"+name+".dbin", store.ObjectPath(name))
+		assert.Contains(t, store.data, store.ObjectPath(name))
+	}
+
+	content, err := ReadObjectString(ctx, store, "0000000200")
+	require.NoError(t, err)
+	assert.Equal(t, "content 0000000200", content)
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, names, files)
+
+	files, err = store.ListFiles(ctx, "00000", -1)
+	require.NoError(t, err)
+	assert.Equal(t, names[:2], files)
+
+	sub, err := store.SubStore("0000000")
+	require.NoError(t, err)
+	files, err = sub.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"100", "200"}, files)
+
+	content, err = ReadObjectString(ctx, sub, "100")
+	require.NoError(t, err)
+	assert.Equal(t, "content 0000000100", content)
+}
+
+func TestOpenObjectLines(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "jsonl.gz", "gzip", false)
+	require.NoError(t, err)
+
+	longLine := `{"data":"` + strings.Repeat("a", 256*1024) + `"}`
+	lines := []string{`{"block":1}`, longLine, `{"block":3}`}
+	require.NoError(t, WriteObjectString(ctx, store, "events", strings.Join(lines, "\n")+"\n"))
+
+	scanner, closer, err := OpenObjectLines(ctx, store, "events")
+	require.NoError(t, err)
+
+	var read []string
+	for scanner.Scan() {
+		read = append(read, scanner.Text())
+	}
+	require.NoError(t, scanner.Err())
+	require.NoError(t, closer())
+	assert.Equal(t, lines, read)
+
+	_, _, err = OpenObjectLines(ctx, store, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryStore_ListSubPrefixes(t *testing.T) {
+	store := newTestMemoryStore(t, "eth/mainnet/0001", "eth/sepolia/0001", "eth/top", "sol/mainnet/0001", "root")
+
+	prefixes, err := store.ListSubPrefixes(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eth/", "sol/"}, prefixes)
+
+	prefixes, err = store.ListSubPrefixes(context.Background(), "eth/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eth/mainnet/", "eth/sepolia/"}, prefixes)
+}
+
+func TestMemoryStore_WithKeepLocalAfterPush(t *testing.T) {
+	ctx := context.Background()
+	localFile := filepath.Join(t.TempDir(), "file")
+
+	for _, keep := range []bool{false, true} {
+		require.NoError(t, os.WriteFile(localFile, []byte("content"), 0644))
+
+		var opts []Option
+		if keep {
+			opts = append(opts, WithKeepLocalAfterPush())
+		}
+		store, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "", false, opts...)
+		require.NoError(t, err)
+
+		require.NoError(t, store.PushLocalFile(ctx, localFile, "file"))
+
+		content, err := ReadObjectString(ctx, store, "file")
+		require.NoError(t, err)
+		assert.Equal(t, "content", content)
+
+		_, err = os.Stat(localFile)
+		if keep {
+			assert.NoError(t, err, "local file should be kept")
+		} else {
+			assert.True(t, os.IsNotExist(err), "local file should be removed")
+		}
+	}
+}
+
+func TestMemoryStore_WithErrorOnEmptyWrite(t *testing.T) {
+	ctx := context.Background()
+
+	plain, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "zstd", false)
+	require.NoError(t, err)
+	require.NoError(t, plain.WriteObject(ctx, "empty", strings.NewReader("")))
+	exists, err := plain.FileExists(ctx, "empty")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	guarded, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "zstd", false, WithErrorOnEmptyWrite())
+	require.NoError(t, err)
+	assert.ErrorIs(t, guarded.WriteObject(ctx, "empty", strings.NewReader("")), ErrEmptyObject)
+	assert.ErrorIs(t, UploadFrom(ctx, guarded, "empty", strings.NewReader(""), 0), ErrEmptyObject)
+	exists, err = guarded.FileExists(ctx, "empty")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, WriteObjectString(ctx, guarded, "content", "content"))
+	content, err := ReadObjectString(ctx, guarded, "content")
+	require.NoError(t, err)
+	assert.Equal(t, "content", content)
+}
+
+func TestWalkWithBudget(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("slow callback", func(t *testing.T) {
+		store := newTestMemoryStore(t, "a", "b", "c", "d", "e", "f")
+
+		var seen []string
+		err := WalkWithBudget(ctx, store, "", 50*time.Millisecond, func(filename string) error {
+			seen = append(seen, filename)
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		})
+		assert.ErrorIs(t, err, ErrWalkDeadlineExceeded)
+		assert.NotEmpty(t, seen)
+		assert.Less(t, len(seen), 6)
+		assert.Equal(t, []string{"a", "b", "c", "d", "e", "f"}[:len(seen)], seen)
+	})
+
+	t.Run("slow listing", func(t *testing.T) {
+		store := NewMockStore(nil)
+		store.WalkFunc = func(ctx context.Context, prefix string, f func(filename string) error) error {
+			if err := f("first"); err != nil {
+				return err
+			}
+
+			// The next page never comes before the deadline
+			<-ctx.Done()
+			return fmt.Errorf("listing page: %w", ctx.Err())
+		}
+
+		var seen []string
+		err := WalkWithBudget(ctx, store, "", 20*time.Millisecond, func(filename string) error {
+			seen = append(seen, filename)
+			return nil
+		})
+		assert.ErrorIs(t, err, ErrWalkDeadlineExceeded)
+		assert.Equal(t, []string{"first"}, seen)
+	})
+
+	t.Run("within budget", func(t *testing.T) {
+		store := newTestMemoryStore(t, "a", "b")
+
+		var seen []string
+		require.NoError(t, WalkWithBudget(ctx, store, "", time.Minute, func(filename string) error {
+			seen = append(seen, filename)
+			return nil
+		}))
+		assert.Equal(t, []string{"a", "b"}, seen)
+	})
+}
+
+// countingWalkStore counts the files yielded to the callbacks of `WalkFrom`
+type countingWalkStore struct {
+	Store
+	yielded int
+}
+
+func (s *countingWalkStore) WalkFrom(ctx context.Context, prefix, startingPoint string, f func(filename string) error) error {
+	return s.Store.WalkFrom(ctx, prefix, startingPoint, func(filename string) error {
+		s.yielded++
+		return f(filename)
+	})
+}
+
+func TestHighestContiguous(t *testing.T) {
+	ctx := context.Background()
+
+	store := &countingWalkStore{Store: newTestMemoryStore(t,
+		"0000000000", "0000000100", "0000000200", "0000000300", "0000000500", "0000000600", "0000000700",
+		"blocks/0000000100", "blocks/0000000200", "blocks/0000000250", "blocks/0000000300", "blocks/0000000400", "blocks/index",
+	)}
+
+	highest, err := HighestContiguous(ctx, store, "", 0, 10, 100)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(300), highest)
+	assert.Equal(t, 5, store.yielded, "walk should stop at the first file after the gap")
+
+	highest, err = HighestContiguous(ctx, store, "", 500, 10, 100)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(700), highest)
+
+	highest, err = HighestContiguous(ctx, store, "blocks/", 100, 10, 100)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(400), highest, "files out of the sequence are ignored")
+
+	_, err = HighestContiguous(ctx, store, "", 400, 10, 100)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = HighestContiguous(ctx, store, "", 0, 10, 0)
+	assert.Error(t, err)
+}
+
+func TestMemoryStore_WriteObjectWithDeadline(t *testing.T) {
+	ctx := context.Background()
+	store := newTestMemoryStore(t, "kept")
+
+	slow := func() io.Reader {
+		return &slowReader{content: bytes.Repeat([]byte("a"), 100), delay: 10 * time.Millisecond}
+	}
+
+	err := WriteObjectWithDeadline(ctx, store, "slow", slow(), time.Now().Add(50*time.Millisecond))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	exists, err := store.FileExists(ctx, "slow")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Without overwrites, the write of an object existing beforehand is skipped and the object kept
+	require.NoError(t, WriteObjectWithDeadline(ctx, store, "kept", slow(), time.Now().Add(50*time.Millisecond)))
+	content, err := ReadObjectString(ctx, store, "kept")
+	require.NoError(t, err)
+	assert.Equal(t, "kept", content)
+}
+
+func TestMemoryStore_HasAnyFiles(t *testing.T) {
+	ctx := context.Background()
+	store := newTestMemoryStore(t, "blocks/0001", "blocks/0002", "index/0001")
+
+	for prefix, expected := range map[string]bool{
+		"":         true,
+		"blocks/":  true,
+		"index":    true,
+		"missing/": false,
+		"blocks/9": false,
+	} {
+		found, err := HasAnyFiles(ctx, store, prefix)
+		require.NoError(t, err)
+		assert.Equal(t, expected, found, "prefix %q", prefix)
+	}
+
+	found, err := HasAnyFiles(ctx, newTestMemoryStore(t), "")
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestMemoryStore_WalkSorted(t *testing.T) {
+	ctx := context.Background()
+	store := newTestMemoryStore(t, "blocks/100", "blocks/9", "blocks/10", "blocks/1")
+
+	var natural []string
+	require.NoError(t, WalkSorted(ctx, store, "blocks/", NaturalLess, func(filename string) error {
+		natural = append(natural, filename)
+		return nil
+	}))
+	assert.Equal(t, []string{"blocks/1", "blocks/9", "blocks/10", "blocks/100"}, natural)
+
+	var stopped []string
+	require.NoError(t, WalkSorted(ctx, store, "blocks/", NaturalLess, func(filename string) error {
+		stopped = append(stopped, filename)
+		if len(stopped) == 2 {
+			return StopIteration
+		}
+		return nil
+	}))
+	assert.Equal(t, []string{"blocks/1", "blocks/9"}, stopped)
+}
+
+func TestMemoryStore_WithPostWriteHook(t *testing.T) {
+	ctx := context.Background()
+
+	var written []string
+	var writtenAttrs []*ObjectAttributes
+	store, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "", false, WithPostWriteHook(func(ctx context.Context, name string, attrs *ObjectAttributes) {
+		written = append(written, name)
+		writtenAttrs = append(writtenAttrs, attrs)
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, WriteObjectString(ctx, store, "file", "content"))
+	require.Equal(t, []string{"file"}, written)
+	require.NotNil(t, writtenAttrs[0])
+	assert.Equal(t, int64(7), writtenAttrs[0].Size)
+	assert.False(t, writtenAttrs[0].LastModified.IsZero())
+
+	// Skipped, the object exists and the store does not overwrite
+	require.NoError(t, WriteObjectString(ctx, store, "file", "other"))
+	// Failed, the content cannot be read
+	assert.Error(t, store.WriteObject(ctx, "failed", &failingReader{content: strings.NewReader("partial"), err: errors.New("read failure")}))
+
+	assert.Equal(t, []string{"file"}, written)
+}
+
+func TestMemoryStore_PeekObject(t *testing.T) {
+	ctx := context.Background()
+
+	for _, compression := range []string{"", "gzip", "zstd"} {
+		store, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", compression, false)
+		require.NoError(t, err)
+		require.NoError(t, WriteObjectString(ctx, store, "file", "dbin content"))
+
+		head, err := PeekObject(ctx, store, "file", 4)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("dbin"), head, "compression %q", compression)
+
+		head, err = PeekObject(ctx, store, "file", 100)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("dbin content"), head, "compression %q", compression)
+
+		_, err = PeekObject(ctx, store, "missing", 4)
+		assert.ErrorIs(t, err, ErrNotFound)
+	}
+}
+
+func TestMemoryStore_WithWalkProgress(t *testing.T) {
+	ctx := context.Background()
+
+	type report struct{ files, pages int }
+	var reports []report
+	store, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "", false, WithWalkProgress(func(_ context.Context, filesSeen, pagesFetched int) {
+		reports = append(reports, report{filesSeen, pagesFetched})
+	}))
+	require.NoError(t, err)
+
+	for i := 0; i < 2500; i++ {
+		require.NoError(t, WriteObjectString(ctx, store, fmt.Sprintf("%010d", i), "content"))
+	}
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	require.Len(t, files, 2500)
+
+	assert.Equal(t, []report{{1000, 1}, {2000, 2}, {2500, 3}}, reports)
+	for i := 1; i < len(reports); i++ {
+		assert.Greater(t, reports[i].files, reports[i-1].files)
+		assert.Greater(t, reports[i].pages, reports[i-1].pages)
+	}
+}
+
+func TestContentAddressedStore(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestMemoryStore(t)
+	inner.SetOverwrite(true)
+	store := NewContentAddressedStore(inner, sha256.New)
+
+	require.NoError(t, WriteObjectString(ctx, store, "0000/a", "same content"))
+	require.NoError(t, WriteObjectString(ctx, store, "0001/b", "same content"))
+	require.NoError(t, WriteObjectString(ctx, store, "0002/c", "other content"))
+
+	digest := sha256.Sum256([]byte("same content"))
+	blobs, err := ListFilesGlob(ctx, inner, "*", -1)
+	require.NoError(t, err)
+	assert.Len(t, blobs, 2, "identical content must be stored once")
+	assert.Contains(t, blobs, hex.EncodeToString(digest[:]))
+
+	temps, err := inner.ListFiles(ctx, contentAddressedTempPrefix, -1)
+	require.NoError(t, err)
+	assert.Empty(t, temps)
+
+	for name, expected := range map[string]string{"0000/a": "same content", "0001/b": "same content", "0002/c": "other content"} {
+		content, err := ReadObjectString(ctx, store, name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, content, name)
+	}
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0000/a", "0001/b", "0002/c"}, files)
+
+	require.NoError(t, store.DeleteObject(ctx, "0000/a"))
+	_, err = store.OpenObject(ctx, "0000/a")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	content, err := ReadObjectString(ctx, store, "0001/b")
+	require.NoError(t, err)
+	assert.Equal(t, "same content", content)
+}
+
+func TestWalkFromN(t *testing.T) {
+	ctx := context.Background()
+	store := newTestMemoryStore(t, "a/01", "a/02", "a/03", "a/04", "a/05", "a/06", "a/07", "b/01")
+
+	var pages [][]string
+	cursor := ""
+	for {
+		var page []string
+		next, err := WalkFromN(ctx, store, "a/", cursor, 3, func(filename string) error {
+			page = append(page, filename)
+			return nil
+		})
+		require.NoError(t, err)
+
+		if len(page) > 0 {
+			assert.Equal(t, page[len(page)-1], next, "the cursor is the last walked file")
+			pages = append(pages, page)
+		} else {
+			assert.Equal(t, cursor, next, "the cursor is kept when nothing is walked")
+		}
+		if len(page) < 3 {
+			break
+		}
+		cursor = next
+	}
+
+	assert.Equal(t, [][]string{{"a/01", "a/02", "a/03"}, {"a/04", "a/05", "a/06"}, {"a/07"}}, pages)
+
+	_, err := WalkFromN(ctx, store, "a/", "", 0, func(string) error { return nil })
+	assert.Error(t, err)
+}
+
+func TestWriteObjectPreCompressed(t *testing.T) {
+	ctx := context.Background()
+
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	compressed := encoder.EncodeAll([]byte("some block content"), nil)
+	require.NoError(t, encoder.Close())
+
+	var uncompressedWritten int64
+	store, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "dbin", "zstd", false, WithWriteStats(func(_ context.Context, uncompressed, _ int64) {
+		uncompressedWritten += uncompressed
+	}))
+	require.NoError(t, err)
+
+	require.NoError(t, WriteObjectPreCompressed(ctx, store, "file", bytes.NewReader(compressed), "zstd"))
+
+	content, err := ReadObjectString(ctx, store, "file")
+	require.NoError(t, err)
+	assert.Equal(t, "some block content", content)
+
+	raw, err := OpenObjectWithCompression(ctx, store, "file", "")
+	require.NoError(t, err)
+	rawContent, err := io.ReadAll(raw)
+	require.NoError(t, err)
+	require.NoError(t, raw.Close())
+	assert.Equal(t, compressed, rawContent, "pre-compressed content should be stored verbatim")
+	assert.Equal(t, int64(len(compressed)), uncompressedWritten)
+
+	err = WriteObjectPreCompressed(ctx, store, "gzipped", bytes.NewReader(compressed), "gzip")
+	assert.Error(t, err)
+	exists, err := store.FileExists(ctx, "gzipped")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Regular writes keep being compressed
+	require.NoError(t, WriteObjectString(ctx, store, "regular", "some block content"))
+	content, err = ReadObjectString(ctx, store, "regular")
+	require.NoError(t, err)
+	assert.Equal(t, "some block content", content)
+}
+
+func TestLastFile(t *testing.T) {
+	ctx := context.Background()
+	store := newTestMemoryStore(t, "0000000200-0000000300", "0000000000-0000000100", "0000000100-0000000200", "other/0000000900-0000001000")
+
+	last, found, err := LastFile(ctx, store, "00")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "0000000200-0000000300", last)
+
+	last, found, err = LastFile(ctx, store, "other/")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "other/0000000900-0000001000", last)
+
+	last, found, err = LastFile(ctx, store, "missing/")
+	require.NoError(t, err)
+	assert.False(t, found)
+	assert.Equal(t, "", last)
+}
+
+func TestListFilesModifiedSince(t *testing.T) {
+	ctx := context.Background()
+	store := newTestMemoryStore(t, "a/old", "a/recent", "a/newest", "b/recent")
+
+	now := time.Now()
+	store.modified["a/old"] = now.Add(-48 * time.Hour)
+	store.modified["a/recent"] = now.Add(-1 * time.Hour)
+	store.modified["a/newest"] = now
+	store.modified["b/recent"] = now.Add(-1 * time.Hour)
+
+	files, err := ListFilesModifiedSince(ctx, store, "a/", now.Add(-2*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []FileWithAttrs{
+		{Name: "a/newest", ObjectAttributes: ObjectAttributes{Size: 8, LastModified: now}},
+		{Name: "a/recent", ObjectAttributes: ObjectAttributes{Size: 8, LastModified: now.Add(-1 * time.Hour)}},
+	}, files)
+
+	files, err = ListFilesModifiedSince(ctx, store, "a/", now.Add(-1*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, files, 2, "files modified exactly at since should be listed")
+
+	files, err = ListFilesModifiedSince(ctx, store, "", now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestMemoryStore_WithExistenceBloomHint(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "", false, WithExistenceBloomHint(time.Minute))
+	require.NoError(t, err)
+
+	for i := 0; i < 2000; i++ {
+		require.NoError(t, WriteObjectString(ctx, store, fmt.Sprintf("present/%04d", i), "content"))
+	}
+
+	definitelyAbsent := 0
+	for i := 0; i < 2000; i++ {
+		exists, err := store.FileExists(ctx, fmt.Sprintf("present/%04d", i))
+		require.NoError(t, err)
+		require.True(t, exists, "a present file must never be reported absent")
+
+		exists, err = store.FileExists(ctx, fmt.Sprintf("missing/%04d", i))
+		require.NoError(t, err)
+		require.False(t, exists)
+
+		if store.existenceBloom.definitelyAbsent(ctx, store, fmt.Sprintf("missing/%04d", i)) {
+			definitelyAbsent++
+		}
+	}
+	assert.Greater(t, definitelyAbsent, 1900, "most missing files should be answered without a check")
+
+	// Objects written or copied after the filter was built are not reported absent
+	require.NoError(t, WriteObjectString(ctx, store, "later", "content"))
+	require.NoError(t, store.CopyObject(ctx, "later", "copied"))
+	for _, name := range []string{"later", "copied"} {
+		exists, err := store.FileExists(ctx, name)
+		require.NoError(t, err)
+		assert.True(t, exists, name)
+	}
+
+	// Once too old, the filter is rebuilt from a new listing
+	store.existenceBloom.maxAge = 0
+
+	exists, err := store.FileExists(ctx, "present/0042")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+}
+
+func TestMemoryStore_ObjectMetadata(t *testing.T) {
+	ctx := context.Background()
+	store := newTestMemoryStore(t, "file")
+	store.SetOverwrite(true)
+
+	md, err := GetObjectMetadata(ctx, store, "file")
+	require.NoError(t, err)
+	assert.Empty(t, md)
+
+	require.NoError(t, SetObjectMetadata(ctx, store, "file", map[string]string{"producer_version": "1.2.0", "schema_id": "7"}))
+	require.NoError(t, SetObjectMetadata(ctx, store, "file", map[string]string{"schema_id": "8"}))
+
+	md, err = GetObjectMetadata(ctx, store, "file")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"producer_version": "1.2.0", "schema_id": "8"}, md)
+
+	// Rewriting the object drops its metadata
+	require.NoError(t, WriteObjectString(ctx, store, "file", "new content"))
+	md, err = GetObjectMetadata(ctx, store, "file")
+	require.NoError(t, err)
+	assert.Empty(t, md)
+
+	assert.ErrorIs(t, SetObjectMetadata(ctx, store, "missing", map[string]string{"key": "value"}), ErrNotFound)
+	_, err = GetObjectMetadata(ctx, store, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
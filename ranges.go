@@ -0,0 +1,171 @@
+package dstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// RangeCoalescingMaxGap is the largest gap, in bytes, between two ranges requested through
+// `OpenObjectRanges` for them to be fetched by a single request. The bytes of the gap are
+// downloaded and discarded, which is cheaper than a round trip as long as the gap is small.
+var RangeCoalescingMaxGap int64 = 64 * 1024
+
+// ByteRange is the `Length` bytes of an object starting at `Offset`.
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+func (r ByteRange) end() int64 {
+	return r.Offset + r.Length
+}
+
+// rangeReaderStore is implemented by the stores able to fetch a range of the stored bytes of an
+// object, a range extending past the end of the object being truncated to it. The compression
+// recorded for the object is returned along, see `commonStore.recordedCompression`.
+type rangeReaderStore interface {
+	commonConfig() *commonStore
+	readRange(ctx context.Context, name string, offset, length int64) (content []byte, recordedCompression string, err error)
+}
+
+// OpenObjectRanges returns a reader for each of `ranges` of the object `name`, in the order of
+// `ranges`. A range extending past the end of the object yields the bytes up to its end.
+//
+// Uncompressed S3, GCS, Azure, local and memory stores merge the ranges separated by at most
+// `RangeCoalescingMaxGap` bytes and fetch each merged range with a single ranged request, the
+// returned readers then being served from memory. Other stores, compressed ones and objects
+// recorded as compressed (see `WithCompressionDetectionOnWrite`), whose ranges are of the
+// decompressed content, open the object once per range and skip to its offset.
+func OpenObjectRanges(ctx context.Context, store Store, name string, ranges []ByteRange) ([]io.ReadCloser, error) {
+	for _, r := range ranges {
+		if r.Offset < 0 || r.Length < 0 {
+			return nil, fmt.Errorf("invalid range of %d bytes at offset %d", r.Length, r.Offset)
+		}
+	}
+
+	ranged, ok := store.(rangeReaderStore)
+	if !ok || ranged.commonConfig().compressionType != "" {
+		return openObjectRangesSeparately(ctx, store, name, ranges)
+	}
+
+	out := make([]io.ReadCloser, len(ranges))
+	for i, r := range ranges {
+		if r.Length == 0 {
+			out[i] = io.NopCloser(bytes.NewReader(nil))
+		}
+	}
+
+	for _, group := range coalesceRanges(ranges, RangeCoalescingMaxGap) {
+		content, recordedCompression, err := ranged.readRange(ctx, name, group.ByteRange.Offset, group.ByteRange.Length)
+		if err != nil {
+			return nil, fmt.Errorf("reading range of %d bytes at offset %d of %q: %w", group.ByteRange.Length, group.ByteRange.Offset, name, err)
+		}
+		if recordedCompression != "" {
+			return openObjectRangesSeparately(ctx, store, name, ranges)
+		}
+
+		for _, i := range group.members {
+			start := clampRange(ranges[i].Offset-group.ByteRange.Offset, len(content))
+			end := clampRange(ranges[i].end()-group.ByteRange.Offset, len(content))
+			out[i] = io.NopCloser(bytes.NewReader(content[start:end]))
+		}
+	}
+	return out, nil
+}
+
+// openObjectRangesSeparately opens `name` once per range, the readers being opened lazily so
+// that only the range being read holds a connection.
+func openObjectRangesSeparately(ctx context.Context, store Store, name string, ranges []ByteRange) ([]io.ReadCloser, error) {
+	exists, err := store.FileExists(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	out := make([]io.ReadCloser, len(ranges))
+	for i, r := range ranges {
+		out[i] = &lazyRangeReader{ctx: ctx, store: store, name: name, byteRange: r}
+	}
+	return out, nil
+}
+
+type lazyRangeReader struct {
+	ctx       context.Context
+	store     Store
+	name      string
+	byteRange ByteRange
+
+	reader io.ReadCloser
+	limit  io.Reader
+}
+
+func (r *lazyRangeReader) Read(p []byte) (int, error) {
+	if r.reader == nil {
+		reader, err := r.store.OpenObject(r.ctx, r.name)
+		if err != nil {
+			return 0, err
+		}
+		r.reader = reader
+
+		if _, err := io.CopyN(io.Discard, reader, r.byteRange.Offset); err != nil && err != io.EOF {
+			return 0, fmt.Errorf("skipping to offset %d of %q: %w", r.byteRange.Offset, r.name, err)
+		}
+		r.limit = io.LimitReader(reader, r.byteRange.Length)
+	}
+
+	return r.limit.Read(p)
+}
+
+func (r *lazyRangeReader) Close() error {
+	if r.reader == nil {
+		return nil
+	}
+	return r.reader.Close()
+}
+
+// coalescedRange is a range covering the requested ranges at indexes `members`
+type coalescedRange struct {
+	ByteRange
+	members []int
+}
+
+// coalesceRanges merges the overlapping `ranges` and the ones separated by at most `maxGap`
+// bytes, empty ranges being left out.
+func coalesceRanges(ranges []ByteRange, maxGap int64) []coalescedRange {
+	order := make([]int, 0, len(ranges))
+	for i, r := range ranges {
+		if r.Length > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return ranges[order[a]].Offset < ranges[order[b]].Offset })
+
+	var out []coalescedRange
+	for _, i := range order {
+		r := ranges[i]
+		if len(out) > 0 {
+			last := &out[len(out)-1]
+			if r.Offset <= last.end()+maxGap {
+				if r.end() > last.end() {
+					last.Length = r.end() - last.Offset
+				}
+				last.members = append(last.members, i)
+				continue
+			}
+		}
+		out = append(out, coalescedRange{ByteRange: r, members: []int{i}})
+	}
+	return out
+}
+
+func clampRange(position int64, size int) int64 {
+	if position > int64(size) {
+		return int64(size)
+	}
+	return position
+}
@@ -0,0 +1,107 @@
+package dstore
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rangeCountingStore records the ranges fetched from the memory store it wraps
+type rangeCountingStore struct {
+	*MemoryStore
+	fetched []ByteRange
+}
+
+func (s *rangeCountingStore) readRange(ctx context.Context, name string, offset, length int64) ([]byte, string, error) {
+	s.fetched = append(s.fetched, ByteRange{offset, length})
+	return s.MemoryStore.readRange(ctx, name, offset, length)
+}
+
+func readRanges(t *testing.T, readers []io.ReadCloser) []string {
+	t.Helper()
+
+	out := make([]string, len(readers))
+	for i, reader := range readers {
+		content, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		out[i] = string(content)
+	}
+	return out
+}
+
+func TestOpenObjectRanges(t *testing.T) {
+	defer func(gap int64) { RangeCoalescingMaxGap = gap }(RangeCoalescingMaxGap)
+	RangeCoalescingMaxGap = 10
+
+	ctx := context.Background()
+	content := "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	ranges := []ByteRange{
+		{Offset: 40, Length: 5},
+		{Offset: 2, Length: 3},
+		{Offset: 10, Length: 4},
+		{Offset: 12, Length: 6},
+		{Offset: 20, Length: 0},
+		{Offset: 60, Length: 10},
+	}
+	expected := []string{"EFGHI", "234", "abcd", "cdefgh", "", "YZ"}
+
+	memory, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "", false)
+	require.NoError(t, err)
+	require.NoError(t, WriteObjectString(ctx, memory, "index", content))
+
+	store := &rangeCountingStore{MemoryStore: memory}
+	readers, err := OpenObjectRanges(ctx, store, "index", ranges)
+	require.NoError(t, err)
+	assert.Equal(t, expected, readRanges(t, readers))
+	assert.Equal(t, []ByteRange{{2, 16}, {40, 5}, {60, 10}}, store.fetched, "nearby ranges should be fetched together")
+
+	_, err = OpenObjectRanges(ctx, store, "missing", ranges)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	t.Run("compressed store reads each range separately", func(t *testing.T) {
+		compressed, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "zstd", false)
+		require.NoError(t, err)
+		require.NoError(t, WriteObjectString(ctx, compressed, "index", content))
+
+		store := &rangeCountingStore{MemoryStore: compressed}
+		readers, err := OpenObjectRanges(ctx, store, "index", ranges)
+		require.NoError(t, err)
+		assert.Equal(t, expected, readRanges(t, readers))
+		assert.Empty(t, store.fetched)
+
+		_, err = OpenObjectRanges(ctx, store, "missing", ranges)
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("object recorded as compressed reads each range separately", func(t *testing.T) {
+		compressed, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "zstd", false, WithCompressionDetectionOnWrite())
+		require.NoError(t, err)
+		require.NoError(t, WriteObjectString(ctx, compressed, "index", content))
+
+		plain, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "", false, WithCompressionDetectionOnWrite())
+		require.NoError(t, err)
+		plain.data, plain.modified, plain.metadata = compressed.data, compressed.modified, compressed.metadata
+
+		readers, err := OpenObjectRanges(ctx, plain, "index", ranges)
+		require.NoError(t, err)
+		assert.Equal(t, expected, readRanges(t, readers))
+	})
+
+	t.Run("local store", func(t *testing.T) {
+		local, err := NewLocalStore(&url.URL{Scheme: "file", Path: t.TempDir()}, "", "", false)
+		require.NoError(t, err)
+		require.NoError(t, WriteObjectString(ctx, local, "index", content))
+
+		readers, err := OpenObjectRanges(ctx, local, "index", ranges)
+		require.NoError(t, err)
+		assert.Equal(t, expected, readRanges(t, readers))
+	})
+
+	_, err = OpenObjectRanges(ctx, store, "index", []ByteRange{{Offset: -1, Length: 2}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,138 @@
+package dstore
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// NewReadOnlyStore wraps `inner` so that read operations pass through while mutations
+// (`WriteObject`, `WriteObjectSized`, `UploadFrom`, `WriteObjectSeekable`,
+// `WriteObjectWithDeadline`, `PushLocalFile`, `WriteFrom`, `CopyObject`, `Touch`,
+// `SetObjectMetadata`, `DeleteObject` and `DeleteObjectsUnderPrefix`) are turned into no-ops
+// reporting success without touching the backend. Each intercepted mutation invokes `onMutation`
+// (when non-nil) with the operation name and the object it targets, useful to preview the effect of
+// a destructive job.
+func NewReadOnlyStore(inner Store, onMutation func(op, name string)) Store {
+	return &readOnlyStore{
+		Store:      inner,
+		onMutation: onMutation,
+	}
+}
+
+type readOnlyStore struct {
+	Store
+
+	onMutation func(op, name string)
+}
+
+func (s *readOnlyStore) OpenObjectWithCompression(ctx context.Context, name string, compressionType string) (io.ReadCloser, error) {
+	return OpenObjectWithCompression(ctx, s.Store, name, compressionType)
+}
+
+func (s *readOnlyStore) OpenObjectIfModifiedSince(ctx context.Context, name string, since time.Time) (io.ReadCloser, bool, error) {
+	return OpenObjectIfModifiedSince(ctx, s.Store, name, since)
+}
+
+func (s *readOnlyStore) DownloadTo(ctx context.Context, name string, w io.Writer) (int64, error) {
+	return DownloadTo(ctx, s.Store, name, w)
+}
+
+func (s *readOnlyStore) PeekObject(ctx context.Context, name string, n int) ([]byte, error) {
+	return PeekObject(ctx, s.Store, name, n)
+}
+
+func (s *readOnlyStore) WriteObject(ctx context.Context, base string, f io.Reader) error {
+	s.mutation("WriteObject", base)
+	return drain(f)
+}
+
+func (s *readOnlyStore) WriteObjectSized(ctx context.Context, base string, f io.Reader, size int64) error {
+	s.mutation("WriteObjectSized", base)
+	return drain(f)
+}
+
+func (s *readOnlyStore) UploadFrom(ctx context.Context, base string, r io.ReaderAt, size int64) error {
+	s.mutation("UploadFrom", base)
+	return nil
+}
+
+func (s *readOnlyStore) WriteObjectSeekable(ctx context.Context, base string, rs io.ReadSeeker) error {
+	s.mutation("WriteObjectSeekable", base)
+	return nil
+}
+
+func (s *readOnlyStore) WriteObjectWithDeadline(ctx context.Context, base string, f io.Reader, _ time.Time) error {
+	s.mutation("WriteObjectWithDeadline", base)
+	return drain(f)
+}
+
+func (s *readOnlyStore) PushLocalFile(ctx context.Context, localFile, toBaseName string) error {
+	s.mutation("PushLocalFile", toBaseName)
+	return nil
+}
+
+func (s *readOnlyStore) WriteFrom(ctx context.Context, base string, src Store, srcName string) error {
+	s.mutation("WriteFrom", base)
+	return nil
+}
+
+func (s *readOnlyStore) CopyObject(ctx context.Context, src, dest string) error {
+	s.mutation("CopyObject", dest)
+	return nil
+}
+
+func (s *readOnlyStore) Touch(ctx context.Context, base string) error {
+	s.mutation("Touch", base)
+	return nil
+}
+
+func (s *readOnlyStore) SetObjectMetadata(ctx context.Context, base string, md map[string]string) error {
+	s.mutation("SetObjectMetadata", base)
+	return nil
+}
+
+func (s *readOnlyStore) GetObjectMetadata(ctx context.Context, base string) (map[string]string, error) {
+	return GetObjectMetadata(ctx, s.Store, base)
+}
+
+func (s *readOnlyStore) DeleteObject(ctx context.Context, base string) error {
+	s.mutation("DeleteObject", base)
+	return nil
+}
+
+// DeleteObjectsUnderPrefix walks the inner store for real so that `onMutation` is invoked
+// for every object that would have been deleted, the returned count is the would-be one.
+func (s *readOnlyStore) DeleteObjectsUnderPrefix(ctx context.Context, prefix string, force bool) (int, error) {
+	return deleteObjectsUnderPrefix(ctx, s, prefix, force)
+}
+
+func (s *readOnlyStore) HasAnyFiles(ctx context.Context, prefix string) (bool, error) {
+	return HasAnyFiles(ctx, s.Store, prefix)
+}
+
+func (s *readOnlyStore) ListSubPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	return ListSubPrefixes(ctx, s.Store, prefix)
+}
+
+func (s *readOnlyStore) SubStore(subFolder string) (Store, error) {
+	sub, err := s.Store.SubStore(subFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewReadOnlyStore(sub, s.onMutation), nil
+}
+
+func (s *readOnlyStore) mutation(op, name string) {
+	if s.onMutation != nil {
+		s.onMutation(op, name)
+	}
+}
+
+// drain consumes the reader so that producers writing to it (e.g. through an `io.Pipe`)
+// are not blocked forever by the discarded write.
+func drain(f io.Reader) error {
+	_, err := io.Copy(io.Discard, f)
+	return err
+}
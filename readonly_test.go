@@ -0,0 +1,117 @@
+package dstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordedMutation struct {
+	op   string
+	name string
+}
+
+func newTestReadOnlyStore(t *testing.T, files ...string) (Store, *MemoryStore, *[]recordedMutation) {
+	t.Helper()
+
+	inner := newTestMemoryStore(t, files...)
+
+	var mutations []recordedMutation
+	store := NewReadOnlyStore(inner, func(op, name string) {
+		mutations = append(mutations, recordedMutation{op, name})
+	})
+
+	return store, inner, &mutations
+}
+
+func TestReadOnlyStore_ReadsPassThrough(t *testing.T) {
+	ctx := context.Background()
+	store, _, mutations := newTestReadOnlyStore(t, "a", "b")
+
+	content, err := ReadObjectString(ctx, store, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "a", content)
+
+	exists, err := store.FileExists(ctx, "b")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, files)
+
+	assert.Empty(t, *mutations)
+}
+
+func TestReadOnlyStore_MutationsIntercepted(t *testing.T) {
+	ctx := context.Background()
+	store, inner, mutations := newTestReadOnlyStore(t, "a", "b")
+
+	localFile := filepath.Join(t.TempDir(), "local")
+	require.NoError(t, os.WriteFile(localFile, []byte("local"), 0644))
+
+	require.NoError(t, store.WriteObject(ctx, "new", strings.NewReader("new")))
+	require.NoError(t, WriteObjectSized(ctx, store, "sized", strings.NewReader("sized"), 5))
+	require.NoError(t, store.PushLocalFile(ctx, localFile, "pushed"))
+	require.NoError(t, store.CopyObject(ctx, "a", "copied"))
+	require.NoError(t, Touch(ctx, store, "b"))
+	require.NoError(t, store.DeleteObject(ctx, "a"))
+
+	deleted, err := DeleteObjectsUnderPrefix(ctx, store, "", true)
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	assert.Equal(t, []recordedMutation{
+		{"WriteObject", "new"},
+		{"WriteObjectSized", "sized"},
+		{"PushLocalFile", "pushed"},
+		{"CopyObject", "copied"},
+		{"Touch", "b"},
+		{"DeleteObject", "a"},
+		{"DeleteObject", "a"},
+		{"DeleteObject", "b"},
+	}, *mutations)
+
+	files, err := inner.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, files)
+
+	_, err = os.Stat(localFile)
+	assert.NoError(t, err, "local file must be left untouched")
+}
+
+func TestReadOnlyStore_SubStore(t *testing.T) {
+	ctx := context.Background()
+	store, inner, mutations := newTestReadOnlyStore(t, "sub/a")
+
+	sub, err := store.SubStore("sub/")
+	require.NoError(t, err)
+
+	content, err := ReadObjectString(ctx, sub, "a")
+	require.NoError(t, err)
+	assert.Equal(t, "sub/a", content)
+
+	require.NoError(t, sub.DeleteObject(ctx, "a"))
+	assert.Equal(t, []recordedMutation{{"DeleteObject", "a"}}, *mutations)
+
+	exists, err := inner.FileExists(ctx, "sub/a")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestReadOnlyStore_WriteFromIntercepted(t *testing.T) {
+	ctx := context.Background()
+	store, inner, mutations := newTestReadOnlyStore(t, "a")
+
+	require.NoError(t, store.WriteFrom(ctx, "copied", inner, "a"))
+	assert.Equal(t, []recordedMutation{{"WriteFrom", "copied"}}, *mutations)
+
+	exists, err := inner.FileExists(ctx, "copied")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
@@ -0,0 +1,354 @@
+package dstore
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// OpRecord is an operation performed through a `RecordingStore`.
+type OpRecord struct {
+	// Op is the name of the `Store` method called, e.g. "FileExists" or "WriteObject".
+	Op string
+	// Name is the object operated on, the prefix (or pattern) for listing operations and the
+	// destination for copies.
+	Name string
+	// Bytes is the amount of content transferred: consumed from the source by writes, and
+	// consumed from the returned reader by reads, updated as the reader is consumed.
+	Bytes int64
+	// Duration is the time spent in the call, excluding the consumption of returned readers.
+	Duration time.Duration
+	Err      error
+}
+
+// RecordingStore wraps a store, recording each operation performed through it so tests can
+// assert on access patterns, e.g. that no more than a given number of existence checks were
+// issued. Operations are recorded as called on the wrapper: an operation the inner store
+// implements in terms of others, like `StatObject`, is recorded once under its own name. It is
+// safe for concurrent use, sub stores sharing the log of the store they were created from.
+type RecordingStore struct {
+	Store
+
+	log *opLog
+}
+
+type opLog struct {
+	lock sync.Mutex
+	ops  []*OpRecord
+}
+
+// NewRecordingStore returns a store recording the operations performed through it on `inner`.
+func NewRecordingStore(inner Store) *RecordingStore {
+	return &RecordingStore{Store: inner, log: &opLog{}}
+}
+
+// Ops returns a copy of the operations recorded so far, in call order.
+func (s *RecordingStore) Ops() []OpRecord {
+	s.log.lock.Lock()
+	defer s.log.lock.Unlock()
+
+	out := make([]OpRecord, len(s.log.ops))
+	for i, record := range s.log.ops {
+		out[i] = *record
+	}
+	return out
+}
+
+// Count returns how many `op` operations were recorded.
+func (s *RecordingStore) Count(op string) (count int) {
+	for _, record := range s.Ops() {
+		if record.Op == op {
+			count++
+		}
+	}
+	return count
+}
+
+// Bytes returns the total bytes transferred by the recorded `op` operations.
+func (s *RecordingStore) Bytes(op string) (total int64) {
+	for _, record := range s.Ops() {
+		if record.Op == op {
+			total += record.Bytes
+		}
+	}
+	return total
+}
+
+// Reset forgets the operations recorded so far.
+func (s *RecordingStore) Reset() {
+	s.log.lock.Lock()
+	defer s.log.lock.Unlock()
+
+	s.log.ops = nil
+}
+
+func (s *RecordingStore) OpenObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	start := time.Now()
+	reader, err := s.Store.OpenObject(ctx, name)
+	return s.recordRead("OpenObject", name, start, reader, err)
+}
+
+func (s *RecordingStore) OpenObjectWithCompression(ctx context.Context, name string, compressionType string) (io.ReadCloser, error) {
+	start := time.Now()
+	reader, err := OpenObjectWithCompression(ctx, s.Store, name, compressionType)
+	return s.recordRead("OpenObjectWithCompression", name, start, reader, err)
+}
+
+func (s *RecordingStore) OpenObjectIfModifiedSince(ctx context.Context, name string, since time.Time) (io.ReadCloser, bool, error) {
+	start := time.Now()
+	reader, modified, err := OpenObjectIfModifiedSince(ctx, s.Store, name, since)
+	if reader == nil {
+		s.record("OpenObjectIfModifiedSince", name, start, 0, err)
+		return nil, modified, err
+	}
+
+	reader, err = s.recordRead("OpenObjectIfModifiedSince", name, start, reader, err)
+	return reader, modified, err
+}
+
+func (s *RecordingStore) PeekObject(ctx context.Context, name string, n int) ([]byte, error) {
+	start := time.Now()
+	out, err := PeekObject(ctx, s.Store, name, n)
+	s.record("PeekObject", name, start, int64(len(out)), err)
+	return out, err
+}
+
+func (s *RecordingStore) DownloadTo(ctx context.Context, name string, w io.Writer) (int64, error) {
+	start := time.Now()
+	written, err := DownloadTo(ctx, s.Store, name, w)
+	s.record("DownloadTo", name, start, written, err)
+	return written, err
+}
+
+func (s *RecordingStore) FileExists(ctx context.Context, base string) (bool, error) {
+	start := time.Now()
+	exists, err := s.Store.FileExists(ctx, base)
+	s.record("FileExists", base, start, 0, err)
+	return exists, err
+}
+
+func (s *RecordingStore) ObjectAttributes(ctx context.Context, base string) (*ObjectAttributes, error) {
+	start := time.Now()
+	attrs, err := s.Store.ObjectAttributes(ctx, base)
+	s.record("ObjectAttributes", base, start, 0, err)
+	return attrs, err
+}
+
+func (s *RecordingStore) StatObject(ctx context.Context, base string) (bool, *ObjectAttributes, error) {
+	start := time.Now()
+	exists, attrs, err := StatObject(ctx, s.Store, base)
+	s.record("StatObject", base, start, 0, err)
+	return exists, attrs, err
+}
+
+func (s *RecordingStore) GetObjectMetadata(ctx context.Context, base string) (map[string]string, error) {
+	start := time.Now()
+	md, err := GetObjectMetadata(ctx, s.Store, base)
+	s.record("GetObjectMetadata", base, start, 0, err)
+	return md, err
+}
+
+func (s *RecordingStore) WriteObject(ctx context.Context, base string, f io.Reader) error {
+	start := time.Now()
+	source := &countingReader{r: f}
+	err := s.Store.WriteObject(ctx, base, source)
+	s.record("WriteObject", base, start, source.n, err)
+	return err
+}
+
+func (s *RecordingStore) WriteObjectSized(ctx context.Context, base string, f io.Reader, size int64) error {
+	start := time.Now()
+	source := &countingReader{r: f}
+	err := WriteObjectSized(ctx, s.Store, base, source, size)
+	s.record("WriteObjectSized", base, start, source.n, err)
+	return err
+}
+
+func (s *RecordingStore) UploadFrom(ctx context.Context, base string, r io.ReaderAt, size int64) error {
+	start := time.Now()
+	err := UploadFrom(ctx, s.Store, base, r, size)
+	s.record("UploadFrom", base, start, size, err)
+	return err
+}
+
+func (s *RecordingStore) WriteObjectSeekable(ctx context.Context, base string, rs io.ReadSeeker) error {
+	start := time.Now()
+	err := WriteObjectSeekable(ctx, s.Store, base, rs)
+	s.record("WriteObjectSeekable", base, start, 0, err)
+	return err
+}
+
+func (s *RecordingStore) WriteObjectWithDeadline(ctx context.Context, base string, f io.Reader, deadline time.Time) error {
+	start := time.Now()
+	source := &countingReader{r: f}
+	err := WriteObjectWithDeadline(ctx, s.Store, base, source, deadline)
+	s.record("WriteObjectWithDeadline", base, start, source.n, err)
+	return err
+}
+
+func (s *RecordingStore) PushLocalFile(ctx context.Context, localFile, toBaseName string) error {
+	start := time.Now()
+	err := s.Store.PushLocalFile(ctx, localFile, toBaseName)
+	s.record("PushLocalFile", toBaseName, start, 0, err)
+	return err
+}
+
+func (s *RecordingStore) PushLocalFiles(ctx context.Context, files map[string]string, concurrency int) error {
+	start := time.Now()
+	err := PushLocalFiles(ctx, s.Store, files, concurrency)
+	s.record("PushLocalFiles", "", start, 0, err)
+	return err
+}
+
+func (s *RecordingStore) WriteFrom(ctx context.Context, base string, src Store, srcName string) error {
+	start := time.Now()
+	err := s.Store.WriteFrom(ctx, base, src, srcName)
+	s.record("WriteFrom", base, start, 0, err)
+	return err
+}
+
+func (s *RecordingStore) CopyObject(ctx context.Context, src, dest string) error {
+	start := time.Now()
+	err := s.Store.CopyObject(ctx, src, dest)
+	s.record("CopyObject", dest, start, 0, err)
+	return err
+}
+
+func (s *RecordingStore) Touch(ctx context.Context, base string) error {
+	start := time.Now()
+	err := Touch(ctx, s.Store, base)
+	s.record("Touch", base, start, 0, err)
+	return err
+}
+
+func (s *RecordingStore) SetObjectMetadata(ctx context.Context, base string, md map[string]string) error {
+	start := time.Now()
+	err := SetObjectMetadata(ctx, s.Store, base, md)
+	s.record("SetObjectMetadata", base, start, 0, err)
+	return err
+}
+
+func (s *RecordingStore) WalkFrom(ctx context.Context, prefix, startingPoint string, f func(filename string) (err error)) error {
+	start := time.Now()
+	err := s.Store.WalkFrom(ctx, prefix, startingPoint, f)
+	s.record("WalkFrom", prefix, start, 0, err)
+	return err
+}
+
+func (s *RecordingStore) WalkFromExclusive(ctx context.Context, prefix, afterPoint string, f func(filename string) (err error)) error {
+	start := time.Now()
+	err := WalkFromExclusive(ctx, s.Store, prefix, afterPoint, f)
+	s.record("WalkFromExclusive", prefix, start, 0, err)
+	return err
+}
+
+func (s *RecordingStore) Walk(ctx context.Context, prefix string, f func(filename string) (err error)) error {
+	start := time.Now()
+	err := s.Store.Walk(ctx, prefix, f)
+	s.record("Walk", prefix, start, 0, err)
+	return err
+}
+
+func (s *RecordingStore) WalkReverse(ctx context.Context, prefix string, f func(filename string) (err error)) error {
+	start := time.Now()
+	err := WalkReverse(ctx, s.Store, prefix, f)
+	s.record("WalkReverse", prefix, start, 0, err)
+	return err
+}
+
+func (s *RecordingStore) WalkSorted(ctx context.Context, prefix string, less func(a, b string) bool, f func(filename string) (err error)) error {
+	start := time.Now()
+	err := WalkSorted(ctx, s.Store, prefix, less, f)
+	s.record("WalkSorted", prefix, start, 0, err)
+	return err
+}
+
+func (s *RecordingStore) ListFiles(ctx context.Context, prefix string, max int) ([]string, error) {
+	start := time.Now()
+	files, err := s.Store.ListFiles(ctx, prefix, max)
+	s.record("ListFiles", prefix, start, 0, err)
+	return files, err
+}
+
+func (s *RecordingStore) HasAnyFiles(ctx context.Context, prefix string) (bool, error) {
+	start := time.Now()
+	found, err := HasAnyFiles(ctx, s.Store, prefix)
+	s.record("HasAnyFiles", prefix, start, 0, err)
+	return found, err
+}
+
+func (s *RecordingStore) ListFilesGlob(ctx context.Context, pattern string, max int) ([]string, error) {
+	start := time.Now()
+	files, err := ListFilesGlob(ctx, s.Store, pattern, max)
+	s.record("ListFilesGlob", pattern, start, 0, err)
+	return files, err
+}
+
+func (s *RecordingStore) ListSubPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	start := time.Now()
+	subPrefixes, err := ListSubPrefixes(ctx, s.Store, prefix)
+	s.record("ListSubPrefixes", prefix, start, 0, err)
+	return subPrefixes, err
+}
+
+func (s *RecordingStore) DeleteObject(ctx context.Context, base string) error {
+	start := time.Now()
+	err := s.Store.DeleteObject(ctx, base)
+	s.record("DeleteObject", base, start, 0, err)
+	return err
+}
+
+func (s *RecordingStore) DeleteObjectsUnderPrefix(ctx context.Context, prefix string, force bool) (int, error) {
+	start := time.Now()
+	deleted, err := DeleteObjectsUnderPrefix(ctx, s.Store, prefix, force)
+	s.record("DeleteObjectsUnderPrefix", prefix, start, 0, err)
+	return deleted, err
+}
+
+func (s *RecordingStore) SubStore(subFolder string) (Store, error) {
+	sub, err := s.Store.SubStore(subFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RecordingStore{Store: sub, log: s.log}, nil
+}
+
+func (s *RecordingStore) record(op, name string, start time.Time, bytes int64, err error) *OpRecord {
+	record := &OpRecord{Op: op, Name: name, Bytes: bytes, Duration: time.Since(start), Err: err}
+
+	s.log.lock.Lock()
+	defer s.log.lock.Unlock()
+
+	s.log.ops = append(s.log.ops, record)
+	return record
+}
+
+// recordRead records the opening of `reader`, the bytes later read from it being added to the
+// record
+func (s *RecordingStore) recordRead(op, name string, start time.Time, reader io.ReadCloser, err error) (io.ReadCloser, error) {
+	record := s.record(op, name, start, 0, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recordingReader{ReadCloser: reader, log: s.log, record: record}, nil
+}
+
+type recordingReader struct {
+	io.ReadCloser
+
+	log    *opLog
+	record *OpRecord
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+
+	r.log.lock.Lock()
+	r.record.Bytes += int64(n)
+	r.log.lock.Unlock()
+
+	return n, err
+}
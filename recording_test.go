@@ -0,0 +1,56 @@
+package dstore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordingStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewRecordingStore(newTestMemoryStore(t))
+
+	require.NoError(t, store.WriteObject(ctx, "file", strings.NewReader("some content")))
+
+	reader, err := store.OpenObject(ctx, "file")
+	require.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.Equal(t, "some content", string(content))
+
+	_, err = store.OpenObject(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	exists, err := store.FileExists(ctx, "file")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	ops := store.Ops()
+	require.Len(t, ops, 4)
+	assert.Equal(t, OpRecord{Op: "WriteObject", Name: "file", Bytes: 12}, withoutDuration(ops[0]))
+	assert.Equal(t, OpRecord{Op: "OpenObject", Name: "file", Bytes: 12}, withoutDuration(ops[1]))
+	assert.Equal(t, OpRecord{Op: "OpenObject", Name: "missing", Err: ErrNotFound}, withoutDuration(ops[2]))
+	assert.Equal(t, OpRecord{Op: "FileExists", Name: "file"}, withoutDuration(ops[3]))
+
+	assert.Equal(t, 2, store.Count("OpenObject"))
+	assert.Equal(t, int64(12), store.Bytes("OpenObject"))
+	assert.Equal(t, 0, store.Count("ObjectAttributes"))
+
+	sub, err := store.SubStore("sub")
+	require.NoError(t, err)
+	require.NoError(t, WriteObjectString(ctx, sub, "other", "content"))
+	assert.Equal(t, 1, store.Count("WriteObjectSized"), "sub stores should share the log")
+
+	store.Reset()
+	assert.Empty(t, store.Ops())
+}
+
+func withoutDuration(record OpRecord) OpRecord {
+	record.Duration = 0
+	return record
+}
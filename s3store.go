@@ -3,22 +3,26 @@ package dstore
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -29,6 +33,9 @@ var retryS3PushLocalFilesDelay time.Duration
 var s3ReadAttempts = 1
 var bufferedS3Read bool
 
+// s3ReadRetryDelay is the wait before each `OpenObject` retry, a variable so tests can shorten it
+var s3ReadRetryDelay = 500 * time.Millisecond
+
 func init() {
 	retry := os.Getenv("DSTORE_S3_RETRY_PUSH_DELAY")
 	if retry != "" {
@@ -58,10 +65,17 @@ type S3Store struct {
 
 	bucket   string
 	path     string
+	session  *session.Session
 	service  *s3.S3
 	uploader *s3manager.Uploader
 	context  context.Context
 
+	contentMD5         bool
+	retryableErrorFunc func(err error) bool
+
+	// acl is the canned ACL set on uploaded objects, nil when none, see `WithObjectACL`
+	acl *string
+
 	*commonStore
 }
 
@@ -70,25 +84,70 @@ func NewS3Store(baseURL *url.URL, extension, compressionType string, overwrite b
 	return newS3StoreContext(ctx, baseURL, extension, compressionType, overwrite, opts...)
 }
 
-func newS3StoreContext(_ context.Context, baseURL *url.URL, extension, compressionType string, overwrite bool, opts ...Option) (*S3Store, error) {
+func newS3StoreContext(ctx context.Context, baseURL *url.URL, extension, compressionType string, overwrite bool, opts ...Option) (*S3Store, error) {
 	conf := config{}
 	for _, opt := range opts {
 		opt.apply(&conf)
 	}
+	if conf.err != nil {
+		return nil, conf.err
+	}
+	baseURL = withDefaultPrefix(baseURL, conf.defaultPrefix)
+
+	var acl *string
+	if conf.objectACL != "" {
+		if compat, _, _ := s3CompatProfileOf(baseURL); compat.noObjectACL {
+			return nil, fmt.Errorf("object ACL is not supported by s3 compat %q", baseURL.Query().Get("compat"))
+		}
+
+		for _, known := range s3.ObjectCannedACL_Values() {
+			if conf.objectACL == known {
+				acl = aws.String(known)
+			}
+		}
+		if acl == nil {
+			return nil, fmt.Errorf("invalid object ACL %q, expected one of %s", conf.objectACL, strings.Join(s3.ObjectCannedACL_Values(), ", "))
+		}
+	}
 
 	common := &commonStore{
 		compressionType:           compressionType,
 		extension:                 extension,
 		overwrite:                 overwrite,
+		skipDirectoryMarkers:      conf.skipDirectoryMarkers,
+		sizeValidation:            conf.sizeValidation,
+		listPageSize:              conf.listPageSize,
+		sharder:                   conf.sharder,
+		objectPathFunc:            conf.objectPathFunc,
+		keySeparator:              conf.keySeparator,
 		uncompressedReadCallback:  conf.uncompressedReadCallback,
 		compressedReadCallback:    conf.compressedReadCallback,
 		uncompressedWriteCallback: conf.uncompressedWriteCallback,
 		compressedWriteCallback:   conf.compressedWriteCallback,
+		writeStatsCallback:        conf.writeStatsCallback,
+		overwriteSkipCallback:     conf.overwriteSkipCallback,
+		baseContext:               conf.baseContextOr(ctx),
+		uploadBuffers:             conf.uploadBuffers,
+		keepLocalAfterPush:        conf.keepLocalAfterPush,
+		clampFutureMTimes:         conf.clampFutureMTimes,
+		errorOnEmptyWrite:         conf.errorOnEmptyWrite,
+		deleteIgnoreNotFound:      conf.deleteIgnoreNotFound,
+		walkProgressCallback:      conf.walkProgressCallback,
+		operationTimeout:          conf.operationTimeout,
+		existenceCache:            newExistenceCache(conf.existenceCacheTTL),
+		existenceBloom:            newExistenceBloom(conf.existenceBloomHint, conf.existenceBloomHintMaxAge),
+		zstdDecoders:              zstdDecoderPoolFor(conf.zstdDecoderConcurrency, conf.zstdMaxIdleDecoders),
+		postWriteHook:             conf.postWriteHook,
+		retryObserver:             conf.retryObserver,
+		compressionDetection:      conf.compressionDetection,
 	}
 
 	s := &S3Store{
-		baseURL:     baseURL,
-		commonStore: common,
+		baseURL:            baseURL,
+		commonStore:        common,
+		contentMD5:         conf.s3ContentMD5,
+		retryableErrorFunc: conf.retryableErrorFunc,
+		acl:                acl,
 	}
 
 	awsConfig, bucket, path, err := ParseS3URL(baseURL)
@@ -96,11 +155,25 @@ func newS3StoreContext(_ context.Context, baseURL *url.URL, extension, compressi
 		return nil, fmt.Errorf("invalid s3 url: %w", err)
 	}
 
+	if conf.httpClient != nil {
+		awsConfig.HTTPClient = conf.httpClient
+	}
+
 	sess, err := session.NewSession(awsConfig)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching AWS session info from env: %w", err)
 	}
+	sess.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(conf.userAgentOrDefault()))
+	if isRetryable := conf.retryableErrorFunc; isRetryable != nil {
+		// Retry handlers run before the SDK classification, which keeps an already set decision
+		sess.Handlers.Retry.PushBack(func(r *request.Request) {
+			if r.Error != nil && isRetryable(r.Error) {
+				r.Retryable = aws.Bool(true)
+			}
+		})
+	}
 
+	s.session = sess
 	s.service = s3.New(sess)
 	s.uploader = s3manager.NewUploader(sess)
 	s.bucket = bucket
@@ -113,7 +186,19 @@ func (s *S3Store) Clone(ctx context.Context, opts ...Option) (Store, error) {
 	return newS3StoreContext(ctx, s.baseURL, s.extension, s.compressionType, s.overwrite, opts...)
 }
 
+func (s *S3Store) Rebase(ctx context.Context, baseURL string, opts ...Option) (Store, error) {
+	return s.rebase(ctx, baseURL, func(config *config) {
+		config.s3ContentMD5 = s.contentMD5
+		config.retryableErrorFunc = s.retryableErrorFunc
+		config.objectACL = aws.StringValue(s.acl)
+	}, opts)
+}
+
 func (s *S3Store) SubStore(subFolder string) (Store, error) {
+	if err := s.subStoreErr(subFolder); err != nil {
+		return nil, err
+	}
+
 	url, err := url.Parse(s.baseURL.String())
 	if err != nil {
 		return nil, fmt.Errorf("s3 store parsing base url: %w", err)
@@ -123,24 +208,121 @@ func (s *S3Store) SubStore(subFolder string) (Store, error) {
 	return &S3Store{
 		baseURL:     url,
 		commonStore: s.commonStore,
+		session:     s.session,
 		service:     s.service,
 		uploader:    s.uploader,
 		bucket:      s.bucket,
 		path:        newPath,
+		contentMD5:  s.contentMD5,
+		acl:         s.acl,
+
+		retryableErrorFunc: s.retryableErrorFunc,
 	}, nil
 }
 
+// serviceFor returns the client to use for an operation, a one-off client using the overridden
+// credentials when the context carries some, see `WithRequestCredentials`.
+func (s *S3Store) serviceFor(ctx context.Context) (*s3.S3, error) {
+	creds := requestCredentialsFromContext(ctx)
+	if creds == nil {
+		return s.service, nil
+	}
+	if creds.S3 == nil {
+		return nil, missingRequestCredentials("S3")
+	}
+
+	return s3.New(s.session, &aws.Config{Credentials: creds.S3}), nil
+}
+
+func (s *S3Store) uploaderFor(ctx context.Context) (*s3manager.Uploader, error) {
+	if requestCredentialsFromContext(ctx) == nil {
+		return s.uploader, nil
+	}
+
+	service, err := s.serviceFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s3manager.NewUploaderWithClient(service), nil
+}
+
+// s3MaxListPageSize is the maximum number of keys S3 returns per `ListObjectsV2` page
+const s3MaxListPageSize = 1000
+
+// DefaultS3CustomEndpointRegion is the region used when a custom (non-AWS) S3 endpoint is
+// configured without a `region` query parameter. Such deployments (MinIO, SeaweedFS, ...)
+// usually ignore the region, but the AWS SDK still requires a non-empty one for signing.
+var DefaultS3CustomEndpointRegion = "us-east-1"
+
+// s3CompatProfile holds the known-good settings of an S3 compatible provider, selected with the
+// `compat` query parameter of S3 URLs, see `ParseS3URL`.
+type s3CompatProfile struct {
+	// defaultRegion is used when the URL has no `region`, the provider ignoring it
+	defaultRegion string
+
+	// disableContentMD5 disables the Content-MD5 the SDK computes on uploads and validates on
+	// downloads, which the provider does not honor
+	disableContentMD5 bool
+
+	// noObjectACL rejects `WithObjectACL`, the provider not supporting per-object ACLs
+	noObjectACL bool
+}
+
+var s3CompatProfiles = map[string]s3CompatProfile{
+	"r2":    {defaultRegion: "auto", disableContentMD5: true, noObjectACL: true},
+	"b2":    {disableContentMD5: true, noObjectACL: true},
+	"minio": {},
+	"ceph":  {},
+}
+
+// s3CompatProfileOf returns the profile selected by the `compat` query parameter of `s3URL`, if any
+func s3CompatProfileOf(s3URL *url.URL) (profile s3CompatProfile, found bool, err error) {
+	compat := s3URL.Query().Get("compat")
+	if compat == "" {
+		return profile, false, nil
+	}
+
+	profile, found = s3CompatProfiles[compat]
+	if !found {
+		return profile, false, fmt.Errorf("unsupported s3 compat %q, expected one of r2, b2, minio, ceph", compat)
+	}
+	return profile, true, nil
+}
+
+// ParseS3URL returns the AWS configuration, the bucket and the path of `s3URL`. The `compat`
+// query parameter (`r2`, `b2`, `minio` or `ceph`) tunes the configuration for S3 compatible
+// providers: path-style addressing, which they all support, default region and Content-MD5
+// checksums. It requires a custom endpoint, like `s3://<account>.r2.cloudflarestorage.com/bucket/path?compat=r2`.
 func ParseS3URL(s3URL *url.URL) (config *aws.Config, bucket string, path string, err error) {
+	hasEndpoint := hasCustomEndpoint(s3URL)
+
+	compat, hasCompat, err := s3CompatProfileOf(s3URL)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if hasCompat && (!hasEndpoint || isAWSEndpoint(s3URL)) {
+		return nil, "", "", fmt.Errorf("s3 compat %[1]q requires a custom endpoint, like: s3://endpoint/bucket/path?compat=%[1]s", s3URL.Query().Get("compat"))
+	}
+
 	region := s3URL.Query().Get("region")
 	if region == "" {
-		return nil, "", "", fmt.Errorf("specify s3 bucket like: s3://bucket/path?region=us-east-1")
+		if !hasEndpoint || isAWSEndpoint(s3URL) {
+			return nil, "", "", fmt.Errorf("specify s3 bucket like: s3://bucket/path?region=us-east-1")
+		}
+
+		region = DefaultS3CustomEndpointRegion
+		if compat.defaultRegion != "" {
+			region = compat.defaultRegion
+		}
 	}
 
 	awsConfig := &aws.Config{
 		Region: &region,
 	}
+	if compat.disableContentMD5 {
+		awsConfig.S3DisableContentMD5Validation = aws.Bool(true)
+	}
 
-	hasEndpoint := hasCustomEndpoint(s3URL)
 	if hasEndpoint {
 		awsConfig.Endpoint = aws.String(s3URL.Host)
 		awsConfig.S3ForcePathStyle = aws.Bool(true)
@@ -190,92 +372,450 @@ func hasCustomEndpoint(s3URL *url.URL) bool {
 	return s3URL.Query().Get("infer_aws_endpoint") == ""
 }
 
+func isAWSEndpoint(s3URL *url.URL) bool {
+	host := s3URL.Hostname()
+	return host == "amazonaws.com" || strings.HasSuffix(host, ".amazonaws.com")
+}
+
 func (s *S3Store) BaseURL() *url.URL {
 	return s.baseURL
 }
 
 func (s *S3Store) ObjectPath(name string) string {
-	return path.Join(s.path, s.pathWithExt(name))
+	return path.Join(s.path, s.shardedPathWithExt(name))
 }
 
 func (s *S3Store) ObjectURL(name string) string {
-	return fmt.Sprintf("%s/%s", strings.TrimRight(s.baseURL.String(), "/"), strings.TrimLeft(s.pathWithExt(name), "/"))
+	return objectURL(s.baseURL, s.shardedPathWithExt(name))
+}
+
+func (s *S3Store) SupportsConcurrentWrites() bool {
+	return true
 }
 
 func (s *S3Store) WriteObject(ctx context.Context, base string, f io.Reader) (err error) {
+	return s.writeObject(ctx, base, f, -1)
+}
+
+func (s *S3Store) WriteObjectSized(ctx context.Context, base string, f io.Reader, size int64) (err error) {
+	return s.writeObject(ctx, base, f, size)
+}
+
+func (s *S3Store) WriteObjectSeekable(ctx context.Context, base string, rs io.ReadSeeker) error {
+	return writeObjectSeekable(ctx, s, base, rs, s.isRetryableError, s.observeRetry)
+}
+
+// isRetryableError classifies the write failures of `WriteObjectSeekable` like the SDK retryer
+// classifies failed requests, the ones `WithRetryableErrorFunc` accepts being transient too.
+func (s *S3Store) isRetryableError(err error) bool {
+	if s.retryableErrorFunc != nil && s.retryableErrorFunc(err) {
+		return true
+	}
+
+	// Upload manager failures wrap the failed request error
+	var aerr awserr.Error
+	for errors.As(err, &aerr) {
+		if reqErr, ok := aerr.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+			return true
+		}
+		if request.IsErrorRetryable(aerr) || request.IsErrorThrottle(aerr) {
+			return true
+		}
+		err = aerr.OrigErr()
+	}
+	return false
+}
+
+// UploadFrom uploads uncompressed content with the S3 uploader reading parts concurrently from
+// `r`, without buffering them. Compressed stores, or ones validating the Content-MD5, go through
+// `WriteObjectSized`.
+func (s *S3Store) UploadFrom(ctx context.Context, base string, r io.ReaderAt, size int64) error {
+	if s.compressionType != "" || s.contentMD5 {
+		return uploadFrom(ctx, s, base, r, size)
+	}
+
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	ctx = withFileName(ctx, base)
+	ctx = withStoreType(ctx, "s3store")
+	ctx = withLogger(ctx, zlog, tracer)
+
+	if err := s.ensureWritable(); err != nil {
+		return err
+	}
+
+	uploader, err := s.uploaderFor(ctx)
+	if err != nil {
+		return err
+	}
+
+	skip, err := s.skipExistingObject(ctx, base, s.ObjectURL(base), s.fileExists)
+	if err != nil || skip {
+		return err
+	}
+
+	if err := s.nonEmptySize(size); err != nil {
+		return err
+	}
+
+	partSize := s3PartSize(size)
+	_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(s.ObjectPath(base)),
+		Body:     io.NewSectionReader(r, 0, size),
+		ACL:      s.acl,
+		Metadata: aws.StringMap(s.compressionMetadata(ctx, CompressionMetadataKey)),
+	}, func(u *s3manager.Uploader) {
+		u.PartSize = partSize
+	})
+	if err != nil {
+		return fmt.Errorf("uploading to S3 through manager: %w", err)
+	}
+
+	s.reportUncompressedUpload(ctx, size)
+	s.reportWritten(ctx, base, s.ObjectURL(base), s.ObjectAttributes)
+	return nil
+}
+
+// writeObject uploads the object, `size` is the known uncompressed size of the content
+// or -1 if unknown, the upload being tuned with the size stored, see `storedSizeBound`.
+func (s *S3Store) writeObject(ctx context.Context, base string, f io.Reader, size int64) (err error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	size = s.storedSizeBound(size)
+
 	ctx = withFileName(ctx, base)
 	ctx = withStoreType(ctx, "s3store")
 	ctx = withLogger(ctx, zlog, tracer)
 
+	if err := s.ensureWritable(); err != nil {
+		return err
+	}
+
 	objPath := s.ObjectPath(base)
 
-	exists, err := s.FileExists(ctx, base)
+	uploader, err := s.uploaderFor(ctx)
+	if err != nil {
+		return err
+	}
+
+	skip, err := s.skipExistingObject(ctx, base, s.ObjectURL(base), s.fileExists)
+	if err != nil || skip {
+		return err
+	}
+
+	f, err = s.nonEmptySource(f)
 	if err != nil {
 		return err
 	}
 
-	if !s.overwrite && exists {
-		// We silently ignore when we ask not to overwrite
-		return nil
+	if s.contentMD5 && size >= 0 && size <= S3ContentMD5PutObjectMaxSize {
+		return s.putObjectWithMD5(ctx, base, objPath, f, size)
 	}
 
+	partSize := uploader.PartSize
+	if size >= 0 {
+		partSize = s3PartSize(size)
+	}
+
+	releaseBuffers, err := s.uploadBuffers.acquire(ctx, s3UploadBuffersSize(size, partSize, uploader.Concurrency))
+	if err != nil {
+		return err
+	}
+	defer releaseBuffers()
+
 	pr, pw := io.Pipe()
 	writeDone := make(chan error, 1)
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-
+	var stats writeStats
 	go func(ctx context.Context) {
-		defer wg.Done()
-
-		err := s.compressedCopy(ctx, pw, f)
-		writeDone <- err
-		pw.Close() // required to allow the uploader to complete
-
+		var err error
+		stats, err = s.compressedCopyWithStats(ctx, pw, f)
 		if err != nil {
+			// Fails the upload reading from the pipe instead of letting it complete a truncated object
+			pw.CloseWithError(err)
 			cancel()
+		} else {
+			pw.Close() // required to allow the uploader to complete
 		}
+		writeDone <- err
 	}(ctx)
 
-	_, err = s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-		Bucket: aws.String(s.bucket),
-		Key:    &objPath,
-		Body:   pr,
-	})
+	var uploaderOpts []func(*s3manager.Uploader)
+	if size >= 0 {
+		uploaderOpts = append(uploaderOpts, func(u *s3manager.Uploader) {
+			u.PartSize = partSize
+		})
+	}
+	if s.contentMD5 {
+		// Parts are uploaded from seekable buffers, for which the SDK computes and sends the
+		// Content-MD5 unless disabled in the session configuration
+		uploaderOpts = append(uploaderOpts, func(u *s3manager.Uploader) {
+			u.RequestOptions = append(u.RequestOptions, func(r *request.Request) {
+				r.Config.S3DisableContentMD5Validation = aws.Bool(false)
+			})
+		})
+	}
+
+	_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      &objPath,
+		Body:     pr,
+		ACL:      s.acl,
+		Metadata: aws.StringMap(s.compressionMetadata(ctx, CompressionMetadataKey)),
+	}, uploaderOpts...)
 	if err != nil {
-		select {
-		case err2 := <-writeDone:
-			if err2 != nil {
-				return fmt.Errorf("writing through pipe: %w", err2)
-			}
-		default:
-			// error was generated in the Upload (s3 or context timeout), compressedCopy is not finished,
-			// we make it fail. double closing is safe here
-			pw.Close()
+		// Unblocks the compression if it's still writing to the pipe, then waits for it, its
+		// error being the root cause of the upload failure when there is one
+		pr.CloseWithError(err)
+		if copyErr := <-writeDone; copyErr != nil {
+			return fmt.Errorf("writing through pipe: %w", copyErr)
 		}
 		return fmt.Errorf("uploading to S3 through manager: %w", err)
 	}
 
-	wg.Wait()
+	if err := <-writeDone; err != nil {
+		return fmt.Errorf("writing through pipe: %w", err)
+	}
 
+	s.reportWriteStats(ctx, stats)
+	s.reportWritten(ctx, base, s.ObjectURL(base), s.ObjectAttributes)
 	return nil
 }
 
+// s3PartSize returns the multipart upload part size to use for content of the given
+// size, the default one unless the content is too big for the parts limit. The uploader
+// sends content smaller than a part in a single `PutObject` request whether its size is
+// known or not, knowing it only matters to bigger content.
+func s3PartSize(size int64) int64 {
+	partSize := s3manager.DefaultUploadPartSize
+	if size/partSize >= s3manager.MaxUploadParts {
+		partSize = (size / s3manager.MaxUploadParts) + 1
+	}
+	return partSize
+}
+
+// S3ContentMD5PutObjectMaxSize is the biggest known object size uploaded through a single
+// `PutObject` when `WithS3ContentMD5Validation` is used, the default multipart upload part size.
+var S3ContentMD5PutObjectMaxSize int64 = s3manager.DefaultUploadPartSize
+
+// putObjectWithMD5 compresses the whole content in memory, computing its MD5 on the way, and
+// uploads it with a single `PutObject` request carrying the MD5 for S3 to validate it.
+func (s *S3Store) putObjectWithMD5(ctx context.Context, base, objPath string, f io.Reader, size int64) error {
+	releaseBuffers, err := s.uploadBuffers.acquire(ctx, size)
+	if err != nil {
+		return err
+	}
+	defer releaseBuffers()
+
+	service, err := s.serviceFor(ctx)
+	if err != nil {
+		return err
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	hasher := md5.New()
+	stats, err := s.compressedCopyWithStats(ctx, io.MultiWriter(buffer, hasher), f)
+	if err != nil {
+		return err
+	}
+
+	_, err = service.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        &objPath,
+		Body:       bytes.NewReader(buffer.Bytes()),
+		ContentMD5: aws.String(base64.StdEncoding.EncodeToString(hasher.Sum(nil))),
+		ACL:        s.acl,
+		Metadata:   aws.StringMap(s.compressionMetadata(ctx, CompressionMetadataKey)),
+	})
+	if err != nil {
+		return fmt.Errorf("putting object %q to S3: %w", base, err)
+	}
+
+	s.reportWriteStats(ctx, stats)
+	s.reportWritten(ctx, base, s.ObjectURL(base), s.ObjectAttributes)
+	return nil
+}
+
+// s3UploadBuffersSize returns the memory the uploader buffers for an upload of `size` bytes,
+// a part buffer per part uploaded concurrently, all of them when the size is unknown.
+func s3UploadBuffersSize(size, partSize int64, concurrency int) int64 {
+	parts := int64(concurrency)
+	if size >= 0 {
+		if sizeParts := (size + partSize - 1) / partSize; sizeParts < parts {
+			parts = sizeParts
+		}
+		if parts < 1 {
+			parts = 1
+		}
+	}
+	return parts * partSize
+}
+
+// CopyObject copies the object server-side, its content, metadata and headers being kept as is,
+// with the store's ACL, see `WithObjectACL`. Objects bigger than 5 GiB cannot be copied in a
+// single request and are refused by S3.
 func (s *S3Store) CopyObject(ctx context.Context, src, dest string) error {
-	// TODO optimize this
-	reader, err := s.OpenObject(ctx, src)
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	service, err := s.serviceFor(ctx)
 	if err != nil {
 		return err
 	}
-	defer reader.Close()
 
-	return s.WriteObject(ctx, dest, reader)
+	destPath := s.ObjectPath(dest)
+	copySource := (&url.URL{Path: s.bucket + "/" + s.ObjectPath(src)}).EscapedPath()
+	_, err = service.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        &destPath,
+		CopySource: &copySource,
+		ACL:        s.acl,
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return ErrNotFound
+		}
+		return fmt.Errorf("copying object %q to %q: %w", src, dest, err)
+	}
+
+	s.existenceBloom.add(s.ObjectURL(dest))
+	return nil
+}
+
+// Touch copies the object onto itself to bump its last modified time. S3 only accepts such a
+// copy when replacing the metadata, the existing one is carried over unchanged. Objects bigger
+// than 5 GiB cannot be copied in a single request and are refused by S3.
+func (s *S3Store) Touch(ctx context.Context, base string) error {
+	err := s.copyInPlace(ctx, base, func(metadata map[string]*string) map[string]*string {
+		return metadata
+	})
+	if err != nil && err != ErrNotFound {
+		return fmt.Errorf("touching object %q: %w", base, err)
+	}
+	return err
+}
+
+func (s *S3Store) SetObjectMetadata(ctx context.Context, base string, md map[string]string) error {
+	err := s.copyInPlace(ctx, base, func(metadata map[string]*string) map[string]*string {
+		merged := map[string]*string{}
+		for key, value := range metadata {
+			merged[strings.ToLower(key)] = value
+		}
+		for key, value := range md {
+			merged[strings.ToLower(key)] = aws.String(value)
+		}
+		return merged
+	})
+	if err != nil && err != ErrNotFound {
+		return fmt.Errorf("setting metadata of object %q: %w", base, err)
+	}
+	return err
+}
+
+func (s *S3Store) GetObjectMetadata(ctx context.Context, base string) (map[string]string, error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	path := s.ObjectPath(base)
+
+	service, err := s.serviceFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := service.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    &path,
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	// The SDK canonicalizes the keys as HTTP headers, S3 keeps them lower cased
+	md := map[string]string{}
+	for key, value := range head.Metadata {
+		md[strings.ToLower(key)] = aws.StringValue(value)
+	}
+	return md, nil
+}
+
+// copyInPlace copies the object `base` onto itself, which bumps its last modified time, with
+// the metadata returned by `metadata` from its current one. Replacing the metadata resets the
+// headers, storage class, encryption and ACL not sent along, they are carried over from the
+// object, the ACL being the store's one, see `WithObjectACL`.
+func (s *S3Store) copyInPlace(ctx context.Context, base string, metadata func(current map[string]*string) map[string]*string) error {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	path := s.ObjectPath(base)
+
+	service, err := s.serviceFor(ctx)
+	if err != nil {
+		return err
+	}
+
+	head, err := service.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    &path,
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	copySource := (&url.URL{Path: s.bucket + "/" + path}).EscapedPath()
+	_, err = service.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:                  aws.String(s.bucket),
+		Key:                     &path,
+		CopySource:              &copySource,
+		MetadataDirective:       aws.String(s3.MetadataDirectiveReplace),
+		Metadata:                metadata(head.Metadata),
+		ACL:                     s.acl,
+		StorageClass:            head.StorageClass,
+		ContentType:             head.ContentType,
+		ContentEncoding:         head.ContentEncoding,
+		ContentDisposition:      head.ContentDisposition,
+		ContentLanguage:         head.ContentLanguage,
+		CacheControl:            head.CacheControl,
+		WebsiteRedirectLocation: head.WebsiteRedirectLocation,
+		ServerSideEncryption:    head.ServerSideEncryption,
+		SSEKMSKeyId:             head.SSEKMSKeyId,
+		BucketKeyEnabled:        head.BucketKeyEnabled,
+	})
+	return err
 }
+
 func (s *S3Store) FileExists(ctx context.Context, base string) (bool, error) {
+	if s.existenceBloom.definitelyAbsent(ctx, s, base) {
+		return false, nil
+	}
+	return s.fileExists(ctx, base)
+}
+
+// fileExists checks the existence of the object with the backend, regardless of the existence
+// bloom hint, see `WithExistenceBloomHint`
+func (s *S3Store) fileExists(ctx context.Context, base string) (bool, error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
 	path := s.ObjectPath(base)
 
-	_, err := s.service.HeadObject(&s3.HeadObjectInput{
+	service, err := s.serviceFor(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = service.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    &path,
 	})
@@ -291,23 +831,174 @@ func (s *S3Store) FileExists(ctx context.Context, base string) (bool, error) {
 }
 
 func (s *S3Store) ObjectAttributes(ctx context.Context, base string) (*ObjectAttributes, error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
 	path := s.ObjectPath(base)
 
-	output, err := s.service.HeadObject(&s3.HeadObjectInput{
+	service, err := s.serviceFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := service.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    &path,
 	})
 	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return nil, ErrNotFound
+		}
+
 		return nil, err
 	}
 
 	return &ObjectAttributes{
-		LastModified: *output.LastModified,
+		LastModified: s.clampedMTime(base, *output.LastModified),
 		Size:         *output.ContentLength,
 	}, nil
 }
 
+func (s *S3Store) WriteFrom(ctx context.Context, base string, src Store, srcName string) error {
+	return writeFrom(ctx, s, base, src, srcName)
+}
+
 func (s *S3Store) OpenObject(ctx context.Context, name string) (out io.ReadCloser, err error) {
+	return s.openObject(ctx, name, s.compressionType, true, time.Time{})
+}
+
+func (s *S3Store) OpenObjectIfModifiedSince(ctx context.Context, name string, since time.Time) (io.ReadCloser, bool, error) {
+	return openedIfModified(s.openObject(ctx, name, s.compressionType, true, since))
+}
+
+// DownloadTo downloads the object into `w` with the S3 downloader, fetching ranges in parallel,
+// when the store is not compressed and `w` is an `io.WriterAt`, through `OpenObject` otherwise
+// or when the object is recorded as compressed.
+func (s *S3Store) DownloadTo(ctx context.Context, name string, w io.Writer) (int64, error) {
+	writerAt, ok := w.(io.WriterAt)
+	if !ok || s.compressionType != "" {
+		return downloadTo(ctx, s, name, w)
+	}
+
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	ctx = withFileName(ctx, s.ObjectPath(name))
+	ctx = withStoreType(ctx, "s3store")
+
+	service, err := s.serviceFor(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.ObjectPath(name)),
+	}
+	if s.compressionDetection {
+		// The recorded compression is checked first, the ranges then being fetched from the
+		// version of the object checked
+		head, err := service.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: input.Bucket,
+			Key:    input.Key,
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+				return 0, ErrNotFound
+			}
+			return 0, err
+		}
+		if s.recordedCompression(aws.StringValueMap(head.Metadata), CompressionMetadataKey) != "" {
+			return downloadTo(ctx, s, name, w)
+		}
+		input.IfMatch = head.ETag
+	}
+
+	written, err := s3manager.NewDownloaderWithClient(service).DownloadWithContext(ctx, writerAt, input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return written, ErrNotFound
+		}
+		return written, fmt.Errorf("s3 download object %q: %w", name, err)
+	}
+
+	if s.compressedReadCallback != nil {
+		s.compressedReadCallback(ctx, int(written))
+	}
+	if s.uncompressedReadCallback != nil {
+		s.uncompressedReadCallback(ctx, int(written))
+	}
+	return written, nil
+}
+
+// PeekObject fetches only the first `n` bytes with a ranged request on stores without
+// compression, streaming through `OpenObject` otherwise or when the object is recorded as
+// compressed.
+func (s *S3Store) PeekObject(ctx context.Context, name string, n int) ([]byte, error) {
+	if s.compressionType != "" {
+		return peekObject(ctx, s, name, n)
+	}
+	if n <= 0 {
+		return []byte{}, nil
+	}
+
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	service, err := s.serviceFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := service.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.ObjectPath(name)),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", n-1)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case s3.ErrCodeNoSuchKey:
+				return nil, ErrNotFound
+			case "InvalidRange":
+				// The object is empty, no range of it is satisfiable
+				return []byte{}, nil
+			}
+		}
+		return nil, err
+	}
+
+	if s.recordedCompression(aws.StringValueMap(output.Metadata), CompressionMetadataKey) != "" {
+		output.Body.Close()
+		return peekObject(ctx, s, name, n)
+	}
+
+	reader, err := s.uncompressedReaderWith(ctx, output.Body, "")
+	if err != nil {
+		return nil, err
+	}
+	return readPeeked(reader, n)
+}
+
+func (s *S3Store) OpenObjectWithCompression(ctx context.Context, name string, compressionType string) (out io.ReadCloser, err error) {
+	return s.openObject(ctx, name, compressionType, false, time.Time{})
+}
+
+// openObject opens the object, when `since` is not zero only if it was modified after `since`,
+// `errNotModified` being returned otherwise. The compression recorded in the object's metadata,
+// if any, replaces `compressionType` when `detectCompression` is set, see
+// `WithCompressionDetectionOnWrite`.
+func (s *S3Store) openObject(ctx context.Context, name string, compressionType string, detectCompression bool, since time.Time) (out io.ReadCloser, err error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer func() {
+		// The operation lasts until the returned reader is closed
+		if err != nil {
+			cancelOperation()
+			return
+		}
+		out = wrapReadCloser(out, cancelOperation)
+	}()
+
 	ctx = withStoreType(ctx, "s3store")
 	ctx = withLogger(ctx, zlog, tracer)
 
@@ -318,6 +1009,11 @@ func (s *S3Store) OpenObject(ctx context.Context, name string) (out io.ReadClose
 		zlog.Debug("opening dstore file", zap.String("path", path))
 	}
 
+	service, err := s.serviceFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	for i := 0; i < s3ReadAttempts; i++ {
 		if i > 0 { // small wait on retry
 			zlog.Debug("got an error on s3 OpenObject, retrying",
@@ -327,14 +1023,23 @@ func (s *S3Store) OpenObject(ctx context.Context, name string) (out io.ReadClose
 				zap.String("name", name),
 				zap.String("path", path),
 			)
-			time.Sleep(500 * time.Millisecond)
+			s.observeRetry("OpenObject", i, err, true)
+			time.Sleep(s3ReadRetryDelay)
 		}
-		var reader *s3.GetObjectOutput
-		reader, err = s.service.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		input := &s3.GetObjectInput{
 			Bucket: aws.String(s.bucket),
 			Key:    &path,
-		})
+		}
+		if !since.IsZero() {
+			input.IfModifiedSince = aws.Time(since)
+		}
+
+		var reader *s3.GetObjectOutput
+		reader, err = service.GetObjectWithContext(ctx, input)
 		if err != nil {
+			if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotModified {
+				return nil, errNotModified
+			}
 			if aerr, ok := err.(awserr.Error); ok {
 				switch aerr.Code() {
 				case s3.ErrCodeNoSuchBucket:
@@ -345,6 +1050,15 @@ func (s *S3Store) OpenObject(ctx context.Context, name string) (out io.ReadClose
 			}
 			continue
 		}
+
+		expectedSize := int64(-1)
+		if reader.ContentLength != nil {
+			expectedSize = *reader.ContentLength
+		}
+		if detectCompression && s.compressionDetection {
+			compressionType = detectedCompression(aws.StringValueMap(reader.Metadata), CompressionMetadataKey, compressionType)
+		}
+
 		if bufferedS3Read {
 			var data []byte
 			data, err = ioutil.ReadAll(reader.Body)
@@ -354,36 +1068,72 @@ func (s *S3Store) OpenObject(ctx context.Context, name string) (out io.ReadClose
 			if err = reader.Body.Close(); err != nil {
 				continue
 			}
-			out, err = s.uncompressedReader(ctx, ioutil.NopCloser(bytes.NewReader(data)))
+			out, err = s.uncompressedReaderWith(ctx, s.sizeValidatedReader(ioutil.NopCloser(bytes.NewReader(data)), expectedSize), compressionType)
 		} else {
-			out, err = s.uncompressedReader(ctx, reader.Body)
+			out, err = s.uncompressedReaderWith(ctx, s.sizeValidatedReader(reader.Body, expectedSize), compressionType)
 		}
 		if tracer.Enabled() {
 			out = wrapReadCloser(out, func() {
 				zlog.Debug("closing dstore file", zap.String("path", path))
 			})
 		}
+		if i > 0 {
+			s.observeRetry("OpenObject", i+1, err, false)
+		}
 		return out, err
 	}
+	s.observeRetry("OpenObject", s3ReadAttempts, err, false)
 	return nil, fmt.Errorf("s3 open object (%d attempts, buffered_read: %v): %w", s3ReadAttempts, bufferedS3Read, err)
 }
 
 func (s *S3Store) WalkFrom(ctx context.Context, prefix, startingPoint string, f func(filename string) (err error)) error {
-	targetPrefix := s.path
-	if targetPrefix != "" {
-		targetPrefix += "/"
+	if s.isSharded() {
+		return commonWalkFrom(s, ctx, prefix, startingPoint, f)
 	}
-	if prefix != "" {
-		targetPrefix = filepath.Join(targetPrefix, prefix)
-		if prefix[len(prefix)-1:] == "/" {
-			targetPrefix += "/"
-		}
+	return s.walkFrom(ctx, prefix, startingPoint, f)
+}
+
+// s3StartAfter returns the `StartAfter` value listing the keys from `key` included. To match
+// 'helloworld.html', the last byte is decremented and followed by the highest code point, giving
+// 'helloworld.htmk\U0010FFFF' which is after every key listed before 'helloworld.html' in practice,
+// so the server skips them all. When the last character is not ASCII, it is trimmed instead,
+// giving 'helloworld.htm', the keys in between being filtered out again in the walk function.
+func s3StartAfter(key string) string {
+	last := key[len(key)-1]
+	if last == 0 || last >= utf8.RuneSelf {
+		_, size := utf8.DecodeLastRuneInString(key)
+		return key[:len(key)-size]
+	}
+
+	return key[:len(key)-1] + string(rune(last-1)) + string(utf8.MaxRune)
+}
+
+func (s *S3Store) walkFrom(ctx context.Context, prefix, startingPoint string, f func(filename string) (err error)) error {
+	return s.walkFromWithAttributes(ctx, prefix, startingPoint, func(file FileWithAttrs) error {
+		return f(file.Name)
+	})
+}
+
+func (s *S3Store) walkWithAttributes(ctx context.Context, prefix string, f func(file FileWithAttrs) error) error {
+	if s.isSharded() {
+		return walkWithObjectAttributes(ctx, s, prefix, f)
 	}
+	return s.walkFromWithAttributes(ctx, prefix, "", f)
+}
+
+func (s *S3Store) walkFromWithAttributes(ctx context.Context, prefix, startingPoint string, f func(file FileWithAttrs) error) error {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	targetPrefix := s.listPrefix(prefix)
 
 	q := &s3.ListObjectsV2Input{
 		Bucket: aws.String(s.bucket),
 		Prefix: &targetPrefix,
 	}
+	if pageSize := s.cappedListPageSize(s3MaxListPageSize); pageSize > 0 {
+		q.MaxKeys = aws.Int64(int64(pageSize))
+	}
 
 	if startingPoint != "" {
 		if !strings.HasPrefix(startingPoint, prefix) {
@@ -395,12 +1145,9 @@ func (s *S3Store) WalkFrom(ctx context.Context, prefix, startingPoint string, f
 		// "original prefix" from the "startingPoint" and append it to the real "final" prefix instead.
 		relativeStartingPoint := strings.TrimPrefix(startingPoint, prefix)
 
-		// to match 'helloworld.html' by using startAfter, we use 'helloworld.htm' (and we filter again in the walk function  to filter out 'helloworld.htm0')
-		if len(relativeStartingPoint) > 1 {
-			rightBeforeStartingPoint := relativeStartingPoint[0 : len(relativeStartingPoint)-1]
-			startAfter := targetPrefix + rightBeforeStartingPoint
-
-			// StartAfter is also known as 'marker' within S3 compatible layer
+		// StartAfter is also known as 'marker' within S3 compatible layer
+		if relativeStartingPoint != "" {
+			startAfter := s3StartAfter(targetPrefix + s.flatKey(relativeStartingPoint))
 			q.StartAfter = &startAfter
 		}
 	}
@@ -409,9 +1156,21 @@ func (s *S3Store) WalkFrom(ctx context.Context, prefix, startingPoint string, f
 		zlog.Info("walking files from", zap.String("original_prefix", targetPrefix), zap.String("prefix", targetPrefix), zap.Stringp("start_after", q.StartAfter))
 	}
 
+	service, err := s.serviceFor(ctx)
+	if err != nil {
+		return err
+	}
+
 	var innerErr error
-	err := s.service.ListObjectsV2PagesWithContext(ctx, q, func(page *s3.ListObjectsV2Output, _ bool) bool {
+	progress := s.newWalkProgress(ctx)
+	err = service.ListObjectsV2PagesWithContext(ctx, q, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		progress.pageFetched(len(page.Contents))
+
 		for _, el := range page.Contents {
+			if s.isSkippedDirectoryMarker(*el.Key) {
+				continue
+			}
+
 			filename := s.toBaseName(*el.Key)
 			if filename == "" {
 				zlog.Debug("got an empty filename from s3 store, ignoring it", zap.String("key", *el.Key))
@@ -424,7 +1183,11 @@ func (s *S3Store) WalkFrom(ctx context.Context, prefix, startingPoint string, f
 				}
 			}
 
-			if err := f(filename); err != nil {
+			file := FileWithAttrs{Name: filename, ObjectAttributes: ObjectAttributes{
+				Size:         aws.Int64Value(el.Size),
+				LastModified: s.clampedMTime(filename, aws.TimeValue(el.LastModified)),
+			}}
+			if err := f(file); err != nil {
 				if errors.Is(err, StopIteration) {
 					return false
 				}
@@ -446,32 +1209,189 @@ func (s *S3Store) WalkFrom(ctx context.Context, prefix, startingPoint string, f
 }
 
 func (s *S3Store) Walk(ctx context.Context, prefix string, f func(filename string) (err error)) error {
-	return s.WalkFrom(ctx, prefix, "", f)
+	if s.isSharded() {
+		return s.shardedWalk(ctx, prefix, func(ctx context.Context, prefix string, f func(filename string) error) error {
+			return s.walkFrom(ctx, prefix, "", f)
+		}, f)
+	}
+	return s.walkFrom(ctx, prefix, "", f)
+}
+
+// listPrefix returns the key prefix listing the objects under `prefix`
+func (s *S3Store) listPrefix(prefix string) string {
+	prefix = s.flatKey(prefix)
+	targetPrefix := s.path
+	if targetPrefix != "" {
+		targetPrefix += "/"
+	}
+	if prefix != "" {
+		targetPrefix = filepath.Join(targetPrefix, prefix)
+		if prefix[len(prefix)-1:] == "/" {
+			targetPrefix += "/"
+		}
+	}
+	return targetPrefix
+}
+
+// HasAnyFiles lists a single key under `prefix`.
+func (s *S3Store) HasAnyFiles(ctx context.Context, prefix string) (bool, error) {
+	if s.isSharded() {
+		return hasAnyFiles(ctx, s, prefix)
+	}
+
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	service, err := s.serviceFor(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	out, err := service.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(s.listPrefix(prefix)),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(out.Contents) == 0 {
+		return false, nil
+	}
+
+	key := aws.StringValue(out.Contents[0].Key)
+	if s.isSkippedDirectoryMarker(key) || s.toBaseName(key) == "" {
+		// The first key is not a file, the following ones are walked
+		return hasAnyFiles(ctx, s, prefix)
+	}
+	return true, nil
 }
 
 func (s *S3Store) toBaseName(filename string) string {
-	return strings.TrimPrefix(strings.TrimSuffix(filename, s.pathWithExt("")), s.path+"/")
+	return s.unflatKey(strings.TrimPrefix(strings.TrimSuffix(filename, s.pathWithExt("")), s.path+"/"))
+}
+
+func (s *S3Store) readRange(ctx context.Context, name string, offset, length int64) ([]byte, string, error) {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	service, err := s.serviceFor(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	output, err := service.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.ObjectPath(name)),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case s3.ErrCodeNoSuchKey:
+				return nil, "", ErrNotFound
+			case "InvalidRange":
+				// The range starts past the end of the object
+				return []byte{}, "", nil
+			}
+		}
+		return nil, "", err
+	}
+	defer output.Body.Close()
+
+	content, err := io.ReadAll(output.Body)
+	return content, s.recordedCompression(aws.StringValueMap(output.Metadata), CompressionMetadataKey), err
 }
 
 func (s *S3Store) DeleteObject(ctx context.Context, base string) error {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	s.existenceCache.forget(s.ObjectURL(base))
+
 	path := s.ObjectPath(base)
-	_, err := s.service.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+
+	if !s.deleteIgnoreNotFound {
+		// S3 reports the deletion of a missing object as a success, it must be checked beforehand
+		exists, err := s.fileExists(ctx, base)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotFound
+		}
+	}
+
+	service, err := s.serviceFor(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = service.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    &path,
 	})
 	if aerr, ok := err.(awserr.Error); ok {
 		if aerr.Code() == s3.ErrCodeNoSuchKey {
-			return ErrNotFound
+			return s.deleteResult(ErrNotFound)
 		}
 	}
 	return err
 }
 
+// DeleteObjects deletes the given objects using S3 batch deletion, each request deleting
+// up to 1000 objects.
+func (s *S3Store) DeleteObjects(ctx context.Context, bases []string) error {
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	service, err := s.serviceFor(ctx)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(bases); start += 1000 {
+		end := start + 1000
+		if end > len(bases) {
+			end = len(bases)
+		}
+
+		objects := make([]*s3.ObjectIdentifier, 0, end-start)
+		for _, base := range bases[start:end] {
+			s.existenceCache.forget(s.ObjectURL(base))
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(s.ObjectPath(base))})
+		}
+
+		output, err := service.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &s3.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(output.Errors) > 0 {
+			first := output.Errors[0]
+			return fmt.Errorf("%d object(s) failed to delete, first being %q: %s", len(output.Errors), aws.StringValue(first.Key), aws.StringValue(first.Message))
+		}
+	}
+
+	return nil
+}
+
+// OpenObjectSeekable is not supported on S3 stores.
+func (s *S3Store) OpenObjectSeekable(_ context.Context, _ string) (io.ReadSeekCloser, error) {
+	return nil, fmt.Errorf("seeking S3 objects: %w", ErrNotSupported)
+}
+
 func (s *S3Store) PushLocalFile(ctx context.Context, localFile, toBaseName string) error {
 	remove, err := pushLocalFile(ctx, s, localFile, toBaseName)
 	if retryS3PushLocalFilesDelay != 0 {
 		time.Sleep(retryS3PushLocalFilesDelay)
-		exists, err := s.FileExists(ctx, toBaseName)
+		exists, err := s.fileExists(ctx, toBaseName)
 		if err != nil {
 			zlog.Debug("just pushed file to dstore, but cannot check if it is still there after 500 milliseconds and retryS3PushLocalFiles is set", zap.Error(err))
 			return err
@@ -495,3 +1415,46 @@ func (s *S3Store) PushLocalFile(ctx context.Context, localFile, toBaseName strin
 func (s *S3Store) ListFiles(ctx context.Context, prefix string, max int) ([]string, error) {
 	return listFiles(ctx, s, prefix, max)
 }
+
+func (s *S3Store) ListSubPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	if s.isSharded() || s.keySeparator != "" {
+		// Physical keys do not follow the logical names, the sub-prefixes are derived from them
+		return listSubPrefixes(ctx, s, prefix)
+	}
+
+	ctx, cancelOperation := s.operationContext(ctx)
+	defer cancelOperation()
+
+	basePrefix := s.path
+	if basePrefix != "" {
+		basePrefix += "/"
+	}
+
+	q := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(s.listPrefix(prefix)),
+		Delimiter: aws.String("/"),
+	}
+	if pageSize := s.cappedListPageSize(s3MaxListPageSize); pageSize > 0 {
+		q.MaxKeys = aws.Int64(int64(pageSize))
+	}
+
+	service, err := s.serviceFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []string{}
+	err = service.ListObjectsV2PagesWithContext(ctx, q, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, commonPrefix := range page.CommonPrefixes {
+			out = append(out, strings.TrimPrefix(aws.StringValue(commonPrefix.Prefix), basePrefix))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing sub prefixes: %w", err)
+	}
+
+	// Listings are in lexicographical order, and so are the sub-prefixes
+	return out, nil
+}
@@ -1,11 +1,25 @@
 package dstore
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -58,3 +72,999 @@ func TestNewS3Store(t *testing.T) {
 		})
 	}
 }
+
+func TestParseS3URL_Region(t *testing.T) {
+	tests := []struct {
+		url            string
+		expectedRegion string
+		expectedErr    bool
+	}{
+		{url: "s3://bucket/path?region=test", expectedRegion: "test"},
+		{url: "s3://bucket/path", expectedErr: true},
+		{url: "s3://s3.us-east-2.amazonaws.com/bucket/path", expectedErr: true},
+
+		{url: "s3://localhost:9000/bucket/path?insecure=true", expectedRegion: DefaultS3CustomEndpointRegion},
+		{url: "s3://minio.example.com/bucket/path", expectedRegion: DefaultS3CustomEndpointRegion},
+		{url: "s3://minio.example.com/bucket/path?region=none", expectedRegion: "none"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			s3URL, err := url.Parse(test.url)
+			require.NoError(t, err)
+
+			config, bucket, path, err := ParseS3URL(s3URL)
+			if test.expectedErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedRegion, *config.Region)
+			assert.Equal(t, "bucket", bucket)
+			assert.Equal(t, "path", path)
+		})
+	}
+}
+
+func TestParseS3URL_Compat(t *testing.T) {
+	tests := []struct {
+		url                       string
+		expectedRegion            string
+		expectedDisableContentMD5 bool
+		expectedErr               bool
+	}{
+		{url: "s3://account.r2.cloudflarestorage.com/bucket/path?compat=r2", expectedRegion: "auto", expectedDisableContentMD5: true},
+		{url: "s3://account.r2.cloudflarestorage.com/bucket/path?compat=r2&region=wnam", expectedRegion: "wnam", expectedDisableContentMD5: true},
+		{url: "s3://s3.us-west-004.backblazeb2.com/bucket/path?compat=b2&region=us-west-004", expectedRegion: "us-west-004", expectedDisableContentMD5: true},
+		{url: "s3://localhost:9000/bucket/path?compat=minio", expectedRegion: DefaultS3CustomEndpointRegion},
+		{url: "s3://ceph.example.com/bucket/path?compat=ceph", expectedRegion: DefaultS3CustomEndpointRegion},
+
+		{url: "s3://minio.example.com/bucket/path?compat=unknown", expectedErr: true},
+		{url: "s3://bucket/path?region=test&compat=r2", expectedErr: true},
+		{url: "s3://s3.us-east-2.amazonaws.com/bucket/path?region=us-east-2&compat=minio", expectedErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			s3URL, err := url.Parse(test.url)
+			require.NoError(t, err)
+
+			config, bucket, path, err := ParseS3URL(s3URL)
+			if test.expectedErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedRegion, *config.Region)
+			assert.True(t, aws.BoolValue(config.S3ForcePathStyle))
+			assert.Equal(t, test.expectedDisableContentMD5, aws.BoolValue(config.S3DisableContentMD5Validation))
+			assert.Equal(t, "bucket", bucket)
+			assert.Equal(t, "path", path)
+		})
+	}
+}
+
+func TestNewS3Store_CompatRejectsObjectACL(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	baseURL, err := url.Parse("s3://account.r2.cloudflarestorage.com/bucket/path?compat=r2&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	_, err = NewS3Store(baseURL, "", "", false, WithObjectACL("public-read"))
+	assert.Error(t, err)
+
+	_, err = NewS3Store(baseURL, "", "", false)
+	assert.NoError(t, err)
+}
+
+func TestS3PartSize(t *testing.T) {
+	assert.Equal(t, s3manager.DefaultUploadPartSize, s3PartSize(0))
+	assert.Equal(t, s3manager.DefaultUploadPartSize, s3PartSize(1024))
+
+	size := s3manager.DefaultUploadPartSize * s3manager.MaxUploadParts * 2
+	assert.LessOrEqual(t, size/s3PartSize(size), int64(s3manager.MaxUploadParts))
+}
+
+// shortBodyTransport answers every request with a body shorter than its announced Content-Length
+type shortBodyTransport struct{}
+
+func (shortBodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		Header:        http.Header{"Content-Length": []string{"100"}},
+		ContentLength: 100,
+		Body:          io.NopCloser(strings.NewReader("truncated")),
+		Request:       req,
+	}, nil
+}
+
+func TestS3Store_WithSizeValidation(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	store, err := NewS3Store(baseURL, "", "", false, WithSizeValidation(), WithHTTPClient(&http.Client{Transport: shortBodyTransport{}}))
+	require.NoError(t, err)
+
+	reader, err := store.OpenObject(context.Background(), "file")
+	require.NoError(t, err)
+	defer reader.Close()
+
+	_, err = io.ReadAll(reader)
+	assert.ErrorIs(t, err, ErrShortRead)
+}
+
+// listingTransport answers S3 `ListObjectsV2` requests with a fixed set of keys and common
+// prefixes, and records the `max-keys` and `delimiter` query parameters of each request
+type listingTransport struct {
+	keys           []string
+	commonPrefixes []string
+	maxKeys        []string
+	delimiters     []string
+}
+
+func (t *listingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.maxKeys = append(t.maxKeys, req.URL.Query().Get("max-keys"))
+	t.delimiters = append(t.delimiters, req.URL.Query().Get("delimiter"))
+
+	body := `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><Name>bucket</Name><IsTruncated>false</IsTruncated>`
+	for _, key := range t.keys {
+		body += "<Contents><Key>" + key + "</Key></Contents>"
+	}
+	for _, prefix := range t.commonPrefixes {
+		body += "<CommonPrefixes><Prefix>" + prefix + "</Prefix></CommonPrefixes>"
+	}
+	body += "</ListBucketResult>"
+
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		Header:        http.Header{"Content-Type": []string{"application/xml"}},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		Request:       req,
+	}, nil
+}
+
+func TestS3Store_WithListPageSize(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	tests := []struct {
+		name            string
+		opts            []Option
+		expectedMaxKeys string
+	}{
+		{"default", nil, ""},
+		{"custom", []Option{WithListPageSize(250)}, "250"},
+		{"capped", []Option{WithListPageSize(5000)}, "1000"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+			require.NoError(t, err)
+
+			transport := &listingTransport{keys: []string{"path/a", "path/b"}}
+			store, err := NewS3Store(baseURL, "", "", false, append(test.opts, WithHTTPClient(&http.Client{Transport: transport}))...)
+			require.NoError(t, err)
+
+			files, err := store.ListFiles(context.Background(), "", -1)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"a", "b"}, files)
+			assert.Equal(t, []string{test.expectedMaxKeys}, transport.maxKeys)
+		})
+	}
+}
+
+func TestS3Store_HasAnyFiles(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	transport := &listingTransport{keys: []string{"path/a"}}
+	store, err := NewS3Store(baseURL, "", "", false, WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	found, err := store.HasAnyFiles(context.Background(), "")
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []string{"1"}, transport.maxKeys)
+
+	transport.keys = nil
+	found, err = store.HasAnyFiles(context.Background(), "")
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestS3Store_WithDefaultPrefix(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	transport := &listingTransport{keys: []string{"path/p/x", "path/p/y"}}
+	store, err := NewS3Store(baseURL, "", "", false, WithDefaultPrefix("p"), WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	assert.Equal(t, "path/p/x", store.ObjectPath("x"))
+
+	files, err := store.ListFiles(context.Background(), "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"x", "y"}, files)
+}
+
+func TestS3Store_WithWalkProgress(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	var filesSeen, pagesFetched int
+	transport := &listingTransport{keys: []string{"path/a", "path/b", "path/c"}}
+	store, err := NewS3Store(baseURL, "", "", false, WithHTTPClient(&http.Client{Transport: transport}), WithWalkProgress(func(_ context.Context, files, pages int) {
+		filesSeen, pagesFetched = files, pages
+	}))
+	require.NoError(t, err)
+
+	_, err = store.ListFiles(context.Background(), "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, 3, filesSeen)
+	assert.Equal(t, 1, pagesFetched)
+}
+
+func TestS3Store_ListSubPrefixes(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	transport := &listingTransport{keys: []string{"path/eth/top"}, commonPrefixes: []string{"path/eth/mainnet/", "path/eth/sepolia/"}}
+	store, err := NewS3Store(baseURL, "", "", false, WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	prefixes, err := store.ListSubPrefixes(context.Background(), "eth/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eth/mainnet/", "eth/sepolia/"}, prefixes)
+	assert.Equal(t, []string{"/"}, transport.delimiters)
+
+	// Sharded keys are prefixed by their shard, the sub-prefixes are derived from the walked names
+	sharder, err := HexHashSharder(2)
+	require.NoError(t, err)
+	names := []string{"eth/mainnet/0001", "eth/sepolia/0001", "eth/top"}
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		keys = append(keys, "path/"+sharder(name)+"/"+name)
+	}
+
+	transport = &listingTransport{keys: keys}
+	store, err = NewS3Store(baseURL, "", "", false, WithPrefixSharding(sharder), WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	prefixes, err = store.ListSubPrefixes(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eth/"}, prefixes)
+
+	prefixes, err = store.ListSubPrefixes(context.Background(), "eth/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eth/mainnet/", "eth/sepolia/"}, prefixes)
+}
+
+// uploadTransport answers S3 `HeadObject` requests with a 404 and `PutObject` ones with a 200
+// after a short delay, recording the peak number of concurrent uploads
+type uploadTransport struct {
+	lock     sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func (t *uploadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodHead {
+		return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+	}
+
+	io.Copy(io.Discard, req.Body)
+
+	t.lock.Lock()
+	t.inFlight++
+	if t.inFlight > t.peak {
+		t.peak = t.inFlight
+	}
+	t.lock.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	t.lock.Lock()
+	t.inFlight--
+	t.lock.Unlock()
+
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+}
+
+// persistingTransport acknowledges uploads, recording the keys of the objects fully received
+type persistingTransport struct {
+	lock      sync.Mutex
+	persisted []string
+}
+
+func (t *persistingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodHead {
+		return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+	}
+
+	if _, err := io.Copy(io.Discard, req.Body); err != nil {
+		return nil, err
+	}
+
+	t.lock.Lock()
+	t.persisted = append(t.persisted, req.URL.Path)
+	t.lock.Unlock()
+
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+}
+
+// copyInPlaceTransport answers S3 `HeadObject` requests with the headers of an archived public
+// object and records the headers of the `CopyObject` requests
+type copyInPlaceTransport struct {
+	copyHeaders http.Header
+}
+
+func (t *copyInPlaceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodHead {
+		header := http.Header{}
+		header.Set("Content-Length", "7")
+		header.Set("Content-Disposition", "attachment")
+		header.Set("Content-Language", "en")
+		header.Set("x-amz-storage-class", "STANDARD_IA")
+		header.Set("x-amz-server-side-encryption", "aws:kms")
+		header.Set("x-amz-server-side-encryption-aws-kms-key-id", "key-id")
+		return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: header, Body: http.NoBody, Request: req}, nil
+	}
+
+	t.copyHeaders = req.Header.Clone()
+	body := `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+}
+
+func TestS3Store_Touch_KeepsObjectSettings(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	transport := &copyInPlaceTransport{}
+	store, err := NewS3Store(baseURL, "", "", false, WithObjectACL("public-read"), WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	require.NoError(t, Touch(context.Background(), store, "file"))
+
+	assert.Equal(t, "REPLACE", transport.copyHeaders.Get("x-amz-metadata-directive"))
+	assert.Equal(t, "public-read", transport.copyHeaders.Get("x-amz-acl"))
+	assert.Equal(t, "STANDARD_IA", transport.copyHeaders.Get("x-amz-storage-class"))
+	assert.Equal(t, "attachment", transport.copyHeaders.Get("Content-Disposition"))
+	assert.Equal(t, "en", transport.copyHeaders.Get("Content-Language"))
+	assert.Equal(t, "aws:kms", transport.copyHeaders.Get("x-amz-server-side-encryption"))
+	assert.Equal(t, "key-id", transport.copyHeaders.Get("x-amz-server-side-encryption-aws-kms-key-id"))
+}
+
+func TestS3Store_CopyObject(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	transport := &copyInPlaceTransport{}
+	store, err := NewS3Store(baseURL, "dbin", "zstd", false, WithObjectACL("public-read"), WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	require.NoError(t, store.WriteFrom(context.Background(), "dest", store, "src"))
+
+	assert.Equal(t, "bucket/path/src.dbin", transport.copyHeaders.Get("x-amz-copy-source"))
+	assert.Empty(t, transport.copyHeaders.Get("x-amz-metadata-directive"), "metadata is copied along")
+	assert.Equal(t, "public-read", transport.copyHeaders.Get("x-amz-acl"))
+}
+
+func TestS3Store_WriteObject_ReaderError(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	for _, compression := range []string{"", "zstd"} {
+		transport := &persistingTransport{}
+		store, err := NewS3Store(baseURL, "", compression, true, WithHTTPClient(&http.Client{Transport: transport}))
+		require.NoError(t, err)
+
+		readErr := errors.New("reader failure")
+		err = store.WriteObject(context.Background(), "file", &failingReader{content: strings.NewReader("partial content"), err: readErr})
+		assert.ErrorIs(t, err, readErr, "compression %q", compression)
+		assert.Empty(t, transport.persisted, "compression %q", compression)
+
+		require.NoError(t, store.WriteObject(context.Background(), "file", strings.NewReader("content")))
+		assert.Equal(t, []string{"/path/file"}, transport.persisted)
+	}
+}
+
+func TestS3Store_WithMaxInFlightBytes(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	// Small objects are uploaded with a single part buffer, the budget fits two of them
+	transport := &uploadTransport{}
+	store, err := NewS3Store(baseURL, "", "", false, WithMaxInFlightBytes(2*s3manager.DefaultUploadPartSize), WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, WriteObjectString(context.Background(), store, fmt.Sprintf("file-%d", i), "content"))
+		}(i)
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, transport.peak, 2)
+}
+
+func TestS3UploadBuffersSize(t *testing.T) {
+	partSize := s3manager.DefaultUploadPartSize
+
+	assert.Equal(t, partSize, s3UploadBuffersSize(0, partSize, 5))
+	assert.Equal(t, partSize, s3UploadBuffersSize(10, partSize, 5))
+	assert.Equal(t, 2*partSize, s3UploadBuffersSize(partSize+1, partSize, 5))
+	assert.Equal(t, 5*partSize, s3UploadBuffersSize(100*partSize, partSize, 5))
+	assert.Equal(t, 5*partSize, s3UploadBuffersSize(-1, partSize, 5))
+}
+
+// contentMD5Transport answers S3 `HeadObject` requests with a 404 and records the Content-MD5
+// header of `PutObject` requests along with the MD5 of their actual body
+type contentMD5Transport struct {
+	headers []string
+	bodies  []string
+}
+
+func (t *contentMD5Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodHead {
+		return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(body)
+
+	t.headers = append(t.headers, req.Header.Get("Content-Md5"))
+	t.bodies = append(t.bodies, base64.StdEncoding.EncodeToString(sum[:]))
+
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+}
+
+func TestS3Store_WithS3ContentMD5Validation(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	transport := &contentMD5Transport{}
+	store, err := NewS3Store(baseURL, "", "gzip", false, WithS3ContentMD5Validation(), WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	// Known size, single `PutObject` with the MD5 computed while compressing
+	require.NoError(t, WriteObjectString(context.Background(), store, "sized", "content"))
+	// Unknown size, uploader
+	require.NoError(t, store.WriteObject(context.Background(), "unsized", strings.NewReader("content")))
+
+	require.Len(t, transport.headers, 2)
+	for i := range transport.headers {
+		assert.NotEmpty(t, transport.headers[i])
+		assert.Equal(t, transport.bodies[i], transport.headers[i])
+	}
+}
+
+// flakyGatewayTransport fails the first `failures` requests with a gateway specific error code
+// the SDK does not consider transient, then serves `content`.
+type flakyGatewayTransport struct {
+	failures int
+	content  string
+
+	lock     sync.Mutex
+	requests int
+}
+
+func (t *flakyGatewayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.Lock()
+	t.requests++
+	failing := t.requests <= t.failures
+	t.lock.Unlock()
+
+	if failing {
+		body := `<?xml version="1.0" encoding="UTF-8"?><Error><Code>GatewayInternalError</Code><Message>internal error</Message></Error>`
+		return &http.Response{StatusCode: http.StatusBadRequest, Status: "400 Bad Request", Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+	}
+
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{}, ContentLength: int64(len(t.content)), Body: io.NopCloser(strings.NewReader(t.content)), Request: req}, nil
+}
+
+func TestS3Store_WithRetryableErrorFunc(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	store, err := NewS3Store(baseURL, "", "", false, WithHTTPClient(&http.Client{Transport: &flakyGatewayTransport{failures: 2, content: "content"}}))
+	require.NoError(t, err)
+	_, err = ReadObjectString(context.Background(), store, "file")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "GatewayInternalError")
+
+	transport := &flakyGatewayTransport{failures: 2, content: "content"}
+	store, err = NewS3Store(baseURL, "", "", false, WithHTTPClient(&http.Client{Transport: transport}), WithRetryableErrorFunc(func(err error) bool {
+		var aerr awserr.Error
+		return errors.As(err, &aerr) && aerr.Code() == "GatewayInternalError"
+	}))
+	require.NoError(t, err)
+
+	content, err := ReadObjectString(context.Background(), store, "file")
+	require.NoError(t, err)
+	assert.Equal(t, "content", content)
+	assert.Equal(t, 3, transport.requests)
+}
+
+func TestS3Store_isRetryableError(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	store := &S3Store{}
+
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"access denied", awserr.NewRequestFailure(awserr.New("AccessDenied", "access denied", nil), 403, ""), false},
+		{"invalid credentials", awserr.NewRequestFailure(awserr.New("InvalidAccessKeyId", "invalid key", nil), 403, ""), false},
+		{"service unavailable", awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), 503, ""), true},
+		{"throttled", awserr.NewRequestFailure(awserr.New("RequestLimitExceeded", "slow down", nil), 400, ""), true},
+		{"connection reset", awserr.New(request.ErrCodeRequestError, "send request failed", &url.Error{Op: "Put", URL: "https://bucket", Err: errors.New("connection reset")}), true},
+		{"upload manager", fmt.Errorf("uploading to S3 through manager: %w", awserr.New("MultipartUpload", "upload failed", awserr.NewRequestFailure(awserr.New("InternalError", "internal", nil), 500, ""))), true},
+		{"not an SDK error", errors.New("reading content"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.retryable, store.isRetryableError(test.err))
+		})
+	}
+
+	store.retryableErrorFunc = func(err error) bool {
+		var aerr awserr.Error
+		return errors.As(err, &aerr) && aerr.Code() == "AccessDenied"
+	}
+	assert.True(t, store.isRetryableError(tests[0].err))
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+	store, err = NewS3Store(baseURL, "", "", false, WithRetryableErrorFunc(store.retryableErrorFunc))
+	require.NoError(t, err)
+
+	sub, err := store.SubStore("sub")
+	require.NoError(t, err)
+	assert.True(t, sub.(*S3Store).isRetryableError(tests[0].err), "sub stores keep the retryable error func")
+}
+
+func TestS3Store_PeekObject(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	transport := &rangeTransport{content: []byte("\x89PNG rest of the image")}
+	store, err := NewS3Store(baseURL, "", "", false, WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	head, err := store.PeekObject(context.Background(), "image", 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("\x89PNG"), head)
+	assert.Equal(t, []string{"bytes=0-3"}, transport.ranges)
+
+	head, err = store.PeekObject(context.Background(), "image", 1024)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("\x89PNG rest of the image"), head)
+}
+
+func TestS3Store_PeekObject_RecordedCompression(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	ctx := context.Background()
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	compressed := &bytes.Buffer{}
+	writer, err := zstd.NewWriter(compressed)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("\x89PNG rest of the image"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	transport := &rangeTransport{content: compressed.Bytes(), header: http.Header{"X-Amz-Meta-X-Dstore-Compression": []string{"zstd"}}}
+	store, err := NewS3Store(baseURL, "", "", false, WithHTTPClient(&http.Client{Transport: transport}), WithCompressionDetectionOnWrite())
+	require.NoError(t, err)
+
+	// The ranged request tells the object is compressed, it is then read from the start
+	head, err := store.PeekObject(ctx, "image", 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("\x89PNG"), head)
+	assert.Equal(t, []string{"bytes=0-3", ""}, transport.ranges)
+}
+
+// existenceTransport serves HEAD and listing requests from the objects uploaded so far, counting
+// requests
+type existenceTransport struct {
+	lock     sync.Mutex
+	existing map[string]bool
+	heads    int
+	uploads  int
+}
+
+func (t *existenceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	switch req.Method {
+	case http.MethodHead:
+		t.heads++
+		if !t.existing[req.URL.Path] {
+			return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+		}
+		header := http.Header{"Content-Length": []string{"7"}, "Last-Modified": []string{time.Now().UTC().Format(http.TimeFormat)}}
+		return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: header, Body: http.NoBody, Request: req}, nil
+	case http.MethodPut:
+		t.uploads++
+		t.existing[req.URL.Path] = true
+	case http.MethodDelete:
+		delete(t.existing, req.URL.Path)
+		return &http.Response{StatusCode: http.StatusNoContent, Status: "204 No Content", Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+	case http.MethodGet:
+		if req.URL.Query().Get("list-type") == "2" {
+			body := `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><Name>bucket</Name><IsTruncated>false</IsTruncated>`
+			for path := range t.existing {
+				body += "<Contents><Key>" + strings.TrimPrefix(path, "/") + "</Key></Contents>"
+			}
+			body += "</ListBucketResult>"
+			return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{"Content-Type": []string{"application/xml"}}, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+		}
+	}
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+}
+
+func TestS3Store_WithExistenceCache(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	ctx := context.Background()
+
+	transport := &existenceTransport{existing: map[string]bool{"/path/existing": true}}
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+	store, err := NewS3Store(baseURL, "", "", false, WithExistenceCache(time.Minute), WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	require.NoError(t, store.WriteObject(ctx, "existing", strings.NewReader("content")))
+	require.NoError(t, store.WriteObject(ctx, "existing", strings.NewReader("content")))
+	assert.Equal(t, 1, transport.heads, "second write of an existing object should not check its existence")
+	assert.Equal(t, 0, transport.uploads)
+
+	// Missing objects are never cached, the second write checks again and finds the first one
+	require.NoError(t, store.WriteObject(ctx, "new", strings.NewReader("content")))
+	require.NoError(t, store.WriteObject(ctx, "new", strings.NewReader("content")))
+	assert.Equal(t, 3, transport.heads)
+	assert.Equal(t, 1, transport.uploads)
+
+	// Deleted objects are forgotten
+	require.NoError(t, store.DeleteObject(ctx, "existing"))
+	require.NoError(t, store.WriteObject(ctx, "existing", strings.NewReader("content")))
+	assert.Equal(t, 2, transport.uploads)
+}
+
+func TestS3Store_WithExistenceBloomHint_GuardsCheckBackend(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	ctx := context.Background()
+
+	transport := &existenceTransport{existing: map[string]bool{}}
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+	store, err := NewS3Store(baseURL, "", "", false, WithExistenceBloomHint(time.Minute), WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	exists, err := store.FileExists(ctx, "other")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// Written by another process after the filter was built
+	transport.existing["/path/other"] = true
+
+	require.NoError(t, store.WriteObject(ctx, "other", strings.NewReader("content")))
+	assert.Equal(t, 0, transport.uploads, "an existing object must not be overwritten")
+
+	require.NoError(t, store.DeleteObject(ctx, "other"))
+	assert.False(t, transport.existing["/path/other"], "an existing object must be deleted")
+}
+
+type flakyReadTransport struct {
+	failures int
+	calls    int
+}
+
+func (t *flakyReadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls++
+	if t.calls <= t.failures {
+		body := `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>not yet</Message></Error>`
+		return &http.Response{
+			StatusCode: http.StatusNotFound,
+			Status:     "404 Not Found",
+			Header:     http.Header{"Content-Type": []string{"application/xml"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	}
+
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		Header:        http.Header{},
+		ContentLength: 7,
+		Body:          io.NopCloser(strings.NewReader("content")),
+		Request:       req,
+	}, nil
+}
+
+func TestS3Store_WithRetryObserver(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	defer func(attempts int, delay time.Duration) { s3ReadAttempts, s3ReadRetryDelay = attempts, delay }(s3ReadAttempts, s3ReadRetryDelay)
+	s3ReadAttempts, s3ReadRetryDelay = 3, time.Millisecond
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	type decision struct {
+		op        string
+		attempt   int
+		failed    bool
+		willRetry bool
+	}
+	var decisions []decision
+	transport := &flakyReadTransport{failures: 2}
+	store, err := NewS3Store(baseURL, "", "", false, WithHTTPClient(&http.Client{Transport: transport}), WithRetryObserver(func(op string, attempt int, err error, willRetry bool) {
+		decisions = append(decisions, decision{op, attempt, err != nil, willRetry})
+	}))
+	require.NoError(t, err)
+
+	content, err := ReadObjectString(context.Background(), store, "file")
+	require.NoError(t, err)
+	assert.Equal(t, "content", content)
+
+	assert.Equal(t, 3, transport.calls)
+	assert.Equal(t, []decision{
+		{"OpenObject", 1, true, true},
+		{"OpenObject", 2, true, true},
+		{"OpenObject", 3, false, false},
+	}, decisions)
+}
+
+// startAfterTransport serves a listing of `keys` honoring the prefix and start-after parameters,
+// recording the keys returned
+type startAfterTransport struct {
+	keys     []string
+	returned []string
+}
+
+func (t *startAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	query := req.URL.Query()
+
+	body := `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><Name>bucket</Name><IsTruncated>false</IsTruncated>`
+	for _, key := range t.keys {
+		if strings.HasPrefix(key, query.Get("prefix")) && key > query.Get("start-after") {
+			body += "<Contents><Key>" + key + "</Key></Contents>"
+			t.returned = append(t.returned, key)
+		}
+	}
+	body += "</ListBucketResult>"
+
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		Header:        http.Header{"Content-Type": []string{"application/xml"}},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		Request:       req,
+	}, nil
+}
+
+func TestS3Store_WalkFrom_StartAfter(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	var keys []string
+	for i := 0; i < 200; i++ {
+		keys = append(keys, fmt.Sprintf("path/aa/%04d", i))
+	}
+	keys = append(keys, "path/ab", "path/ab0", "path/ac", "path/bé", "path/béa", "path/c")
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	tests := []struct {
+		startingPoint string
+		expected      []string
+	}{
+		{"ab", []string{"ab", "ab0", "ac", "bé", "béa", "c"}},
+		{"aa/0198", []string{"aa/0198", "aa/0199", "ab", "ab0", "ac", "bé", "béa", "c"}},
+		{"b", []string{"bé", "béa", "c"}},
+		{"bé", []string{"bé", "béa", "c"}},
+		{"d", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.startingPoint, func(t *testing.T) {
+			transport := &startAfterTransport{keys: keys}
+			store, err := NewS3Store(baseURL, "", "", false, WithHTTPClient(&http.Client{Transport: transport}))
+			require.NoError(t, err)
+
+			var seen []string
+			err = store.WalkFrom(context.Background(), "", test.startingPoint, func(filename string) error {
+				seen = append(seen, filename)
+				return nil
+			})
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, seen)
+			for _, key := range transport.returned {
+				assert.GreaterOrEqual(t, key, "path/"+test.startingPoint, "keys before the starting point should not be listed")
+			}
+		})
+	}
+}
+
+// s3RangeTransport serves the ranges of `content` requested by GetObject calls, recording them
+type s3RangeTransport struct {
+	content string
+	ranges  []string
+}
+
+func (t *s3RangeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	requested := req.Header.Get("Range")
+	t.ranges = append(t.ranges, requested)
+
+	var start, end int
+	fmt.Sscanf(requested, "bytes=%d-%d", &start, &end)
+	if end >= len(t.content) {
+		end = len(t.content) - 1
+	}
+	body := t.content[start : end+1]
+
+	return &http.Response{
+		StatusCode:    http.StatusPartialContent,
+		Status:        "206 Partial Content",
+		Header:        http.Header{},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		Request:       req,
+	}, nil
+}
+
+func TestS3Store_OpenObjectRanges(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	transport := &s3RangeTransport{content: strings.Repeat("0123456789", 10)}
+	store, err := NewS3Store(baseURL, "", "", false, WithHTTPClient(&http.Client{Transport: transport}))
+	require.NoError(t, err)
+
+	readers, err := OpenObjectRanges(context.Background(), store, "index", []ByteRange{{Offset: 25, Length: 3}, {Offset: 11, Length: 2}, {Offset: 95, Length: 10}})
+	require.NoError(t, err)
+
+	var contents []string
+	for _, reader := range readers {
+		content, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		contents = append(contents, string(content))
+	}
+
+	assert.Equal(t, []string{"567", "12", "56789"}, contents)
+	assert.Equal(t, []string{"bytes=11-104"}, transport.ranges)
+}
+
+// objectTransport keeps the objects put to it in memory along with their user metadata headers,
+// serving them back on GET
+type objectTransport struct {
+	lock    sync.Mutex
+	objects map[string][]byte
+	headers map[string]http.Header
+}
+
+func (t *objectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	key := req.URL.Path
+	switch req.Method {
+	case http.MethodPut:
+		content, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		header := http.Header{}
+		for name, values := range req.Header {
+			if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+				header[name] = values
+			}
+		}
+		t.objects[key], t.headers[key] = content, header
+		return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+
+	default:
+		content, found := t.objects[key]
+		if !found && req.Method == http.MethodHead {
+			return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+		}
+		if !found {
+			body := `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>missing</Message></Error>`
+			return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Header: http.Header{"Content-Type": []string{"application/xml"}}, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+		}
+
+		body := io.NopCloser(bytes.NewReader(content))
+		if req.Method == http.MethodHead {
+			body = http.NoBody
+		}
+		return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: t.headers[key].Clone(), ContentLength: int64(len(content)), Body: body, Request: req}, nil
+	}
+}
+
+func TestS3Store_WithCompressionDetectionOnWrite(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+	ctx := context.Background()
+
+	baseURL, err := url.Parse("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret")
+	require.NoError(t, err)
+
+	transport := &objectTransport{objects: map[string][]byte{}, headers: map[string]http.Header{}}
+	client := WithHTTPClient(&http.Client{Transport: transport})
+
+	writer, err := NewS3Store(baseURL, "", "zstd", false, client, WithCompressionDetectionOnWrite())
+	require.NoError(t, err)
+	require.NoError(t, WriteObjectString(ctx, writer, "file", "some content"))
+	assert.Equal(t, "zstd", transport.headers["/path/file"].Get("X-Amz-Meta-X-Dstore-Compression"))
+
+	reader, err := NewS3Store(baseURL, "", "gzip", false, client, WithCompressionDetectionOnWrite())
+	require.NoError(t, err)
+
+	content, err := ReadObjectString(ctx, reader, "file")
+	require.NoError(t, err)
+	assert.Equal(t, "some content", content)
+}
+
+func TestS3Store_WithKeySeparator(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	store, err := NewStore("s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret", "", "", false, WithKeySeparator("-"))
+	require.NoError(t, err)
+	s3Store := store.(*S3Store)
+
+	assert.Equal(t, "path/a-b-c", s3Store.ObjectPath("a/b/c"))
+	assert.Equal(t, "path/a-b-", s3Store.listPrefix("a/b/"))
+	assert.Equal(t, "a/b/c", s3Store.toBaseName("path/a-b-c"))
+
+	_, err = store.SubStore("a")
+	assert.ErrorIs(t, err, ErrNotSupported)
+}
@@ -3,16 +3,81 @@ package dstore
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/api/googleapi"
 )
 
 var ErrNotFound = errors.New("not found")
+var ErrNotSupported = errors.New("not supported")
+var ErrShortRead = errors.New("short read")
+var ErrMalformedBaseURL = errors.New("malformed base URL")
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+var ErrEmptyObject = errors.New("empty object")
+var ErrWalkDeadlineExceeded = errors.New("walk deadline exceeded")
+var ErrPreconditionFailed = errors.New("precondition failed")
+var ErrAlreadyExists = errors.New("already exists")
+
+// ShortReadError is returned when reading an object ends before its expected size has been
+// delivered, see `WithSizeValidation`. It matches `ErrShortRead` through `errors.Is`.
+type ShortReadError struct {
+	Expected int64
+	Actual   int64
+}
+
+func (e *ShortReadError) Error() string {
+	return fmt.Sprintf("short read: expected %d bytes, got %d", e.Expected, e.Actual)
+}
+
+func (e *ShortReadError) Unwrap() error {
+	return ErrShortRead
+}
+
+// kindError is the backend error `err` matching the dstore error `kind` through `errors.Is`, the
+// backend error itself remaining available through `errors.As`.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return fmt.Sprintf("%s: %s", e.kind, e.err)
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+// supportedSchemes lists the base URL schemes `NewStore` accepts, besides plain local paths
+var supportedSchemes = []string{"file", "gs", "s3", "az", "azblob", "azure", "memory"}
+
+// UnsupportedSchemeError is returned by `NewStore` when the scheme of the base URL matches
+// no store implementation.
+type UnsupportedSchemeError struct {
+	Scheme string
+}
+
+func (e *UnsupportedSchemeError) Error() string {
+	return fmt.Sprintf("unsupported store scheme %q, supported schemes are %s:// or a local path", e.Scheme, strings.Join(supportedSchemes, "://, "))
+}
 
 type Store interface {
 	OpenObject(ctx context.Context, name string) (out io.ReadCloser, err error)
@@ -25,21 +90,37 @@ type Store interface {
 	WriteObject(ctx context.Context, base string, f io.Reader) (err error)
 	PushLocalFile(ctx context.Context, localFile, toBaseName string) (err error)
 
+	// WriteFrom writes the object `srcName` of the `src` store as `base` in this store. The content
+	// is decompressed according to `src` configuration and compressed according to this store's one,
+	// when both stores share the same location and encoding a server-side copy is performed instead.
+	WriteFrom(ctx context.Context, base string, src Store, srcName string) (err error)
+
 	CopyObject(ctx context.Context, src, dest string) error
 	Overwrite() bool
 	SetOverwrite(enabled bool)
 
+	// SupportsConcurrentWrites reports whether concurrent writes of the same object are safe, the
+	// last one winning (cloud and memory stores), or may corrupt or fail each other (local and
+	// mock stores).
+	SupportsConcurrentWrites() bool
+
+	// WalkFrom is like Walk but only invokes `f` for files greater than or equal to
+	// `startingPoint`, which must start with `prefix`: a file named exactly `startingPoint` is
+	// yielded.
 	WalkFrom(ctx context.Context, prefix, startingPoint string, f func(filename string) (err error)) error
 
 	// Walk recursively all files starting with the given prefix within this store. The `f` callback is invoked
 	// for each file found.
 	//
 	// If you return `dstore.StopIteration` from your callback, iteration stops right away and `nil` will
-	// returned by the `Walk` function. If your callback returns any error, iteration stops right away and
+	// returned by the `Walk` function. A wrapped `dstore.StopIteration` (e.g. `fmt.Errorf("done: %w",
+	// dstore.StopIteration)`) is recognized as well. If your callback returns any error, iteration stops right away and
 	// callback returned error is return by the `Walk` function.
 	Walk(ctx context.Context, prefix string, f func(filename string) (err error)) error
 	ListFiles(ctx context.Context, prefix string, max int) ([]string, error)
 
+	// DeleteObject deletes the object, returning an error matching `ErrNotFound` if it does not
+	// exist unless `WithDeleteIgnoreNotFound` is used.
 	DeleteObject(ctx context.Context, base string) error
 
 	// Used to retrieve original query parameters, allowing further
@@ -55,6 +136,374 @@ type Clonable interface {
 	Clone(ctx context.Context, opts ...Option) (Store, error)
 }
 
+var (
+	_ Store = (*S3Store)(nil)
+	_ Store = (*GSStore)(nil)
+	_ Store = (*AzureStore)(nil)
+	_ Store = (*LocalStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+	_ Store = (*MockStore)(nil)
+	_ Store = (*FSStore)(nil)
+)
+
+// Rebasable is implemented by stores able to create a store of the same configuration at another
+// location.
+type Rebasable interface {
+	// Rebase creates a store at `baseURL`, of any supported scheme, with this store's extension,
+	// compression, overwrite flag and options (callbacks, validation, sharding, ...), `opts` being
+	// applied on top to override them. Options configuring the transport (`WithHTTPClient`,
+	// `WithUserAgent`) are not inherited and must be passed again. Like for `Clone`, the new
+	// store is anchored to `ctx` unless `WithBaseContext` is given.
+	Rebase(ctx context.Context, baseURL string, opts ...Option) (Store, error)
+}
+
+// SeekableStore is implemented by stores able to open an object for random access.
+// Seeking is only meaningful on uncompressed objects, stores configured with a
+// compression return `ErrNotSupported`, as do cloud stores.
+type SeekableStore interface {
+	OpenObjectSeekable(ctx context.Context, name string) (io.ReadSeekCloser, error)
+}
+
+// BatchDeleter is implemented by stores able to delete multiple objects in a single
+// request, it's used by `DeleteObjectsUnderPrefix` when available.
+type BatchDeleter interface {
+	DeleteObjects(ctx context.Context, bases []string) error
+}
+
+// SizedWriter is implemented by stores tuning their uploads with the known size of the content,
+// it's used by `WriteObjectSized` when available.
+type SizedWriter interface {
+	// WriteObjectSized is like WriteObject but receives the known uncompressed size of the
+	// content, used by the backend as a hint to tune its upload (part/chunk sizes, buffers).
+	WriteObjectSized(ctx context.Context, base string, f io.Reader, size int64) (err error)
+}
+
+// WriteObjectSized writes `f` as the object `base` of `store`, passing the known uncompressed
+// `size` of the content to stores implementing `SizedWriter`, through `WriteObject` otherwise.
+func WriteObjectSized(ctx context.Context, store Store, base string, f io.Reader, size int64) error {
+	if sized, ok := store.(SizedWriter); ok {
+		return sized.WriteObjectSized(ctx, base, f, size)
+	}
+	return store.WriteObject(ctx, base, f)
+}
+
+// ReverseWalker is implemented by stores walking in descending order natively, it's used by
+// `WalkReverse` when available.
+type ReverseWalker interface {
+	WalkReverse(ctx context.Context, prefix string, f func(filename string) (err error)) error
+}
+
+// WalkReverse is like `Store.Walk` but invokes `f` in descending lexicographical order, useful to
+// find the latest file under a prefix. Backends only list in ascending order, so unless `store`
+// implements `ReverseWalker`, all file names under `prefix` are buffered in memory before the
+// first call to `f`: use a prefix narrow enough to keep the listing small.
+func WalkReverse(ctx context.Context, store Store, prefix string, f func(filename string) (err error)) error {
+	if walker, ok := store.(ReverseWalker); ok {
+		return walker.WalkReverse(ctx, prefix, f)
+	}
+	return commonWalkReverse(store, ctx, prefix, f)
+}
+
+// GlobLister is implemented by stores listing glob patterns natively, it's used by
+// `ListFilesGlob` when available.
+type GlobLister interface {
+	ListFilesGlob(ctx context.Context, pattern string, max int) ([]string, error)
+}
+
+// ListFilesGlob lists the files of `store` matching the glob `pattern`, using `path.Match` syntax
+// (`*`, `?` and `[...]`, `*` not matching `/`). Unless `store` implements `GlobLister`, only files
+// under the literal part of the pattern preceding its first wildcard are listed from the backend.
+// At most `max` files are returned, a negative `max` meaning no limit.
+func ListFilesGlob(ctx context.Context, store Store, pattern string, max int) ([]string, error) {
+	if lister, ok := store.(GlobLister); ok {
+		return lister.ListFilesGlob(ctx, pattern, max)
+	}
+	return listFilesGlob(ctx, store, pattern, max)
+}
+
+// SubPrefixLister is implemented by stores listing sub-prefixes natively, through delimiter
+// listings or directory reads, it's used by `ListSubPrefixes` when available.
+type SubPrefixLister interface {
+	ListSubPrefixes(ctx context.Context, prefix string) ([]string, error)
+}
+
+// ListSubPrefixes returns, in sorted order, the immediate "sub-directories" of `store` under
+// `prefix`, that is the distinct prefixes of files under `prefix` up to their next `/` after it,
+// `/` included (e.g. `eth/` and `sol/` for files `eth/a`, `eth/b/c` and `sol/d`). Files directly
+// under `prefix` are not part of the result. Unless `store` implements `SubPrefixLister`, all
+// files under `prefix` are walked.
+func ListSubPrefixes(ctx context.Context, store Store, prefix string) ([]string, error) {
+	if lister, ok := store.(SubPrefixLister); ok {
+		return lister.ListSubPrefixes(ctx, prefix)
+	}
+	return listSubPrefixes(ctx, store, prefix)
+}
+
+// ConditionalOpener is implemented by stores opening objects conditionally in a single request,
+// it's used by `OpenObjectIfModifiedSince` when available.
+type ConditionalOpener interface {
+	OpenObjectIfModifiedSince(ctx context.Context, name string, since time.Time) (out io.ReadCloser, modified bool, err error)
+}
+
+// OpenObjectIfModifiedSince opens the object of `store` only if it was modified after `since`,
+// returning `(nil, false, nil)` when it was not, useful to refresh a cached copy without
+// transferring unchanged content. Unless `store` implements `ConditionalOpener`, the modification
+// time of the object is checked before opening it, the object being replaced in between being
+// opened anyway.
+func OpenObjectIfModifiedSince(ctx context.Context, store Store, name string, since time.Time) (out io.ReadCloser, modified bool, err error) {
+	if opener, ok := store.(ConditionalOpener); ok {
+		return opener.OpenObjectIfModifiedSince(ctx, name, since)
+	}
+	return openObjectIfModifiedSince(ctx, store, name, since)
+}
+
+// BatchPusher is implemented by stores pushing batches of local files their own way, it's used by
+// `PushLocalFiles` when available.
+type BatchPusher interface {
+	PushLocalFiles(ctx context.Context, files map[string]string, concurrency int) (err error)
+}
+
+// PushLocalFiles pushes each local file of `files` (local path to object name) to `store` like
+// `PushLocalFile` does, using at most `concurrency` concurrent uploads. A failing push does not
+// stop the others, the returned error combines the error of every failed push, whose local file
+// is kept.
+func PushLocalFiles(ctx context.Context, store Store, files map[string]string, concurrency int) error {
+	if pusher, ok := store.(BatchPusher); ok {
+		return pusher.PushLocalFiles(ctx, files, concurrency)
+	}
+	return pushLocalFiles(ctx, store, files, concurrency)
+}
+
+// ExclusiveWalker is implemented by stores starting their listings strictly after a given name,
+// it's used by `WalkFromExclusive` when available.
+type ExclusiveWalker interface {
+	WalkFromExclusive(ctx context.Context, prefix, afterPoint string, f func(filename string) (err error)) error
+}
+
+// WalkFromExclusive is like `Store.WalkFrom` but only invokes `f` for files strictly greater than
+// `afterPoint`, a file named exactly `afterPoint` is skipped. Useful to resume a walk right after
+// the last processed file.
+func WalkFromExclusive(ctx context.Context, store Store, prefix, afterPoint string, f func(filename string) (err error)) error {
+	if walker, ok := store.(ExclusiveWalker); ok {
+		return walker.WalkFromExclusive(ctx, prefix, afterPoint, f)
+	}
+	return commonWalkFromExclusive(store, ctx, prefix, afterPoint, f)
+}
+
+// Downloader is implemented by stores with a transfer more efficient than reading the object
+// sequentially, it's used by `DownloadTo` when available.
+type Downloader interface {
+	DownloadTo(ctx context.Context, name string, w io.Writer) (int64, error)
+}
+
+// DownloadTo copies the (decompressed) content of the object of `store` into `w` and returns the
+// number of bytes written. Stores implementing `Downloader` use their most efficient transfer
+// when possible, e.g. S3 stores without compression download ranges in parallel when `w` is an
+// `io.WriterAt`, others go through `OpenObject`.
+func DownloadTo(ctx context.Context, store Store, name string, w io.Writer) (int64, error) {
+	if downloader, ok := store.(Downloader); ok {
+		return downloader.DownloadTo(ctx, name, w)
+	}
+	return downloadTo(ctx, store, name, w)
+}
+
+// ReaderAtUploader is implemented by stores uploading content with random access to it, it's
+// used by `UploadFrom` when available.
+type ReaderAtUploader interface {
+	UploadFrom(ctx context.Context, base string, r io.ReaderAt, size int64) (err error)
+}
+
+// UploadFrom writes the `size` bytes of `r` (e.g. an `*os.File`) as the object `base` of `store`.
+// Random access lets stores implementing `ReaderAtUploader` use it, uncompressed S3 stores
+// uploading parts concurrently straight from `r` and Azure stores uploading files with
+// `UploadFileToBlockBlob`, other cases going through `WriteObjectSized`.
+func UploadFrom(ctx context.Context, store Store, base string, r io.ReaderAt, size int64) error {
+	if uploader, ok := store.(ReaderAtUploader); ok {
+		return uploader.UploadFrom(ctx, base, r, size)
+	}
+	return uploadFrom(ctx, store, base, r, size)
+}
+
+// Peeker is implemented by stores fetching the head of an object without reading it all, it's
+// used by `PeekObject` when available.
+type Peeker interface {
+	PeekObject(ctx context.Context, name string, n int) ([]byte, error)
+}
+
+// PeekObject returns the first `n` (decompressed) bytes of the object of `store`, fewer if the
+// object is smaller. Uncompressed cloud stores fetch only those bytes with a ranged request,
+// other stores stream the object and stop once `n` bytes were decompressed, which requires
+// reading enough compressed input to produce them.
+func PeekObject(ctx context.Context, store Store, name string, n int) ([]byte, error) {
+	if peeker, ok := store.(Peeker); ok {
+		return peeker.PeekObject(ctx, name, n)
+	}
+	return peekObject(ctx, store, name, n)
+}
+
+// DeadlineWriter is implemented by stores bounding writes by a deadline their own way, it's used
+// by `WriteObjectWithDeadline` when available.
+type DeadlineWriter interface {
+	WriteObjectWithDeadline(ctx context.Context, base string, f io.Reader, deadline time.Time) (err error)
+}
+
+// WriteObjectWithDeadline is like `Store.WriteObject` but fails the whole transfer, reading `f`
+// and uploading included, with an error matching `context.DeadlineExceeded` once `deadline` is
+// reached. Writes being atomic, no partially written object is left behind.
+func WriteObjectWithDeadline(ctx context.Context, store Store, base string, f io.Reader, deadline time.Time) error {
+	if writer, ok := store.(DeadlineWriter); ok {
+		return writer.WriteObjectWithDeadline(ctx, base, f, deadline)
+	}
+	return writeObjectWithDeadline(ctx, store, base, f, deadline)
+}
+
+// AnyFilesChecker is implemented by stores able to list a single file, it's used by
+// `HasAnyFiles` when available.
+type AnyFilesChecker interface {
+	HasAnyFiles(ctx context.Context, prefix string) (bool, error)
+}
+
+// HasAnyFiles reports whether there is any file of `store` under `prefix`, listing as few of them
+// as the backend allows (a single one when `store` implements `AnyFilesChecker`) and stopping at
+// the first one found.
+func HasAnyFiles(ctx context.Context, store Store, prefix string) (bool, error) {
+	if checker, ok := store.(AnyFilesChecker); ok {
+		return checker.HasAnyFiles(ctx, prefix)
+	}
+	return hasAnyFiles(ctx, store, prefix)
+}
+
+// SortedWalker is implemented by stores walking their files in a custom order their own way,
+// it's used by `WalkSorted` when available.
+type SortedWalker interface {
+	WalkSorted(ctx context.Context, prefix string, less func(a, b string) bool, f func(filename string) (err error)) error
+}
+
+// WalkSorted is like `Store.Walk` but invokes `f` in the order defined by `less`, for example
+// `NaturalLess` to walk mixed-width numbered files (`9`, `10`, `100`) in numeric order. Unless
+// `store` implements `SortedWalker`, all file names under `prefix` are buffered in memory and
+// sorted before the first call to `f`, which costs memory proportional to the listing.
+func WalkSorted(ctx context.Context, store Store, prefix string, less func(a, b string) bool, f func(filename string) (err error)) error {
+	if walker, ok := store.(SortedWalker); ok {
+		return walker.WalkSorted(ctx, prefix, less, f)
+	}
+	return commonWalkSorted(store, ctx, prefix, less, f)
+}
+
+// CompressionOverrideOpener is implemented by stores decoding objects with another compression
+// than the one they are configured with, it's used by `OpenObjectWithCompression`.
+type CompressionOverrideOpener interface {
+	OpenObjectWithCompression(ctx context.Context, name string, compressionType string) (out io.ReadCloser, err error)
+}
+
+// OpenObjectWithCompression is like `Store.OpenObject` but decodes the object of `store` using the
+// given compression type instead of the one the store is configured with, an empty
+// `compressionType` means no decompression at all. Useful to read files written with a different
+// compression than the store's one. Stores not implementing `CompressionOverrideOpener` return an
+// error matching `ErrNotSupported`.
+func OpenObjectWithCompression(ctx context.Context, store Store, name string, compressionType string) (out io.ReadCloser, err error) {
+	if opener, ok := store.(CompressionOverrideOpener); ok {
+		return opener.OpenObjectWithCompression(ctx, name, compressionType)
+	}
+	return nil, fmt.Errorf("opening objects of %T with another compression: %w", store, ErrNotSupported)
+}
+
+// ObjectStater is implemented by stores checking the existence of an object their own way, it's
+// used by `StatObject` when available.
+type ObjectStater interface {
+	StatObject(ctx context.Context, base string) (exists bool, attrs *ObjectAttributes, err error)
+}
+
+// StatObject returns whether the object of `store` exists and, when it does, its attributes,
+// using a single `ObjectAttributes` request to the backend unless `store` implements
+// `ObjectStater`. A missing object is reported as `(false, nil, nil)`.
+func StatObject(ctx context.Context, store Store, base string) (exists bool, attrs *ObjectAttributes, err error) {
+	if stater, ok := store.(ObjectStater); ok {
+		return stater.StatObject(ctx, base)
+	}
+	return statObject(ctx, store, base)
+}
+
+// Toucher is implemented by stores able to bump the last modified time of an object, it's used by
+// `Touch`.
+type Toucher interface {
+	Touch(ctx context.Context, base string) error
+}
+
+// Touch bumps the last modified time of the object of `store` to now without re-uploading its
+// content, returns an error matching `ErrNotFound` if the object does not exist. Stores not
+// implementing `Toucher` return an error matching `ErrNotSupported`.
+func Touch(ctx context.Context, store Store, base string) error {
+	if toucher, ok := store.(Toucher); ok {
+		return toucher.Touch(ctx, base)
+	}
+	return fmt.Errorf("touching objects of %T: %w", store, ErrNotSupported)
+}
+
+// MetadataStore is implemented by stores keeping custom metadata along with their objects, it's
+// used by `SetObjectMetadata` and `GetObjectMetadata`.
+type MetadataStore interface {
+	SetObjectMetadata(ctx context.Context, base string, md map[string]string) error
+	GetObjectMetadata(ctx context.Context, base string) (map[string]string, error)
+}
+
+// SetObjectMetadata adds `md` to the custom metadata of the object `base` of `store`, replacing the
+// value of the keys already set while keeping the others. Rewriting the object drops its metadata.
+// Keys are case insensitive and returned lower cased on S3 while Azure requires them to be valid
+// C# identifiers, portable keys are made of lower case letters, digits and underscores. Stores not
+// implementing `MetadataStore` return an error matching `ErrNotSupported`.
+func SetObjectMetadata(ctx context.Context, store Store, base string, md map[string]string) error {
+	if metadataStore, ok := store.(MetadataStore); ok {
+		return metadataStore.SetObjectMetadata(ctx, base, md)
+	}
+	return fmt.Errorf("setting metadata of objects of %T: %w", store, ErrNotSupported)
+}
+
+// GetObjectMetadata returns the custom metadata of the object `base` of `store`, see
+// `SetObjectMetadata`, an empty map when it has none.
+func GetObjectMetadata(ctx context.Context, store Store, base string) (map[string]string, error) {
+	if metadataStore, ok := store.(MetadataStore); ok {
+		return metadataStore.GetObjectMetadata(ctx, base)
+	}
+	return nil, fmt.Errorf("getting metadata of objects of %T: %w", store, ErrNotSupported)
+}
+
+// SeekableWriter is implemented by stores retrying the uploads of seekable content their own way,
+// it's used by `WriteObjectSeekable` when available.
+type SeekableWriter interface {
+	WriteObjectSeekable(ctx context.Context, base string, rs io.ReadSeeker) (err error)
+}
+
+// WriteObjectSeekable writes the content of `rs`, from its start, as the object `base` of `store`
+// through `WriteObjectSized`, its size being known. As the content can be read again, an upload
+// failing with a retryable error is retried from the start of `rs`, up to
+// `WriteObjectSeekableAttempts` attempts in total. Cloud stores retry the failures their SDK
+// considers transient, refused writes (permission denied, failed precondition, ...) are not
+// retried.
+func WriteObjectSeekable(ctx context.Context, store Store, base string, rs io.ReadSeeker) error {
+	if writer, ok := store.(SeekableWriter); ok {
+		return writer.WriteObjectSeekable(ctx, base, rs)
+	}
+	return writeObjectSeekable(ctx, store, base, rs, nil, nil)
+}
+
+// PrefixDeleter is implemented by stores deleting the files under a prefix their own way, it's
+// used by `DeleteObjectsUnderPrefix` when available.
+type PrefixDeleter interface {
+	DeleteObjectsUnderPrefix(ctx context.Context, prefix string, force bool) (deleted int, err error)
+}
+
+// DeleteObjectsUnderPrefix deletes all files of `store` starting with the given prefix and returns
+// the number of deleted files. An empty prefix is refused unless `force` is true, as it would
+// delete every file of the store. Unless `store` implements `PrefixDeleter`, the files are walked
+// then deleted in a single request by stores implementing `BatchDeleter`, one by one otherwise.
+func DeleteObjectsUnderPrefix(ctx context.Context, store Store, prefix string, force bool) (deleted int, err error) {
+	if deleter, ok := store.(PrefixDeleter); ok {
+		return deleter.DeleteObjectsUnderPrefix(ctx, prefix, force)
+	}
+	return deleteObjectsUnderPrefix(ctx, store, prefix, force)
+}
+
 var StopIteration = errors.New("stop iteration")
 
 func NewDBinStore(baseURL string, opts ...Option) (Store, error) {
@@ -71,10 +520,24 @@ func NewSimpleStore(baseURL string, opts ...Option) (Store, error) {
 	return NewStore(baseURL, "", "", true, opts...)
 }
 
-// NewStore creates a new Store instance. The baseURL is always a directory, and does not end with a `/`.
+// NewStore creates a new Store instance. The baseURL is always a directory, a single trailing
+// `/` is accepted and trimmed. A baseURL that is malformed, like ending with multiple `/` or
+// pointing to a file (its last segment carrying `extension` or a compression suffix), returns an
+// error matching `ErrMalformedBaseURL`.
 func NewStore(baseURL, extension, compressionType string, overwrite bool, opts ...Option) (Store, error) {
+	return newStoreContext(context.Background(), baseURL, extension, compressionType, overwrite, opts...)
+}
+
+// newStoreContext is `NewStore` with the store anchored to `ctx`, see `WithBaseContext`.
+func newStoreContext(ctx context.Context, baseURL, extension, compressionType string, overwrite bool, opts ...Option) (Store, error) {
 	if strings.HasSuffix(baseURL, "/") {
-		return nil, fmt.Errorf("baseURL shouldn't end with a /")
+		trimmed := strings.TrimSuffix(baseURL, "/")
+		if trimmed == "" || strings.HasSuffix(trimmed, "/") {
+			return nil, fmt.Errorf("baseURL %q should end with at most a single /: %w", baseURL, ErrMalformedBaseURL)
+		}
+
+		zlog.Debug("trimmed trailing / from base url", zap.String("original_base_url", baseURL), zap.String("base_url", trimmed))
+		baseURL = trimmed
 	}
 
 	// WARN: if you were passing `jsonl` as an extension, you should now add `.gz` if you intend
@@ -84,6 +547,10 @@ func NewStore(baseURL, extension, compressionType string, overwrite bool, opts .
 		return nil, err
 	}
 
+	if looksLikeFile(base.Path, extension) {
+		return nil, fmt.Errorf("baseURL %q should be a directory, not a file: %w", baseURL, ErrMalformedBaseURL)
+	}
+
 	config := config{}
 	for _, opt := range opts {
 		opt.apply(&config)
@@ -93,33 +560,114 @@ func NewStore(baseURL, extension, compressionType string, overwrite bool, opts .
 		compressionType = config.compression
 	}
 
+	switch compressionType {
+	case "", "gzip", "zstd", "bzip2":
+	default:
+		return nil, fmt.Errorf("unsupported compression type %q, expected one of gzip, zstd or bzip2 (read-only)", compressionType)
+	}
+
 	switch base.Scheme {
 	case "gs":
-		return NewGSStore(base, extension, compressionType, overwrite, opts...)
-	case "az":
-		return NewAzureStore(base, extension, compressionType, overwrite, opts...)
+		return newGSStoreContext(ctx, base, extension, compressionType, overwrite, opts...)
+	case "az", "azblob", "azure":
+		return newAzureStoreContext(ctx, base, extension, compressionType, overwrite, opts...)
 	case "s3":
-		return NewS3Store(base, extension, compressionType, overwrite, opts...)
+		return newS3StoreContext(ctx, base, extension, compressionType, overwrite, opts...)
 	case "file":
-		return NewLocalStore(base, extension, compressionType, overwrite, opts...)
+		return newLocalStoreContext(ctx, base, extension, compressionType, overwrite, opts...)
 	case "memory":
-		return NewMemoryStore(base, extension, compressionType, overwrite, opts...)
+		return newMemoryStoreContext(ctx, base, extension, compressionType, overwrite, opts...)
 	case "":
 		// If scheme is empty, let's assume baseURL was a absolute/relative path without being an actual URL
-		return NewLocalStore(base, extension, compressionType, overwrite, opts...)
+		return newLocalStoreContext(ctx, base, extension, compressionType, overwrite, opts...)
 	}
 
-	return nil, fmt.Errorf("archive store only supports, file://, gs:// or local path")
+	return nil, &UnsupportedSchemeError{Scheme: base.Scheme}
+}
+
+// looksLikeFile returns true when the last segment of `basePath` carries the store `extension`
+// or a known compression suffix, the base URL then pointing to an object instead of a directory.
+func looksLikeFile(basePath, extension string) bool {
+	last := path.Base(basePath)
+	if basePath == "" || last == "/" || last == "." {
+		return false
+	}
+
+	if extension != "" && strings.HasSuffix(last, "."+extension) {
+		return true
+	}
+	return strings.HasSuffix(last, ".gz") || strings.HasSuffix(last, ".zst") || strings.HasSuffix(last, ".bz2")
 }
 
 type config struct {
 	compression string
 	overwrite   bool
+	httpClient  *http.Client
+	userAgent   string
+
+	skipDirectoryMarkers bool
+	sizeValidation       bool
+	listPageSize         int
+
+	sharder        func(name string) string
+	objectPathFunc func(base string) string
+	keySeparator   string
+
+	gcsSendCRC32C                 bool
+	gcsReadChunk                  int64
+	s3ContentMD5                  bool
+	localFsync                    bool
+	localSkipDecompressionIfPlain bool
+	localWriteBufferSize          int
+	objectACL                     string
+
+	retryableErrorFunc func(err error) bool
+
+	baseContext context.Context
+
+	uploadBuffers *uploadBufferLimiter
+
+	autoCompressionFromExtension bool
+	defaultPrefix                string
+	keepLocalAfterPush           bool
+	clampFutureMTimes            bool
+	errorOnEmptyWrite            bool
+	deleteIgnoreNotFound         bool
+
+	walkProgressCallback func(ctx context.Context, filesSeen int, pagesFetched int)
+
+	operationTimeout  time.Duration
+	existenceCacheTTL time.Duration
+
+	existenceBloomHint       bool
+	existenceBloomHintMaxAge time.Duration
+
+	zstdDecoderConcurrency int
+	zstdMaxIdleDecoders    int
+
+	postWriteHook func(ctx context.Context, name string, attrs *ObjectAttributes)
+	retryObserver func(op string, attempt int, err error, willRetry bool)
+
+	compressionDetection bool
 
 	compressedWriteCallback   func(ctx context.Context, size int)
 	compressedReadCallback    func(ctx context.Context, size int)
 	uncompressedWriteCallback func(ctx context.Context, size int)
 	uncompressedReadCallback  func(ctx context.Context, size int)
+	writeStatsCallback        func(ctx context.Context, uncompressed, compressed int64)
+	overwriteSkipCallback     func(ctx context.Context, name string)
+
+	// err is the error of the first option given an invalid value, returned by the store
+	// constructors, see `invalid`
+	err error
+}
+
+// invalid records `err`, the error of an option given an invalid value, the store constructor
+// failing with the first one recorded
+func (c *config) invalid(err error) {
+	if c.err == nil {
+		c.err = err
+	}
 }
 
 type Option interface {
@@ -139,6 +687,9 @@ func (f optionFunc) apply(config *config) {
 // - <empty>       No compression
 // - zstd          Use ZSTD compression
 // - gzip          Use GZIP compression
+// - bzip2         Use BZIP2 decompression, read-only, writing objects returns an error
+//
+// Any other value is refused by `NewStore`.
 func Compression(compressionType string) Option {
 	return optionFunc(func(config *config) {
 		config.compression = compressionType
@@ -153,6 +704,531 @@ func AllowOverwrite() Option {
 	})
 }
 
+// WithHTTPClient defines the `*http.Client` used by the underlying cloud SDK
+// (S3, Azure and Google Storage) to perform its requests, useful to route traffic
+// through a proxy, use custom TLS roots or tweak timeouts. It has no effect on
+// the local and memory stores.
+//
+// For Google Storage, the provided client is used as-is and automatic credentials
+// discovery is bypassed, it's the responsibility of the client's transport to
+// authenticate the requests (for example by wrapping it in an `oauth2.Transport`).
+// For S3, when a custom CA bundle is configured (`AWS_CA_BUNDLE`), the client's
+// transport must be an `*http.Transport` so the SDK can install the bundle on it.
+func WithHTTPClient(client *http.Client) Option {
+	return optionFunc(func(config *config) {
+		config.httpClient = client
+	})
+}
+
+// WithUserAgent defines the User-Agent added to the requests performed by the underlying
+// cloud SDK (S3, Azure and Google Storage), defaults to `dstore/<version>`. For Google
+// Storage, it's not applied when a custom client is provided through `WithHTTPClient`.
+func WithUserAgent(userAgent string) Option {
+	return optionFunc(func(config *config) {
+		config.userAgent = userAgent
+	})
+}
+
+// baseContextOr returns the base context configured through `WithBaseContext`, or `ctx` if none
+func (c *config) baseContextOr(ctx context.Context) context.Context {
+	if c.baseContext != nil {
+		return c.baseContext
+	}
+	return ctx
+}
+
+// userAgentOrDefault returns the configured User-Agent or `dstore/<version>` if unset
+func (c *config) userAgentOrDefault() string {
+	if c.userAgent != "" {
+		return c.userAgent
+	}
+	return defaultUserAgent
+}
+
+var defaultUserAgent = "dstore/" + moduleVersion()
+
+// moduleVersion returns the version of this module as recorded in the binary's build
+// information, `devel` when unavailable.
+func moduleVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/streamingfast/dstore" && dep.Version != "" {
+				return dep.Version
+			}
+		}
+	}
+	return "devel"
+}
+
+// WithSkipDirectoryMarkers filters out directory marker objects, keys ending with a `/`
+// created by some S3-compatible systems and UIs to emulate directories, from `Walk`,
+// `WalkFrom` and `ListFiles` on cloud stores.
+//
+// By default, such markers are returned like any other file (e.g. `dir/`). The local store
+// never returns directories.
+func WithSkipDirectoryMarkers() Option {
+	return optionFunc(func(config *config) {
+		config.skipDirectoryMarkers = true
+	})
+}
+
+// WithBaseContext anchors all operations of the store to `ctx`, cancelling it aborts every
+// in-flight operation of the store, and of its sub stores, at once, useful on shutdown. Each
+// operation still honors its own context too. Local and memory stores, whose I/O takes no
+// context, check it before each file walked and each read of a transfer.
+//
+// By default, stores are anchored to the context they are created with, which is
+// `context.Background()` for `NewStore` and the context given to `Clone`.
+func WithBaseContext(ctx context.Context) Option {
+	return optionFunc(func(config *config) {
+		config.baseContext = ctx
+	})
+}
+
+// WithMaxInFlightBytes bounds to `n` bytes the memory used by the upload buffers of S3 and
+// Azure writes. Each upload reserves its buffers (S3 part size times the number of parts
+// uploaded concurrently, Azure buffer size times the number of rotating buffers) before it
+// starts and waits until enough of the budget is free, an upload needing more than `n` bytes
+// reserves the whole budget. The budget is held by the returned Option, pass the same Option
+// value to several stores to bound their uploads together. `n` must be positive, the store
+// constructor failing otherwise.
+func WithMaxInFlightBytes(n int64) Option {
+	if n <= 0 {
+		return optionFunc(func(config *config) {
+			config.invalid(fmt.Errorf("max in-flight bytes must be positive, got %d", n))
+		})
+	}
+
+	limiter := newUploadBufferLimiter(n)
+	return optionFunc(func(config *config) {
+		config.uploadBuffers = limiter
+	})
+}
+
+// WithDefaultPrefix scopes all the operations of the store under `prefix`, as if it was part of
+// the base URL path: writing `x` creates the object `<base>/<prefix>/x`, which is walked back
+// as `x`. The store behaves like a `SubStore(prefix)` of the store without it, `BaseURL`
+// returning the base URL including the prefix.
+func WithDefaultPrefix(prefix string) Option {
+	return optionFunc(func(config *config) {
+		config.defaultPrefix = prefix
+	})
+}
+
+// withDefaultPrefix returns `baseURL` with `prefix` appended to its path, see `WithDefaultPrefix`.
+func withDefaultPrefix(baseURL *url.URL, prefix string) *url.URL {
+	if prefix == "" {
+		return baseURL
+	}
+
+	prefixed := *baseURL
+	prefixed.Path = path.Join(baseURL.Path, prefix)
+	if prefixed.Host != "" && !strings.HasPrefix(prefixed.Path, "/") {
+		prefixed.Path = "/" + prefixed.Path
+	}
+	return &prefixed
+}
+
+// WithKeepLocalAfterPush makes `PushLocalFile` (and `PushLocalFiles`) keep the local file once
+// successfully pushed instead of deleting it, useful to keep a local copy as a warm cache.
+func WithKeepLocalAfterPush() Option {
+	return optionFunc(func(config *config) {
+		config.keepLocalAfterPush = true
+	})
+}
+
+// FutureMTimeSkew is the tolerated clock skew of backends before a last modified time in the
+// future is clamped when `WithClampFutureMTimes` is used.
+var FutureMTimeSkew = 1 * time.Minute
+
+// WithClampFutureMTimes makes `ObjectAttributes` (and `StatObject`) clamp to the current time
+// any last modified time later than now plus `FutureMTimeSkew`, logging a warning. It defends
+// "newer than" comparisons against backends with a skewed clock.
+func WithClampFutureMTimes() Option {
+	return optionFunc(func(config *config) {
+		config.clampFutureMTimes = true
+	})
+}
+
+// WithErrorOnEmptyWrite makes writes (`WriteObject`, `WriteObjectSized`, `UploadFrom`,
+// `PushLocalFile`, ...) of content with zero uncompressed bytes fail with `ErrEmptyObject`
+// instead of persisting an empty object. The source is checked before anything is sent to
+// the backend, so no empty object is ever created.
+func WithErrorOnEmptyWrite() Option {
+	return optionFunc(func(config *config) {
+		config.errorOnEmptyWrite = true
+	})
+}
+
+// WithDeleteIgnoreNotFound makes `DeleteObject` return `nil` when the object does not exist
+// instead of an error matching `ErrNotFound`, for callers deleting defensively. S3 reporting the
+// deletion of a missing object as a success, S3 stores without it check the object exists with
+// an extra `HEAD` request before each deletion.
+func WithDeleteIgnoreNotFound() Option {
+	return optionFunc(func(config *config) {
+		config.deleteIgnoreNotFound = true
+	})
+}
+
+// WithWalkProgress makes walks (`Walk`, `WalkFrom`, `ListFiles`, ...) invoke `cb` after each
+// listing page fetched with the running totals of objects listed and pages fetched since the
+// walk started, useful to monitor the discovery progress of long walks. Stores without listing
+// pages (local, memory) report batches of 1000 files as pages.
+func WithWalkProgress(cb func(ctx context.Context, filesSeen int, pagesFetched int)) Option {
+	return optionFunc(func(config *config) {
+		config.walkProgressCallback = cb
+	})
+}
+
+// WithOperationTimeout bounds each individual backend call issued by Google Storage stores
+// (fetching attributes, opening a reader, finalizing an upload, deleting an object and fetching
+// each listing page) to `d`, failing the operation with an error matching
+// `context.DeadlineExceeded` when a call takes longer, so stalled connections on flaky
+// networks do not hang forever. Reading and writing object content is not bounded, only the
+// calls themselves are. It has no effect on other stores.
+func WithOperationTimeout(d time.Duration) Option {
+	return optionFunc(func(config *config) {
+		config.operationTimeout = d
+	})
+}
+
+// WithExistenceCache makes S3 and Azure stores not allowing overwrites remember for `ttl` the
+// objects their writes found existing, so that writing them again within `ttl` is skipped
+// without checking their existence with the backend again, saving a request per write for
+// producers re-writing the same objects. Missing objects are never remembered, their writes
+// always check with the backend. Objects deleted through the store are forgotten, but objects
+// deleted by others are considered existing until `ttl` expires. It is distinct from
+// `NewAttributeCachingStore` and has no effect on other stores.
+func WithExistenceCache(ttl time.Duration) Option {
+	return optionFunc(func(config *config) {
+		config.existenceCacheTTL = ttl
+	})
+}
+
+// WithZstdDecoderConcurrency makes zstd compressed objects be decompressed by decoders running
+// up to `n` concurrent goroutines each, instead of the zstd library default. Decoders are pooled
+// and reused across reads, by all the stores using the same concurrency, limiting allocations
+// under many concurrent `OpenObject` calls, a low `n` also bounding the memory of each decoder.
+// `n` must be positive, the store constructor failing otherwise.
+func WithZstdDecoderConcurrency(n int) Option {
+	return optionFunc(func(config *config) {
+		if n <= 0 {
+			config.invalid(fmt.Errorf("zstd decoder concurrency must be positive, got %d", n))
+			return
+		}
+		config.zstdDecoderConcurrency = n
+	})
+}
+
+// WithMaxIdleZstdDecoders keeps up to `n` idle zstd decoders for reuse, instead of 64, the
+// decoders released beyond it being closed. Decoders are pooled by concurrency and idle count,
+// see `WithZstdDecoderConcurrency`. `n` must be positive, the store constructor failing
+// otherwise.
+func WithMaxIdleZstdDecoders(n int) Option {
+	return optionFunc(func(config *config) {
+		if n <= 0 {
+			config.invalid(fmt.Errorf("max idle zstd decoders must be positive, got %d", n))
+			return
+		}
+		config.zstdMaxIdleDecoders = n
+	})
+}
+
+// WithExistenceBloomHint makes `FileExists` answer from a bloom filter built from a listing of
+// the whole store when the object is definitely not present, skipping the backend check (a HEAD
+// on cloud stores), while objects the filter may hold are still checked with the backend. It
+// suits workloads polling for objects that mostly do not exist yet, on stores whose listing is
+// reasonably small.
+//
+// The filter is built on the first check and rebuilt once older than `maxAge`, each sub store
+// having its own. Objects written through the store are added to it as they are written, but
+// objects written by other processes since the last listing are reported missing until the next
+// rebuild: that is the staleness window to account for, `FileExists` never reporting missing an
+// object that was present at listing time or written through the store. Writes of stores not
+// allowing overwrites, and deletions, always check with the backend. `maxAge` must be positive,
+// the store constructor failing otherwise.
+func WithExistenceBloomHint(maxAge time.Duration) Option {
+	return optionFunc(func(config *config) {
+		if maxAge <= 0 {
+			config.invalid(fmt.Errorf("existence bloom hint max age must be positive, got %s", maxAge))
+			return
+		}
+		config.existenceBloomHint = true
+		config.existenceBloomHintMaxAge = maxAge
+	})
+}
+
+// WithCompressionDetectionOnWrite makes the store record the compression of each object it
+// writes in the object's metadata, under `CompressionMetadataKey` ("none" for uncompressed
+// objects), and decode the objects it opens with the compression they record, falling back to
+// its configured compression for objects without it. Stores reading each other's objects then
+// decode them properly even when configured with different compressions.
+//
+// S3, Azure and memory stores get the metadata along with the content, local stores read it
+// from the sidecar file of the object and Google Storage stores fetch the object's attributes
+// first, at the cost of an extra request per read. `OpenObjectWithCompression` keeps decoding
+// with the compression it is given.
+func WithCompressionDetectionOnWrite() Option {
+	return optionFunc(func(config *config) {
+		config.compressionDetection = true
+	})
+}
+
+// WithLocalFsync makes local stores flush each written file to stable storage before renaming
+// it into place, then flush its parent directory so the rename itself survives a crash.
+//
+// This guarantees durability at a significant cost, each write waiting for the disk to
+// acknowledge two syncs, so it should be reserved to data that must not be lost. Ignored by
+// the other stores.
+func WithLocalFsync() Option {
+	return optionFunc(func(config *config) {
+		config.localFsync = true
+	})
+}
+
+// WithLocalSkipDecompressionIfPlain makes local stores check the magic bytes of each file they
+// open and read it as-is when it is clearly not in the configured compression format, so that
+// a file decompressed by hand while debugging can still be read through a compressed store.
+// It has no effect on other stores.
+func WithLocalSkipDecompressionIfPlain() Option {
+	return optionFunc(func(config *config) {
+		config.localSkipDecompressionIfPlain = true
+	})
+}
+
+// WithLocalWriteBufferSize makes local stores buffer up to `n` bytes in memory before writing
+// them to the file, so that a source delivering its content in many small reads does not turn
+// each of them into a write call. The buffer is flushed before the file is closed. By default,
+// or when `n` is 0, writes are not buffered. Ignored by the other stores.
+func WithLocalWriteBufferSize(n int) Option {
+	return optionFunc(func(config *config) {
+		config.localWriteBufferSize = n
+	})
+}
+
+// WithListPageSize sets how many objects are requested per listing call when walking a cloud
+// store, larger pages reduce the number of requests needed to walk many files. S3 accepts at
+// most 1000 keys per page and Azure 5000, bigger values are capped. By default, or when `n` is
+// 0, the backend's default page size is used.
+func WithListPageSize(n int) Option {
+	return optionFunc(func(config *config) {
+		config.listPageSize = n
+	})
+}
+
+// WithSizeValidation validates that reading an object delivers as many bytes as the size
+// reported by the backend when the object was opened. A premature end of the content
+// results in a `*ShortReadError` instead of a silent `io.EOF`. On compressed stores, the
+// raw compressed bytes are validated, before decompression.
+func WithSizeValidation() Option {
+	return optionFunc(func(config *config) {
+		config.sizeValidation = true
+	})
+}
+
+// WithPrefixSharding spreads objects across many prefixes by injecting the sub-prefix
+// computed by `sharder` in front of each object name, `<base>/<shard>/<name>`, which
+// helps staying under per-prefix request rate limits. The `sharder` must be deterministic
+// and return a single path segment (no `/`). See `HexHashSharder` for a default
+// implementation.
+//
+// Walking a sharded store lists the whole store, strips the shard from each file and
+// merges the results in sorted order, which is costlier than walking a plain store.
+func WithPrefixSharding(sharder func(name string) string) Option {
+	return optionFunc(func(config *config) {
+		config.sharder = sharder
+	})
+}
+
+// WithObjectPathFunc maps each logical object name to the physical path of the object relative
+// to the store's base path, the extension being appended to the returned path, for example
+// `100` to `0/0/100` (see `ZeroPaddedBucketPathFunc`). The function must be deterministic, and
+// must keep the logical name as the trailing part of the path so that `Walk` can invert it: a
+// listed file is only yielded when re-applying the function to one of its path suffixes gives
+// back its path. It takes precedence over `WithPrefixSharding`.
+//
+// Walking such a store lists the whole store and sorts the inverted names, which is costlier
+// than walking a plain store.
+func WithObjectPathFunc(fn func(base string) string) Option {
+	return optionFunc(func(config *config) {
+		config.objectPathFunc = fn
+	})
+}
+
+// WithKeySeparator replaces the `/` of object names by `sep` in the object keys, for example
+// storing `a/b/c` at `a-b-c`, for S3 compatible systems performing badly with deep keys. Walked
+// keys have `sep` replaced back by `/`, and walked prefixes are translated, so the logical names
+// stay unchanged: object names must thus not contain `sep` themselves. Walks follow the order of
+// the keys, which differs from the one of the names when other characters sort between `sep` and
+// `/`. Sub-prefixes of a store with a key separator are not listed by `ListSubPrefixes`, its keys
+// being flat, and `SubStore` fails with `ErrNotSupported`, a sub folder not being a folder of its
+// keys. An empty `sep` or `/` keeps the keys as-is.
+func WithKeySeparator(sep string) Option {
+	return optionFunc(func(config *config) {
+		if sep == "/" {
+			sep = ""
+		}
+		config.keySeparator = sep
+	})
+}
+
+// ZeroPaddedBucketPathFunc returns an object path function, to be used with `WithObjectPathFunc`,
+// that left pads names with zeros to `width` characters and nests them under `levels` directories
+// made of `digits` consecutive characters of the padded name each. For example with a width of 5,
+// 2 levels of 1 digit, `100` (padded `00100`) is mapped to `0/0/100`. Width, levels and digits
+// must be positive with `levels * digits <= width`, an error being returned otherwise.
+func ZeroPaddedBucketPathFunc(width, levels, digits int) (func(base string) string, error) {
+	if width <= 0 || levels <= 0 || digits <= 0 || levels*digits > width {
+		return nil, fmt.Errorf("zero padded bucket path needs positive width, levels and digits with levels * digits <= width, got width %d, levels %d, digits %d", width, levels, digits)
+	}
+
+	return func(base string) string {
+		padded := base
+		if len(padded) < width {
+			padded = strings.Repeat("0", width-len(padded)) + padded
+		}
+
+		segments := make([]string, 0, levels+1)
+		for i := 0; i < levels; i++ {
+			segments = append(segments, padded[i*digits:(i+1)*digits])
+		}
+
+		return strings.Join(append(segments, base), "/")
+	}, nil
+}
+
+// NaturalLess orders names naturally, comparing runs of digits by their numeric value and the
+// rest byte by byte, so that `file9` comes before `file10`, itself before `file100`. Numbers only
+// differing by leading zeros fall back to lexicographical order. To be used with `WalkSorted`.
+func NaturalLess(a, b string) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a[i]) || !isDigit(b[j]) {
+			if a[i] != b[j] {
+				return a[i] < b[j]
+			}
+			i++
+			j++
+			continue
+		}
+
+		startA, startB := i, j
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+
+		numberA := strings.TrimLeft(a[startA:i], "0")
+		numberB := strings.TrimLeft(b[startB:j], "0")
+		if len(numberA) != len(numberB) {
+			return len(numberA) < len(numberB)
+		}
+		if numberA != numberB {
+			return numberA < numberB
+		}
+	}
+
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	return a < b
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// HexHashSharder returns a sharder, to be used with `WithPrefixSharding`, using the first
+// `n` hexadecimal characters of the SHA-256 hash of the name as the shard, yielding
+// 16^n distinct shards. `n` must be between 1 and 64, an error being returned otherwise.
+func HexHashSharder(n int) (func(name string) string, error) {
+	if n <= 0 || n > sha256.Size*2 {
+		return nil, fmt.Errorf("hex hash sharder length must be between 1 and %d, got %d", sha256.Size*2, n)
+	}
+
+	return func(name string) string {
+		hash := sha256.Sum256([]byte(name))
+		return hex.EncodeToString(hash[:])[:n]
+	}, nil
+}
+
+// WithS3ContentMD5Validation makes S3 stores send the Content-MD5 of the uploaded data so that
+// S3 rejects a corrupted upload. Objects written with a known size (see `WriteObjectSized`) of at
+// most `S3ContentMD5PutObjectMaxSize` bytes are compressed in memory while computing their MD5
+// and sent with a single `PutObject` carrying it. Bigger objects, or ones of unknown size, go
+// through the multipart uploader which buffers each part and sends the part's MD5 along with
+// it, the validation being enforced regardless of the session configuration. It has no effect
+// on other stores.
+func WithS3ContentMD5Validation() Option {
+	return optionFunc(func(config *config) {
+		config.s3ContentMD5 = true
+	})
+}
+
+// WithRetryableErrorFunc makes S3 stores retry, with the SDK backoff and retry limit, the failed
+// requests for which `isRetryable` returns true on top of the ones the SDK already considers
+// transient. This covers every request, reads of the `OpenObject` attempts loop and uploads of
+// `WriteObjectSeekable` included, and lets operators handle the error codes their S3 compatible
+// gateway uses for transient failures. Without it, the default classification applies. It has
+// no effect on other stores.
+func WithRetryableErrorFunc(isRetryable func(err error) bool) Option {
+	return optionFunc(func(config *config) {
+		config.retryableErrorFunc = isRetryable
+	})
+}
+
+// WithObjectACL sets the canned ACL `acl` on objects written by S3 and Google Storage stores,
+// for example `public-read` to publish objects for anonymous download. It is one of the S3
+// canned ACLs (`private`, `public-read`, `public-read-write`, `authenticated-read`,
+// `aws-exec-read`, `bucket-owner-read`, `bucket-owner-full-control`, `log-delivery-write`),
+// mapped to the equivalent predefined ACL on Google Storage, which only supports `private`,
+// `public-read`, `authenticated-read`, `bucket-owner-read` and `bucket-owner-full-control`.
+// Creating the store fails with an unknown or unsupported ACL.
+//
+// Azure has no per-blob ACL, public access being configured on the container, the option has
+// no effect on Azure stores nor on other stores.
+func WithObjectACL(acl string) Option {
+	return optionFunc(func(config *config) {
+		config.objectACL = acl
+	})
+}
+
+// gcsPredefinedACLs maps the canned ACLs of `WithObjectACL` to the Google Storage predefined ACLs
+var gcsPredefinedACLs = map[string]string{
+	"private":                   "private",
+	"public-read":               "publicRead",
+	"authenticated-read":        "authenticatedRead",
+	"bucket-owner-read":         "bucketOwnerRead",
+	"bucket-owner-full-control": "bucketOwnerFullControl",
+}
+
+// WithGCSSendCRC32C makes Google Storage stores send the CRC32C checksum of the content
+// along with each upload so that Google Storage rejects a corrupted upload. As the checksum
+// must be known before the upload starts, the (compressed) content is fully buffered in
+// memory prior to being sent. It has no effect on other stores.
+func WithGCSSendCRC32C() Option {
+	return optionFunc(func(config *config) {
+		config.gcsSendCRC32C = true
+	})
+}
+
+// WithGCSReadChunkSize makes Google Storage stores read objects by sequential ranged requests
+// of `n` bytes instead of a single request streaming the whole object. Smaller chunks avoid
+// transferring content that is never consumed when readers stop early, larger ones reduce the
+// per-request overhead on big streams. The size must be a positive multiple of 256 KiB, the
+// store constructor failing otherwise. It has no effect on other stores.
+func WithGCSReadChunkSize(n int) Option {
+	return optionFunc(func(config *config) {
+		if n <= 0 || n%googleapi.MinUploadChunkSize != 0 {
+			config.invalid(fmt.Errorf("gcs read chunk size must be a positive multiple of %d, got %d", googleapi.MinUploadChunkSize, n))
+			return
+		}
+		config.gcsReadChunk = int64(n)
+	})
+}
+
 // WithCompressedReadCallback allows you to set a callback function that is invoked
 // when a compressed read operation is performed.
 func WithCompressedReadCallback(cb func(context.Context, int)) Option {
@@ -185,9 +1261,82 @@ func WithUncompressedWriteCallback(cb func(context.Context, int)) Option {
 	})
 }
 
+// WithWriteStats allows you to set a callback function that is invoked once at the end
+// of each successful write with the total uncompressed bytes received and the total
+// compressed bytes sent to the backend. When the store is not compressed, both values
+// are the same.
+func WithWriteStats(cb func(ctx context.Context, uncompressed, compressed int64)) Option {
+	return optionFunc(func(config *config) {
+		config.writeStatsCallback = cb
+	})
+}
+
+// WithPostWriteHook invokes `hook` once each write (`WriteObject`, `WriteObjectSized`,
+// `UploadFrom`, `PushLocalFile`, ...) durably succeeded, that is after the rename on local
+// stores, the upload completion on S3 and Azure, and the writer close on Google Storage, with the
+// attributes of the object written. It is not invoked for failed writes nor for writes skipped
+// because the object exists on a store not allowing overwrites.
+//
+// Fetching the attributes costs an extra request on S3 and Azure stores, `attrs` is nil when
+// they could not be fetched.
+func WithPostWriteHook(hook func(ctx context.Context, name string, attrs *ObjectAttributes)) Option {
+	return optionFunc(func(config *config) {
+		config.postWriteHook = hook
+	})
+}
+
+// WithRetryObserver invokes `observer` on each retry decision of the stores retrying failed
+// operations, that is the S3 `OpenObject` attempts (see `DSTORE_S3_READ_ATTEMPTS`) and the
+// `WriteObjectSeekable` attempts of all stores, so that retry storms become visible. It receives
+// the operation name, the 1-based attempt number, the error of the attempt and whether another
+// attempt follows. A success following failed attempts is reported too, with a nil `err` and
+// `willRetry` false, first attempt successes are not.
+func WithRetryObserver(observer func(op string, attempt int, err error, willRetry bool)) Option {
+	return optionFunc(func(config *config) {
+		config.retryObserver = observer
+	})
+}
+
+// WithOverwriteSkipLogger allows you to set a callback function that is invoked whenever
+// a write is skipped because the object already exists and the store does not allow
+// overwrites, which is otherwise silent. The received context carries the file name,
+// see `FileNameFromContext`.
+func WithOverwriteSkipLogger(cb func(ctx context.Context, name string)) Option {
+	return optionFunc(func(config *config) {
+		config.overwriteSkipCallback = cb
+	})
+}
+
 // Deprecated: Use NewStoreFromFileURL
 var NewStoreFromURL = NewStoreFromFileURL
 
+// WithAutoCompressionFromExtension makes `NewStoreFromFileURL` (and the `OpenObject` and
+// `ReadObject` helpers) configure the store's compression from the extension of the file,
+// see `CompressionFromFilename`, unless a compression is explicitly given through `Compression`.
+func WithAutoCompressionFromExtension() Option {
+	return optionFunc(func(config *config) {
+		config.autoCompressionFromExtension = true
+	})
+}
+
+// CompressionFromFilename returns the compression type matching the extension of `filename`:
+// gzip for `.gz`, zstd for `.zst` and bzip2 for `.bz2`, no compression for any other one. An
+// error matching `ErrNotSupported` is returned for `.snappy`, snappy compression being
+// unsupported.
+func CompressionFromFilename(filename string) (string, error) {
+	switch {
+	case strings.HasSuffix(filename, ".gz"):
+		return "gzip", nil
+	case strings.HasSuffix(filename, ".zst"):
+		return "zstd", nil
+	case strings.HasSuffix(filename, ".bz2"):
+		return "bzip2", nil
+	case strings.HasSuffix(filename, ".snappy"):
+		return "", fmt.Errorf("file %q is snappy compressed: %w", filename, ErrNotSupported)
+	}
+	return "", nil
+}
+
 // NewStoreFromFileURL works against a full file URL to derive the store from it as well as
 // the filename it points to. Use this method **only and only if** the input points to a file directly,
 // if your input is to build a store, use NewStore instead.
@@ -195,20 +1344,43 @@ var NewStoreFromURL = NewStoreFromFileURL
 // This is a shortcut helper function that make it simpler to get store from a single file
 // url.
 func NewStoreFromFileURL(fileURL string, opts ...Option) (store Store, filename string, err error) {
-	var storeURL string
-	if _, err := os.Stat(fileURL); !os.IsNotExist(err) {
-		sanitizedURL := filepath.Clean(fileURL)
-		filename = filepath.Base(sanitizedURL)
-		storeURL = filepath.Dir(sanitizedURL)
+	file, err := parseFileURL(fileURL, opts)
+	if err != nil {
+		return nil, file.filename, err
+	}
+
+	store, err = NewStore(file.storeURL, "", file.compression, file.overwrite, opts...)
+	if err != nil {
+		return nil, file.filename, fmt.Errorf("open store: %w", err)
+	}
+
+	return store, file.filename, nil
+}
+
+// parsedFileURL is a file URL split into the store holding it and its name, see `parseFileURL`.
+type parsedFileURL struct {
+	storeURL    string
+	filename    string
+	compression string
+	overwrite   bool
+}
+
+// parseFileURL splits `rawURL` into the URL of the store holding the file and the file name,
+// resolving the compression and overwrite flag the store must be created with from `opts`.
+func parseFileURL(rawURL string, opts []Option) (file parsedFileURL, err error) {
+	if _, err := os.Stat(rawURL); !os.IsNotExist(err) {
+		sanitizedURL := filepath.Clean(rawURL)
+		file.filename = filepath.Base(sanitizedURL)
+		file.storeURL = filepath.Dir(sanitizedURL)
 	} else {
-		url, err := url.Parse(fileURL)
+		url, err := url.Parse(rawURL)
 		if err != nil {
-			return store, "", fmt.Errorf("parse file url: %w", err)
+			return file, fmt.Errorf("parse file url: %w", err)
 		}
 
-		filename = filepath.Base(url.Path)
+		file.filename = filepath.Base(url.Path)
 		url.Path = strings.TrimSuffix(filepath.Dir(url.Path), "/")
-		storeURL = url.String()
+		file.storeURL = url.String()
 	}
 
 	config := config{}
@@ -216,12 +1388,15 @@ func NewStoreFromFileURL(fileURL string, opts ...Option) (store Store, filename
 		opt.apply(&config)
 	}
 
-	store, err = NewStore(storeURL, "", config.compression, config.overwrite, opts...)
-	if err != nil {
-		return nil, filename, fmt.Errorf("open store: %w", err)
+	file.overwrite = config.overwrite
+	file.compression = config.compression
+	if file.compression == "" && config.autoCompressionFromExtension {
+		if file.compression, err = CompressionFromFilename(file.filename); err != nil {
+			return file, err
+		}
 	}
 
-	return store, filename, nil
+	return file, nil
 }
 
 // OpenObject directly opens the giving file URL by parsing the file url, extracting the
@@ -257,13 +1432,187 @@ func ReadObject(ctx context.Context, fileURL string, opts ...Option) ([]byte, er
 	return io.ReadAll(reader)
 }
 
+// ReadObjectString reads the object `name` from `store` and returns its full content as
+// a string. The object is fully buffered in memory, it's meant for small objects.
+func ReadObjectString(ctx context.Context, store Store, name string) (string, error) {
+	reader, err := store.OpenObject(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("open object: %w", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", fmt.Errorf("read object: %w", err)
+	}
+
+	return string(data), nil
+}
+
+// MaxObjectLineSize is the longest line `OpenObjectLines` scanners accept, a longer line makes
+// the scan fail with `bufio.ErrTooLong`.
+var MaxObjectLineSize = 64 * 1024 * 1024
+
+// OpenObjectLines opens the object `name` from `store`, decompressed according to the store
+// configuration, and returns a scanner yielding its lines, useful to read JSONL objects. The
+// scanner accepts lines up to `MaxObjectLineSize` bytes. The returned `closer` must be called
+// once done with the scanner, and `scanner.Err()` checked once `Scan` returns false.
+func OpenObjectLines(ctx context.Context, store Store, name string) (scanner *bufio.Scanner, closer func() error, err error) {
+	reader, err := store.OpenObject(ctx, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open object: %w", err)
+	}
+
+	scanner = bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), MaxObjectLineSize)
+
+	return scanner, reader.Close, nil
+}
+
+// WriteObjectString writes `content` as the object `name` in `store`.
+func WriteObjectString(ctx context.Context, store Store, name, content string) error {
+	return WriteObjectSized(ctx, store, name, strings.NewReader(content), int64(len(content)))
+}
+
+// WriteObjectPreCompressed writes `compressed`, content already compressed with
+// `asCompression`, verbatim as the object `base` of `store`, saving the decompression and
+// recompression a transcode would otherwise go through. Reading the object back then decodes it
+// like any other. `asCompression` must match the compression of `store`, an error is returned
+// otherwise. The write callbacks and stats only see compressed bytes, as no uncompressed content
+// goes through the store. Only the stores created by this package support it.
+func WriteObjectPreCompressed(ctx context.Context, store Store, base string, compressed io.Reader, asCompression string) error {
+	common, ok := store.(interface{ commonConfig() *commonStore })
+	if !ok {
+		return fmt.Errorf("writing pre-compressed content to %T: %w", store, ErrNotSupported)
+	}
+
+	if compressionType := common.commonConfig().compressionType; asCompression != compressionType {
+		return fmt.Errorf("content compressed with %q cannot be written to a store compressing with %q", asCompression, compressionType)
+	}
+
+	return store.WriteObject(withPreCompressed(ctx), base, compressed)
+}
+
+// WalkWithBudget is like `store.Walk` but stops once `budget` has elapsed, returning
+// `ErrWalkDeadlineExceeded` after `f` was invoked for the files processed so far, so the caller
+// can decide to proceed with partial results. The budget bounds both the listing, interrupted
+// while fetching a page, and the time spent in `f`. A `ctx` done earlier returns its own error.
+func WalkWithBudget(ctx context.Context, store Store, prefix string, budget time.Duration, f func(filename string) error) error {
+	deadline := time.Now().Add(budget)
+	walkCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	var exceeded bool
+	err := store.Walk(walkCtx, prefix, func(filename string) error {
+		if !time.Now().Before(deadline) {
+			exceeded = true
+			return StopIteration
+		}
+		return f(filename)
+	})
+	// Backends wrap the context error in their own ones, a failure once the budget is spent is
+	// attributed to it
+	if exceeded || (err != nil && walkCtx.Err() != nil && ctx.Err() == nil) {
+		return ErrWalkDeadlineExceeded
+	}
+	return err
+}
+
+// HighestContiguous returns the highest number of the sequence of files named `prefix`
+// followed by the number left padded with zeros to `width` digits, starting at `start` and
+// increasing by `step`, that has no gap: all the files from `start` to the returned number are
+// present. The walk stops at the first gap. Files not named after a number of the sequence are
+// ignored. When the file of `start` itself is missing, an error matching `ErrNotFound` is
+// returned.
+func HighestContiguous(ctx context.Context, store Store, prefix string, start uint64, width int, step uint64) (uint64, error) {
+	if width <= 0 || step == 0 {
+		return 0, fmt.Errorf("highest contiguous needs a positive width and step, got width %d, step %d", width, step)
+	}
+
+	first := fmt.Sprintf("%s%0*d", prefix, width, start)
+	next := start
+	found := false
+	err := store.WalkFrom(ctx, prefix, first, func(filename string) error {
+		name := strings.TrimPrefix(filename, prefix)
+		if len(name) != width {
+			return nil
+		}
+		number, err := strconv.ParseUint(name, 10, 64)
+		if err != nil || number < next {
+			return nil
+		}
+		if number > next {
+			return StopIteration
+		}
+
+		found = true
+		next += step
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("first file of sequence %q: %w", first, ErrNotFound)
+	}
+	return next - step, nil
+}
+
+// WalkFromN walks the files of `store` under `prefix` that come strictly after `afterPoint`
+// (from the first one when empty), calling `f` for at most `max` of them, and returns the
+// cursor to resume from: the last file passed to `f`, or `afterPoint` when none was. Passing
+// the cursor back as `afterPoint` continues the walk where it stopped, which makes paginating
+// over a store straightforward. Fewer than `max` files being walked means the end was reached.
+func WalkFromN(ctx context.Context, store Store, prefix, afterPoint string, max int, f func(filename string) error) (cursor string, err error) {
+	if max <= 0 {
+		return "", fmt.Errorf("walk from needs a positive max, got %d", max)
+	}
+
+	cursor = afterPoint
+	count := 0
+	err = WalkFromExclusive(ctx, store, prefix, afterPoint, func(filename string) error {
+		if err := f(filename); err != nil {
+			return err
+		}
+
+		cursor = filename
+		count++
+		if count >= max {
+			return StopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return cursor, nil
+}
+
+// LastFile returns the lexicographically largest file of `store` under `prefix`, which is the
+// latest one when file names are monotonically increasing numbers of a fixed width, like block
+// range files. It walks the whole prefix keeping only the largest name seen, without relying on
+// modification times nor buffering the listing. `found` is false when the prefix holds no file.
+func LastFile(ctx context.Context, store Store, prefix string) (last string, found bool, err error) {
+	err = store.Walk(ctx, prefix, func(filename string) error {
+		// Backends list in ascending order, the comparison only guards against sharded layouts
+		if !found || filename > last {
+			last, found = filename, true
+		}
+		return nil
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return last, found, nil
+}
+
 //
 // Buffered ReadCloser
 //
 
 type BufferedFileReadCloser struct {
 	file   *os.File
-	reader io.Reader
+	reader *bufio.Reader
 }
 
 func NewBufferedFileReadCloser(file *os.File) *BufferedFileReadCloser {
@@ -278,6 +1627,12 @@ func (readCloser *BufferedFileReadCloser) Read(p []byte) (n int, err error) {
 	return readCloser.reader.Read(p)
 }
 
+// WriteTo implements `io.WriterTo` so that `io.Copy` hands the file over to the destination
+// (e.g. a `io.ReaderFrom` or the OS copy facilities) instead of copying through a buffer.
+func (readCloser *BufferedFileReadCloser) WriteTo(w io.Writer) (n int64, err error) {
+	return readCloser.reader.WriteTo(w)
+}
+
 func (readCloser *BufferedFileReadCloser) Close() error {
 	return readCloser.file.Close()
 }
@@ -2,9 +2,24 @@ package dstore
 
 import (
 	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
 )
 
 func TestWithUncompressedReadCallback(t *testing.T) {
@@ -75,3 +90,665 @@ func TestWithAllCallbacks(t *testing.T) {
 	assert.NotNil(t, conf.compressedWriteCallback)
 	assert.NotNil(t, conf.uncompressedWriteCallback)
 }
+
+// sentinelTransport answers every request with a 403 (not retried by any of the SDKs) and
+// counts how many requests it has seen, recording the last User-Agent and Authorization received.
+type sentinelTransport struct {
+	calls         int32
+	userAgent     atomic.Value
+	authorization atomic.Value
+}
+
+func (t *sentinelTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.calls, 1)
+	t.userAgent.Store(req.Header.Get("User-Agent"))
+	t.authorization.Store(req.Header.Get("Authorization"))
+
+	return &http.Response{
+		StatusCode: http.StatusForbidden,
+		Status:     "403 Forbidden",
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_KEY", "c2VjcmV0")
+	// The AWS SDK requires an `*http.Transport` to load a custom CA bundle, which our sentinel is not
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	tests := []struct {
+		name    string
+		baseURL string
+	}{
+		{"s3", "s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret"},
+		{"azure", "az://account.container/path"},
+		{"gs", "gs://bucket/path"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := &sentinelTransport{}
+
+			store, err := NewStore(test.baseURL, "", "", false, WithHTTPClient(&http.Client{Transport: transport}))
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, _ = store.FileExists(ctx, "file")
+			assert.Greater(t, atomic.LoadInt32(&transport.calls), int32(0), "sentinel transport should have been used")
+		})
+	}
+}
+
+func TestWithHTTPClient_Option(t *testing.T) {
+	conf := &config{}
+	client := &http.Client{}
+
+	WithHTTPClient(client).apply(conf)
+	assert.Same(t, client, conf.httpClient)
+}
+
+func TestWithSkipDirectoryMarkers(t *testing.T) {
+	conf := &config{}
+	WithSkipDirectoryMarkers().apply(conf)
+	assert.True(t, conf.skipDirectoryMarkers)
+
+	c := &commonStore{}
+	assert.False(t, c.isSkippedDirectoryMarker("dir/"))
+
+	c.skipDirectoryMarkers = true
+	assert.True(t, c.isSkippedDirectoryMarker("dir/"))
+	assert.False(t, c.isSkippedDirectoryMarker("dir/file"))
+}
+
+func TestObjectPathAndURL_SpecialCharacters(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_KEY", "c2VjcmV0")
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	const name = "dir/a b#c?d/é %41.txt"
+
+	tests := []struct {
+		baseURL      string
+		expectedPath string
+		expectedURL  string
+	}{
+		{"gs://bucket/path", "path/" + name, "gs://bucket/path/dir/a%20b%23c%3Fd/%C3%A9%20%2541.txt"},
+		{"s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret", "path/" + name, "s3://bucket/path/dir/a%20b%23c%3Fd/%C3%A9%20%2541.txt?region=test&access_key_id=key&secret_access_key=secret"},
+		{"az://account.container/path", "path/" + name, "az://account.container/path/dir/a%20b%23c%3Fd/%C3%A9%20%2541.txt"},
+		{"file:///tmp/path", "/tmp/path/" + name, "file:///tmp/path/dir/a%20b%23c%3Fd/%C3%A9%20%2541.txt"},
+		{"memory://bucket/path", "path/" + name, "memory://bucket/path/dir/a%20b%23c%3Fd/%C3%A9%20%2541.txt"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.baseURL, func(t *testing.T) {
+			store, err := NewStore(test.baseURL, "", "", false, WithHTTPClient(&http.Client{}))
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expectedPath, store.ObjectPath(name))
+			assert.Equal(t, test.expectedURL, store.ObjectURL(name))
+
+			parsed, err := url.Parse(store.ObjectURL(name))
+			require.NoError(t, err)
+			assert.Equal(t, "/path/"+name, strings.TrimPrefix(parsed.Path, "/tmp"))
+		})
+	}
+}
+
+func TestNaturalLess(t *testing.T) {
+	names := []string{"file100", "file10", "file9", "file010", "a", "file", "file9b", "file9a"}
+	sort.Slice(names, func(i, j int) bool { return NaturalLess(names[i], names[j]) })
+
+	assert.Equal(t, []string{"a", "file", "file9", "file9a", "file9b", "file010", "file10", "file100"}, names)
+}
+
+func TestSupportsConcurrentWrites(t *testing.T) {
+	local, err := NewLocalStore(&url.URL{Scheme: "file", Path: t.TempDir()}, "", "", false)
+	require.NoError(t, err)
+	memory := newTestMemoryStore(t)
+
+	assert.False(t, local.SupportsConcurrentWrites())
+	assert.False(t, NewMockStore(nil).SupportsConcurrentWrites())
+	assert.True(t, memory.SupportsConcurrentWrites())
+	assert.True(t, NewReadOnlyStore(memory, nil).SupportsConcurrentWrites(), "wrappers should delegate")
+}
+
+func TestReadWriteObjectString(t *testing.T) {
+	ctx := context.Background()
+	store := newTestMemoryStore(t)
+
+	content := "première ligne\nsecond line ✓\n"
+	require.NoError(t, WriteObjectString(ctx, store, "file.txt", content))
+
+	read, err := ReadObjectString(ctx, store, "file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, content, read)
+
+	_, err = ReadObjectString(ctx, store, "missing.txt")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestNewStore_TrailingSlash(t *testing.T) {
+	withSlash, err := NewStore("gs://bucket/path/", "dbin", "", false, WithHTTPClient(&http.Client{}))
+	require.NoError(t, err)
+
+	withoutSlash, err := NewStore("gs://bucket/path", "dbin", "", false, WithHTTPClient(&http.Client{}))
+	require.NoError(t, err)
+
+	assert.Equal(t, withoutSlash.BaseURL().String(), withSlash.BaseURL().String())
+	assert.Equal(t, withoutSlash.ObjectPath("file"), withSlash.ObjectPath("file"))
+	assert.Equal(t, withoutSlash.ObjectURL("file"), withSlash.ObjectURL("file"))
+
+	_, err = NewStore("gs://bucket/path//", "", "", false, WithHTTPClient(&http.Client{}))
+	assert.ErrorIs(t, err, ErrMalformedBaseURL)
+
+	_, err = NewStore("/", "", "", false)
+	assert.ErrorIs(t, err, ErrMalformedBaseURL)
+}
+
+func TestNewStore_FileBaseURL(t *testing.T) {
+	_, err := NewStore("gs://bucket/path/0000000100.dbin", "dbin", "", false, WithHTTPClient(&http.Client{}))
+	assert.ErrorIs(t, err, ErrMalformedBaseURL)
+
+	_, err = NewStore("gs://bucket/path/0000000100.jsonl.zst", "", "zstd", false, WithHTTPClient(&http.Client{}))
+	assert.ErrorIs(t, err, ErrMalformedBaseURL)
+
+	_, err = NewStore("memory://memory/path/file.gz/", "", "", false)
+	assert.ErrorIs(t, err, ErrMalformedBaseURL)
+
+	_, err = NewStore("gs://bucket/path/v1.2", "dbin", "", false, WithHTTPClient(&http.Client{}))
+	assert.NoError(t, err)
+
+	_, err = NewStore("gs://bucket", "dbin", "", false, WithHTTPClient(&http.Client{}))
+	assert.NoError(t, err)
+}
+
+func TestWithUserAgent(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_KEY", "c2VjcmV0")
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	tests := []struct {
+		name              string
+		baseURL           string
+		userAgent         string
+		expectedUserAgent string
+	}{
+		{"s3 custom", "s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret", "my-app/1.0", "my-app/1.0"},
+		{"s3 default", "s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret", "", "dstore/"},
+		{"azure custom", "az://account.container/path", "my-app/1.0", "my-app/1.0"},
+		{"azure default", "az://account.container/path", "", "dstore/"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := &sentinelTransport{}
+
+			opts := []Option{WithHTTPClient(&http.Client{Transport: transport})}
+			if test.userAgent != "" {
+				opts = append(opts, WithUserAgent(test.userAgent))
+			}
+
+			store, err := NewStore(test.baseURL, "", "", false, opts...)
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, _ = store.FileExists(ctx, "file")
+			userAgent, _ := transport.userAgent.Load().(string)
+			assert.Contains(t, userAgent, test.expectedUserAgent)
+		})
+	}
+}
+
+func TestWithRequestCredentials(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_KEY", "c2VjcmV0")
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	azureCredential, err := azblob.NewSharedKeyCredential("override", "c2VjcmV0")
+	require.NoError(t, err)
+
+	overrides := &RequestCredentials{
+		S3:    credentials.NewStaticCredentials("override-key", "override-secret", ""),
+		GCS:   oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "override-token"}),
+		Azure: azureCredential,
+	}
+
+	tests := []struct {
+		name                  string
+		baseURL               string
+		expectedDefault       string
+		expectedOverridden    string
+		missingOverrideFields *RequestCredentials
+	}{
+		{"s3", "s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret", "Credential=key/", "Credential=override-key/", &RequestCredentials{GCS: overrides.GCS, Azure: overrides.Azure}},
+		{"azure", "az://account.container/path", "SharedKey account:", "SharedKey override:", &RequestCredentials{S3: overrides.S3, GCS: overrides.GCS}},
+		{"gs", "gs://bucket/path", "", "Bearer override-token", &RequestCredentials{S3: overrides.S3, Azure: overrides.Azure}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := &sentinelTransport{}
+
+			store, err := NewStore(test.baseURL, "", "", false, WithHTTPClient(&http.Client{Transport: transport}))
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, _ = store.FileExists(ctx, "file")
+			authorization, _ := transport.authorization.Load().(string)
+			if test.expectedDefault == "" {
+				assert.Empty(t, authorization)
+			} else {
+				assert.Contains(t, authorization, test.expectedDefault)
+			}
+
+			_, _ = store.FileExists(WithRequestCredentials(ctx, overrides), "file")
+			authorization, _ = transport.authorization.Load().(string)
+			assert.Contains(t, authorization, test.expectedOverridden)
+
+			calls := atomic.LoadInt32(&transport.calls)
+			_, err = store.FileExists(WithRequestCredentials(ctx, test.missingOverrideFields), "file")
+			assert.Error(t, err)
+			assert.Equal(t, calls, atomic.LoadInt32(&transport.calls), "no request should be sent without credentials for the store")
+		})
+	}
+}
+
+func TestNewStore_CompressionType(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, compression := range []string{"", "gzip", "zstd", "bzip2"} {
+		_, err := NewStore("file://"+dir, "", compression, false)
+		assert.NoError(t, err, "compression %q", compression)
+	}
+
+	_, err := NewStore("file://"+dir, "", "lz4", false)
+	assert.Error(t, err)
+
+	_, err = NewStore("file://"+dir, "", "", false, Compression("unknown"))
+	assert.Error(t, err)
+}
+
+// blockingTransport blocks every request until its context is done, signaling when the first
+// request is in flight
+type blockingTransport struct {
+	inFlight chan struct{}
+	once     sync.Once
+}
+
+func (t *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.once.Do(func() { close(t.inFlight) })
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestWithBaseContext_CancelsInFlightOperations(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_KEY", "c2VjcmV0")
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	tests := []struct {
+		name    string
+		baseURL string
+	}{
+		{"s3", "s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret"},
+		{"azure", "az://account.container/path"},
+		{"gs", "gs://bucket/path"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			baseCtx, cancelBase := context.WithCancel(context.Background())
+			transport := &blockingTransport{inFlight: make(chan struct{})}
+
+			store, err := NewStore(test.baseURL, "", "", false, WithBaseContext(baseCtx), WithHTTPClient(&http.Client{Transport: transport}))
+			require.NoError(t, err)
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := store.FileExists(context.Background(), "file")
+				done <- err
+			}()
+
+			<-transport.inFlight
+			cancelBase()
+
+			select {
+			case err := <-done:
+				assert.Error(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("operation should have been aborted by the base context cancellation")
+			}
+		})
+	}
+}
+
+func TestWithBaseContext_Walk(t *testing.T) {
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+
+	store, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "", false, WithBaseContext(baseCtx))
+	require.NoError(t, err)
+
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, WriteObjectString(context.Background(), store, name, name))
+	}
+
+	var seen []string
+	err = store.Walk(context.Background(), "", func(filename string) error {
+		seen = append(seen, filename)
+		cancelBase()
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []string{"a"}, seen)
+}
+
+func TestWithBaseContext_LocalAndMemoryTransfers(t *testing.T) {
+	ctx := context.Background()
+
+	for _, baseURL := range []string{"file://" + t.TempDir(), "memory://memory"} {
+		t.Run(baseURL, func(t *testing.T) {
+			baseCtx, cancelBase := context.WithCancel(ctx)
+			defer cancelBase()
+
+			store, err := NewStore(baseURL, "", "", false, WithBaseContext(baseCtx))
+			require.NoError(t, err)
+			require.NoError(t, WriteObjectString(ctx, store, "file", "content"))
+
+			reader, err := store.OpenObject(ctx, "file")
+			require.NoError(t, err)
+			defer reader.Close()
+
+			cancelBase()
+
+			_, err = io.ReadAll(reader)
+			assert.ErrorIs(t, err, context.Canceled, "in-flight read")
+
+			_, err = store.OpenObject(ctx, "file")
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.ErrorIs(t, WriteObjectString(ctx, store, "other", "content"), context.Canceled)
+		})
+	}
+}
+
+func TestClone_AnchoredToContext(t *testing.T) {
+	store, err := NewStore("file://"+t.TempDir(), "", "", false)
+	require.NoError(t, err)
+	require.NoError(t, WriteObjectString(context.Background(), store, "file", "content"))
+
+	cloneCtx, cancelClone := context.WithCancel(context.Background())
+	clone, err := store.(Clonable).Clone(cloneCtx)
+	require.NoError(t, err)
+
+	files, err := clone.ListFiles(context.Background(), "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"file"}, files)
+
+	cancelClone()
+	_, err = clone.ListFiles(context.Background(), "", -1)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	files, err = store.ListFiles(context.Background(), "", -1)
+	require.NoError(t, err, "original store should not be affected by the clone context")
+	assert.Equal(t, []string{"file"}, files)
+}
+
+func TestRebase(t *testing.T) {
+	ctx := context.Background()
+
+	var writes int
+	store, err := NewStore("file://"+t.TempDir(), "dbin.zst", "zstd", true, WithWriteStats(func(ctx context.Context, uncompressed, compressed int64) {
+		writes++
+	}))
+	require.NoError(t, err)
+
+	otherDir := t.TempDir()
+	rebased, err := store.(Rebasable).Rebase(ctx, "file://"+otherDir)
+	require.NoError(t, err)
+
+	assert.Equal(t, otherDir, rebased.BaseURL().Path)
+	assert.NotEqual(t, store.BaseURL().String(), rebased.BaseURL().String())
+	assert.Equal(t, filepath.Join(otherDir, "file.dbin.zst"), rebased.ObjectPath("file"))
+	assert.True(t, rebased.Overwrite())
+
+	require.NoError(t, WriteObjectString(ctx, rebased, "file", "content"))
+	assert.Equal(t, 1, writes, "write stats callback should be inherited")
+
+	reader, err := OpenObjectWithCompression(ctx, rebased, "file", "zstd")
+	require.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.Equal(t, "content", string(content))
+
+	overridden, err := store.(Rebasable).Rebase(ctx, "file://"+t.TempDir(), Compression("gzip"))
+	require.NoError(t, err)
+	assert.Equal(t, "gzip", overridden.(interface{ commonConfig() *commonStore }).commonConfig().compressionType)
+
+	memory, err := store.(Rebasable).Rebase(ctx, "memory://memory")
+	require.NoError(t, err)
+	require.IsType(t, &MemoryStore{}, memory)
+	assert.Equal(t, "file.dbin.zst", memory.ObjectPath("file"))
+}
+
+func TestNewStoreFromFileURL_WithAutoCompressionFromExtension(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	for _, compression := range []string{"gzip", "zstd"} {
+		store, err := NewStore("file://"+dir, "", compression, false)
+		require.NoError(t, err)
+		require.NoError(t, WriteObjectString(ctx, store, map[string]string{"gzip": "file.jsonl.gz", "zstd": "file.jsonl.zst"}[compression], "some "+compression+" content"))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file.jsonl.bz2"), bzip2Content, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file.jsonl"), []byte("some plain content"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file.jsonl.snappy"), []byte("snappy"), 0644))
+
+	tests := []struct {
+		filename string
+		expected string
+	}{
+		{"file.jsonl.gz", "some gzip content"},
+		{"file.jsonl.zst", "some zstd content"},
+		{"file.jsonl.bz2", "some bzip2 content"},
+		{"file.jsonl", "some plain content"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			content, err := ReadObject(ctx, filepath.Join(dir, test.filename), WithAutoCompressionFromExtension())
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, string(content))
+		})
+	}
+
+	_, _, err := NewStoreFromFileURL(filepath.Join(dir, "file.jsonl.snappy"), WithAutoCompressionFromExtension())
+	assert.ErrorIs(t, err, ErrNotSupported)
+
+	// An explicit compression wins over the extension
+	_, err = ReadObject(ctx, filepath.Join(dir, "file.jsonl.zst"), WithAutoCompressionFromExtension(), Compression("gzip"))
+	assert.Error(t, err)
+
+	// Without the option, the extension is ignored
+	content, err := ReadObject(ctx, filepath.Join(dir, "file.jsonl.gz"))
+	require.NoError(t, err)
+	assert.NotEqual(t, "some gzip content", string(content))
+}
+
+func TestNewStore_UnsupportedScheme(t *testing.T) {
+	_, err := NewStore("ftp://host/path", "", "", false)
+
+	var schemeErr *UnsupportedSchemeError
+	require.True(t, errors.As(err, &schemeErr))
+	assert.Equal(t, "ftp", schemeErr.Scheme)
+	assert.Equal(t, `unsupported store scheme "ftp", supported schemes are file://, gs://, s3://, az://, azblob://, azure://, memory:// or a local path`, err.Error())
+}
+
+// aclRecordingTransport acknowledges S3 and Google Storage uploads, recording the ACL each
+// upload request carries
+type aclRecordingTransport struct {
+	lock sync.Mutex
+	acls []string
+}
+
+func (t *aclRecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodHead {
+		return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+	}
+	io.Copy(io.Discard, req.Body)
+
+	t.lock.Lock()
+	if acl := req.Header.Get("x-amz-acl"); acl != "" {
+		t.acls = append(t.acls, acl)
+	}
+	if acl := req.URL.Query().Get("predefinedAcl"); acl != "" {
+		t.acls = append(t.acls, acl)
+	}
+	t.lock.Unlock()
+
+	header := http.Header{"Content-Type": []string{"application/json"}}
+	return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", Header: header, Body: io.NopCloser(strings.NewReader(`{"bucket":"bucket","name":"path/file"}`)), Request: req}, nil
+}
+
+func TestWithObjectACL(t *testing.T) {
+	t.Setenv("AWS_CA_BUNDLE", "")
+
+	tests := []struct {
+		name     string
+		baseURL  string
+		expected string
+	}{
+		{"s3", "s3://bucket/path?region=test&access_key_id=key&secret_access_key=secret", "public-read"},
+		{"gs", "gs://bucket/path", "publicRead"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := &aclRecordingTransport{}
+			store, err := NewStore(test.baseURL, "", "", false, WithObjectACL("public-read"), WithHTTPClient(&http.Client{Transport: transport}))
+			require.NoError(t, err)
+
+			require.NoError(t, store.WriteObject(context.Background(), "file", strings.NewReader("content")))
+			assert.Equal(t, []string{test.expected}, transport.acls)
+
+			_, err = NewStore(test.baseURL, "", "", false, WithObjectACL("public-write"))
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := NewStore("gs://bucket/path", "", "", false, WithObjectACL("log-delivery-write"))
+	assert.Error(t, err, "S3 only canned ACL is not supported by Google Storage")
+}
+
+func TestURLOpener(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "other"), 0755))
+	for _, name := range []string{"a", "b", "other/c"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("content "+name), 0644))
+	}
+
+	opener := NewURLOpener()
+	constructions := 0
+	opener.newStore = func(baseURL, extension, compressionType string, overwrite bool, opts ...Option) (Store, error) {
+		constructions++
+		return NewStore(baseURL, extension, compressionType, overwrite, opts...)
+	}
+
+	for _, name := range []string{"a", "b", "a", "other/c"} {
+		reader, err := opener.Open(ctx, "file://"+filepath.Join(dir, name))
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		assert.Equal(t, "content "+name, string(content))
+	}
+
+	assert.Equal(t, 2, constructions, "files of the same directory must share their store")
+
+	_, err := opener.Open(ctx, "file://"+filepath.Join(dir, "missing"))
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+type tenantKey struct{}
+
+func TestCallbacks_SeeCallerContextValues(t *testing.T) {
+	ctx := context.WithValue(context.Background(), tenantKey{}, "tenant-1")
+
+	type seen struct {
+		callback, tenant, file, storeType string
+	}
+	var lock sync.Mutex
+	var calls []seen
+	record := func(callback string) func(ctx context.Context) {
+		return func(ctx context.Context) {
+			tenant, _ := ctx.Value(tenantKey{}).(string)
+
+			lock.Lock()
+			defer lock.Unlock()
+			calls = append(calls, seen{callback, tenant, FileNameFromContext(ctx), StoreTypeFromContext(ctx)})
+		}
+	}
+	opts := []Option{
+		WithUncompressedWriteCallback(func(ctx context.Context, _ int) { record("uncompressed write")(ctx) }),
+		WithCompressedWriteCallback(func(ctx context.Context, _ int) { record("compressed write")(ctx) }),
+		WithWriteStats(func(ctx context.Context, _, _ int64) { record("write stats")(ctx) }),
+		WithUncompressedReadCallback(func(ctx context.Context, _ int) { record("uncompressed read")(ctx) }),
+		WithCompressedReadCallback(func(ctx context.Context, _ int) { record("compressed read")(ctx) }),
+	}
+
+	memoryStore, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/"}, "", "gzip", false, opts...)
+	require.NoError(t, err)
+	localStore, err := NewLocalStore(&url.URL{Scheme: "file", Path: t.TempDir()}, "", "gzip", false, opts...)
+	require.NoError(t, err)
+
+	for storeType, store := range map[string]Store{"memory": memoryStore, "localstore": localStore} {
+		t.Run(storeType, func(t *testing.T) {
+			calls = nil
+
+			require.NoError(t, store.WriteObject(ctx, "file", strings.NewReader("content")))
+			reader, err := store.OpenObject(ctx, "file")
+			require.NoError(t, err)
+			_, err = io.ReadAll(reader)
+			require.NoError(t, err)
+			require.NoError(t, reader.Close())
+
+			// Writes see the object name, reads the object path
+			callbacks := map[string]bool{}
+			for _, call := range calls {
+				callbacks[call.callback] = true
+				file := "file"
+				if strings.HasSuffix(call.callback, " read") {
+					file = store.ObjectPath("file")
+				}
+				assert.Equal(t, seen{call.callback, "tenant-1", file, storeType}, call)
+			}
+			assert.Len(t, callbacks, 5, "all callbacks should have been invoked")
+		})
+	}
+}
+
+func TestNewStore_InvalidOption(t *testing.T) {
+	tests := []struct {
+		option      Option
+		expectedErr string
+	}{
+		{WithMaxInFlightBytes(0), "max in-flight bytes must be positive, got 0"},
+		{WithZstdDecoderConcurrency(-1), "zstd decoder concurrency must be positive, got -1"},
+		{WithMaxIdleZstdDecoders(0), "max idle zstd decoders must be positive, got 0"},
+		{WithExistenceBloomHint(0), "existence bloom hint max age must be positive, got 0s"},
+	}
+
+	for _, test := range tests {
+		for _, baseURL := range []string{"file://" + t.TempDir(), "memory://memory"} {
+			_, err := NewStore(baseURL, "", "", false, test.option)
+			assert.EqualError(t, err, test.expectedErr, baseURL)
+		}
+	}
+}
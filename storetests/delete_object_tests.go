@@ -0,0 +1,51 @@
+package storetests
+
+import (
+	"testing"
+
+	"github.com/streamingfast/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var deleteObjectTests = []StoreTestFunc{
+	TestDeleteObject,
+	TestDeleteObject_IgnoreNotFound,
+}
+
+func TestDeleteObject(t *testing.T, factory StoreFactory) {
+	store, _, cleanup := factory()
+	defer cleanup()
+
+	addFileToStore(t, store, "file", "content")
+
+	require.NoError(t, store.DeleteObject(ctx, "file"))
+	exists, err := store.FileExists(ctx, "file")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.ErrorIs(t, store.DeleteObject(ctx, "file"), dstore.ErrNotFound)
+}
+
+func TestDeleteObject_IgnoreNotFound(t *testing.T, factory StoreFactory) {
+	store, _, cleanup := factory()
+	defer cleanup()
+
+	clonable, ok := store.(dstore.Clonable)
+	if !ok {
+		t.Skipf("store %T does not support options through Clone", store)
+		return
+	}
+
+	ignoring, err := clonable.Clone(ctx, dstore.WithDeleteIgnoreNotFound())
+	require.NoError(t, err)
+
+	addFileToStore(t, ignoring, "file", "content")
+
+	require.NoError(t, ignoring.DeleteObject(ctx, "file"))
+	exists, err := ignoring.FileExists(ctx, "file")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, ignoring.DeleteObject(ctx, "file"))
+}
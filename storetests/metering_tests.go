@@ -0,0 +1,56 @@
+package storetests
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/streamingfast/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var meteringTests = []StoreTestFunc{
+	TestMetering_Consistency,
+}
+
+type testMeter struct {
+	BytesRead    int
+	BytesWritten int
+}
+
+func (m *testMeter) AddBytesRead(n int)    { m.BytesRead += n }
+func (m *testMeter) AddBytesWritten(n int) { m.BytesWritten += n }
+
+// TestMetering_Consistency ensures that the deprecated `SetMeter` accounts the same way
+// on every backend: written bytes are the uncompressed bytes handed to the store while
+// read bytes are the raw (possibly compressed) bytes fetched from the backend.
+func TestMetering_Consistency(t *testing.T, factory StoreFactory) {
+	store, descriptor, cleanup := factory()
+	defer cleanup()
+
+	if _, ok := store.(*dstore.MockStore); ok {
+		t.Skip("MockStore does not support metering")
+		return
+	}
+
+	meter := &testMeter{}
+	store.SetMeter(meter)
+
+	payload := bytes.Repeat([]byte("metering consistency "), 512)
+	require.NoError(t, store.WriteObject(ctx, "metered", bytes.NewReader(payload)))
+	assert.Equal(t, len(payload), meter.BytesWritten)
+
+	rd, err := store.OpenObject(ctx, "metered")
+	require.NoError(t, err)
+	assert.Equal(t, string(payload), readObjectAndClose(t, rd))
+
+	attrs, err := store.ObjectAttributes(ctx, "metered")
+	require.NoError(t, err)
+
+	assert.Equal(t, int(attrs.Size), meter.BytesRead, "bytes read should match the stored object size")
+	if descriptor.Compression == "" {
+		assert.Equal(t, len(payload), meter.BytesRead)
+	} else {
+		assert.Less(t, meter.BytesRead, len(payload), "compressed read should be smaller than the payload")
+	}
+}
@@ -0,0 +1,63 @@
+package storetests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streamingfast/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var objectAttributesTests = []StoreTestFunc{
+	TestObjectAttributes,
+	TestObjectAttributes_NotFound,
+	TestStatObject,
+}
+
+func TestObjectAttributes(t *testing.T, factory StoreFactory) {
+	store, descriptor, cleanup := factory()
+	defer cleanup()
+
+	before := time.Now().Add(-1 * time.Minute)
+	addFileToStore(t, store, "file", "some content")
+
+	attrs, err := store.ObjectAttributes(ctx, "file")
+	require.NoError(t, err)
+	require.NotNil(t, attrs)
+
+	if descriptor.Compression == "" {
+		assert.Equal(t, int64(len("some content")), attrs.Size)
+	} else {
+		assert.Greater(t, attrs.Size, int64(0))
+	}
+	assert.True(t, attrs.LastModified.After(before), "last modified %s should be after %s", attrs.LastModified, before)
+}
+
+func TestObjectAttributes_NotFound(t *testing.T, factory StoreFactory) {
+	store, _, cleanup := factory()
+	defer cleanup()
+
+	_, err := store.ObjectAttributes(ctx, "missing")
+	assert.ErrorIs(t, err, dstore.ErrNotFound)
+}
+
+func TestStatObject(t *testing.T, factory StoreFactory) {
+	store, descriptor, cleanup := factory()
+	defer cleanup()
+
+	addFileToStore(t, store, "file", "some content")
+
+	exists, attrs, err := dstore.StatObject(ctx, store, "file")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	require.NotNil(t, attrs)
+	if descriptor.Compression == "" {
+		assert.Equal(t, int64(len("some content")), attrs.Size)
+	}
+
+	exists, attrs, err = dstore.StatObject(ctx, store, "missing")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Nil(t, attrs)
+}
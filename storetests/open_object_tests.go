@@ -8,6 +8,7 @@ import (
 )
 
 var openObjectTests = []StoreTestFunc{
+	TestOpenObject_ErrNotFound,
 	TestOpenObject_ReadSameFileMultipleTimes,
 	TestOpenObject_ReadFileOnce,
 }
@@ -18,7 +19,7 @@ func TestOpenObject_ErrNotFound(t *testing.T, factory StoreFactory) {
 
 	rd, err := store.OpenObject(ctx, "anything_that_does_not_exist")
 	assert.Nil(t, rd)
-	assert.Equal(t, dstore.ErrNotFound, err)
+	assert.ErrorIs(t, err, dstore.ErrNotFound)
 }
 
 func TestOpenObject_ReadFileOnce(t *testing.T, factory StoreFactory) {
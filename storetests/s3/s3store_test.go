@@ -1,9 +1,12 @@
 package s3
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"math/rand"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
@@ -79,6 +82,98 @@ func TestS3Store_Minio_EmptyBucket_FilePrefix(t *testing.T) {
 	storetests.TestWalk_FilePrefix(t, createS3StoreFactory(t, s3MinioStoreBaseURL, "", false, true))
 }
 
+func TestS3Store_Minio_DirectoryMarkers(t *testing.T) {
+	if s3MinioStoreBaseURL == "" {
+		t.Skip("You must provide a valid Minio S3 URL via STORETESTS_S3_MINIO_STORE_URL environment variable to execute those tests")
+		return
+	}
+
+	for _, skip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skip_%t", skip), func(t *testing.T) {
+			var opts []dstore.Option
+			if skip {
+				opts = append(opts, dstore.WithSkipDirectoryMarkers())
+			}
+
+			store, _, cleanup := createS3StoreFactory(t, s3MinioStoreBaseURL, "", false, false, opts...)()
+			defer cleanup()
+
+			require.NoError(t, store.WriteObject(ctx, "foo/file", strings.NewReader("content")))
+
+			awsConfig, bucket, _, err := dstore.ParseS3URL(store.BaseURL())
+			require.NoError(t, err)
+
+			sess, err := session.NewSession(awsConfig)
+			require.NoError(t, err)
+
+			_, err = s3.New(sess).PutObjectWithContext(ctx, &s3.PutObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(store.ObjectPath("foo") + "/"),
+				Body:   strings.NewReader(""),
+			})
+			require.NoError(t, err)
+
+			files, err := store.ListFiles(ctx, "", 100)
+			require.NoError(t, err)
+
+			if skip {
+				require.Equal(t, []string{"foo/file"}, files)
+			} else {
+				require.Equal(t, []string{"foo/", "foo/file"}, files)
+			}
+		})
+	}
+}
+
+func TestS3Store_Minio_ListPageSize(t *testing.T) {
+	if s3MinioStoreBaseURL == "" {
+		t.Skip("You must provide a valid Minio S3 URL via STORETESTS_S3_MINIO_STORE_URL environment variable to execute those tests")
+		return
+	}
+
+	store, _, cleanup := createS3StoreFactory(t, s3MinioStoreBaseURL, "", false, false, dstore.WithListPageSize(2))()
+	defer cleanup()
+
+	expected := []string{"file-0", "file-1", "file-2", "file-3", "file-4"}
+	for _, name := range expected {
+		require.NoError(t, store.WriteObject(ctx, name, strings.NewReader("content")))
+	}
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	require.Equal(t, expected, files)
+}
+
+func TestS3Store_Minio_WalkFromBoundary(t *testing.T) {
+	if s3MinioStoreBaseURL == "" {
+		t.Skip("You must provide a valid Minio S3 URL via STORETESTS_S3_MINIO_STORE_URL environment variable to execute those tests")
+		return
+	}
+
+	filesSeen := 0
+	store, _, cleanup := createS3StoreFactory(t, s3MinioStoreBaseURL, "", false, false, dstore.WithWalkProgress(func(_ context.Context, seen, _ int) {
+		filesSeen = seen
+	}))()
+	defer cleanup()
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, store.WriteObject(ctx, fmt.Sprintf("aa/%04d", i), strings.NewReader("content")))
+	}
+	expected := []string{"ab", "ab0", "ac", "b"}
+	for _, name := range expected {
+		require.NoError(t, store.WriteObject(ctx, name, strings.NewReader("content")))
+	}
+
+	var seen []string
+	require.NoError(t, store.WalkFrom(ctx, "", "ab", func(filename string) error {
+		seen = append(seen, filename)
+		return nil
+	}))
+
+	require.Equal(t, expected, seen)
+	require.Equal(t, len(expected), filesSeen, "the objects before the starting point should not be listed")
+}
+
 func TestS3Store_Minio_CompressionAndMetering(t *testing.T) {
 	compressedReadByteCount := 0
 	compressedWriteByteCount := 0
@@ -213,3 +308,103 @@ func createS3StoreFactory(t *testing.T, baseURL string, compression string, over
 			}
 	}
 }
+
+// corruptingTransport flips the first byte of every `PutObject` body on its way to the server
+type corruptingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *corruptingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut && req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > 0 {
+			body[0] ^= 0xff
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+func TestS3Store_Minio_ContentMD5Validation(t *testing.T) {
+	if s3MinioStoreBaseURL == "" {
+		t.Skip("You must provide a valid Minio S3 URL via STORETESTS_S3_MINIO_STORE_URL environment variable to execute those tests")
+		return
+	}
+
+	client := &http.Client{Transport: &corruptingTransport{next: http.DefaultTransport}}
+	store, _, cleanup := createS3StoreFactory(t, s3MinioStoreBaseURL, "", false, false, dstore.WithS3ContentMD5Validation(), dstore.WithHTTPClient(client))()
+	defer cleanup()
+
+	require.Error(t, dstore.WriteObjectString(ctx, store, "corrupted", "content"))
+	require.Error(t, store.WriteObject(ctx, "corrupted", strings.NewReader("content")))
+}
+
+func TestS3Store_Minio_DownloadTo(t *testing.T) {
+	if s3MinioStoreBaseURL == "" {
+		t.Skip("You must provide a valid Minio S3 URL via STORETESTS_S3_MINIO_STORE_URL environment variable to execute those tests")
+		return
+	}
+
+	store, _, cleanup := createS3StoreFactory(t, s3MinioStoreBaseURL, "", false, false)()
+	defer cleanup()
+
+	// Bigger than the downloader part size so that multiple ranges are fetched
+	payload := make([]byte, 12*1024*1024)
+	rand.New(rand.NewSource(time.Now().UnixNano())).Read(payload)
+	require.NoError(t, store.WriteObject(ctx, "payload", bytes.NewReader(payload)))
+
+	// A file is an io.WriterAt, the parallel downloader is used
+	parallel, err := os.CreateTemp(t.TempDir(), "payload")
+	require.NoError(t, err)
+	defer parallel.Close()
+
+	written, err := dstore.DownloadTo(ctx, store, "payload", parallel)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(payload)), written)
+	downloaded, err := os.ReadFile(parallel.Name())
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(payload, downloaded), "downloaded content through io.WriterAt differs from payload")
+
+	var sequential bytes.Buffer
+	written, err = dstore.DownloadTo(ctx, store, "payload", &sequential)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(payload)), written)
+	require.True(t, bytes.Equal(payload, sequential.Bytes()), "downloaded content through io.Writer differs from payload")
+
+	_, err = dstore.DownloadTo(ctx, store, "missing", parallel)
+	require.ErrorIs(t, err, dstore.ErrNotFound)
+}
+
+func TestS3Store_Minio_UploadFrom(t *testing.T) {
+	if s3MinioStoreBaseURL == "" {
+		t.Skip("You must provide a valid Minio S3 URL via STORETESTS_S3_MINIO_STORE_URL environment variable to execute those tests")
+		return
+	}
+
+	// Bigger than the uploader part size so that multiple parts are uploaded from the file
+	payload := make([]byte, 12*1024*1024)
+	rand.New(rand.NewSource(time.Now().UnixNano())).Read(payload)
+
+	file, err := os.CreateTemp(t.TempDir(), "payload")
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = file.Write(payload)
+	require.NoError(t, err)
+
+	for _, compression := range []string{"", "zstd"} {
+		store, _, cleanup := createS3StoreFactory(t, s3MinioStoreBaseURL, compression, false, false)()
+
+		require.NoError(t, dstore.UploadFrom(ctx, store, "payload", file, int64(len(payload))))
+
+		var out bytes.Buffer
+		_, err = dstore.DownloadTo(ctx, store, "payload", &out)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(payload, out.Bytes()), "uploaded content differs from payload with compression %q", compression)
+
+		cleanup()
+	}
+}
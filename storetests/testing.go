@@ -3,7 +3,6 @@ package storetests
 import (
 	"bytes"
 	"context"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -26,6 +25,9 @@ func TestAll(t *testing.T, factory StoreFactory) {
 		openObjectTests,
 		walkTests,
 		writeObjectTests,
+		meteringTests,
+		objectAttributesTests,
+		deleteObjectTests,
 	}
 
 	for _, testFuncs := range all {
@@ -79,14 +81,3 @@ func readObjectAndClose(t *testing.T, o io.ReadCloser) string {
 
 	return string(data)
 }
-
-func supportsConcurrentWrites(store dstore.Store) bool {
-	switch store.(type) {
-	case *dstore.GSStore, *dstore.S3Store, *dstore.AzureStore:
-		return true
-	case *dstore.LocalStore, *dstore.MockStore:
-		return false
-	}
-
-	panic(fmt.Errorf("unknown store type %T regarding support for concurrent writes", store))
-}
@@ -2,9 +2,11 @@ package storetests
 
 import (
 	"context"
+	"fmt"
 	"math"
 	"testing"
 
+	"github.com/streamingfast/dstore"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -19,6 +21,12 @@ var walkTests = []StoreTestFunc{
 	TestWalkFrom_WithPrefix,
 	TestWalkFrom_SingleLetterStartingPoint,
 	TestWalkFrom_StartingPointHasWrongPrefix,
+	TestWalkFromExclusive,
+	TestWalkFromExclusive_WithPrefix,
+	TestWalk_WrappedStopIteration,
+	TestWalkReverse,
+	TestWalkReverse_StopIteration,
+	TestListSubPrefixes,
 }
 
 func TestWalk_IgnoreNotFound(t *testing.T, factory StoreFactory) {
@@ -107,6 +115,64 @@ func TestWalkFrom_WithPrefix(t *testing.T, factory StoreFactory) {
 	assert.EqualValues(t, expected[1:3], seen)
 }
 
+func TestWalkFromExclusive(t *testing.T, factory StoreFactory) {
+	store, _, cleanup := factory()
+	defer cleanup()
+
+	written := []string{"00000001", "00000002", "00000003", "00000004"}
+	for _, f := range written {
+		addFileToStore(t, store, f, f)
+	}
+
+	var inclusive []string
+	err := store.WalkFrom(ctx, "", "00000002", func(f string) error {
+		inclusive = append(inclusive, f)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, written[1:], inclusive)
+
+	var exclusive []string
+	err = dstore.WalkFromExclusive(ctx, store, "", "00000002", func(f string) error {
+		exclusive = append(exclusive, f)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, written[2:], exclusive)
+
+	// A point between two files behaves like the inclusive variant
+	exclusive = nil
+	err = dstore.WalkFromExclusive(ctx, store, "", "000000025", func(f string) error {
+		exclusive = append(exclusive, f)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, written[2:], exclusive)
+}
+
+func TestWalkFromExclusive_WithPrefix(t *testing.T, factory StoreFactory) {
+	store, _, cleanup := factory()
+	defer cleanup()
+
+	written := []string{"0000/0001", "0000/0002", "0000/0003", "0001/0003"}
+	for _, f := range written {
+		addFileToStore(t, store, f, f)
+	}
+
+	var seen []string
+	err := dstore.WalkFromExclusive(ctx, store, "0000", "0000/0002", func(f string) error {
+		seen = append(seen, f)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, written[2:3], seen)
+
+	err = dstore.WalkFromExclusive(ctx, store, "0000", "0001/0002", func(f string) error {
+		return nil
+	})
+	require.EqualError(t, err, `starting point "0001/0002" must start with prefix "0000"`)
+}
+
 func TestWalkFrom_SingleLetterStartingPoint(t *testing.T, factory StoreFactory) {
 	store, _, cleanup := factory()
 	defer cleanup()
@@ -203,3 +269,105 @@ type listFilesQuery struct {
 	ignoreSuffix string
 	max          int
 }
+
+func TestWalk_WrappedStopIteration(t *testing.T, factory StoreFactory) {
+	store, _, cleanup := factory()
+	defer cleanup()
+
+	for _, f := range []string{"00000001", "00000002", "00000003"} {
+		addFileToStore(t, store, f, f)
+	}
+
+	var seen []string
+	err := store.Walk(ctx, "", func(filename string) error {
+		seen = append(seen, filename)
+		return fmt.Errorf("done walking: %w", dstore.StopIteration)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"00000001"}, seen)
+
+	seen = nil
+	err = store.WalkFrom(ctx, "", "00000002", func(filename string) error {
+		seen = append(seen, filename)
+		return fmt.Errorf("done walking: %w", dstore.StopIteration)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"00000002"}, seen)
+}
+
+func TestWalkReverse(t *testing.T, factory StoreFactory) {
+	store, _, cleanup := factory()
+	defer cleanup()
+
+	for _, f := range []string{"00000001", "00000002", "00000003", "00000010", "other"} {
+		addFileToStore(t, store, f, f)
+	}
+
+	var seen []string
+	err := dstore.WalkReverse(ctx, store, "0000000", func(filename string) error {
+		seen = append(seen, filename)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"00000003", "00000002", "00000001"}, seen)
+
+	seen = nil
+	err = dstore.WalkReverse(ctx, store, "", func(filename string) error {
+		seen = append(seen, filename)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"other", "00000010", "00000003", "00000002", "00000001"}, seen)
+}
+
+func TestWalkReverse_StopIteration(t *testing.T, factory StoreFactory) {
+	store, _, cleanup := factory()
+	defer cleanup()
+
+	for _, f := range []string{"00000001", "00000002", "00000003"} {
+		addFileToStore(t, store, f, f)
+	}
+
+	var seen []string
+	err := dstore.WalkReverse(ctx, store, "", func(filename string) error {
+		seen = append(seen, filename)
+		if filename == "00000002" {
+			return dstore.StopIteration
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"00000003", "00000002"}, seen)
+
+	failure := fmt.Errorf("callback failure")
+	err = dstore.WalkReverse(ctx, store, "", func(filename string) error {
+		return failure
+	})
+	assert.Equal(t, failure, err)
+}
+
+func TestListSubPrefixes(t *testing.T, factory StoreFactory) {
+	store, _, cleanup := factory()
+	defer cleanup()
+
+	for _, f := range []string{"eth/mainnet/0001", "eth/mainnet/0002", "eth/sepolia/0001", "eth/top", "sol/mainnet/0001", "root"} {
+		addFileToStore(t, store, f, f)
+	}
+
+	tests := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"", []string{"eth/", "sol/"}},
+		{"eth/", []string{"eth/mainnet/", "eth/sepolia/"}},
+		{"eth/main", []string{"eth/mainnet/"}},
+		{"eth/mainnet/", []string{}},
+		{"missing/", []string{}},
+	}
+
+	for _, test := range tests {
+		prefixes, err := dstore.ListSubPrefixes(ctx, store, test.prefix)
+		require.NoError(t, err, test.prefix)
+		assert.Equal(t, test.expected, prefixes, test.prefix)
+	}
+}
@@ -33,7 +33,7 @@ func TestWriteObject_ConcurrentOverwrite(t *testing.T, factory StoreFactory) {
 	store, _, cleanup := factory()
 	defer cleanup()
 
-	if !supportsConcurrentWrites(store) {
+	if !store.SupportsConcurrentWrites() {
 		t.Skip("Store does not support concurrent writes, tests is not designed for this case")
 		return
 	}
@@ -74,7 +74,7 @@ func TestWriteObject_ConcurrentNoOverwrite(t *testing.T, factory StoreFactory) {
 	store, _, cleanup := factory()
 	defer cleanup()
 
-	if !supportsConcurrentWrites(store) {
+	if !store.SupportsConcurrentWrites() {
 		t.Skip("Store does not support concurrent writes, tests is not designed for this case")
 		return
 	}
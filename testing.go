@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -20,6 +21,7 @@ import (
 type MockStore struct {
 	OpenObjectFunc       func(ctx context.Context, name string) (out io.ReadCloser, err error)
 	WriteObjectFunc      func(ctx context.Context, base string, f io.Reader) error
+	WriteObjectSizedFunc func(ctx context.Context, base string, f io.Reader, size int64) error
 	CopyObjectFunc       func(ctx context.Context, src, dest string) error
 	DeleteObjectFunc     func(ctx context.Context, base string) error
 	FileExistsFunc       func(ctx context.Context, base string) (bool, error)
@@ -29,11 +31,13 @@ type MockStore struct {
 	PushLocalFileFunc    func(ctx context.Context, localFile string, toBaseName string) (err error)
 
 	Files           map[string][]byte
+	modified        map[string]time.Time
+	metadata        map[string]map[string]string
 	shouldOverwrite bool
 }
 
 func NewMockStore(writeFunc func(base string, f io.Reader) (err error)) *MockStore {
-	store := &MockStore{Files: make(map[string][]byte)}
+	store := &MockStore{Files: make(map[string][]byte), modified: make(map[string]time.Time)}
 	if writeFunc != nil {
 		store.WriteObjectFunc = func(ctx context.Context, base string, f io.Reader) error {
 			return writeFunc(base, f)
@@ -45,24 +49,29 @@ func NewMockStore(writeFunc func(base string, f io.Reader) (err error)) *MockSto
 
 func (s *MockStore) SubStore(subFolder string) (Store, error) {
 	newFiles := map[string][]byte{}
+	newModified := map[string]time.Time{}
 	for k, v := range s.Files {
 		prefix := filepath.Join(subFolder, "") + string(filepath.Separator)
 		if strings.HasPrefix(k, prefix) {
 			newFiles[strings.TrimPrefix(k, prefix)] = v
+			newModified[strings.TrimPrefix(k, prefix)] = s.modified[k]
 		}
 	}
 
 	return &MockStore{
-		Files:             newFiles,
-		shouldOverwrite:   s.shouldOverwrite,
-		OpenObjectFunc:    s.OpenObjectFunc,
-		WriteObjectFunc:   s.WriteObjectFunc,
-		CopyObjectFunc:    s.CopyObjectFunc,
-		DeleteObjectFunc:  s.DeleteObjectFunc,
-		FileExistsFunc:    s.FileExistsFunc,
-		ListFilesFunc:     s.ListFilesFunc,
-		WalkFunc:          s.WalkFunc,
-		PushLocalFileFunc: s.PushLocalFileFunc,
+		Files:                newFiles,
+		modified:             newModified,
+		shouldOverwrite:      s.shouldOverwrite,
+		OpenObjectFunc:       s.OpenObjectFunc,
+		WriteObjectFunc:      s.WriteObjectFunc,
+		WriteObjectSizedFunc: s.WriteObjectSizedFunc,
+		CopyObjectFunc:       s.CopyObjectFunc,
+		DeleteObjectFunc:     s.DeleteObjectFunc,
+		FileExistsFunc:       s.FileExistsFunc,
+		ObjectAttributesFunc: s.ObjectAttributesFunc,
+		ListFilesFunc:        s.ListFilesFunc,
+		WalkFunc:             s.WalkFunc,
+		PushLocalFileFunc:    s.PushLocalFileFunc,
 	}, nil
 }
 
@@ -82,12 +91,21 @@ func (s *MockStore) WriteFiles(toDirectory string) error {
 }
 
 // SetFile sets the content of a file. Set the value "err" to trigger
-// an error when reading this file.
+// an error when reading this file or walking over it.
 func (s *MockStore) SetFile(name string, content []byte) {
 	isError := string(content) == "err"
 	zlog.Debug("adding file", zap.String("name", name), zap.Int("content_length", len(content)), zap.Bool("is_error", isError))
 
 	s.Files[name] = content
+	s.touch(name)
+}
+
+// touch records the current time as the last modification time of the file
+func (s *MockStore) touch(name string) {
+	if s.modified == nil {
+		s.modified = map[string]time.Time{}
+	}
+	s.modified[name] = time.Now()
 }
 
 func (s *MockStore) OpenObject(ctx context.Context, name string) (out io.ReadCloser, err error) {
@@ -100,7 +118,7 @@ func (s *MockStore) OpenObject(ctx context.Context, name string) (out io.ReadClo
 	content, exists := s.Files[name]
 	if !exists {
 		zlog.Debug("opening object not found", zap.String("name", name))
-		return nil, io.EOF
+		return nil, ErrNotFound
 	}
 
 	if string(content) == "err" {
@@ -113,6 +131,19 @@ func (s *MockStore) OpenObject(ctx context.Context, name string) (out io.ReadClo
 
 }
 
+func (s *MockStore) OpenObjectIfModifiedSince(ctx context.Context, name string, since time.Time) (io.ReadCloser, bool, error) {
+	if modified, found := s.modified[name]; found && !modified.After(since) {
+		return nil, false, nil
+	}
+
+	return openedIfModified(s.OpenObject(ctx, name))
+}
+
+// OpenObjectWithCompression ignores the compression type, MockStore does not compress its content.
+func (s *MockStore) OpenObjectWithCompression(ctx context.Context, name string, _ string) (out io.ReadCloser, err error) {
+	return s.OpenObject(ctx, name)
+}
+
 func (s *MockStore) CopyObject(ctx context.Context, src, dest string) error {
 	if s.CopyObjectFunc != nil {
 		return s.CopyObjectFunc(ctx, src, dest)
@@ -126,6 +157,44 @@ func (s *MockStore) CopyObject(ctx context.Context, src, dest string) error {
 	return s.WriteObject(ctx, dest, reader)
 }
 
+func (s *MockStore) Touch(ctx context.Context, base string) error {
+	if _, exists := s.Files[base]; !exists {
+		return ErrNotFound
+	}
+
+	s.touch(base)
+	return nil
+}
+
+func (s *MockStore) SetObjectMetadata(ctx context.Context, base string, md map[string]string) error {
+	if _, exists := s.Files[base]; !exists {
+		return ErrNotFound
+	}
+
+	if s.metadata == nil {
+		s.metadata = map[string]map[string]string{}
+	}
+	if s.metadata[base] == nil {
+		s.metadata[base] = map[string]string{}
+	}
+	for key, value := range md {
+		s.metadata[base][key] = value
+	}
+	return nil
+}
+
+func (s *MockStore) GetObjectMetadata(ctx context.Context, base string) (map[string]string, error) {
+	if _, exists := s.Files[base]; !exists {
+		return nil, ErrNotFound
+	}
+
+	md := map[string]string{}
+	for key, value := range s.metadata[base] {
+		md[key] = value
+	}
+	return md, nil
+}
+
 func (s *MockStore) WriteObject(ctx context.Context, base string, f io.Reader) (err error) {
 	if s.WriteObjectFunc != nil {
 		return s.WriteObjectFunc(ctx, base, f)
@@ -151,11 +220,20 @@ func (s *MockStore) WriteObject(ctx context.Context, base string, f io.Reader) (
 	}
 
 	s.Files[base] = buffer.Bytes()
+	s.touch(base)
 
 	zlog.Debug("wrote object", zap.String("name", base), zap.Int("content_length", len(s.Files[base])))
 	return nil
 }
 
+func (s *MockStore) WriteObjectSized(ctx context.Context, base string, f io.Reader, size int64) (err error) {
+	if s.WriteObjectSizedFunc != nil {
+		return s.WriteObjectSizedFunc(ctx, base, f, size)
+	}
+
+	return s.WriteObject(ctx, base, f)
+}
+
 func (s *MockStore) ObjectPath(base string) string {
 	return base
 }
@@ -164,13 +242,22 @@ func (s *MockStore) ObjectURL(base string) string {
 	return base
 }
 
+func (s *MockStore) SupportsConcurrentWrites() bool {
+	return false
+}
+
 func (s *MockStore) DeleteObject(ctx context.Context, base string) error {
 	if s.DeleteObjectFunc != nil {
 		return s.DeleteObjectFunc(ctx, base)
 	}
 
 	zlog.Debug("deleting object", zap.String("name", base))
+	if _, exists := s.Files[base]; !exists {
+		return ErrNotFound
+	}
+
 	delete(s.Files, base)
+	delete(s.modified, base)
 	return nil
 }
 
@@ -198,7 +285,23 @@ func (s *MockStore) ObjectAttributes(ctx context.Context, base string) (*ObjectA
 		return s.ObjectAttributesFunc(ctx, base)
 	}
 
-	return nil, nil
+	content, exists := s.Files[base]
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	if string(content) == "err" {
+		return nil, fmt.Errorf("%q errored", base)
+	}
+
+	return &ObjectAttributes{
+		LastModified: s.modified[base],
+		Size:         int64(len(content)),
+	}, nil
+}
+
+func (s *MockStore) WriteFrom(ctx context.Context, base string, src Store, srcName string) error {
+	return writeFrom(ctx, s, base, src, srcName)
 }
 
 func (s *MockStore) ListFiles(ctx context.Context, prefix string, max int) ([]string, error) {
@@ -209,6 +312,15 @@ func (s *MockStore) ListFiles(ctx context.Context, prefix string, max int) ([]st
 	return listFiles(ctx, s, prefix, max)
 }
 
+func (s *MockStore) ListSubPrefixes(_ context.Context, prefix string) ([]string, error) {
+	names := make([]string, 0, len(s.Files))
+	for name := range s.Files {
+		names = append(names, name)
+	}
+
+	return subPrefixesOf(names, prefix), nil
+}
+
 func (s *MockStore) SetOverwrite(in bool) {
 	s.shouldOverwrite = in
 }
@@ -222,26 +334,48 @@ func (s *MockStore) Walk(ctx context.Context, prefix string, f func(filename str
 		return s.WalkFunc(ctx, prefix, f)
 	}
 
+	prefix = cleanWalkPrefix(prefix)
 	zlog.Debug("walking files", zap.String("prefix", prefix))
 	sortedFiles := s.sortedFiles()
 
 	for _, file := range sortedFiles {
-		zlog.Debug("walking file", zap.String("file", file), zap.Bool("has_prefix", strings.HasPrefix(file, prefix)))
-		if strings.Contains(file, "err") {
+		if !strings.HasPrefix(file, prefix) {
+			continue
+		}
+
+		zlog.Debug("walking file", zap.String("file", file))
+		if string(s.Files[file]) == "err" {
 			return fmt.Errorf("mock err, %s", file)
 		}
-		if strings.HasPrefix(file, prefix) {
-			if err := f(file); err != nil {
-				if errors.Is(err, StopIteration) {
-					return nil
-				}
-				return err
+
+		if err := f(file); err != nil {
+			if errors.Is(err, StopIteration) {
+				return nil
 			}
+			return err
 		}
 	}
 	return nil
 }
 
+// cleanWalkPrefix normalizes a walk prefix the way cloud stores do when joining it to their
+// base path: redundant `/` and `.` elements are removed while a trailing `/` is preserved, so
+// that `dir/` only matches files within `dir` and not `dir-other`.
+func cleanWalkPrefix(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+
+	cleaned := path.Clean(prefix)
+	if cleaned == "." || cleaned == "/" {
+		return ""
+	}
+	if strings.HasSuffix(prefix, "/") {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
 func (s *MockStore) sortedFiles() []string {
 	sortedFiles := make([]string, len(s.Files))
 
@@ -0,0 +1,182 @@
+package dstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMockStore_ObjectAttributes(t *testing.T) {
+	ctx := context.Background()
+	store := NewMockStore(nil)
+
+	before := time.Now()
+	store.SetFile("file", []byte("content"))
+	store.SetFile("broken", []byte("err"))
+
+	attrs, err := store.ObjectAttributes(ctx, "file")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), attrs.Size)
+	assert.False(t, attrs.LastModified.Before(before))
+
+	_, err = store.ObjectAttributes(ctx, "missing")
+	assert.Equal(t, ErrNotFound, err)
+
+	_, err = store.ObjectAttributes(ctx, "broken")
+	assert.Error(t, err)
+
+	store.ObjectAttributesFunc = func(ctx context.Context, base string) (*ObjectAttributes, error) {
+		return &ObjectAttributes{Size: 42}, nil
+	}
+
+	attrs, err = store.ObjectAttributes(ctx, "missing")
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), attrs.Size)
+}
+
+func TestMockStore_StatObject(t *testing.T) {
+	ctx := context.Background()
+	store := NewMockStore(nil)
+	store.SetFile("present", []byte("content"))
+	store.SetFile("broken", []byte("err"))
+
+	exists, attrs, err := StatObject(ctx, store, "present")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, int64(len("content")), attrs.Size)
+
+	exists, attrs, err = StatObject(ctx, store, "absent")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Nil(t, attrs)
+
+	_, _, err = StatObject(ctx, store, "broken")
+	assert.Error(t, err)
+}
+
+func TestMockStore_Walk_ErrorTrigger(t *testing.T) {
+	ctx := context.Background()
+	store := NewMockStore(nil)
+	store.SetFile("terror.txt", []byte("content"))
+	store.SetFile("valid", []byte("content"))
+
+	files, err := store.ListFiles(ctx, "", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"terror.txt", "valid"}, files)
+
+	store.SetFile("terror.txt", []byte("err"))
+	_, err = store.ListFiles(ctx, "", -1)
+	assert.Error(t, err)
+
+	files, err = store.ListFiles(ctx, "valid", -1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"valid"}, files, "erroring files outside of the prefix should not be walked")
+}
+
+func TestMockStore_Walk_Prefix(t *testing.T) {
+	ctx := context.Background()
+	store := NewMockStore(nil)
+	for _, name := range []string{"dir/a", "dir/b", "dir-other/a", "directory", "other"} {
+		store.SetFile(name, []byte("content"))
+	}
+
+	tests := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"", []string{"dir-other/a", "dir/a", "dir/b", "directory", "other"}},
+		{"./", []string{"dir-other/a", "dir/a", "dir/b", "directory", "other"}},
+		{"dir", []string{"dir-other/a", "dir/a", "dir/b", "directory"}},
+		{"dir/", []string{"dir/a", "dir/b"}},
+		{"dir//", []string{"dir/a", "dir/b"}},
+		{"./dir/a", []string{"dir/a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.prefix, func(t *testing.T) {
+			files, err := store.ListFiles(ctx, test.prefix, -1)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, files)
+		})
+	}
+}
+
+func TestMockStore_WalkFrom(t *testing.T) {
+	ctx := context.Background()
+	store := NewMockStore(nil)
+	for _, name := range []string{"dir/c", "dir/a", "dir/b"} {
+		store.SetFile(name, []byte("content"))
+	}
+
+	var seen []string
+	require.NoError(t, store.WalkFrom(ctx, "dir/", "dir/b", func(filename string) error {
+		seen = append(seen, filename)
+		return nil
+	}))
+	assert.Equal(t, []string{"dir/b", "dir/c"}, seen)
+}
+
+func TestMockStore_WriteObjectSeekable(t *testing.T) {
+	ctx := context.Background()
+	store := NewMockStore(nil)
+
+	var attempts []string
+	var sizes []int64
+	store.WriteObjectSizedFunc = func(ctx context.Context, base string, f io.Reader, size int64) error {
+		sizes = append(sizes, size)
+		if len(attempts) == 0 {
+			// Consumes part of the content before failing, the retry must start over
+			partial := make([]byte, 4)
+			_, err := io.ReadFull(f, partial)
+			require.NoError(t, err)
+			attempts = append(attempts, string(partial))
+			return errors.New("connection reset")
+		}
+
+		content, err := io.ReadAll(f)
+		require.NoError(t, err)
+		attempts = append(attempts, string(content))
+		return nil
+	}
+
+	require.NoError(t, WriteObjectSeekable(ctx, store, "file", strings.NewReader("seekable content")))
+	assert.Equal(t, []string{"seek", "seekable content"}, attempts)
+	assert.Equal(t, []int64{16, 16}, sizes)
+
+	attempts = nil
+	store.WriteObjectSizedFunc = func(ctx context.Context, base string, f io.Reader, size int64) error {
+		attempts = append(attempts, base)
+		return fmt.Errorf("refused: %w", ErrNotSupported)
+	}
+
+	err := WriteObjectSeekable(ctx, store, "file", strings.NewReader("seekable content"))
+	assert.ErrorIs(t, err, ErrNotSupported)
+	assert.Len(t, attempts, 1, "a refused write is not retried")
+
+	attempts = nil
+	store.WriteObjectSizedFunc = func(ctx context.Context, base string, f io.Reader, size int64) error {
+		attempts = append(attempts, base)
+		return fmt.Errorf("conditional write: %w", ErrPreconditionFailed)
+	}
+
+	err = WriteObjectSeekable(ctx, store, "file", strings.NewReader("seekable content"))
+	assert.ErrorIs(t, err, ErrPreconditionFailed)
+	assert.Len(t, attempts, 1, "a failed precondition is not retried")
+
+	attempts = nil
+	store.WriteObjectSizedFunc = func(ctx context.Context, base string, f io.Reader, size int64) error {
+		attempts = append(attempts, base)
+		return errors.New("connection reset")
+	}
+
+	err = WriteObjectSeekable(ctx, store, "file", strings.NewReader("seekable content"))
+	assert.Error(t, err)
+	assert.Len(t, attempts, WriteObjectSeekableAttempts)
+}
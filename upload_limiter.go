@@ -0,0 +1,38 @@
+package dstore
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// uploadBufferLimiter is a budget of bytes shared by concurrent uploads, each reserving the
+// size of its buffers for the duration of the upload.
+type uploadBufferLimiter struct {
+	max int64
+	sem *semaphore.Weighted
+}
+
+// newUploadBufferLimiter creates a budget of `max` bytes, which must be positive
+func newUploadBufferLimiter(max int64) *uploadBufferLimiter {
+	return &uploadBufferLimiter{max: max, sem: semaphore.NewWeighted(max)}
+}
+
+// acquire reserves `n` bytes of the budget, capped to the whole budget, waiting until they
+// are available. The returned `release` must be called once the buffers are not used anymore.
+// A nil limiter reserves nothing.
+func (l *uploadBufferLimiter) acquire(ctx context.Context, n int64) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	if n > l.max {
+		n = l.max
+	}
+
+	if err := l.sem.Acquire(ctx, n); err != nil {
+		return nil, fmt.Errorf("waiting for %d bytes of upload buffers: %w", n, err)
+	}
+	return func() { l.sem.Release(n) }, nil
+}
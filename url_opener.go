@@ -0,0 +1,68 @@
+package dstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// URLOpener opens files given by their full URL, like the `OpenObject` helper, but keeps the
+// stores it creates so that opening many files from the same location reuses a single store and
+// its client instead of creating one per file. Stores are keyed by the file URL stripped of its
+// file name, that is the scheme, host, directory and query parameters, and by the compression
+// resolved for the file.
+//
+// It is safe for concurrent use, stores are kept for the lifetime of the opener.
+type URLOpener struct {
+	opts []Option
+
+	lock   sync.Mutex
+	stores map[string]Store
+
+	// newStore creates the stores, a field so tests can observe the constructions
+	newStore func(baseURL, extension, compressionType string, overwrite bool, opts ...Option) (Store, error)
+}
+
+// NewURLOpener returns an opener creating its stores with `opts`.
+func NewURLOpener(opts ...Option) *URLOpener {
+	return &URLOpener{
+		opts:     opts,
+		stores:   map[string]Store{},
+		newStore: NewStore,
+	}
+}
+
+// Open opens the file at `fileURL`, creating the store holding it on first use.
+func (o *URLOpener) Open(ctx context.Context, fileURL string) (io.ReadCloser, error) {
+	file, err := parseFileURL(fileURL, o.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := o.store(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.OpenObject(ctx, file.filename)
+}
+
+func (o *URLOpener) store(file parsedFileURL) (Store, error) {
+	key := file.compression + "|" + file.storeURL
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if store, found := o.stores[key]; found {
+		return store, nil
+	}
+
+	store, err := o.newStore(file.storeURL, "", file.compression, file.overwrite, o.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("open store: %w", err)
+	}
+
+	o.stores[key] = store
+	return store, nil
+}
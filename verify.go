@@ -0,0 +1,83 @@
+package dstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// VerifyCopy checks that the object `name` of `dst` matches the one of `src`, meant to be
+// called after a `CopyObject` or `WriteFrom` to prove the replication is correct. An error
+// matching `ErrChecksumMismatch` is returned when the objects diverge.
+//
+// Stored sizes are compared first when both stores share the same compression. Backends do not
+// expose a checksum of the decoded content, so both objects are then fully read and hashed: the
+// cost is one download of each object, keep that in mind for large objects or remote stores.
+func VerifyCopy(ctx context.Context, src, dst Store, name string) error {
+	srcExists, srcAttrs, err := StatObject(ctx, src, name)
+	if err != nil {
+		return fmt.Errorf("stat source object %q: %w", name, err)
+	}
+	if !srcExists {
+		return fmt.Errorf("source object %q: %w", name, ErrNotFound)
+	}
+
+	dstExists, dstAttrs, err := StatObject(ctx, dst, name)
+	if err != nil {
+		return fmt.Errorf("stat destination object %q: %w", name, err)
+	}
+	if !dstExists {
+		return fmt.Errorf("destination object %q: %w", name, ErrNotFound)
+	}
+
+	if sameCompression(src, dst) && srcAttrs.Size != dstAttrs.Size {
+		return fmt.Errorf("object %q size differs, source has %d bytes, destination has %d bytes: %w", name, srcAttrs.Size, dstAttrs.Size, ErrChecksumMismatch)
+	}
+
+	srcSum, err := objectChecksum(ctx, src, name)
+	if err != nil {
+		return fmt.Errorf("checksum source object %q: %w", name, err)
+	}
+
+	dstSum, err := objectChecksum(ctx, dst, name)
+	if err != nil {
+		return fmt.Errorf("checksum destination object %q: %w", name, err)
+	}
+
+	if srcSum != dstSum {
+		return fmt.Errorf("object %q content differs, source sha256 %x, destination sha256 %x: %w", name, srcSum, dstSum, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// sameCompression returns true when both stores are known to encode objects the same way, in
+// which case their stored sizes are comparable.
+func sameCompression(src, dst Store) bool {
+	srcCommon, ok := src.(interface{ commonConfig() *commonStore })
+	if !ok {
+		return false
+	}
+	dstCommon, ok := dst.(interface{ commonConfig() *commonStore })
+	if !ok {
+		return false
+	}
+
+	return srcCommon.commonConfig().compressionType == dstCommon.commonConfig().compressionType
+}
+
+func objectChecksum(ctx context.Context, store Store, name string) (sum [sha256.Size]byte, err error) {
+	reader, err := store.OpenObject(ctx, name)
+	if err != nil {
+		return sum, err
+	}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return sum, err
+	}
+
+	copy(sum[:], hasher.Sum(nil))
+	return sum, nil
+}
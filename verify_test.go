@@ -0,0 +1,53 @@
+package dstore
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyCopy(t *testing.T) {
+	ctx := context.Background()
+
+	newStores := func(t *testing.T) (src, dst *MemoryStore) {
+		src, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/src"}, "", "gzip", false)
+		require.NoError(t, err)
+		dst, err = NewMemoryStore(&url.URL{Scheme: "memory", Path: "/dst"}, "", "zstd", true)
+		require.NoError(t, err)
+
+		require.NoError(t, WriteObjectString(ctx, src, "file", "content"))
+		require.NoError(t, dst.WriteFrom(ctx, "file", src, "file"))
+		return src, dst
+	}
+
+	t.Run("identical", func(t *testing.T) {
+		src, dst := newStores(t)
+		assert.NoError(t, VerifyCopy(ctx, src, dst, "file"))
+	})
+
+	t.Run("mutated content", func(t *testing.T) {
+		src, dst := newStores(t)
+		require.NoError(t, WriteObjectString(ctx, dst, "file", "CONTENT"))
+		assert.ErrorIs(t, VerifyCopy(ctx, src, dst, "file"), ErrChecksumMismatch)
+	})
+
+	t.Run("mutated size", func(t *testing.T) {
+		src, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/src"}, "", "", false)
+		require.NoError(t, err)
+		dst, err := NewMemoryStore(&url.URL{Scheme: "memory", Path: "/dst"}, "", "", true)
+		require.NoError(t, err)
+
+		require.NoError(t, WriteObjectString(ctx, src, "file", "content"))
+		require.NoError(t, WriteObjectString(ctx, dst, "file", "content plus more"))
+		assert.ErrorIs(t, VerifyCopy(ctx, src, dst, "file"), ErrChecksumMismatch)
+	})
+
+	t.Run("missing destination", func(t *testing.T) {
+		src, _ := newStores(t)
+		dst := newTestMemoryStore(t)
+		assert.ErrorIs(t, VerifyCopy(ctx, src, dst, "file"), ErrNotFound)
+	})
+}
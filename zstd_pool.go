@@ -0,0 +1,121 @@
+package dstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// defaultMaxIdleZstdDecoders is the count of idle zstd decoders kept for reuse by each pool,
+// unless `WithMaxIdleZstdDecoders` is used
+const defaultMaxIdleZstdDecoders = 64
+
+type zstdDecoderPoolKey struct {
+	concurrency int
+	maxIdle     int
+}
+
+var (
+	zstdDecoderPoolsLock sync.Mutex
+	zstdDecoderPools     = map[zstdDecoderPoolKey]*zstdDecoderPool{}
+)
+
+// zstdDecoderPool keeps idle zstd decoders so that reading zstd objects reuses the buffers of
+// decoders released by previous reads instead of allocating new ones, each decoder being reset
+// on the stream it decodes. It is a bounded free list rather than a `sync.Pool` because a
+// decoder owns a goroutine until closed, which a `sync.Pool` dropping it would leak.
+type zstdDecoderPool struct {
+	concurrency int
+	maxIdle     int
+	idle        chan *zstd.Decoder
+}
+
+// zstdDecoderPoolFor returns the pool shared by stores decoding with `concurrency` goroutines
+// and keeping up to `maxIdle` idle decoders, 0 meaning respectively the zstd library default and
+// `defaultMaxIdleZstdDecoders`.
+func zstdDecoderPoolFor(concurrency, maxIdle int) *zstdDecoderPool {
+	if maxIdle == 0 {
+		maxIdle = defaultMaxIdleZstdDecoders
+	}
+	key := zstdDecoderPoolKey{concurrency: concurrency, maxIdle: maxIdle}
+
+	zstdDecoderPoolsLock.Lock()
+	defer zstdDecoderPoolsLock.Unlock()
+
+	pool, found := zstdDecoderPools[key]
+	if !found {
+		pool = &zstdDecoderPool{concurrency: concurrency, maxIdle: maxIdle, idle: make(chan *zstd.Decoder, maxIdle)}
+		zstdDecoderPools[key] = pool
+	}
+	return pool
+}
+
+// newReader returns a reader decompressing `src`, closing `src` and releasing its decoder to the
+// pool when closed.
+func (p *zstdDecoderPool) newReader(src io.ReadCloser) (io.ReadCloser, error) {
+	var decoder *zstd.Decoder
+	select {
+	case decoder = <-p.idle:
+	default:
+		var opts []zstd.DOption
+		if p.concurrency > 0 {
+			opts = append(opts, zstd.WithDecoderConcurrency(p.concurrency))
+		}
+
+		var err error
+		if decoder, err = zstd.NewReader(nil, opts...); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := decoder.Reset(src); err != nil {
+		decoder.Close()
+		return nil, err
+	}
+
+	return &pooledZstdReadCloser{decoder: decoder, src: src, pool: p}, nil
+}
+
+// release keeps `decoder` for reuse, or closes it when enough decoders are idle already
+func (p *zstdDecoderPool) release(decoder *zstd.Decoder) {
+	select {
+	case p.idle <- decoder:
+	default:
+		decoder.Close()
+	}
+}
+
+var errZstdReaderClosed = errors.New("read on closed zstd reader")
+
+type pooledZstdReadCloser struct {
+	decoder *zstd.Decoder
+	src     io.ReadCloser
+	pool    *zstdDecoderPool
+}
+
+func (r *pooledZstdReadCloser) Read(p []byte) (int, error) {
+	if r.decoder == nil {
+		return 0, errZstdReaderClosed
+	}
+	return r.decoder.Read(p)
+}
+
+func (r *pooledZstdReadCloser) Close() error {
+	if r.decoder == nil {
+		return nil
+	}
+
+	// The source is closed first so that a stream still being decoded ends before the decoder
+	// is reset on the next one
+	err := r.src.Close()
+	r.pool.release(r.decoder)
+	r.decoder = nil
+
+	if err != nil {
+		return fmt.Errorf("closing zstd source: %w", err)
+	}
+	return nil
+}